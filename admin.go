@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"github.com/elazarl/goproxy"
+)
+
+type adminServer struct {
+	conf       *Configuration
+	configPath string
+	proxy      *goproxy.ProxyHttpServer
+	router     *Router
+	health     *ProxyHealth
+	tunnels    *tunnelRegistry
+	feeds      *threatFeeds
+	mux        *http.ServeMux
+	// nil unless stats_listen or admin_ui is set
+	stats *proxyStats
+	bans  *clientBans
+	// restarts the proxy, replaced in tests
+	reloadProcess func() error
+}
+
+type upstreamRequest struct {
+	URL string `json:"url"`
+}
+
+type upstreamsResponse struct {
+	*Routing
+	Health map[string]UpstreamHealth `json:"health"`
+}
+
+// newAdminServer creates the admin API handler, bans are the ones the proxy checks
+// clients against and may be nil. Endpoints changing the proxy's state are served
+// only if admin_token is set, without it the API is read-only.
+func newAdminServer(conf *Configuration, configPath string, proxy *goproxy.ProxyHttpServer, router *Router,
+	health *ProxyHealth, tunnels *tunnelRegistry, feeds *threatFeeds, bans *clientBans,
+) *adminServer {
+	admin := &adminServer{
+		conf:       conf,
+		configPath: configPath,
+		proxy:      proxy,
+		router:     router,
+		health:     health,
+		tunnels:    tunnels,
+		feeds:      feeds,
+		bans:       bans,
+		mux:        http.NewServeMux(),
+
+		reloadProcess: reloadProcess,
+	}
+
+	admin.mux.HandleFunc("GET /upstreams", admin.listUpstreams)
+	admin.mux.HandleFunc("GET /tunnels", admin.listTunnels)
+	admin.mux.HandleFunc("GET /traffic", admin.listTraffic)
+	admin.mux.HandleFunc("GET /feeds", admin.listFeeds)
+	admin.mux.HandleFunc("GET /state", admin.getState)
+	admin.mux.HandleFunc("GET /log-level", admin.getLogLevel)
+	admin.mux.HandleFunc("GET /stats", admin.getStats)
+	admin.mux.HandleFunc("GET /denials", admin.listDenials)
+	if bans != nil {
+		admin.mux.HandleFunc("GET /bans", admin.listBans)
+	}
+	if conf.AdminUI {
+		admin.mux.HandleFunc("GET /ui", admin.serveUI)
+	}
+
+	admin.mux.HandleFunc("PUT /upstreams/{alias}", admin.setUpstream)
+	admin.mux.HandleFunc("DELETE /upstreams/{alias}", admin.removeUpstream)
+	admin.mux.HandleFunc("POST /upstreams/{alias}/drain", admin.drainUpstream)
+	admin.mux.HandleFunc("DELETE /upstreams/{alias}/drain", admin.undrainUpstream)
+	admin.mux.HandleFunc("PUT /forward-proxy", admin.setForwardProxyURL)
+	admin.mux.HandleFunc("DELETE /tunnels/{id}", admin.closeTunnel)
+	admin.mux.HandleFunc("PUT /log-level", admin.setLogLevel)
+	if bans != nil {
+		admin.mux.HandleFunc("PUT /bans/{ip}", admin.addBan)
+		admin.mux.HandleFunc("DELETE /bans/{ip}", admin.removeBan)
+	}
+	admin.mux.HandleFunc("POST /reload", admin.reload)
+
+	return admin
+}
+
+func (admin *adminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if admin.conf.AdminUI && req.URL.Path == "/ui" {
+		admin.mux.ServeHTTP(w, req)
+		return
+	}
+
+	if !admin.authorized(req) {
+		writeJSONError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	admin.mux.ServeHTTP(w, req)
+}
+
+// authorized reports whether req carries admin_token or, if the token isn't set,
+// a client certificate verified against admin_client_ca.
+func (admin *adminServer) authorized(req *http.Request) bool {
+	if admin.conf.AdminToken != "" {
+		expected := []byte("Bearer " + admin.conf.AdminToken)
+		return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) == 1
+	}
+
+	return admin.conf.AdminClientCA != "" && req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+}
+
+var adminTLSVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newAdminTLSConfig loads the admin listener's certificate, if admin_client_ca is
+// set clients have to present a certificate signed by that CA. Clients not meeting
+// admin_tls_min_version or admin_tls_alpn are rejected before the handshake, such
+// rejections are written to the proxy's activity log unless proxy is nil.
+func newAdminTLSConfig(conf *Configuration, proxy *goproxy.ProxyHttpServer) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.AdminTLSCert, conf.AdminTLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if conf.AdminTLSMinVersion != "" {
+		version, exists := adminTLSVersions[conf.AdminTLSMinVersion]
+		if !exists {
+			return nil, fmt.Errorf("unsupported minimal TLS version '%s'", conf.AdminTLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if conf.AdminClientCA != "" {
+		data, err := os.ReadFile(conf.AdminClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %v", conf.AdminClientCA)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	minVersion, alpn := tlsConfig.MinVersion, conf.AdminTLSALPN
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if err := checkClientHello(hello, minVersion, alpn); err != nil {
+			if proxy != nil {
+				proxy.Logger.Printf("WARN: rejected admin API TLS client %v: %v\n", hello.Conn.RemoteAddr(), err)
+			}
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	return tlsConfig, nil
+}
+
+// checkClientHello returns an error if the client supports only TLS versions below
+// minVersion or doesn't offer any of alpn protocols.
+func checkClientHello(hello *tls.ClientHelloInfo, minVersion uint16, alpn []string) error {
+	supported := false
+	for _, version := range hello.SupportedVersions {
+		supported = supported || version >= minVersion
+	}
+	if !supported {
+		return fmt.Errorf("TLS versions below %v", tls.VersionName(minVersion))
+	}
+
+	if len(alpn) == 0 {
+		return nil
+	}
+	for _, proto := range hello.SupportedProtos {
+		if slices.Contains(alpn, proto) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no required application protocol in %v", hello.SupportedProtos)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't write admin API response: %v\n", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func validateUpstreamURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		return fmt.Errorf("unsupported upstream proxy scheme '%s'", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return errors.New("upstream proxy URL has no host")
+	}
+
+	return nil
+}
+
+func (admin *adminServer) listUpstreams(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, &upstreamsResponse{
+		Routing: redactedRouting(admin.router.routing()),
+		Health:  admin.health.snapshot(),
+	})
+}
+
+// redactedRouting returns a copy of routing for admin API responses with passwords
+// of upstream proxies' URLs replaced by "xxxxx".
+func redactedRouting(routing *Routing) *Routing {
+	redacted := *routing
+	redacted.ForwardProxyURL = redactURL(routing.ForwardProxyURL)
+	redacted.Proxies = make(map[string]string, len(routing.Proxies))
+	for alias, proxyURL := range routing.Proxies {
+		redacted.Proxies[alias] = redactURL(proxyURL)
+	}
+	redacted.Pools = make(map[string][]PoolMember, len(routing.Pools))
+	for alias, members := range routing.Pools {
+		redacted.Pools[alias] = make([]PoolMember, len(members))
+		for i, member := range members {
+			member.URL = redactURL(member.URL)
+			redacted.Pools[alias][i] = member
+		}
+	}
+	return &redacted
+}
+
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// never echo what can't be parsed, it may contain credentials
+		return ""
+	}
+	return u.Redacted()
+}
+
+// modify updates routing and, if enabled, writes it back to the configuration file.
+func (admin *adminServer) modify(w http.ResponseWriter, f func(routing *Routing) error) {
+	err := admin.router.update(func(routing *Routing) error {
+		if err := f(routing); err != nil {
+			return err
+		}
+		if admin.conf.AdminSaveConfig {
+			if err := saveRoutingToConfigFile(admin.configPath, routing); err != nil {
+				return fmt.Errorf("couldn't save configuration file: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, redactedRouting(admin.router.routing()))
+}
+
+func (admin *adminServer) setUpstream(w http.ResponseWriter, req *http.Request) {
+	alias := req.PathValue("alias")
+
+	var body upstreamRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	admin.modify(w, func(routing *Routing) error {
+		if alias == ruleDirect || alias == ruleDeny {
+			return fmt.Errorf("proxy alias '%s' is reserved", alias)
+		}
+		if err := validateUpstreamURL(body.URL); err != nil {
+			return err
+		}
+		routing.Proxies[alias] = body.URL
+		return nil
+	})
+}
+
+func (admin *adminServer) removeUpstream(w http.ResponseWriter, req *http.Request) {
+	alias := req.PathValue("alias")
+
+	admin.modify(w, func(routing *Routing) error {
+		if _, exists := routing.Proxies[alias]; !exists {
+			return fmt.Errorf("unknown upstream proxy '%s'", alias)
+		}
+		delete(routing.Proxies, alias)
+		delete(routing.Draining, alias)
+		return nil
+	})
+}
+
+func (admin *adminServer) drainUpstream(w http.ResponseWriter, req *http.Request) {
+	admin.setDraining(w, req.PathValue("alias"), true)
+}
+
+func (admin *adminServer) undrainUpstream(w http.ResponseWriter, req *http.Request) {
+	admin.setDraining(w, req.PathValue("alias"), false)
+}
+
+func (admin *adminServer) setDraining(w http.ResponseWriter, alias string, draining bool) {
+	// draining is a runtime only state, it's never saved to the configuration file
+	err := admin.router.update(func(routing *Routing) error {
+		if _, exists := routing.Proxies[alias]; !exists {
+			return fmt.Errorf("unknown upstream proxy '%s'", alias)
+		}
+		if draining {
+			routing.Draining[alias] = true
+		} else {
+			delete(routing.Draining, alias)
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, redactedRouting(admin.router.routing()))
+}
+
+func (admin *adminServer) setForwardProxyURL(w http.ResponseWriter, req *http.Request) {
+	var body upstreamRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	admin.modify(w, func(routing *Routing) error {
+		// empty URL removes the default forward proxy
+		if body.URL != "" {
+			if err := validateUpstreamURL(body.URL); err != nil {
+				return err
+			}
+		}
+		routing.ForwardProxyURL = body.URL
+		return nil
+	})
+}
+
+func (admin *adminServer) listTunnels(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, admin.tunnels.snapshot())
+}
+
+func (admin *adminServer) closeTunnel(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid tunnel id: %w", err))
+		return
+	}
+
+	if !admin.tunnels.close(id) {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown tunnel %v", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]uint64{"closed": id})
+}
+
+func (admin *adminServer) listTraffic(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, admin.tunnels.userTraffic())
+}
+
+func (admin *adminServer) listFeeds(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, admin.feeds.snapshot())
+}
+
+// saveRoutingToConfigFile rewrites proxies and forward_proxy_url options in the
+// configuration file. Note that comments and formatting of the file are not preserved.
+func saveRoutingToConfigFile(path string, routing *Routing) error {
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(path, &raw); err != nil {
+		return err
+	}
+
+	if len(routing.Proxies) > 0 {
+		raw["proxies"] = routing.Proxies
+	} else {
+		delete(raw, "proxies")
+	}
+
+	if routing.ForwardProxyURL != "" {
+		raw["forward_proxy_url"] = routing.ForwardProxyURL
+	} else {
+		delete(raw, "forward_proxy_url")
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, buf.Bytes(), info.Mode().Perm())
+}
+
+// logLevels returns levels of the proxy's activity log or writes an error if they
+// can't be changed.
+func (admin *adminServer) logLevels(w http.ResponseWriter) *logLevels {
+	var levels *logLevels
+	if admin.proxy != nil {
+		levels = activityLogLevels(admin.proxy)
+	}
+	if levels == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("activity log levels aren't available"))
+	}
+
+	return levels
+}
+
+func (admin *adminServer) getLogLevel(w http.ResponseWriter, req *http.Request) {
+	if levels := admin.logLevels(w); levels != nil {
+		writeJSON(w, http.StatusOK, levels.status())
+	}
+}
+
+// setLogLevel changes levels of the activity log until the proxy is restarted,
+// the configuration file isn't modified.
+func (admin *adminServer) setLogLevel(w http.ResponseWriter, req *http.Request) {
+	levels := admin.logLevels(w)
+	if levels == nil {
+		return
+	}
+
+	var body logLevelsStatus
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := levels.update(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	refreshVerbose(admin.proxy)
+
+	writeJSON(w, http.StatusOK, levels.status())
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+var errStatsDisabled = errors.New("stats are collected only if 'stats_listen' or 'admin_ui' is set")
+
+type adminStatsEntry struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type adminStatsResponse struct {
+	UptimeSeconds float64           `json:"uptime_seconds"`
+	Total         int64             `json:"total"`
+	Rate          float64           `json:"rate"`
+	ErrorRate     float64           `json:"error_rate"`
+	DeniedRate    float64           `json:"denied_rate"`
+	ActiveTunnels int               `json:"active_tunnels"`
+	TopHosts      []adminStatsEntry `json:"top_hosts"`
+	TopUsers      []adminStatsEntry `json:"top_users"`
+}
+
+type banRequest struct {
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+func adminStatsEntries(entries []statsTopEntry) []adminStatsEntry {
+	converted := make([]adminStatsEntry, len(entries))
+	for i, e := range entries {
+		converted[i] = adminStatsEntry{Name: e.Name, Requests: e.Requests, Errors: e.Errors, Bytes: e.Bytes}
+	}
+
+	return converted
+}
+
+// reloadProcess gracefully restarts the proxy the same way HUP signal does.
+func reloadProcess() error {
+	return syscall.Kill(os.Getpid(), syscall.SIGHUP)
+}
+
+func (admin *adminServer) getStats(w http.ResponseWriter, req *http.Request) {
+	if admin.stats == nil {
+		writeJSONError(w, http.StatusNotFound, errStatsDisabled)
+		return
+	}
+
+	v := admin.stats.view(time.Now())
+	writeJSON(w, http.StatusOK, &adminStatsResponse{
+		UptimeSeconds: v.Uptime.Seconds(),
+		Total:         v.Total,
+		Rate:          v.Rate,
+		ErrorRate:     v.ErrorRate,
+		DeniedRate:    v.DeniedRate,
+		ActiveTunnels: admin.tunnels.count(),
+		TopHosts:      adminStatsEntries(v.TopHosts),
+		TopUsers:      adminStatsEntries(v.TopUsers),
+	})
+}
+
+func (admin *adminServer) listDenials(w http.ResponseWriter, req *http.Request) {
+	if admin.stats == nil {
+		writeJSONError(w, http.StatusNotFound, errStatsDisabled)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, admin.stats.recentDenials())
+}
+
+func (admin *adminServer) listBans(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, admin.bans.snapshot(time.Now()))
+}
+
+func (admin *adminServer) addBan(w http.ResponseWriter, req *http.Request) {
+	ip := net.ParseIP(req.PathValue("ip"))
+	if ip == nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid IP address '%s'", req.PathValue("ip")))
+		return
+	}
+
+	// the body is optional, bans without duration don't expire
+	var body banRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	now := time.Now()
+	ban := ClientBan{IP: ip.String(), Reason: body.Reason, Created: now}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid ban duration '%s'", body.Duration))
+			return
+		}
+		ban.Expires = now.Add(d)
+	}
+
+	if err := admin.bans.add(ban); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("couldn't save bans: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ban)
+}
+
+func (admin *adminServer) removeBan(w http.ResponseWriter, req *http.Request) {
+	ip := net.ParseIP(req.PathValue("ip"))
+	if ip == nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid IP address '%s'", req.PathValue("ip")))
+		return
+	}
+
+	removed, err := admin.bans.remove(ip.String())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("couldn't save bans: %w", err))
+		return
+	}
+	if !removed {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%v isn't banned", ip))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"removed": ip.String()})
+}
+
+func (admin *adminServer) reload(w http.ResponseWriter, req *http.Request) {
+	if err := admin.reloadProcess(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("couldn't reload: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]bool{"reloading": true})
+}
+
+// serveUI serves the page without authentication, it has no data of its own and
+// calls the admin API with the token entered by the operator.
+func (admin *adminServer) serveUI(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; "+
+		"style-src 'unsafe-inline'; connect-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, adminUIPage)
+}
+
+const adminUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>microproxy admin</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; }
+th { background: #eee; }
+td.n { text-align: right; }
+.down { color: #b00; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>microproxy</h1>
+<p>
+<label>Admin token <input id="token" type="password" size="30"></label>
+<button id="save">Use</button>
+<button id="reload">Reload</button>
+<span id="error"></span>
+</p>
+
+<table id="stats"></table>
+
+<h2>Upstreams</h2>
+<table id="upstreams"></table>
+
+<h2>Recent denials</h2>
+<table id="denials"></table>
+
+<h2>Bans</h2>
+<p>
+<input id="ban-ip" placeholder="IP address" size="20">
+<input id="ban-duration" placeholder="duration, i.e. 1h" size="15">
+<input id="ban-reason" placeholder="reason" size="30">
+<button id="ban">Ban</button>
+</p>
+<table id="bans"></table>
+
+<h2>Active tunnels</h2>
+<table id="tunnels"></table>
+
+<p>Updated <span id="updated">never</span>, the page refreshes every 5 seconds.</p>
+
+<script>
+"use strict";
+
+const tokenKey = "microproxy-admin-token";
+document.getElementById("token").value = sessionStorage.getItem(tokenKey) || "";
+
+async function api(method, path, body) {
+	const headers = {};
+	const token = sessionStorage.getItem(tokenKey);
+	if (token) {
+		headers["Authorization"] = "Bearer " + token;
+	}
+	const resp = await fetch(path, {method: method, headers: headers, body: body ? JSON.stringify(body) : undefined});
+	const data = await resp.json();
+	if (!resp.ok) {
+		throw new Error(data.error || resp.statusText);
+	}
+	return data;
+}
+
+function cell(row, value, numeric) {
+	const td = row.insertCell();
+	td.textContent = value === undefined || value === null ? "" : value;
+	if (numeric) {
+		td.className = "n";
+	}
+	return td;
+}
+
+function fill(id, headers, rows, render) {
+	const table = document.getElementById(id);
+	table.replaceChildren();
+	const head = table.insertRow();
+	for (const h of headers) {
+		const th = document.createElement("th");
+		th.textContent = h;
+		head.appendChild(th);
+	}
+	for (const r of rows) {
+		render(table.insertRow(), r);
+	}
+}
+
+function button(row, label, action) {
+	const b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = () => action().then(refresh, showError);
+	row.insertCell().appendChild(b);
+}
+
+function showError(err) {
+	document.getElementById("error").textContent = err.message;
+}
+
+async function refresh() {
+	try {
+		const [upstreams, tunnels, bans] = await Promise.all([api("GET", "/upstreams"), api("GET", "/tunnels"), api("GET", "/bans")]);
+		const stats = await api("GET", "/stats").catch(() => null);
+		const denials = await api("GET", "/denials").catch(() => []);
+
+		fill("stats", stats ? ["Uptime, s", "Requests", "Requests per second", "Errors, %", "Denied, %", "Active tunnels"] : ["Active tunnels"],
+			[stats], (row, s) => {
+				if (s) {
+					cell(row, Math.round(s.uptime_seconds), true);
+					cell(row, s.total, true);
+					cell(row, s.rate.toFixed(2), true);
+					cell(row, s.error_rate.toFixed(1), true);
+					cell(row, s.denied_rate.toFixed(1), true);
+				}
+				cell(row, tunnels.length, true);
+			});
+
+		const proxies = Object.entries(upstreams.proxies || {});
+		fill("upstreams", ["Alias", "URL", "Failures", "Down until", "Last error", ""], proxies, (row, [alias, url]) => {
+			const health = (upstreams.health || {})[new URL(url).host] || {};
+			cell(row, alias);
+			cell(row, url);
+			cell(row, health.failures || 0, true);
+			const down = cell(row, health.down_until && new Date(health.down_until) > new Date() ? health.down_until : "");
+			down.className = "down";
+			cell(row, health.last_error);
+			const draining = Boolean((upstreams.draining || {})[alias]);
+			button(row, draining ? "Undrain" : "Drain",
+				() => api(draining ? "DELETE" : "POST", "/upstreams/" + encodeURIComponent(alias) + "/drain"));
+		});
+
+		fill("denials", ["Time", "Client", "User", "Method", "Target", "Status", "Rule", ""], denials, (row, d) => {
+			cell(row, d.time);
+			cell(row, d.client);
+			cell(row, d.user);
+			cell(row, d.method);
+			cell(row, d.target);
+			cell(row, d.status, true);
+			cell(row, d.rule);
+			button(row, "Ban", () => api("PUT", "/bans/" + encodeURIComponent(d.client), {reason: "denied " + d.target}));
+		});
+
+		fill("bans", ["IP", "Reason", "Created", "Expires", ""], bans, (row, b) => {
+			cell(row, b.ip);
+			cell(row, b.reason);
+			cell(row, b.created);
+			cell(row, b.expires || "never");
+			button(row, "Unban", () => api("DELETE", "/bans/" + encodeURIComponent(b.ip)));
+		});
+
+		fill("tunnels", ["ID", "User", "Client", "Target", "Upstream", "Started", "Sent", "Received", "Idle, s", ""], tunnels, (row, t) => {
+			cell(row, t.id, true);
+			cell(row, t.user);
+			cell(row, t.client);
+			cell(row, t.target);
+			cell(row, t.upstream);
+			cell(row, t.started);
+			cell(row, t.sent, true);
+			cell(row, t.received, true);
+			cell(row, Math.round(t.idle_seconds), true);
+			button(row, "Close", () => api("DELETE", "/tunnels/" + t.id));
+		});
+
+		document.getElementById("error").textContent = "";
+		document.getElementById("updated").textContent = new Date().toLocaleTimeString();
+	} catch (err) {
+		showError(err);
+	}
+}
+
+document.getElementById("save").onclick = () => {
+	sessionStorage.setItem(tokenKey, document.getElementById("token").value);
+	refresh();
+};
+document.getElementById("reload").onclick = () => {
+	if (confirm("Gracefully restart the proxy with the current configuration file?")) {
+		api("POST", "/reload").then(() => showError(new Error("reloading...")), showError);
+	}
+};
+document.getElementById("ban").onclick = () => {
+	const body = {duration: document.getElementById("ban-duration").value, reason: document.getElementById("ban-reason").value};
+	api("PUT", "/bans/" + encodeURIComponent(document.getElementById("ban-ip").value), body).then(refresh, showError);
+};
+
+refresh();
+setInterval(refresh, 5000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestAdminUI(t *testing.T) {
+	conf := &Configuration{AdminToken: "secret", AdminUI: true, StateDir: t.TempDir()}
+	bans := newClientBans(conf)
+	admin := newAdminServer(conf, "", nil, newRouter(conf), newProxyHealth(conf), newTunnelRegistry(), nil, bans)
+	admin.stats = newProxyStats(conf)
+	reloads := 0
+	admin.reloadProcess = func() error {
+		reloads++
+		return nil
+	}
+
+	// the page is served without the token, the API isn't
+	w := adminRequest(t, admin, "GET", "/ui", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<h2>Recent denials</h2>") {
+		t.Fatalf("Unexpected page %v %v", w.Code, w.Body.String())
+	}
+	if w = adminRequest(t, admin, "POST", "/reload", ""); w.Code != http.StatusUnauthorized || reloads != 0 {
+		t.Fatalf("Expected 401 status code without the token, got %v", w.Code)
+	}
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		return authorizedAdminRequest(t, admin, method, path, body)
+	}
+
+	if w = request("POST", "/reload", ""); w.Code != http.StatusAccepted || reloads != 1 {
+		t.Errorf("Expected reload, got %v %v", w.Code, w.Body.String())
+	}
+	admin.reloadProcess = func() error { return errors.New("failed") }
+	if w = request("POST", "/reload", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 status code of failed reload, got %v", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	admin.stats.record(&LogData{
+		action: AppendLog,
+		resp:   &http.Response{StatusCode: http.StatusForbidden, Request: req},
+		user:   "alice",
+		time:   time.Now(),
+		rule:   "allowed_networks",
+	})
+	w = request("GET", "/denials", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"client":"192.0.2.1","user":"alice","method":"GET",`+
+		`"target":"www.example.com","status":403,"rule":"allowed_networks"`) {
+		t.Errorf("Unexpected denials %v %v", w.Code, w.Body.String())
+	}
+	if w = request("GET", "/stats", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"denied_rate":`) {
+		t.Errorf("Unexpected stats %v %v", w.Code, w.Body.String())
+	}
+
+	if w = request("PUT", "/bans/example.com", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 status code for invalid address, got %v", w.Code)
+	}
+	if w = request("PUT", "/bans/192.0.2.1", `{"duration":"-1h"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 status code for invalid duration, got %v", w.Code)
+	}
+	if w = request("PUT", "/bans/192.0.2.1", `{"reason":"scanning"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 status code, got %v %v", w.Code, w.Body.String())
+	}
+	if w = request("PUT", "/bans/192.0.2.2", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 status code, got %v %v", w.Code, w.Body.String())
+	}
+	if w = request("DELETE", "/bans/192.0.2.2", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 status code, got %v", w.Code)
+	}
+	if w = request("DELETE", "/bans/192.0.2.2", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 status code for unknown ban, got %v", w.Code)
+	}
+	if w = request("GET", "/bans", ""); !strings.Contains(w.Body.String(), `[{"ip":"192.0.2.1","reason":"scanning"`) {
+		t.Errorf("Unexpected bans %v", w.Body.String())
+	}
+
+	// the proxy refuses clients banned through the API
+	proxy := goproxy.NewProxyHttpServer()
+	setClientBansHandler(bans, proxy)
+	req = httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected banned client to get 403 status code, got %v", w.Code)
+	}
+
+	// bans are restored from state_dir
+	restored := newClientBans(conf)
+	if err := restored.loadState(conf.StateDir); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.banned("192.0.2.1", time.Now()) || restored.banned("192.0.2.2", time.Now()) {
+		t.Errorf("Unexpected restored bans %+v", restored.snapshot(time.Now()))
+	}
+}
+
+func TestClientBans(t *testing.T) {
+	bans := newClientBans(&Configuration{})
+	now := time.Now()
+	bans.add(ClientBan{IP: "192.0.2.1", Created: now})
+	bans.add(ClientBan{IP: "192.0.2.2", Created: now, Expires: now.Add(time.Minute)})
+
+	if !bans.banned("192.0.2.2", now) || bans.banned("192.0.2.2", now.Add(time.Minute)) {
+		t.Error("Expected the ban to expire")
+	}
+	if snapshot := bans.snapshot(now); len(snapshot) != 1 || snapshot[0].IP != "192.0.2.1" {
+		t.Errorf("Expected expired ban to be removed, got %+v", snapshot)
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	setClientBansHandler(bans, proxy)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		client string
+		status int
+	}{
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"192.0.2.3:1234", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+		req.RemoteAddr = test.client
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%v: expected %v status code, got %v", test.client, test.status, w.Code)
+		}
+	}
+}
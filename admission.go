@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const defaultRequestQueueTimeout = 5 * time.Second
+
+// admissionControl limits the number of requests processed at the same time,
+// requests above the limit wait in a bounded FIFO queue for a free slot.
+type admissionControl struct {
+	slots     chan struct{}
+	queued    atomic.Int64
+	queueSize int64
+	timeout   time.Duration
+}
+
+// withAdmissionControl applies max_concurrent_requests limit to the handler. Note
+// that CONNECT requests occupy a slot only until the tunnel is established.
+func withAdmissionControl(handler http.Handler, conf *Configuration) http.Handler {
+	if conf.MaxConcurrentRequests <= 0 {
+		return handler
+	}
+
+	ac := &admissionControl{
+		slots:     make(chan struct{}, conf.MaxConcurrentRequests),
+		queueSize: int64(conf.RequestQueueSize),
+		timeout:   conf.RequestQueueTimeout,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !ac.acquire(req) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(ac.timeout.Seconds()+1)))
+			http.Error(w, "Too many requests, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer ac.release()
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// acquire returns false if there was no free slot within the queue timeout or
+// the queue is full.
+func (ac *admissionControl) acquire(req *http.Request) bool {
+	// don't overtake requests already waiting in the queue
+	if ac.queued.Load() == 0 {
+		select {
+		case ac.slots <- struct{}{}:
+			return true
+		default:
+		}
+	}
+
+	if ac.queued.Add(1) > ac.queueSize {
+		ac.queued.Add(-1)
+		return false
+	}
+	defer ac.queued.Add(-1)
+
+	timer := time.NewTimer(ac.timeout)
+	defer timer.Stop()
+
+	select {
+	case ac.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (ac *admissionControl) release() {
+	<-ac.slots
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdmissionControl(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+
+	conf := &Configuration{MaxConcurrentRequests: 1, RequestQueueSize: 1, RequestQueueTimeout: time.Minute}
+	h := withAdmissionControl(handler, conf)
+
+	codes := make([]int, 3)
+	var wg sync.WaitGroup
+	serve := func(i int) {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		codes[i] = w.Code
+	}
+
+	wg.Add(1)
+	go serve(0)
+	<-started
+
+	// the second request waits in the queue, the third one doesn't fit into it
+	wg.Add(1)
+	go serve(1)
+	time.Sleep(20 * time.Millisecond)
+
+	wg.Add(1)
+	serve(2)
+	if codes[2] != http.StatusServiceUnavailable {
+		t.Error("Expected 503 status code for the request over the queue size, got", codes[2])
+	}
+
+	close(release)
+	wg.Wait()
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK {
+		t.Errorf("Expected queued request to succeed, got %v", codes)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/elazarl/goproxy"
+)
+
+// asnDatabase maps IP addresses to autonomous systems using MaxMind's GeoLite2 ASN
+// (or a compatible) database.
+type asnDatabase struct {
+	reader *mmdbReader
+}
+
+func openASNDatabase(path string) (*asnDatabase, error) {
+	reader, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &asnDatabase{reader: reader}, nil
+}
+
+// lookup returns the number of the autonomous system the address belongs to, 0 is
+// returned if it isn't known.
+func (db *asnDatabase) lookup(ip net.IP) uint {
+	record, err := db.reader.lookup(ip)
+	if err != nil {
+		return 0
+	}
+
+	fields, _ := record.(map[string]interface{})
+	number, _ := fields["autonomous_system_number"].(uint64)
+
+	return uint(number)
+}
+
+func formatASN(asn uint) string {
+	if asn == 0 {
+		return "-"
+	}
+
+	return strconv.FormatUint(uint64(asn), 10)
+}
+
+// asnPolicy decides whether requests to autonomous systems are allowed.
+type asnPolicy struct {
+	db         *asnDatabase
+	allowed    map[uint]bool
+	disallowed map[uint]bool
+	resolve    bool
+}
+
+func newASNPolicy(conf *Configuration) *asnPolicy {
+	if conf.ASNDatabase == "" {
+		return nil
+	}
+
+	db, err := openASNDatabase(conf.ASNDatabase)
+	if err != nil {
+		panic(err) // validated when configuration is loaded
+	}
+
+	p := &asnPolicy{
+		db:         db,
+		allowed:    make(map[uint]bool),
+		disallowed: make(map[uint]bool),
+		resolve:    conf.ResolveDestinations,
+	}
+	for _, asn := range conf.AllowedDestinationASNs {
+		p.allowed[asn] = true
+	}
+	for _, asn := range conf.DisallowedDestinationASNs {
+		p.disallowed[asn] = true
+	}
+
+	return p
+}
+
+// check returns the autonomous system of the host and an error if requests to the
+// host are not allowed. Host names are checked only if they are resolved, addresses
+// without known autonomous system are denied if allowed_destination_asns is set.
+func (p *asnPolicy) check(host string) (uint, error) {
+	ips := resolveDestination(host, p.resolve)
+
+	var first uint
+	for i, ip := range ips {
+		asn := p.db.lookup(ip)
+		if i == 0 {
+			first = asn
+		}
+		if p.disallowed[asn] {
+			return asn, fmt.Errorf("%v is in disallowed AS%v", ip, asn)
+		}
+		if len(p.allowed) > 0 && !p.allowed[asn] {
+			return asn, fmt.Errorf("%v is in AS%v, which is not allowed", ip, formatASN(asn))
+		}
+	}
+
+	return first, nil
+}
+
+// setDestinationASNHandler denies requests to destinations in disallowed autonomous
+// systems and records the destination's autonomous system for the access log.
+func setDestinationASNHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	policy := newASNPolicy(conf)
+	if policy == nil {
+		return
+	}
+
+	check := func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		asn, err := policy.check(req.URL.Hostname())
+		if info := requestInfoFromRequest(req); info != nil {
+			info.asn = formatASN(asn)
+		}
+		if err != nil {
+			ctx.Logf("request to %v denied: %v", req.URL.Host, err)
+			if policy.disallowed[asn] {
+				denyRequest(ctx, "disallowed_destination_asns:"+formatASN(asn))
+			} else {
+				denyRequest(ctx, "allowed_destination_asns")
+			}
+			return false
+		}
+		return true
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if !check(ctx.Req, ctx) {
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Access denied")
+				return goproxy.RejectConnect, host
+			}
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if !check(req, ctx) {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+			}
+			return req, nil
+		})
+}
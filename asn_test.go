@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+// mmdbField encodes a field of the data section, payloads up to 284 bytes are supported.
+func mmdbField(kind int, payload []byte) []byte {
+	size, extra := len(payload), []byte{}
+	if size >= 29 {
+		size, extra = 29, []byte{byte(size - 29)}
+	}
+
+	field := []byte{byte(kind<<5 | size)}
+	if kind > 7 {
+		field = []byte{byte(size), byte(kind - 7)}
+	}
+	field = append(field, extra...)
+
+	return append(field, payload...)
+}
+
+func mmdbUint(kind int, v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+
+	return mmdbField(kind, b)
+}
+
+func mmdbMapHeader(size int) []byte {
+	return []byte{byte(mmdbMap<<5 | size)}
+}
+
+// buildTestMMDB builds an IPv4 ASN database with 24 bit records, networks map CIDRs
+// to autonomous system numbers.
+func buildTestMMDB(t *testing.T, networks map[string]uint32) []byte {
+	type node struct {
+		children [2]int // node index, -1 if empty or -2-data offset
+	}
+	nodes := []node{{children: [2]int{-1, -1}}}
+
+	var dataSection []byte
+	keyOffset := -1
+	for cidr, asn := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record := mmdbMapHeader(2)
+		if keyOffset < 0 {
+			keyOffset = len(dataSection) + len(record)
+			record = append(record, mmdbField(mmdbString, []byte("autonomous_system_number"))...)
+		} else {
+			// pointer to the key written by the first record
+			record = append(record, byte(mmdbPointer<<5|keyOffset>>8), byte(keyOffset))
+		}
+		record = append(record, mmdbUint(mmdbUint32, asn)...)
+		record = append(record, mmdbField(mmdbString, []byte("autonomous_system_organization"))...)
+		record = append(record, mmdbField(mmdbString, []byte("Test AS"))...)
+		offset := len(dataSection)
+		dataSection = append(dataSection, record...)
+
+		ones, _ := network.Mask.Size()
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := int(network.IP.To4()[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[current].children[bit] = -2 - offset
+				break
+			}
+			if nodes[current].children[bit] < 0 {
+				nodes = append(nodes, node{children: [2]int{-1, -1}})
+				nodes[current].children[bit] = len(nodes) - 1
+			}
+			current = nodes[current].children[bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	var db []byte
+	for _, n := range nodes {
+		for _, child := range n.children {
+			record := child
+			switch {
+			case child == -1:
+				record = nodeCount
+			case child < -1:
+				record = nodeCount + mmdbDataSeparatorSize + (-2 - child)
+			}
+			db = append(db, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	db = append(db, make([]byte, mmdbDataSeparatorSize)...)
+	db = append(db, dataSection...)
+
+	db = append(db, mmdbMetadataMarker...)
+	db = append(db, mmdbMapHeader(4)...)
+	db = append(db, mmdbField(mmdbString, []byte("node_count"))...)
+	db = append(db, mmdbUint(mmdbUint32, uint32(nodeCount))...)
+	db = append(db, mmdbField(mmdbString, []byte("record_size"))...)
+	db = append(db, mmdbUint(mmdbUint16, 24)...)
+	db = append(db, mmdbField(mmdbString, []byte("ip_version"))...)
+	db = append(db, mmdbUint(mmdbUint16, 4)...)
+	db = append(db, mmdbField(mmdbString, []byte("database_type"))...)
+	db = append(db, mmdbField(mmdbString, []byte("GeoLite2-ASN"))...)
+
+	return db
+}
+
+func writeTestASNDatabase(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "asn.mmdb")
+	data := buildTestMMDB(t, map[string]uint32{
+		"192.0.2.0/24":    64496,
+		"198.51.100.0/24": 64497,
+	})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestASNDatabase(t *testing.T) {
+	db, err := openASNDatabase(writeTestASNDatabase(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.reader.databaseType != "GeoLite2-ASN" {
+		t.Errorf("Unexpected database type '%s'", db.reader.databaseType)
+	}
+
+	tests := []struct {
+		ip  string
+		asn uint
+	}{
+		{"192.0.2.1", 64496},
+		{"198.51.100.200", 64497},
+		{"203.0.113.1", 0},
+		{"2001:db8::1", 0},
+	}
+
+	for _, test := range tests {
+		if asn := db.lookup(net.ParseIP(test.ip)); asn != test.asn {
+			t.Errorf("%s: expected AS%d, got AS%d", test.ip, test.asn, asn)
+		}
+	}
+
+	record, err := db.reader.lookup(net.ParseIP("198.51.100.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org := record.(map[string]interface{})["autonomous_system_organization"]; org != "Test AS" {
+		t.Errorf("Unexpected organization %v", org)
+	}
+}
+
+func TestDestinationASNs(t *testing.T) {
+	conf := &Configuration{
+		ASNDatabase:               writeTestASNDatabase(t),
+		DisallowedDestinationASNs: []uint{64497},
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	setDestinationASNHandler(conf, proxy)
+
+	req := httptest.NewRequest("GET", "http://198.51.100.10/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected 403 status code, got", w.Code)
+	}
+
+	conf = &Configuration{
+		ASNDatabase:            conf.ASNDatabase,
+		AllowedDestinationASNs: []uint{64496},
+	}
+	policy := newASNPolicy(conf)
+
+	tests := []struct {
+		host    string
+		asn     uint
+		allowed bool
+	}{
+		{"192.0.2.1", 64496, true},
+		{"198.51.100.10", 64497, false},
+		{"203.0.113.1", 0, false},
+		{"www.example.com", 0, true},
+	}
+
+	for _, test := range tests {
+		asn, err := policy.check(test.host)
+		if asn != test.asn || (err == nil) != test.allowed {
+			t.Errorf("%s: expected AS%d allowed=%v, got AS%d %v", test.host, test.asn, test.allowed, asn, err)
+		}
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"regexp"
 	"strings"
 
 	"github.com/elazarl/goproxy"
@@ -54,88 +55,134 @@ func digestUnauthorized(req *http.Request, realm string, authFunc DigestAuthFunc
 	}
 }
 
-func getDigestAuthData(req *http.Request) *DigestAuthData {
-	authHeader := strings.SplitN(req.Header.Get(ProxyAuthorizatonHeader), " ", 2)
-	req.Header.Del(ProxyAuthorizatonHeader)
-
-	if len(authHeader) != 2 || authHeader[0] != "Digest" {
-		return nil
+// tokenChars marks characters allowed in tokens (RFC 7230, section 3.2.6).
+var tokenChars = func() (chars [256]bool) {
+	for c := '!'; c <= '~'; c++ {
+		chars[c] = !strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c)
 	}
+	return chars
+}()
 
-	m := make(map[string]string)
-
-	quotedStringsRegexp := regexp.MustCompile("\"(.*?)\"")
-	commasRegexp := regexp.MustCompile(",")
-
-	h := authHeader[1]
-	quotes := quotedStringsRegexp.FindAllStringSubmatchIndex(h, -1)
-	commas := commasRegexp.FindAllStringSubmatchIndex(h, -1)
-
-	separateCommas := make([]int, 0, 8)
-	var quotedComma bool
+func isTokenChar(c byte) bool {
+	return tokenChars[c]
+}
 
-	for _, commaIndices := range commas {
-		commaIndex := commaIndices[0]
-		quotedComma = false
-		for _, quoteIndices := range quotes {
-			if len(quoteIndices) == 4 && commaIndex >= quoteIndices[2] && commaIndex <= quoteIndices[3] {
-				quotedComma = true
-				break
-			}
+// parseAuthParams parses comma separated auth-params of Authorization-like headers
+// (RFC 7235, section 2.1) and calls f for each of them. Values are passed without
+// quotes, the string is copied only for quoted values with escaped characters.
+// It returns false if the header is malformed.
+func parseAuthParams(s string, f func(name, value string)) bool {
+	i := 0
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == ',') {
+			i++
 		}
-		if !quotedComma {
-			separateCommas = append(separateCommas, commaIndex)
+		if i == len(s) {
+			return true
 		}
-	}
-
-	tokens := make([]string, 0, 10)
-	s := 0
-
-	for _, val := range separateCommas {
-		e := val
-		tokens = append(tokens, strings.Trim(h[s:e], " "))
-		s = e + 1
-	}
 
-	tokens = append(tokens, strings.Trim(h[s:], " "))
+		start := i
+		for i < len(s) && isTokenChar(s[i]) {
+			i++
+		}
+		name := s[start:i]
 
-	for _, token := range tokens {
-		kv := strings.SplitN(token, "=", 2)
-		m[kv[0]] = strings.Trim(kv[1], "\"")
-	}
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if name == "" || i == len(s) || s[i] != '=' {
+			return false
+		}
+		i++
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
 
-	var data DigestAuthData
+		var value string
+		if i < len(s) && s[i] == '"' {
+			i++
+			start = i
+			escaped := false
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' {
+					escaped = true
+					i++
+				}
+				i++
+			}
+			if i >= len(s) {
+				return false
+			}
+			value = s[start:i]
+			if escaped {
+				value = unquoteAuthParam(value)
+			}
+			i++
+		} else {
+			start = i
+			for i < len(s) && isTokenChar(s[i]) {
+				i++
+			}
+			value = s[start:i]
+		}
 
-	if v, ok := m["username"]; ok {
-		data.user = v
-	}
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i < len(s) && s[i] != ',' {
+			return false
+		}
 
-	if v, ok := m["realm"]; ok {
-		data.realm = v
+		f(name, value)
 	}
+}
 
-	if v, ok := m["nonce"]; ok {
-		data.nonce = v
+// unquoteAuthParam removes backslashes of quoted-pairs.
+func unquoteAuthParam(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
 	}
 
-	if v, ok := m["uri"]; ok {
-		data.uri = v
-	}
+	return b.String()
+}
 
-	if v, ok := m["response"]; ok {
-		data.response = v
-	}
+func getDigestAuthData(req *http.Request) *DigestAuthData {
+	scheme, params, found := strings.Cut(req.Header.Get(ProxyAuthorizatonHeader), " ")
+	req.Header.Del(ProxyAuthorizatonHeader)
 
-	if v, ok := m["qop"]; ok {
-		data.qop = v
+	if !found || !strings.EqualFold(scheme, "Digest") {
+		return nil
 	}
 
-	if v, ok := m["nc"]; ok {
-		data.nc = v
-	}
+	var data DigestAuthData
 
-	if v, ok := m["cnonce"]; ok {
-		data.cnonce = v
+	ok := parseAuthParams(params, func(name, value string) {
+		switch strings.ToLower(name) {
+		case "username":
+			data.user = value
+		case "realm":
+			data.realm = value
+		case "nonce":
+			data.nonce = value
+		case "uri":
+			data.uri = value
+		case "response":
+			data.response = value
+		case "qop":
+			data.qop = value
+		case "nc":
+			data.nc = value
+		case "cnonce":
+			data.cnonce = value
+		}
+	})
+	if !ok {
+		return nil
 	}
 
 	data.method = req.Method
@@ -197,17 +244,26 @@ func performDigestAuth(req *http.Request, authFunc DigestAuthFunc) (bool, *Diges
 	// return false, data
 }
 
+// authWarnf logs failed authentication attempts with the auth module's level.
+func authWarnf(ctx *goproxy.ProxyCtx, format string, v ...interface{}) {
+	newModuleLogger(ctx.Proxy, logModuleAuth).logf(ctx, slog.LevelWarn, format, v...)
+}
+
 func basicAuthReqHandler(realm string, authFunc BasicAuthFunc) goproxy.ReqHandler {
 	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if getRequestInfo(ctx).authenticated() {
+			return req, nil
+		}
+
 		status, data := performBasicAuth(req, authFunc)
 		if !status {
 			if data != nil {
-				ctx.Warnf("failed basic auth. attempt: user=%v, addr=%v", data.user, req.RemoteAddr)
+				authWarnf(ctx, "failed basic auth. attempt: user=%v, addr=%v", data.user, req.RemoteAddr)
 			}
 			return nil, basicUnauthorized(req, realm)
 		}
 
-		ctx.UserData = data.user
+		getRequestInfo(ctx).user = data.user
 
 		return req, nil
 	})
@@ -215,15 +271,19 @@ func basicAuthReqHandler(realm string, authFunc BasicAuthFunc) goproxy.ReqHandle
 
 func digestAuthReqHandler(realm string, authFunc DigestAuthFunc) goproxy.ReqHandler {
 	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if getRequestInfo(ctx).authenticated() {
+			return req, nil
+		}
+
 		status, data := performDigestAuth(req, authFunc)
 		if !status {
 			if data != nil {
-				ctx.Warnf("failed digest auth. attempt: user=%v, realm=%v, addr=%v", data.user, data.realm, req.RemoteAddr)
+				authWarnf(ctx, "failed digest auth. attempt: user=%v, realm=%v, addr=%v", data.user, data.realm, req.RemoteAddr)
 			}
 			return nil, digestUnauthorized(req, realm, authFunc)
 		}
 
-		ctx.UserData = data.user
+		getRequestInfo(ctx).user = data.user
 
 		return req, nil
 	})
@@ -231,16 +291,18 @@ func digestAuthReqHandler(realm string, authFunc DigestAuthFunc) goproxy.ReqHand
 
 func basicConnectAuthHandler(realm string, authFunc BasicAuthFunc, logger *ProxyLogger) goproxy.HttpsHandler {
 	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		status, data := performBasicAuth(ctx.Req, authFunc)
-		if !status {
-			if data != nil {
-				ctx.Warnf("failed basic auth. CONNECT method attempt: user=%v, addr=%v", data.user, ctx.Req.RemoteAddr)
+		if !getRequestInfo(ctx).authenticated() {
+			status, data := performBasicAuth(ctx.Req, authFunc)
+			if !status {
+				if data != nil {
+					authWarnf(ctx, "failed basic auth. CONNECT method attempt: user=%v, addr=%v", data.user, ctx.Req.RemoteAddr)
+				}
+				ctx.Resp = basicUnauthorized(ctx.Req, realm)
+				return goproxy.RejectConnect, host
 			}
-			ctx.Resp = basicUnauthorized(ctx.Req, realm)
-			return goproxy.RejectConnect, host
-		}
 
-		ctx.UserData = data.user
+			getRequestInfo(ctx).user = data.user
+		}
 		if ctx.Req == nil {
 			ctx.Req = emptyReq
 		}
@@ -249,23 +311,25 @@ func basicConnectAuthHandler(realm string, authFunc BasicAuthFunc, logger *Proxy
 			logger.log(ctx)
 		}
 
-		return goproxy.OkConnect, host
+		return connectAction(ctx), host
 	})
 }
 
 func digestConnectAuthHandler(realm string, authFunc DigestAuthFunc, logger *ProxyLogger) goproxy.HttpsHandler {
 	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		status, data := performDigestAuth(ctx.Req, authFunc)
-		if !status {
-			if data != nil {
-				ctx.Warnf("failed digest auth. CONNECT method attempt: user=%v, realm=%v, addr=%v",
-					data.user, data.realm, ctx.Req.RemoteAddr)
+		if !getRequestInfo(ctx).authenticated() {
+			status, data := performDigestAuth(ctx.Req, authFunc)
+			if !status {
+				if data != nil {
+					authWarnf(ctx, "failed digest auth. CONNECT method attempt: user=%v, realm=%v, addr=%v",
+						data.user, data.realm, ctx.Req.RemoteAddr)
+				}
+				ctx.Resp = digestUnauthorized(ctx.Req, realm, authFunc)
+				return goproxy.RejectConnect, host
 			}
-			ctx.Resp = digestUnauthorized(ctx.Req, realm, authFunc)
-			return goproxy.RejectConnect, host
-		}
 
-		ctx.UserData = data.user
+			getRequestInfo(ctx).user = data.user
+		}
 		if ctx.Req == nil {
 			ctx.Req = emptyReq
 		}
@@ -274,10 +338,52 @@ func digestConnectAuthHandler(realm string, authFunc DigestAuthFunc, logger *Pro
 			logger.log(ctx)
 		}
 
-		return goproxy.OkConnect, host
+		return connectAction(ctx), host
 	})
 }
 
+// setTrustedUserHandler takes the user of requests from trusted_user_networks from
+// trusted_user_header set by an authenticating front proxy, such requests skip proxy
+// authentication. The header is removed from all requests, so clients can't pass
+// it through and it isn't sent to origins.
+func setTrustedUserHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if conf.TrustedUserHeader == "" {
+		return
+	}
+
+	trusted := parseNetworks(conf.TrustedUserNetworks)
+	identify := func(req *http.Request, ctx *goproxy.ProxyCtx) {
+		user := strings.TrimSpace(req.Header.Get(conf.TrustedUserHeader))
+		req.Header.Del(conf.TrustedUserHeader)
+
+		info := getRequestInfo(ctx)
+		if user == "" || info.inspected {
+			return
+		}
+
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil || !networksContain(trusted, net.ParseIP(ip)) {
+			authWarnf(ctx, "ignoring %v header from untrusted address %v", conf.TrustedUserHeader, req.RemoteAddr)
+			return
+		}
+
+		info.user, info.trusted = user, true
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			identify(req, ctx)
+			return req, nil
+		})
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if ctx.Req != nil {
+				identify(ctx.Req, ctx)
+			}
+			return nil, host
+		})
+}
+
 func setProxyBasicAuth(proxy *goproxy.ProxyHttpServer, realm string, authFunc BasicAuthFunc, logger *ProxyLogger) {
 	proxy.OnRequest().Do(basicAuthReqHandler(realm, authFunc))
 	proxy.OnRequest().HandleConnect(basicConnectAuthHandler(realm, authFunc, logger))
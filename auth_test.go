@@ -465,3 +465,147 @@ func TestHTTPSConnectAllowed(t *testing.T) {
 		t.Error("Expected 200 status code, got", resp.Status)
 	}
 }
+
+func TestIPBasedAccessDisallowed(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("Hello, World!"))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	s := "allowed_networks = [\"127.0.0.0/8\"]\ndisallowed_networks = [\"127.0.0.1/32\"]\n"
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	setAllowedNetworksHandler(conf, proxy)
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != 403 {
+		t.Error("Expected 403 status code, got", resp.Status)
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected map[string]string
+		ok       bool
+	}{
+		{`username="user", realm="a, b", qop=auth, nc=00000001`,
+			map[string]string{"username": "user", "realm": "a, b", "qop": "auth", "nc": "00000001"}, true},
+		{`uri="/a\"b\\c" ,, cnonce = "x"`, map[string]string{"uri": `/a"b\c`, "cnonce": "x"}, true},
+		{`response=""`, map[string]string{"response": ""}, true},
+		{``, map[string]string{}, true},
+		{`username`, nil, false},
+		{`username="user`, nil, false},
+		{`username="user" realm="proxy"`, nil, false},
+		{`=value`, nil, false},
+		{`uri="/path\`, nil, false},
+	}
+
+	for _, test := range tests {
+		params := make(map[string]string)
+		ok := parseAuthParams(test.header, func(name, value string) {
+			params[name] = value
+		})
+
+		if ok != test.ok {
+			t.Errorf("%q: expected %v, got %v", test.header, test.ok, ok)
+		} else if ok && fmt.Sprint(params) != fmt.Sprint(test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.header, test.expected, params)
+		}
+	}
+}
+
+func TestGetDigestAuthDataMalformed(t *testing.T) {
+	for _, header := range []string{"Digest", "Digest username", "Digest username=\"user", "Basic dXNlcg=="} {
+		req := &http.Request{Header: http.Header{ProxyAuthorizatonHeader: {header}}}
+		if data := getDigestAuthData(req); data != nil {
+			t.Errorf("%q: expected no digest data, got %+v", header, data)
+		}
+	}
+}
+
+func FuzzParseAuthParams(f *testing.F) {
+	f.Add(`username="user", realm="my_realm", nonce="abc", uri="/", response="def", qop=auth, nc=00000001, cnonce="7e1d"`)
+	f.Add(`uri="/a\"b", x=y`)
+	f.Add(`a=, b="`)
+
+	f.Fuzz(func(t *testing.T, header string) {
+		parseAuthParams(header, func(name, value string) {
+			for i := 0; i < len(name); i++ {
+				if !isTokenChar(name[i]) {
+					t.Fatalf("%q: parameter name %q isn't a token", header, name)
+				}
+			}
+		})
+
+		req := &http.Request{Header: http.Header{ProxyAuthorizatonHeader: {"Digest " + header}}}
+		getDigestAuthData(req)
+	})
+}
+
+func TestTrustedUserHeader(t *testing.T) {
+	forwarded := make(chan string, 1)
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded <- req.Header.Get("X-Authenticated-User")
+	}))
+	defer background.Close()
+	tlsBackground := httptest.NewTLSServer(ConstantHanlder("hello"))
+	defer tlsBackground.Close()
+
+	auth, err := newBasicAuth(bytes.NewBufferString(user + ":" + password + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		networks []string
+		status   int
+	}{
+		{[]string{"127.0.0.0/8"}, http.StatusOK},
+		{[]string{"10.0.0.0/8"}, http.StatusProxyAuthRequired},
+	}
+
+	for _, test := range tests {
+		client, proxy, proxyserver := oneShotProxy()
+		defer proxyserver.Close()
+
+		conf := &Configuration{TrustedUserHeader: "X-Authenticated-User", TrustedUserNetworks: test.networks}
+		setTrustedUserHandler(conf, proxy)
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if getRequestInfo(ctx).user != "alice" {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "")
+			}
+			return req, nil
+		})
+		setProxyBasicAuth(proxy, realm, makeBasicAuthValidator(auth), nil)
+
+		req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+		req.Header.Set("X-Authenticated-User", "alice")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: expected %v, got %v", test.networks, test.status, resp.Status)
+		}
+		if resp.StatusCode == http.StatusOK {
+			if header := <-forwarded; header != "" {
+				t.Errorf("Expected the header to be removed, origin got '%s'", header)
+			}
+		}
+
+		client.Transport.(*http.Transport).ProxyConnectHeader = http.Header{"X-Authenticated-User": {"alice"}}
+		resp, err = client.Get(tlsBackground.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if allowed := test.status == http.StatusOK; allowed != (err == nil) {
+			t.Errorf("%v: expected CONNECT allowed=%v, got %v", test.networks, allowed, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const bansStateFile = "bans.json"
+
+// ClientBan is a client's address banned through the admin API.
+type ClientBan struct {
+	IP      string    `json:"ip"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	// zero if the ban doesn't expire
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// clientBans holds banned clients' addresses. Bans are written to state_dir on
+// every change, so they survive restarts.
+type clientBans struct {
+	stateDir string
+
+	mu   sync.Mutex
+	bans map[string]ClientBan
+}
+
+func newClientBans(conf *Configuration) *clientBans {
+	return &clientBans{stateDir: conf.StateDir, bans: make(map[string]ClientBan)}
+}
+
+// banned reports whether ip is banned, expired bans are removed.
+func (b *clientBans) banned(ip string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban, exists := b.bans[ip]
+	if exists && !ban.Expires.IsZero() && !now.Before(ban.Expires) {
+		delete(b.bans, ip)
+		return false
+	}
+
+	return exists
+}
+
+func (b *clientBans) add(ban ClientBan) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bans[ban.IP] = ban
+
+	return b.save()
+}
+
+// remove returns false if ip isn't banned.
+func (b *clientBans) remove(ip string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.bans[ip]; !exists {
+		return false, nil
+	}
+	delete(b.bans, ip)
+
+	return true, b.save()
+}
+
+// snapshot returns active bans ordered by address.
+func (b *clientBans) snapshot(now time.Time) []ClientBan {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bans := make([]ClientBan, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if ban.Expires.IsZero() || now.Before(ban.Expires) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+
+	return bans
+}
+
+// restore replaces bans with ones imported from the failover primary.
+func (b *clientBans) restore(bans []ClientBan) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bans = make(map[string]ClientBan, len(bans))
+	for _, ban := range bans {
+		b.bans[ban.IP] = ban
+	}
+
+	return b.save()
+}
+
+// save must be called with the lock held.
+func (b *clientBans) save() error {
+	if b.stateDir == "" {
+		return nil
+	}
+
+	bans := make([]ClientBan, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, ban)
+	}
+
+	return saveState(b.stateDir, bansStateFile, bans)
+}
+
+func (b *clientBans) loadState(dir string) error {
+	var saved []ClientBan
+	if err := loadState(dir, bansStateFile, &saved); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, ban := range saved {
+		b.bans[ban.IP] = ban
+	}
+
+	return nil
+}
+
+// setClientBansHandler denies requests and tunnels of banned clients.
+func setClientBansHandler(bans *clientBans, proxy *goproxy.ProxyHttpServer) {
+	if bans == nil {
+		return
+	}
+
+	banned := func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil || !bans.banned(ip, time.Now()) {
+			return false
+		}
+		denyRequest(ctx, "admin_ban")
+		return true
+	}
+
+	proxy.OnRequest(goproxy.ReqConditionFunc(banned)).HandleConnect(goproxy.AlwaysReject)
+	proxy.OnRequest(goproxy.ReqConditionFunc(banned)).DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+		})
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 )
 
 type BasicAuthData struct {
@@ -14,6 +17,8 @@ type BasicAuthData struct {
 
 type basicAuth struct {
 	users map[string]string
+	// TOTP secrets of users who have to append "password:code" to their password
+	totp map[string][]byte
 }
 
 func newBasicAuthFromFile(path string) (*basicAuth, error) {
@@ -30,19 +35,28 @@ func newBasicAuth(file io.Reader) (*basicAuth, error) {
 	csvReader.Comma = ':'
 	csvReader.Comment = '#'
 	csvReader.TrimLeadingSpace = true
+	// users requiring TOTP have the secret in the third field
+	csvReader.FieldsPerRecord = -1
 
 	records, err := csvReader.ReadAll()
 	if err != nil {
 		return nil, err
 	}
 
-	h := &basicAuth{users: make(map[string]string)}
+	h := &basicAuth{users: make(map[string]string), totp: make(map[string][]byte)}
 
 	for _, record := range records {
-		if len(record) != 2 {
+		if len(record) != 2 && len(record) != 3 {
 			return nil, errors.New("invalid basic auth file format")
 		}
 		h.users[record[0]] = record[1]
+		if len(record) == 3 {
+			secret, err := decodeTOTPSecret(record[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid TOTP secret of user '%s': %v", record[0], err)
+			}
+			h.totp[record[0]] = secret
+		}
 	}
 
 	if len(h.users) == 0 {
@@ -54,9 +68,18 @@ func newBasicAuth(file io.Reader) (*basicAuth, error) {
 
 func (h *basicAuth) validate(authData *BasicAuthData) bool {
 	realPassword, exists := h.users[authData.user]
-	if !exists || realPassword != authData.password {
+	if !exists {
 		return false
 	}
 
-	return true
+	password := authData.password
+	if secret, required := h.totp[authData.user]; required {
+		idx := strings.LastIndexByte(password, ':')
+		if idx < 0 || !validTOTP(secret, password[idx+1:], time.Now()) {
+			return false
+		}
+		password = password[:idx]
+	}
+
+	return realPassword == password
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 func TestBasicAuthFile(t *testing.T) {
@@ -19,3 +20,56 @@ func TestBasicAuthFile(t *testing.T) {
 		t.Errorf("password validation failed")
 	}
 }
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test vectors truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+	}
+
+	for _, test := range tests {
+		if !validTOTP(secret, test.code, time.Unix(test.unix, 0)) {
+			t.Errorf("code %s isn't valid at %d", test.code, test.unix)
+		}
+		if validTOTP(secret, test.code, time.Unix(test.unix+3*totpPeriod, 0)) {
+			t.Errorf("code %s must expire", test.code)
+		}
+	}
+}
+
+func TestBasicAuthTOTP(t *testing.T) {
+	file := bytes.NewBuffer([]byte("testuser:asdf:GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\nother:qwerty\n"))
+	auth, err := newBasicAuth(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := totpCode([]byte("12345678901234567890"), uint64(time.Now().Unix()/totpPeriod))
+	tests := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{"testuser", "asdf:" + code, true},
+		{"testuser", "asdf", false},
+		{"testuser", "asdf:000000x", false},
+		{"testuser", "qwerty:" + code, false},
+		{"other", "qwerty", true},
+	}
+
+	for _, test := range tests {
+		if valid := auth.validate(&BasicAuthData{user: test.user, password: test.password}); valid != test.valid {
+			t.Errorf("%s:%s: expected %v", test.user, test.password, test.valid)
+		}
+	}
+
+	if _, err := newBasicAuth(bytes.NewBuffer([]byte("testuser:asdf:not-base32!\n"))); err == nil {
+		t.Error("Expected error for invalid TOTP secret")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// clientHelloFragmenter splits the ClientHello at the beginning of a tunnel into
+// TLS records of at most size bytes, which are written separately, so middleboxes
+// looking for the server name in the first packet or record of the connection
+// don't find it. Servers reassemble fragmented handshake messages, so the
+// handshake isn't changed otherwise. Streams which don't start with a ClientHello
+// fitting into one record are passed through as is.
+type clientHelloFragmenter struct {
+	net.Conn
+	size    int
+	onSplit func(records int)
+
+	mu      sync.Mutex
+	pending []byte
+	done    bool
+}
+
+// halfClosableFragmenter is used for connections supporting half-close, so goproxy
+// keeps shutting down each direction of the tunnel separately.
+type halfClosableFragmenter struct {
+	*clientHelloFragmenter
+}
+
+func newClientHelloFragmenter(conn net.Conn, size int, onSplit func(records int)) net.Conn {
+	c := &clientHelloFragmenter{Conn: conn, size: size, onSplit: onSplit}
+	if _, ok := conn.(halfCloser); ok {
+		return halfClosableFragmenter{c}
+	}
+
+	return c
+}
+
+func (c *clientHelloFragmenter) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return c.Conn.Write(b)
+	}
+
+	c.pending = append(c.pending, b...)
+	records, rest, more := fragmentClientHello(c.pending, c.size)
+	if more {
+		return len(b), nil
+	}
+	if records == nil {
+		rest = c.pending
+	} else if c.onSplit != nil {
+		c.onSplit(len(records))
+	}
+	if len(rest) > 0 {
+		records = append(records, rest)
+	}
+	c.done, c.pending = true, nil
+
+	for _, record := range records {
+		if _, err := c.Conn.Write(record); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// flush writes data held back while waiting for the rest of ClientHello.
+func (c *clientHelloFragmenter) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.done = true
+	if len(c.pending) == 0 {
+		return nil
+	}
+	_, err := c.Conn.Write(c.pending)
+	c.pending = nil
+
+	return err
+}
+
+func (c *clientHelloFragmenter) Close() error {
+	c.flush()
+	return c.Conn.Close()
+}
+
+func (c halfClosableFragmenter) CloseWrite() error {
+	c.flush()
+	return c.Conn.(halfCloser).CloseWrite()
+}
+
+func (c halfClosableFragmenter) CloseRead() error {
+	return c.Conn.(halfCloser).CloseRead()
+}
+
+// fragmentClientHello returns the records the ClientHello at the beginning of the
+// data is split into and the data following it. more is true if the record isn't
+// complete yet, nil records mean the data has to be sent as is.
+func fragmentClientHello(data []byte, size int) (records [][]byte, rest []byte, more bool) {
+	if len(data) > 0 && data[0] != tlsRecordHandshake || len(data) > 1 && data[1] != 3 {
+		return nil, nil, false
+	}
+	if len(data) < 5 {
+		return nil, nil, true
+	}
+
+	length := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+length {
+		return nil, nil, true
+	}
+
+	payload := data[5 : 5+length]
+	if len(payload) < 4 || payload[0] != tlsClientHello ||
+		4+(int(payload[1])<<16|int(payload[2])<<8|int(payload[3])) != length {
+		return nil, nil, false
+	}
+
+	for len(payload) > 0 {
+		n := min(size, len(payload))
+		record := make([]byte, 5, 5+n)
+		copy(record, data[:3])
+		binary.BigEndian.PutUint16(record[3:], uint16(n))
+		records = append(records, append(record, payload[:n]...))
+		payload = payload[n:]
+	}
+
+	return records, data[5+length:], false
+}
+
+// setClientHelloFragmentHandler splits ClientHellos sent through CONNECT tunnels
+// into records of tls_clienthello_fragment bytes. It wraps the dialer installed by
+// setTunnelLoggingHandler, so tunnels' traffic is counted as it's sent.
+func setClientHelloFragmentHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if conf.TLSClientHelloFragment <= 0 || proxy.ConnectDialWithReq == nil {
+		return
+	}
+
+	dial := proxy.ConnectDialWithReq
+	log := newModuleLogger(proxy, logModuleTunnel)
+	proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+		conn, err := dial(req, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return newClientHelloFragmenter(conn, conf.TLSClientHelloFragment, func(records int) {
+			log.logf(nil, slog.LevelDebug, "ClientHello from %v to %v is split into %d records", req.RemoteAddr, addr,
+				records)
+		}), nil
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestFragmentClientHello(t *testing.T) {
+	hello := clientHelloBytes(t, &tls.Config{ServerName: "www.example.com"})
+	data := append(append([]byte{}, hello...), "data"...)
+
+	if _, _, more := fragmentClientHello(data[:10], 16); !more {
+		t.Error("Expected incomplete ClientHello to need more data")
+	}
+
+	records, rest, more := fragmentClientHello(data, 16)
+	if more || string(rest) != "data" {
+		t.Fatalf("Expected ClientHello followed by data, got %q (more %v)", rest, more)
+	}
+	if want := (len(hello) - 5 + 15) / 16; len(records) != want {
+		t.Errorf("Expected %d records, got %d", want, len(records))
+	}
+
+	var joined []byte
+	for _, record := range records {
+		if len(record) > 5+16 {
+			t.Errorf("Expected records of at most 16 bytes, got %d", len(record)-5)
+		}
+		joined = append(joined, record...)
+	}
+	message, err := clientHelloMessage(joined)
+	if err != nil || !bytes.Equal(message, hello[9:]) {
+		t.Errorf("Expected the same ClientHello in fragmented records, got %v", err)
+	}
+	if hello, err := parseClientHello(message); err != nil || hello.hostName != "www.example.com" {
+		t.Errorf("Expected www.example.com server name in fragmented ClientHello, got %+v (%v)", hello, err)
+	}
+
+	if records, _, more := fragmentClientHello([]byte("GET / HTTP/1.1\r\n"), 16); records != nil || more {
+		t.Error("Expected non-TLS stream to be passed as is")
+	}
+}
+
+func TestClientHelloFragmenter(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	split := 0
+	conn := newClientHelloFragmenter(client, 64, func(records int) { split = records })
+
+	hello := clientHelloBytes(t, &tls.Config{ServerName: "www.example.com"})
+	go func() {
+		// the ClientHello arrives in two parts
+		conn.Write(hello[:3])
+		conn.Write(append(hello[3:], "data"...))
+		conn.Close()
+	}()
+
+	var writes int
+	var received []byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := server.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		writes++
+		received = append(received, buf[:n]...)
+	}
+
+	if split == 0 || writes != split+1 {
+		t.Errorf("Expected ClientHello records and data in separate writes, got %d writes of %d records", writes, split)
+	}
+	if message, _ := clientHelloMessage(received); !bytes.Equal(message, hello[9:]) || !bytes.HasSuffix(received, []byte("data")) {
+		t.Errorf("Expected ClientHello and data to be received, got %q", received)
+	}
+}
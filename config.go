@@ -1,38 +1,238 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
+// listenAddresses is "listen" option, either a single address or a list of them.
+type listenAddresses []string
+
+func (l *listenAddresses) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case string:
+		*l = listenAddresses{value}
+	case []interface{}:
+		*l = nil
+		for _, item := range value {
+			addr, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("'listen' must be an address or a list of addresses, got %v", item)
+			}
+			*l = append(*l, addr)
+		}
+	default:
+		return fmt.Errorf("'listen' must be an address or a list of addresses, got %v", data)
+	}
+
+	return nil
+}
+
+// contains reports whether addr is one of the addresses.
+func (l listenAddresses) contains(addr string) bool {
+	for _, a := range l {
+		if a == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
 type Configuration struct {
-	Listen              string            `toml:"listen"`
-	AccessLog           string            `toml:"access_log"`
-	ActivityLog         string            `toml:"activity_log"`
-	AllowedConnectPorts []int             `toml:"allowed_connect_ports"`
-	AllowedNetworks     []string          `toml:"allowed_networks"`
-	DisallowedNetworks  []string          `toml:"disallowed_networks"`
-	AuthRealm           string            `toml:"auth_realm"`
-	AuthType            string            `toml:"auth_type"`
-	AuthFile            string            `toml:"auth_file"`
-	ForwardedForHeader  string            `toml:"forwarded_for_header"`
-	BindIP              string            `toml:"bind_ip"`
-	ViaHeader           string            `toml:"via_header"`
-	ViaProxyName        string            `toml:"via_proxy_name"`
-	AddHeaders          [][]string        `toml:"add_headers"`
-	Proxies             map[string]string `toml:"proxies"`
-	Rules               map[string]string `toml:"rules"`
-	ForwardProxyURL     string            `toml:"forward_proxy_url"`
+	Listen                listenAddresses              `toml:"listen"`
+	ListenSOCKS           string                       `toml:"listen_socks"`
+	ListenTransparent     string                       `toml:"listen_transparent"`
+	ServePAC              bool                         `toml:"serve_pac"`
+	PACProxyAddress       string                       `toml:"pac_proxy_address"`
+	AccessLog             string                       `toml:"access_log"`
+	AccessLogFormat       string                       `toml:"access_log_format"`
+	ActivityLog           string                       `toml:"activity_log"`
+	ConnectionLog         string                       `toml:"connection_log"`
+	AllowedConnectPorts   []int                        `toml:"allowed_connect_ports"`
+	AllowedNetworks       []string                     `toml:"allowed_networks"`
+	DisallowedNetworks    []string                     `toml:"disallowed_networks"`
+	NetworkHostsRefresh   time.Duration                `toml:"network_hosts_refresh"`
+	AuthRealm             string                       `toml:"auth_realm"`
+	AuthType              string                       `toml:"auth_type"`
+	AuthFile              string                       `toml:"auth_file"`
+	TrustedUserHeader     string                       `toml:"trusted_user_header"`
+	TrustedUserNetworks   []string                     `toml:"trusted_user_networks"`
+	ProxyProtocolNetworks []string                     `toml:"proxy_protocol_networks"`
+	ForwardedForHeader    string                       `toml:"forwarded_for_header"`
+	BindIP                string                       `toml:"bind_ip"`
+	EgressIPFamily        string                       `toml:"egress_ip_family"`
+	UserEgressIPs         map[string]string            `toml:"user_egress_ips"`
+	ViaHeader             string                       `toml:"via_header"`
+	ViaProxyName          string                       `toml:"via_proxy_name"`
+	AddHeaders            [][]string                   `toml:"add_headers"`
+	ResponseHeaderRules   []ResponseHeaderRule         `toml:"response_header_rules"`
+	RequestSigning        []SigningRule                `toml:"request_signing"`
+	OAuthTokens           []OAuthRule                  `toml:"oauth_tokens"`
+	Proxies               map[string]string            `toml:"proxies"`
+	SRVProxies            map[string]string            `toml:"srv_proxies"`
+	SRVRefreshInterval    time.Duration                `toml:"srv_refresh_interval"`
+	Rules                 map[string]string            `toml:"rules"`
+	ForwardProxyURL       string                       `toml:"forward_proxy_url"`
+	StateDir              string                       `toml:"state_dir"`
+	CrashReportDir        string                       `toml:"crash_report_dir"`
+	UpstreamMaxFailures   int                          `toml:"upstream_max_failures"`
+	UpstreamRetryInterval time.Duration                `toml:"upstream_retry_interval"`
+	UpstreamTLS           map[string]UpstreamTLS       `toml:"upstream_tls"`
+	UpstreamAuth          map[string]string            `toml:"upstream_auth"`
+	PrewarmConnections    int                          `toml:"prewarm_connections"`
+	PrewarmMaxIdle        time.Duration                `toml:"prewarm_max_idle"`
+	AdminListen           string                       `toml:"admin_listen"`
+	AdminToken            string                       `toml:"admin_token"`
+	AdminUI               bool                         `toml:"admin_ui"`
+	AdminSaveConfig       bool                         `toml:"admin_save_config"`
+	ExplainRouting        bool                         `toml:"explain_routing"`
+	ExplainNetworks       []string                     `toml:"explain_networks"`
+	InsecureSkipVerify    bool                         `toml:"insecure_skip_verify"`
+	RouteFallback         string                       `toml:"route_fallback"`
+	UserRules             map[string]map[string]string `toml:"user_rules"`
+	Groups                map[string][]string          `toml:"groups"`
+
+	DirectFallbackDomains  []string `toml:"direct_fallback_domains"`
+	DirectFallbackStatuses []int    `toml:"direct_fallback_statuses"`
+
+	AllowedDestinationNetworks    []string `toml:"allowed_destination_networks"`
+	DisallowedDestinationNetworks []string `toml:"disallowed_destination_networks"`
+	ResolveDestinations           bool     `toml:"resolve_destinations"`
+	ConnectIPLiterals             string   `toml:"connect_ip_literals"`
+	MetadataProtection            bool     `toml:"metadata_protection"`
+	MetadataAllowedNetworks       []string `toml:"metadata_allowed_networks"`
+	ASNDatabase                   string   `toml:"asn_database"`
+	AllowedDestinationASNs        []uint   `toml:"allowed_destination_asns"`
+	DisallowedDestinationASNs     []uint   `toml:"disallowed_destination_asns"`
+	EgressAllowlist               []string `toml:"egress_allowlist"`
+	EgressAllowlistMode           string   `toml:"egress_allowlist_mode"`
+
+	DNSBLZones    []string      `toml:"dnsbl_zones"`
+	DNSBLAction   string        `toml:"dnsbl_action"`
+	DNSBLCacheTTL time.Duration `toml:"dnsbl_cache_ttl"`
+
+	AnnotationDomains    []string            `toml:"annotation_domains"`
+	AnnotationUserHeader string              `toml:"annotation_user_header"`
+	AnnotationZoneHeader string              `toml:"annotation_zone_header"`
+	ClientZones          map[string][]string `toml:"client_zones"`
+
+	IdentNetworks []string      `toml:"ident_networks"`
+	IdentTimeout  time.Duration `toml:"ident_timeout"`
+	IdentCacheTTL time.Duration `toml:"ident_cache_ttl"`
+
+	ThreatFeeds       []ThreatFeed  `toml:"threat_feeds"`
+	ThreatFeedRefresh time.Duration `toml:"threat_feed_refresh"`
+
+	HostHeaderMismatch string        `toml:"host_header_mismatch"`
+	StrictParsing      bool          `toml:"strict_parsing"`
+	MaxHeaderBytes     int           `toml:"max_header_bytes"`
+	ReadHeaderTimeout  time.Duration `toml:"read_header_timeout"`
+	IdleTimeout        time.Duration `toml:"idle_timeout"`
+	MaxHeaderSize      int           `toml:"max_header_size"`
+	MaxHeaderCount     int           `toml:"max_header_count"`
+	MaxURLLength       int           `toml:"max_url_length"`
+	MaxQueryLength     int           `toml:"max_query_length"`
+	MaxPathDepth       int           `toml:"max_path_depth"`
+
+	AllowedSchemes []string `toml:"allowed_schemes"`
+
+	ExpectContinue        string        `toml:"expect_continue"`
+	ExpectContinueTimeout time.Duration `toml:"expect_continue_timeout"`
+	Trailers              string        `toml:"trailers"`
+	ResponseStallTimeout  time.Duration `toml:"response_stall_timeout"`
+	ConnectTimeout        time.Duration `toml:"connect_timeout"`
+	TLSHandshakeTimeout   time.Duration `toml:"tls_handshake_timeout"`
+	TLSSessionCacheSize   int           `toml:"tls_session_cache_size"`
+	UpstreamHTTP2         bool          `toml:"upstream_http2"`
+	ResponseHeaderTimeout time.Duration `toml:"response_header_timeout"`
+
+	LogTimeFormat string `toml:"log_time_format"`
+	LogTimeZone   string `toml:"log_time_zone"`
+
+	LogToStdout       bool              `toml:"log_to_stdout"`
+	ActivityLogFormat string            `toml:"activity_log_format"`
+	ActivityLogLevel  string            `toml:"activity_log_level"`
+	ActivityLogLevels map[string]string `toml:"activity_log_levels"`
+
+	MITMDomains []string `toml:"mitm_domains"`
+	MITMCACert  string   `toml:"mitm_ca_cert"`
+	MITMCAKey   string   `toml:"mitm_ca_key"`
+
+	LogTLSMetadata     bool `toml:"log_tls_metadata"`
+	LogTLSFingerprints bool `toml:"log_tls_fingerprints"`
+
+	TLSClientHelloFragment int `toml:"tls_clienthello_fragment"`
+
+	WebSocketAllowedDomains []string `toml:"websocket_allowed_domains"`
+	WebSocketDeniedDomains  []string `toml:"websocket_denied_domains"`
+
+	MetricsListen string `toml:"metrics_listen"`
+	HealthListen  string `toml:"health_listen"`
+	StatsListen   string `toml:"stats_listen"`
+
+	TracingEndpoint    string `toml:"tracing_endpoint"`
+	TracingServiceName string `toml:"tracing_service_name"`
+
+	ShadowConfig string `toml:"shadow_config"`
+
+	AdminTLSCert  string `toml:"admin_tls_cert"`
+	AdminTLSKey   string `toml:"admin_tls_key"`
+	AdminClientCA string `toml:"admin_client_ca"`
+	// clients are rejected during the handshake if they don't support them
+	AdminTLSMinVersion string   `toml:"admin_tls_min_version"`
+	AdminTLSALPN       []string `toml:"admin_tls_alpn"`
+
+	RestartDrainTimeout time.Duration `toml:"restart_drain_timeout"`
+	TunnelIdleTimeout   time.Duration `toml:"tunnel_idle_timeout"`
+
+	MaxConcurrentRequests int           `toml:"max_concurrent_requests"`
+	RequestQueueSize      int           `toml:"request_queue_size"`
+	RequestQueueTimeout   time.Duration `toml:"request_queue_timeout"`
+
+	MaxConnectionsPerDestination int           `toml:"max_connections_per_destination"`
+	DestinationQueueTimeout      time.Duration `toml:"destination_queue_timeout"`
+	ConnectRatePerDestination    float64       `toml:"connect_rate_per_destination"`
+	ConnectBurstPerDestination   int           `toml:"connect_burst_per_destination"`
+
+	MemoryLimit        string  `toml:"memory_limit"`
+	MemoryShedRatio    float64 `toml:"memory_shed_ratio"`
+	MemoryShedRequests bool    `toml:"memory_shed_requests"`
+
+	ClusterRedisURL string `toml:"cluster_redis_url"`
+
+	FailoverPeer            string        `toml:"failover_peer"`
+	FailoverInterval        time.Duration `toml:"failover_interval"`
+	FailoverMaxFailures     int           `toml:"failover_max_failures"`
+	FailoverTakeoverCommand string        `toml:"failover_takeover_command"`
+
+	// isolated tenants served by the same process, each on its own listener
+	Tenants map[string]*Configuration `toml:"tenants"`
+
+	// single basic auth user from the environment, used when auth_file isn't set
+	AuthUser     string `toml:"-"`
+	AuthPassword string `toml:"-"`
 }
 
 const (
-	defaultListenAddress      = "127.0.0.1:3128"
-	defaultAllowedNetwork     = "127.0.0.1/32"
-	defaultAllowedConnectPort = 443
+	defaultListenAddress       = "127.0.0.1:3128"
+	defaultAllowedNetwork      = "127.0.0.1/32"
+	defaultAllowedConnectPort  = 443
+	defaultReadHeaderTimeout   = 30 * time.Second
+	defaultConnectTimeout      = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultTLSSessionCacheSize = 1024
 )
 
 func validateNetworks(networks []string) {
@@ -56,6 +256,15 @@ func validateNetworks(networks []string) {
 	}
 }
 
+// validateClientNetworks is validateNetworks which also accepts host names.
+func validateClientNetworks(networks []string) {
+	for i, network := range networks {
+		if !isNetworkHost(network) {
+			validateNetworks(networks[i : i+1])
+		}
+	}
+}
+
 func validateIP(addr string) {
 	if addr != "" {
 		ip := net.ParseIP(addr)
@@ -65,6 +274,25 @@ func validateIP(addr string) {
 	}
 }
 
+func validateTrustedUser(conf *Configuration) {
+	if conf.TrustedUserHeader == "" {
+		if len(conf.TrustedUserNetworks) > 0 {
+			log.Fatalf("'trusted_user_networks' requires 'trusted_user_header'")
+		}
+		return
+	}
+
+	if len(conf.TrustedUserNetworks) == 0 {
+		log.Fatalf("'trusted_user_header' requires 'trusted_user_networks'")
+	}
+	for i := 0; i < len(conf.TrustedUserHeader); i++ {
+		if !isTokenChar(conf.TrustedUserHeader[i]) {
+			log.Fatalf("Incorrect 'trusted_user_header' value '%s'", conf.TrustedUserHeader)
+		}
+	}
+	validateNetworks(conf.TrustedUserNetworks)
+}
+
 func validateAuthType(authType string) {
 	validValues := map[string]bool{
 		"":       true,
@@ -105,6 +333,621 @@ func validateViaHeaderAction(action string) {
 	}
 }
 
+func validateConnectIPLiterals(conf *Configuration) {
+	validValues := map[string]bool{
+		connectIPLiteralsAllow: true,
+		connectIPLiteralsDeny:  true,
+		connectIPLiteralsACL:   true,
+	}
+
+	if !validValues[conf.ConnectIPLiterals] {
+		log.Fatalf("Incorrect 'connect_ip_literals' value '%s'", conf.ConnectIPLiterals)
+	}
+
+	if conf.ConnectIPLiterals == connectIPLiteralsACL && len(conf.AllowedDestinationNetworks) == 0 {
+		log.Fatal("'connect_ip_literals=\"acl\"' requires 'allowed_destination_networks'")
+	}
+}
+
+// validateEgressAllowlist checks that entries are networks or domain names, IP
+// addresses are converted to networks.
+func validateEgressAllowlist(conf *Configuration) {
+	if conf.EgressAllowlistMode != egressAllowlistEnforce && conf.EgressAllowlistMode != egressAllowlistReport {
+		log.Fatalf("Incorrect 'egress_allowlist_mode' value '%s'", conf.EgressAllowlistMode)
+	}
+
+	for i, entry := range conf.EgressAllowlist {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			if ip.To4() != nil {
+				conf.EgressAllowlist[i] = entry + "/32"
+			} else {
+				conf.EgressAllowlist[i] = entry + "/128"
+			}
+			continue
+		}
+		if !isNetworkHost(strings.Trim(entry, ".")) {
+			log.Fatalf("Incorrect 'egress_allowlist' entry '%s'", entry)
+		}
+	}
+}
+
+func validateCrashReportDir(dir string) {
+	if dir == "" {
+		return
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Fatalf("Incorrect 'crash_report_dir' value '%s': not a directory", dir)
+	}
+}
+
+func validateExpectContinue(policy string) {
+	validValues := map[string]bool{
+		expectContinueForward: true,
+		expectContinueLocal:   true,
+	}
+
+	if !validValues[policy] {
+		log.Fatalf("Incorrect 'expect_continue' value '%s'", policy)
+	}
+}
+
+func validateTrailers(action string) {
+	validValues := map[string]bool{
+		trailersPass:  true,
+		trailersStrip: true,
+	}
+
+	if !validValues[action] {
+		log.Fatalf("Incorrect 'trailers' value '%s'", action)
+	}
+}
+
+func validateHostHeaderMismatch(action string) {
+	validValues := map[string]bool{
+		hostHeaderRewrite: true,
+		hostHeaderDeny:    true,
+	}
+
+	if !validValues[action] {
+		log.Fatalf("Incorrect 'host_header_mismatch' value '%s'", action)
+	}
+}
+
+func validateASNDatabase(conf *Configuration) {
+	if conf.ASNDatabase == "" {
+		if len(conf.AllowedDestinationASNs) > 0 || len(conf.DisallowedDestinationASNs) > 0 {
+			log.Fatal("destination ASN lists require 'asn_database'")
+		}
+		return
+	}
+
+	if _, err := openASNDatabase(conf.ASNDatabase); err != nil {
+		log.Fatalf("couldn't open ASN database: %v", err)
+	}
+}
+
+func validateDNSBLAction(action string) {
+	validValues := map[string]bool{
+		dnsblBlock: true,
+		dnsblLog:   true,
+	}
+
+	if !validValues[action] {
+		log.Fatalf("Incorrect 'dnsbl_action' value '%s'", action)
+	}
+}
+
+func validateThreatFeeds(feeds []ThreatFeed) {
+	validValues := map[string]bool{
+		"":                true,
+		threatFeedDomains: true,
+		threatFeedCSV:     true,
+		threatFeedJSON:    true,
+	}
+
+	for _, feed := range feeds {
+		if err := validateHTTPURL(feed.URL); err != nil {
+			log.Fatalf("Incorrect threat feed URL '%s': %v", feed.URL, err)
+		}
+		if !validValues[feed.Format] {
+			log.Fatalf("Incorrect threat feed format '%s'", feed.Format)
+		}
+	}
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validateResponseHeaderRules(rules []ResponseHeaderRule) {
+	for _, rule := range rules {
+		for _, header := range rule.Remove {
+			if !validHeaderName(header) {
+				log.Fatalf("Incorrect header name '%s' in 'response_header_rules'", header)
+			}
+		}
+		for _, header := range rule.Set {
+			if len(header) != 2 || !validHeaderName(header[0]) || strings.ContainsAny(header[1], "\r\n") {
+				log.Fatalf("Incorrect header %q in 'response_header_rules', expected [\"name\", \"value\"]", header)
+			}
+		}
+	}
+}
+
+func validateAnnotation(conf *Configuration) {
+	for _, header := range []struct{ option, name string }{
+		{"annotation_user_header", conf.AnnotationUserHeader},
+		{"annotation_zone_header", conf.AnnotationZoneHeader},
+	} {
+		if !validHeaderName(header.name) {
+			log.Fatalf("Incorrect '%s' value '%s'", header.option, header.name)
+		}
+	}
+
+	if conf.AnnotationUserHeader == conf.AnnotationZoneHeader {
+		log.Fatal("'annotation_user_header' and 'annotation_zone_header' must differ")
+	}
+
+	for name, networks := range conf.ClientZones {
+		if !validHeaderName(name) {
+			log.Fatalf("Incorrect zone name '%s' in 'client_zones'", name)
+		}
+		validateNetworks(networks)
+	}
+}
+
+func validateHTTPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.New("only http and https URLs are supported")
+	}
+
+	return nil
+}
+
+func validateClusterRedisURL(rawURL string) {
+	if rawURL == "" {
+		return
+	}
+
+	if _, err := newRedisClient(rawURL); err != nil {
+		log.Fatalf("Incorrect 'cluster_redis_url' value: %v", err)
+	}
+}
+
+func validateFailoverPeer(peer string) {
+	if peer == "" {
+		return
+	}
+
+	if err := validateHTTPURL(peer); err != nil {
+		log.Fatalf("Incorrect 'failover_peer' value '%s': %v", peer, err)
+	}
+}
+
+func validateEgressIPFamily(conf *Configuration) {
+	validValues := map[string]bool{
+		egressAny:  true,
+		egressIPv4: true,
+		egressIPv6: true,
+	}
+
+	if !validValues[conf.EgressIPFamily] {
+		log.Fatalf("Incorrect 'egress_ip_family' value '%s'", conf.EgressIPFamily)
+	}
+
+	if ip := net.ParseIP(conf.BindIP); ip != nil && conf.EgressIPFamily != egressAny &&
+		(ip.To4() != nil) != (conf.EgressIPFamily == egressIPv4) {
+		log.Fatalf("'bind_ip' %s doesn't belong to 'egress_ip_family' %s", conf.BindIP, conf.EgressIPFamily)
+	}
+
+	for user, addr := range conf.UserEgressIPs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			log.Fatalf("Incorrect egress IP '%s' of user '%s'", addr, user)
+		}
+		if conf.EgressIPFamily != egressAny && (ip.To4() != nil) != (conf.EgressIPFamily == egressIPv4) {
+			log.Fatalf("egress IP %s of user '%s' doesn't belong to 'egress_ip_family' %s", addr, user, conf.EgressIPFamily)
+		}
+	}
+}
+
+func validateLogTime(format, zone string) {
+	if _, err := newTimeFormatter(format, zone, time.RFC3339); err != nil {
+		log.Fatalf("invalid log time settings: %v", err)
+	}
+}
+
+func validateAccessLogFormat(format string) {
+	validFormats := map[string]bool{
+		logFormatPlain: true,
+		logFormatJSON:  true,
+		logFormatSquid: true,
+	}
+
+	if !validFormats[format] {
+		log.Fatalf("Incorrect 'access_log_format' value '%s'", format)
+	}
+}
+
+func validateActivityLog(conf *Configuration) {
+	validFormats := map[string]bool{
+		logFormatPlain: true,
+		logFormatText:  true,
+		logFormatJSON:  true,
+	}
+
+	if conf.LogToStdout && (conf.AccessLog != "" || conf.ActivityLog != "" || conf.ConnectionLog != "") {
+		log.Fatal("'access_log', 'activity_log' and 'connection_log' can't be set together with 'log_to_stdout'")
+	}
+
+	if !validFormats[conf.ActivityLogFormat] {
+		log.Fatalf("Incorrect 'activity_log_format' value '%s'", conf.ActivityLogFormat)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(conf.ActivityLogLevel)); err != nil {
+		log.Fatalf("Incorrect 'activity_log_level' value '%s'", conf.ActivityLogLevel)
+	}
+
+	for module, value := range conf.ActivityLogLevels {
+		if !logModules[module] {
+			log.Fatalf("Unknown module '%s' in 'activity_log_levels'", module)
+		}
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			log.Fatalf("Incorrect 'activity_log_levels' value '%s' of module '%s'", value, module)
+		}
+	}
+}
+
+func validateMetricsListen(conf *Configuration) {
+	if conf.MetricsListen == "" {
+		return
+	}
+
+	if conf.Listen.contains(conf.MetricsListen) || conf.MetricsListen == conf.AdminListen {
+		log.Fatalf("'metrics_listen' address %s is already used", conf.MetricsListen)
+	}
+}
+
+func validateHealthListen(conf *Configuration) {
+	if conf.HealthListen == "" {
+		return
+	}
+
+	if conf.Listen.contains(conf.HealthListen) || conf.HealthListen == conf.AdminListen ||
+		conf.HealthListen == conf.MetricsListen || conf.HealthListen == conf.ListenSOCKS {
+		log.Fatalf("'health_listen' address %s is already used", conf.HealthListen)
+	}
+}
+
+func validateShadowConfig(path string) {
+	if path == "" {
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		log.Fatalf("Incorrect 'shadow_config' value: %v", err)
+	}
+}
+
+func validateStatsListen(conf *Configuration) {
+	if conf.StatsListen == "" {
+		return
+	}
+
+	if conf.Listen.contains(conf.StatsListen) || conf.StatsListen == conf.AdminListen || conf.StatsListen == conf.MetricsListen ||
+		conf.StatsListen == conf.HealthListen || conf.StatsListen == conf.ListenSOCKS {
+		log.Fatalf("'stats_listen' address %s is already used", conf.StatsListen)
+	}
+}
+
+func validateTracingEndpoint(endpoint string) {
+	if endpoint == "" {
+		return
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Incorrect 'tracing_endpoint' value '%s'", endpoint)
+	}
+}
+
+func validateListenSOCKS(conf *Configuration) {
+	if conf.ListenSOCKS == "" {
+		return
+	}
+
+	if conf.Listen.contains(conf.ListenSOCKS) || conf.ListenSOCKS == conf.AdminListen || conf.ListenSOCKS == conf.MetricsListen {
+		log.Fatalf("'listen_socks' address %s is already used", conf.ListenSOCKS)
+	}
+
+	// SOCKS clients' credentials are passed to basic auth
+	if conf.authEnabled() && conf.AuthType != "basic" {
+		log.Fatal("'listen_socks' can be used only with 'basic' auth_type")
+	}
+}
+
+func validateListenTransparent(conf *Configuration) {
+	if conf.ListenTransparent == "" {
+		return
+	}
+
+	if conf.Listen.contains(conf.ListenTransparent) || conf.ListenTransparent == conf.ListenSOCKS ||
+		conf.ListenTransparent == conf.AdminListen || conf.ListenTransparent == conf.MetricsListen ||
+		conf.ListenTransparent == conf.HealthListen || conf.ListenTransparent == conf.StatsListen {
+		log.Fatalf("'listen_transparent' address %s is already used", conf.ListenTransparent)
+	}
+
+	// redirected clients don't know they talk to a proxy, so they can't authenticate
+	if conf.authEnabled() {
+		log.Fatal("'listen_transparent' can't be used with proxy authentication")
+	}
+}
+
+func validateTLSClientHelloFragment(conf *Configuration) {
+	if conf.TLSClientHelloFragment < 0 {
+		log.Fatalf("Incorrect 'tls_clienthello_fragment' value %d", conf.TLSClientHelloFragment)
+	}
+}
+
+func validateUpstreamTLS(conf *Configuration) {
+	if _, err := newHTTPSProxyTLSConfigs(conf, nil); err != nil {
+		log.Fatalf("invalid 'upstream_tls': %v", err)
+	}
+}
+
+func validateUpstreamAuth(conf *Configuration) {
+	for addr, scheme := range conf.UpstreamAuth {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			log.Fatalf("'upstream_auth' entry '%s' isn't host:port", addr)
+		}
+		switch scheme {
+		case upstreamAuthBasic, upstreamAuthNTLM, upstreamAuthNegotiate:
+		default:
+			log.Fatalf("Incorrect 'upstream_auth' value '%s' of '%s'", scheme, addr)
+		}
+	}
+}
+
+func validateMITM(conf *Configuration) {
+	if len(conf.MITMDomains) == 0 {
+		return
+	}
+
+	if conf.MITMCACert == "" || conf.MITMCAKey == "" {
+		log.Fatal("'mitm_domains' requires 'mitm_ca_cert' and 'mitm_ca_key'")
+	}
+
+	if _, err := loadMITMCA(conf.MITMCACert, conf.MITMCAKey); err != nil {
+		log.Fatalf("invalid MITM CA: %v", err)
+	}
+}
+
+func validateRequestSigning(rules []SigningRule) {
+	for i, rule := range rules {
+		if len(rule.Hosts) == 0 {
+			log.Fatalf("'request_signing' rule #%d has no hosts", i+1)
+		}
+
+		switch rule.Type {
+		case signingHMAC:
+			if rule.Secret == "" {
+				log.Fatalf("'request_signing' rule #%d requires 'secret'", i+1)
+			}
+			if rule.Header != "" && !validHeaderName(rule.Header) {
+				log.Fatalf("'request_signing' rule #%d has invalid header name '%s'", i+1, rule.Header)
+			}
+		case signingAWSv4:
+			if rule.AccessKeyID == "" || rule.SecretAccessKey == "" || rule.Region == "" || rule.Service == "" {
+				log.Fatalf("'request_signing' rule #%d requires 'access_key_id', 'secret_access_key', 'region' and 'service'", i+1)
+			}
+		default:
+			log.Fatalf("Incorrect 'request_signing' type '%s' in rule #%d", rule.Type, i+1)
+		}
+	}
+}
+
+func validateOAuthTokens(rules []OAuthRule) {
+	for i, rule := range rules {
+		if len(rule.Hosts) == 0 {
+			log.Fatalf("'oauth_tokens' rule #%d has no hosts", i+1)
+		}
+
+		u, err := url.Parse(rule.TokenURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Incorrect 'token_url' value '%s' in 'oauth_tokens' rule #%d", rule.TokenURL, i+1)
+		}
+
+		if rule.ClientID == "" {
+			log.Fatalf("'oauth_tokens' rule #%d requires 'client_id'", i+1)
+		}
+	}
+}
+
+func validateAdminToken(conf *Configuration) {
+	// the admin API exposes upstream proxies, tunnels and users, so it's never
+	// served without authentication
+	if conf.AdminListen != "" && conf.AdminToken == "" && conf.AdminClientCA == "" {
+		log.Fatal("'admin_listen' requires 'admin_token' or 'admin_client_ca'")
+	}
+}
+
+func validateAdminUI(conf *Configuration) {
+	if !conf.AdminUI {
+		return
+	}
+
+	// the page itself is served without authentication
+	if conf.AdminListen == "" || conf.AdminToken == "" {
+		log.Fatal("'admin_ui' requires 'admin_listen' and 'admin_token'")
+	}
+}
+
+func validateAdminTLS(conf *Configuration) {
+	if (conf.AdminTLSCert == "") != (conf.AdminTLSKey == "") {
+		log.Fatal("both 'admin_tls_cert' and 'admin_tls_key' have to be set")
+	}
+
+	if conf.AdminClientCA != "" && conf.AdminTLSCert == "" {
+		log.Fatal("'admin_client_ca' requires 'admin_tls_cert' and 'admin_tls_key'")
+	}
+
+	if (conf.AdminTLSMinVersion != "" || len(conf.AdminTLSALPN) > 0) && conf.AdminTLSCert == "" {
+		log.Fatal("'admin_tls_min_version' and 'admin_tls_alpn' require 'admin_tls_cert' and 'admin_tls_key'")
+	}
+
+	if conf.AdminTLSCert != "" {
+		if _, err := newAdminTLSConfig(conf, nil); err != nil {
+			log.Fatalf("invalid admin TLS settings: %v", err)
+		}
+	}
+}
+
+// authEnabled reports whether clients have to authenticate.
+func (conf *Configuration) authEnabled() bool {
+	return conf.AuthFile != "" || conf.AuthUser != ""
+}
+
+// readSecret returns the value of the environment variable name or, if it's not
+// set, the content of the file named by name+"_FILE" variable (i.e. Docker secret).
+func readSecret(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// setAuthCredentialsFromEnv sets up a single basic auth user from AUTH_USER and
+// AUTH_PASS variables or their _FILE counterparts.
+func setAuthCredentialsFromEnv(conf *Configuration) {
+	user, err := readSecret("AUTH_USER")
+	if err != nil {
+		log.Fatalf("couldn't read auth user: %v", err)
+	}
+
+	password, err := readSecret("AUTH_PASS")
+	if err != nil {
+		log.Fatalf("couldn't read auth password: %v", err)
+	}
+
+	if user == "" && password == "" {
+		return
+	}
+
+	if user == "" || password == "" {
+		log.Fatal("both auth user and password have to be set in the environment")
+	}
+
+	if conf.AuthType == "" {
+		conf.AuthType = "basic"
+	} else if conf.AuthType != "basic" {
+		log.Fatal("credentials from the environment can be used only with 'basic' auth_type")
+	}
+
+	conf.AuthUser, conf.AuthPassword = user, password
+}
+
+func validateMemoryLimit(limit string, ratio float64) {
+	if limit != "" {
+		if _, err := parseByteSize(limit); err != nil {
+			log.Fatalf("invalid 'memory_limit' value: %v", err)
+		}
+	}
+
+	if ratio > 1 {
+		log.Fatalf("'memory_shed_ratio' has to be in (0, 1] range, got %v", ratio)
+	}
+}
+
+func validateRouteFallback(fallback string) {
+	validValues := map[string]bool{
+		routeFallbackDirect: true,
+		routeFallbackDeny:   true,
+	}
+
+	_, ok := validValues[fallback]
+	if !ok {
+		log.Fatalf("Incorrect route fallback '%s'", fallback)
+	}
+}
+
+func validateDirectFallbackStatuses(statuses []int) {
+	for _, status := range statuses {
+		if status < 500 || status > 599 {
+			log.Fatalf("Incorrect 'direct_fallback_statuses' value %d, only 5xx statuses are allowed", status)
+		}
+	}
+}
+
+func validateProxies(proxies map[string]string, forwardProxyURL string) {
+	for alias, proxyURL := range proxies {
+		if alias == ruleDirect || alias == ruleDeny {
+			log.Fatalf("proxy alias '%s' is reserved", alias)
+		}
+		if _, err := url.Parse(proxyURL); err != nil {
+			log.Fatalf("couldn't parse URL of proxy '%s': %v", alias, err)
+		}
+	}
+
+	if _, err := url.Parse(forwardProxyURL); err != nil {
+		log.Fatalf("couldn't parse forward proxy URL: %v", err)
+	}
+}
+
+func validateSRVProxies(srvProxies, proxies map[string]string) {
+	for alias, name := range srvProxies {
+		if alias == ruleDirect || alias == ruleDeny {
+			log.Fatalf("proxy alias '%s' is reserved", alias)
+		}
+		if _, exists := proxies[alias]; exists {
+			log.Fatalf("upstream pool alias '%s' is already used in 'proxies'", alias)
+		}
+		if _, err := parseSRVProxyURL(name); err != nil {
+			log.Fatalf("couldn't parse SRV name of upstream pool '%s': %v", alias, err)
+		}
+	}
+}
+
+func validateUserRules(userRules map[string]map[string]string, groups map[string][]string) {
+	for identity := range userRules {
+		if group, isGroup := strings.CutPrefix(identity, "@"); isGroup {
+			if _, exists := groups[group]; !exists {
+				log.Fatalf("user_rules refer to unknown group '%s'", group)
+			}
+		}
+	}
+}
+
 func newConfigurationFromFile(path string) *Configuration {
 	file, err := os.Open(path)
 	if err != nil {
@@ -122,20 +965,81 @@ func newConfiguration(data io.Reader) *Configuration {
 		log.Fatalf("Couldn't parse configuration file: %v", err)
 	}
 
-	if conf.Listen == "" {
-		conf.Listen = defaultListenAddress
+	if len(conf.Listen) == 0 {
+		conf.Listen = listenAddresses{defaultListenAddress}
+	}
+
+	if conf.AuthFile == "" {
+		setAuthCredentialsFromEnv(&conf)
+	}
+
+	setConfigurationDefaults(&conf)
+
+	listeners := make(map[string]string)
+	for _, addr := range conf.Listen {
+		if _, exists := listeners[addr]; exists {
+			log.Fatalf("'listen' address %s is listed more than once", addr)
+		}
+		listeners[addr] = "main configuration"
+	}
+	for name, tenant := range conf.Tenants {
+		validateTenant(name, tenant, listeners)
+		setConfigurationDefaults(tenant)
+	}
+
+	return &conf
+}
+
+// validateTenant checks that the tenant has its own listener and doesn't set
+// options which apply to the whole process.
+func validateTenant(name string, tenant *Configuration, listeners map[string]string) {
+	if tenant == nil || len(tenant.Listen) == 0 {
+		log.Fatalf("missed mandatory 'listen' parameter of tenant '%s'", name)
+	}
+
+	for _, addr := range tenant.Listen {
+		if other, exists := listeners[addr]; exists {
+			log.Fatalf("tenant '%s' listens on %s, which is used by %s", name, addr, other)
+		}
+		listeners[addr] = fmt.Sprintf("tenant '%s'", name)
+	}
+
+	processOptions := map[string]bool{
+		"admin_listen":          tenant.AdminListen != "",
+		"admin_ui":              tenant.AdminUI,
+		"state_dir":             tenant.StateDir != "",
+		"memory_limit":          tenant.MemoryLimit != "",
+		"memory_shed_requests":  tenant.MemoryShedRequests,
+		"restart_drain_timeout": tenant.RestartDrainTimeout != 0,
+		"failover_peer":         tenant.FailoverPeer != "",
+		"tenants":               len(tenant.Tenants) > 0,
+	}
+	for option, set := range processOptions {
+		if set {
+			log.Fatalf("'%s' can't be set for tenant '%s', it applies to the whole process", option, name)
+		}
 	}
+}
 
+// setConfigurationDefaults fills in defaults of unset options and validates the
+// configuration.
+func setConfigurationDefaults(conf *Configuration) {
 	// if no auth. enabled allow only from 127.0.0.1/32 if not deliberately specified otherwise
 	if conf.AllowedNetworks == nil || len(conf.AllowedNetworks) == 0 {
-		if conf.AuthFile == "" || conf.AuthType == "" {
+		if !conf.authEnabled() || conf.AuthType == "" {
 			conf.AllowedNetworks = make([]string, 1)
 			conf.AllowedNetworks[0] = defaultAllowedNetwork
 		}
 	}
 
-	validateNetworks(conf.AllowedNetworks)
-	validateNetworks(conf.DisallowedNetworks)
+	validateClientNetworks(conf.AllowedNetworks)
+	validateClientNetworks(conf.DisallowedNetworks)
+	validateNetworks(conf.ExplainNetworks)
+	validateNetworks(conf.AllowedDestinationNetworks)
+	validateNetworks(conf.DisallowedDestinationNetworks)
+	validateNetworks(conf.MetadataAllowedNetworks)
+	validateNetworks(conf.IdentNetworks)
+	validateNetworks(conf.ProxyProtocolNetworks)
 	validateIP(conf.BindIP)
 
 	// by default allow connect only to the https protocol port
@@ -165,9 +1069,199 @@ func newConfiguration(data io.Reader) *Configuration {
 		conf.ViaProxyName = hostname
 	}
 
+	if conf.DirectFallbackStatuses == nil {
+		conf.DirectFallbackStatuses = defaultDirectFallbackStatuses
+	}
+
+	if conf.UpstreamMaxFailures <= 0 {
+		conf.UpstreamMaxFailures = defaultUpstreamMaxFailures
+	}
+
+	if conf.UpstreamRetryInterval <= 0 {
+		conf.UpstreamRetryInterval = defaultUpstreamRetryInterval
+	}
+
+	if conf.PrewarmMaxIdle <= 0 {
+		conf.PrewarmMaxIdle = defaultPrewarmMaxIdle
+	}
+
+	if conf.RequestQueueTimeout <= 0 {
+		conf.RequestQueueTimeout = defaultRequestQueueTimeout
+	}
+
+	if conf.TracingServiceName == "" {
+		conf.TracingServiceName = defaultTracingServiceName
+	}
+
+	// a second worth of tunnels may be opened at once
+	if conf.ConnectRatePerDestination > 0 && conf.ConnectBurstPerDestination <= 0 {
+		conf.ConnectBurstPerDestination = int(math.Max(1, conf.ConnectRatePerDestination))
+	}
+
+	if conf.DestinationQueueTimeout <= 0 {
+		conf.DestinationQueueTimeout = defaultDestinationQueueTimeout
+	}
+
+	if conf.MemoryShedRatio <= 0 {
+		conf.MemoryShedRatio = defaultMemoryShedRatio
+	}
+
+	if conf.ConnectIPLiterals == "" {
+		conf.ConnectIPLiterals = connectIPLiteralsAllow
+	}
+
+	if conf.EgressAllowlistMode == "" {
+		conf.EgressAllowlistMode = egressAllowlistEnforce
+	}
+
+	// by default only schemes supported by the transport are allowed
+	if len(conf.AllowedSchemes) == 0 {
+		conf.AllowedSchemes = []string{"http", "https"}
+	}
+
+	if conf.ExpectContinue == "" {
+		conf.ExpectContinue = expectContinueForward
+	}
+
+	if conf.ExpectContinueTimeout <= 0 {
+		conf.ExpectContinueTimeout = defaultExpectContinueTimeout
+	}
+
+	if conf.Trailers == "" {
+		conf.Trailers = trailersPass
+	}
+
+	if conf.DNSBLAction == "" {
+		conf.DNSBLAction = dnsblBlock
+	}
+
+	if conf.AnnotationUserHeader == "" {
+		conf.AnnotationUserHeader = defaultAnnotationUserHeader
+	}
+
+	if conf.AnnotationZoneHeader == "" {
+		conf.AnnotationZoneHeader = defaultAnnotationZoneHeader
+	}
+
+	if conf.NetworkHostsRefresh <= 0 {
+		conf.NetworkHostsRefresh = defaultNetworkHostsRefresh
+	}
+
+	if conf.DNSBLCacheTTL <= 0 {
+		conf.DNSBLCacheTTL = defaultDNSBLCacheTTL
+	}
+
+	if conf.IdentTimeout <= 0 {
+		conf.IdentTimeout = defaultIdentTimeout
+	}
+
+	if conf.IdentCacheTTL <= 0 {
+		conf.IdentCacheTTL = defaultIdentCacheTTL
+	}
+
+	if conf.ThreatFeedRefresh <= 0 {
+		conf.ThreatFeedRefresh = defaultThreatFeedRefresh
+	}
+
+	if conf.SRVRefreshInterval <= 0 {
+		conf.SRVRefreshInterval = defaultSRVRefreshInterval
+	}
+
+	if conf.FailoverInterval <= 0 {
+		conf.FailoverInterval = defaultFailoverInterval
+	}
+
+	if conf.FailoverMaxFailures <= 0 {
+		conf.FailoverMaxFailures = defaultFailoverMaxFailures
+	}
+
+	if conf.EgressIPFamily == "" {
+		conf.EgressIPFamily = egressAny
+	}
+
+	if conf.AccessLogFormat == "" {
+		conf.AccessLogFormat = logFormatPlain
+		if conf.LogToStdout {
+			conf.AccessLogFormat = logFormatJSON
+		}
+	}
+
+	if conf.ActivityLogFormat == "" {
+		conf.ActivityLogFormat = logFormatPlain
+		if conf.LogToStdout {
+			conf.ActivityLogFormat = logFormatJSON
+		}
+	}
+
+	if conf.ActivityLogLevel == "" {
+		conf.ActivityLogLevel = "info"
+	}
+
+	if conf.ConnectTimeout == 0 {
+		conf.ConnectTimeout = defaultConnectTimeout
+	}
+
+	if conf.TLSHandshakeTimeout == 0 {
+		conf.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+
+	if conf.TLSSessionCacheSize == 0 {
+		conf.TLSSessionCacheSize = defaultTLSSessionCacheSize
+	}
+
+	if conf.ReadHeaderTimeout == 0 {
+		conf.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+
+	if conf.HostHeaderMismatch == "" {
+		conf.HostHeaderMismatch = hostHeaderRewrite
+	}
+
+	if conf.RouteFallback == "" {
+		conf.RouteFallback = routeFallbackDirect
+	}
+
 	validateAuthType(conf.AuthType)
+	validateTrustedUser(conf)
 	validateForwardedForHeaderAction(conf.ForwardedForHeader)
 	validateViaHeaderAction(conf.ViaHeader)
-
-	return &conf
+	validateRouteFallback(conf.RouteFallback)
+	validateDirectFallbackStatuses(conf.DirectFallbackStatuses)
+	validateConnectIPLiterals(conf)
+	validateEgressAllowlist(conf)
+	validateCrashReportDir(conf.CrashReportDir)
+	validateASNDatabase(conf)
+	validateDNSBLAction(conf.DNSBLAction)
+	validateThreatFeeds(conf.ThreatFeeds)
+	validateResponseHeaderRules(conf.ResponseHeaderRules)
+	validateAnnotation(conf)
+	validateRequestSigning(conf.RequestSigning)
+	validateOAuthTokens(conf.OAuthTokens)
+	validateClusterRedisURL(conf.ClusterRedisURL)
+	validateFailoverPeer(conf.FailoverPeer)
+	validateEgressIPFamily(conf)
+	validateHostHeaderMismatch(conf.HostHeaderMismatch)
+	validateExpectContinue(conf.ExpectContinue)
+	validateTrailers(conf.Trailers)
+	validateLogTime(conf.LogTimeFormat, conf.LogTimeZone)
+	validateAccessLogFormat(conf.AccessLogFormat)
+	validateActivityLog(conf)
+	validateAdminTLS(conf)
+	validateAdminToken(conf)
+	validateAdminUI(conf)
+	validateMITM(conf)
+	validateTLSClientHelloFragment(conf)
+	validateListenSOCKS(conf)
+	validateListenTransparent(conf)
+	validateMetricsListen(conf)
+	validateHealthListen(conf)
+	validateStatsListen(conf)
+	validateTracingEndpoint(conf.TracingEndpoint)
+	validateShadowConfig(conf.ShadowConfig)
+	validateMemoryLimit(conf.MemoryLimit, conf.MemoryShedRatio)
+	validateProxies(conf.Proxies, conf.ForwardProxyURL)
+	validateSRVProxies(conf.SRVProxies, conf.Proxies)
+	validateUpstreamTLS(conf)
+	validateUpstreamAuth(conf)
+	validateUserRules(conf.UserRules, conf.Groups)
 }
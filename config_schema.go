@@ -0,0 +1,353 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// README's option list is the documentation of the settings, so the schema's
+// descriptions don't go out of date.
+//
+//go:embed README.md
+var readme string
+
+// Go duration strings, durations may also be given as integer nanoseconds
+const durationPattern = `^-?([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$`
+
+// Output formats of config-schema subcommand.
+const (
+	schemaFormatJSON    = "json-schema"
+	schemaFormatExample = "example"
+)
+
+// jsonSchema is a JSON Schema (draft 2020-12) of a setting or of the whole configuration.
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	OneOf                []*jsonSchema          `json:"oneOf,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	Default              interface{}            `json:"default,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+}
+
+// settingConstraint restricts values of a setting beyond its type, the same way
+// validators of setConfigurationDefaults do. Settings of tables' entries are keyed
+// by "table.setting".
+type settingConstraint struct {
+	enum     []interface{}
+	min, max *float64
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+var settingConstraints = map[string]settingConstraint{
+	"auth_type":                    {enum: []interface{}{"basic", "digest", ""}},
+	"forwarded_for_header":         {enum: []interface{}{"on", "off", "delete", "truncate"}},
+	"via_header":                   {enum: []interface{}{"on", "off", "delete"}},
+	"route_fallback":               {enum: []interface{}{routeFallbackDirect, routeFallbackDeny}},
+	"upstream_auth":                {enum: []interface{}{upstreamAuthBasic, upstreamAuthNTLM, upstreamAuthNegotiate}},
+	"connect_ip_literals":          {enum: []interface{}{connectIPLiteralsAllow, connectIPLiteralsDeny, connectIPLiteralsACL}},
+	"egress_allowlist_mode":        {enum: []interface{}{egressAllowlistEnforce, egressAllowlistReport}},
+	"egress_ip_family":             {enum: []interface{}{egressAny, egressIPv4, egressIPv6}},
+	"dnsbl_action":                 {enum: []interface{}{dnsblBlock, dnsblLog}},
+	"host_header_mismatch":         {enum: []interface{}{hostHeaderRewrite, hostHeaderDeny}},
+	"expect_continue":              {enum: []interface{}{expectContinueForward, expectContinueLocal}},
+	"trailers":                     {enum: []interface{}{trailersPass, trailersStrip}},
+	"access_log_format":            {enum: []interface{}{logFormatPlain, logFormatJSON, logFormatSquid}},
+	"activity_log_format":          {enum: []interface{}{logFormatPlain, logFormatText, logFormatJSON}},
+	"activity_log_level":           {enum: []interface{}{"debug", "info", "warn", "error"}},
+	"admin_tls_min_version":        {enum: []interface{}{"1.2", "1.3"}},
+	"direct_fallback_statuses":     {min: bound(500), max: bound(599)},
+	"tls_clienthello_fragment":     {min: bound(0)},
+	"memory_shed_ratio":            {min: bound(0), max: bound(1)},
+	"allowed_connect_ports":        {min: bound(1), max: bound(65535)},
+	"request_signing.type":         {enum: []interface{}{signingHMAC, signingAWSv4}},
+	"threat_feeds.format":          {enum: []interface{}{threatFeedDomains, threatFeedCSV, threatFeedJSON}},
+	"threat_feeds.column":          {min: bound(1)},
+	"connect_rate_per_destination": {min: bound(0)},
+}
+
+// runConfigSchema implements "microproxy config-schema" subcommand which writes
+// JSON Schema of the configuration file or a commented example of all settings.
+func runConfigSchema(args []string) int {
+	flags := flag.NewFlagSet("config-schema", flag.ContinueOnError)
+	format := flags.String("format", schemaFormatJSON, "output format: json-schema or example")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	switch *format {
+	case schemaFormatJSON:
+		b, err := json.MarshalIndent(configurationSchema(), "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't encode the schema: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(b))
+	case schemaFormatExample:
+		writeConfigurationExample(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format '%s'\n", *format)
+		return 2
+	}
+
+	return 0
+}
+
+// configurationDefaults returns settings of an empty configuration file.
+func configurationDefaults() *Configuration {
+	conf := &Configuration{Listen: listenAddresses{defaultListenAddress}}
+	setConfigurationDefaults(conf)
+	// defaults to the host's name
+	conf.ViaProxyName = ""
+
+	return conf
+}
+
+// settingDescriptions returns descriptions of settings from README's option list.
+func settingDescriptions() map[string]string {
+	keyPattern := regexp.MustCompile("`\\[?([a-z0-9_]+)")
+	descriptions := make(map[string]string)
+
+	for _, line := range strings.Split(readme, "\n") {
+		if !strings.HasPrefix(line, "* `") {
+			continue
+		}
+		keys, description, found := strings.Cut(line[2:], " -- ")
+		if !found {
+			continue
+		}
+		for _, match := range keyPattern.FindAllStringSubmatch(keys, -1) {
+			if _, exists := descriptions[match[1]]; !exists {
+				descriptions[match[1]] = description
+			}
+		}
+	}
+
+	return descriptions
+}
+
+func configurationSchema() *jsonSchema {
+	schema := typeSchema(reflect.TypeOf(Configuration{}), "", settingDescriptions())
+	schema.Schema = "https://json-schema.org/draft/2020-12/schema"
+	schema.Title = "microproxy configuration"
+
+	defaults := reflect.ValueOf(configurationDefaults()).Elem()
+	for _, field := range reflect.VisibleFields(defaults.Type()) {
+		if name := tomlName(field); name != "" {
+			schema.Properties[name].Default = defaultValue(defaults.FieldByIndex(field.Index))
+		}
+	}
+
+	return schema
+}
+
+func tomlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+
+	return name
+}
+
+// defaultValue returns the value in the configuration file's terms, nil if it's
+// the zero value.
+func defaultValue(v reflect.Value) interface{} {
+	if v.IsZero() || v.Kind() == reflect.Slice && v.Len() == 0 {
+		return nil
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return formatDuration(d)
+	}
+	if _, ok := v.Interface().(listenAddresses); ok && v.Len() == 1 {
+		return v.Index(0).Interface()
+	}
+
+	return v.Interface()
+}
+
+// formatDuration omits zero minutes and seconds, i.e. "1h" instead of "1h0m0s".
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+
+	return s
+}
+
+// typeSchema returns the schema of values of type t at path, descriptions are
+// known only for top-level settings.
+func typeSchema(t reflect.Type, path string, descriptions map[string]string) *jsonSchema {
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		return &jsonSchema{Type: []string{"string", "integer"}, Pattern: durationPattern}
+	case reflect.TypeOf(listenAddresses{}):
+		return &jsonSchema{OneOf: []*jsonSchema{
+			{Type: "string"},
+			{Type: "array", Items: &jsonSchema{Type: "string"}},
+		}}
+	case reflect.TypeOf(&Configuration{}):
+		// tenants are configurations themselves
+		return &jsonSchema{Ref: "#"}
+	}
+
+	schema := &jsonSchema{}
+	switch t.Kind() {
+	case reflect.String:
+		schema.Type = "string"
+	case reflect.Bool:
+		schema.Type = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		schema.Type = "integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema.Type, schema.Minimum = "integer", bound(0)
+	case reflect.Float32, reflect.Float64:
+		schema.Type = "number"
+	case reflect.Slice:
+		schema.Type = "array"
+		schema.Items = typeSchema(t.Elem(), path, descriptions)
+		return schema
+	case reflect.Map:
+		schema.Type = "object"
+		schema.AdditionalProperties = typeSchema(t.Elem(), path, descriptions)
+		return schema
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), path, descriptions)
+	case reflect.Struct:
+		schema.Type = "object"
+		schema.AdditionalProperties = false
+		schema.Properties = make(map[string]*jsonSchema)
+		for _, field := range reflect.VisibleFields(t) {
+			name := tomlName(field)
+			if name == "" {
+				continue
+			}
+			key := name
+			if path != "" {
+				key = path + "." + name
+			}
+			property := typeSchema(field.Type, key, descriptions)
+			if path == "" {
+				property.Description = descriptions[name]
+			}
+			schema.Properties[name] = property
+		}
+		return schema
+	}
+
+	if constraint, exists := settingConstraints[path]; exists {
+		schema.Enum, schema.Minimum, schema.Maximum = constraint.enum, constraint.min, constraint.max
+	}
+
+	return schema
+}
+
+// writeConfigurationExample writes all top-level settings commented out, with
+// their descriptions and default values or examples of their types. Tables follow
+// other settings, so uncommented settings don't end up in a table.
+func writeConfigurationExample(w io.Writer) {
+	schema := configurationSchema()
+
+	var names, tables []string
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Configuration{})) {
+		name := tomlName(field)
+		switch {
+		case name == "":
+		case strings.HasPrefix(exampleSetting(name, schema.Properties[name]), "["):
+			tables = append(tables, name)
+		default:
+			names = append(names, name)
+		}
+	}
+	names = append(names, tables...)
+
+	fmt.Fprintln(w, "# microproxy configuration, generated by \"microproxy config-schema -format example\"")
+	for _, name := range names {
+		property := schema.Properties[name]
+		fmt.Fprintln(w)
+		if property.Description != "" {
+			for _, line := range wrapText(property.Description, 100) {
+				fmt.Fprintf(w, "# %s\n", line)
+			}
+		}
+		fmt.Fprintf(w, "#%s\n", exampleSetting(name, property))
+	}
+}
+
+// exampleSetting returns the setting with its default value, or an example of its
+// type if there is none.
+func exampleSetting(name string, property *jsonSchema) string {
+	if property.Default != nil {
+		b, _ := json.Marshal(property.Default)
+		return fmt.Sprintf("%s=%s", name, b)
+	}
+	if property.Type == "object" {
+		return fmt.Sprintf("[%s]", name)
+	}
+	if property.Ref != "" || property.Items != nil && property.Items.Type == "object" {
+		return fmt.Sprintf("[[%s]]", name)
+	}
+
+	value := `""`
+	switch {
+	case property.OneOf != nil:
+		value = `"ip:port"`
+	case len(property.Enum) > 0:
+		value = fmt.Sprintf("%q", property.Enum[0])
+	case property.Type == "boolean":
+		value = "false"
+	case property.Type == "integer" || property.Type == "number":
+		value = "0"
+	case property.Pattern == durationPattern:
+		value = `"0s"`
+	case property.Type == "array":
+		value = "[]"
+	}
+
+	return fmt.Sprintf("%s=%s", name, value)
+}
+
+// wrapText splits the text into lines of at most width characters at spaces.
+func wrapText(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestConfigurationSchema(t *testing.T) {
+	schema := configurationSchema()
+
+	// every setting has to be documented in README
+	for name, property := range schema.Properties {
+		if property.Description == "" {
+			t.Errorf("Setting %v has no description", name)
+		}
+	}
+
+	pattern, _ := json.Marshal(durationPattern)
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"listen", `{"oneOf":[{"type":"string"},{"type":"array","items":{"type":"string"}}],"default":"127.0.0.1:3128"}`},
+		{"connect_timeout", `{"type":["string","integer"],"pattern":` + string(pattern) + `,"default":"30s"}`},
+		{"threat_feed_refresh", `{"type":["string","integer"],"pattern":` + string(pattern) + `,"default":"1h"}`},
+		{"route_fallback", `{"type":"string","enum":["direct","deny"],"default":"direct"}`},
+		{"allowed_destination_asns", `{"type":"array","items":{"type":"integer","minimum":0}}`},
+		{"tenants", `{"type":"object","additionalProperties":{"$ref":"#"}}`},
+	}
+
+	for _, test := range tests {
+		property := *schema.Properties[test.name]
+		property.Description = ""
+		b, err := json.Marshal(&property)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.name, test.expected, b)
+		}
+	}
+
+	feed := schema.Properties["threat_feeds"].Items.Properties["format"]
+	if len(feed.Enum) != 3 {
+		t.Errorf("Expected threat feeds' formats to be listed, got %v", feed.Enum)
+	}
+}
+
+func TestConfigurationExample(t *testing.T) {
+	var buf bytes.Buffer
+	writeConfigurationExample(&buf)
+
+	// uncommented settings other than tables have to be a valid configuration
+	setting := regexp.MustCompile(`^#([a-z0-9_]+=.*)$`)
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if match := setting.FindStringSubmatch(line); match != nil {
+			lines = append(lines, match[1])
+		}
+	}
+
+	var conf Configuration
+	if _, err := toml.Decode(strings.Join(lines, "\n"), &conf); err != nil {
+		t.Fatalf("Couldn't parse the example: %v", err)
+	}
+	if conf.ConnectTimeout != defaultConnectTimeout || conf.AllowedSchemes[1] != "https" || conf.Listen[0] != defaultListenAddress {
+		t.Errorf("Expected defaults in the example, got %v %v %v", conf.ConnectTimeout, conf.AllowedSchemes, conf.Listen)
+	}
+	if !strings.Contains(buf.String(), "\n#[[threat_feeds]]\n") {
+		t.Error("Expected tables in the example")
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
 
 func compareSlices(s1, s2 []int) bool {
 	if len(s1) == len(s2) {
@@ -18,7 +25,7 @@ func compareSlices(s1, s2 []int) bool {
 
 func TestConfigFile(t *testing.T) {
 	expected := Configuration{
-		Listen:              "127.0.0.1:3129",
+		Listen:              listenAddresses{"127.0.0.1:3129"},
 		AccessLog:           "/tmp/microproxy.access.log",
 		AuthType:            "basic",
 		AuthRealm:           "proxy",
@@ -32,7 +39,7 @@ func TestConfigFile(t *testing.T) {
 
 	conf := newConfigurationFromFile("microproxy.toml")
 
-	if conf.Listen != expected.Listen {
+	if len(conf.Listen) != 1 || conf.Listen[0] != expected.Listen[0] {
 		t.Errorf("Got %v, expected %v", conf.Listen, expected.Listen)
 	}
 
@@ -60,3 +67,52 @@ func TestConfigFile(t *testing.T) {
 		t.Errorf("Got %v, expected %v", conf.ForwardedForHeader, expected.ForwardedForHeader)
 	}
 }
+
+func TestAuthCredentialsFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AUTH_USER", "alice")
+	t.Setenv("AUTH_PASS_FILE", path)
+
+	conf := newConfiguration(bytes.NewBufferString(`allowed_networks=["0.0.0.0/0"]`))
+
+	if conf.AuthUser != "alice" || conf.AuthPassword != "secret" {
+		t.Errorf("Unexpected credentials: %v:%v", conf.AuthUser, conf.AuthPassword)
+	}
+
+	if conf.AuthType != "basic" || !conf.authEnabled() {
+		t.Errorf("basic auth has to be enabled, got auth_type '%v'", conf.AuthType)
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected []string
+	}{
+		{``, []string{defaultListenAddress}},
+		{`listen="0.0.0.0:3128"`, []string{"0.0.0.0:3128"}},
+		{`listen=["192.0.2.1:3128", "[2001:db8::1]:3128"]`, []string{"192.0.2.1:3128", "[2001:db8::1]:3128"}},
+	}
+
+	for _, test := range tests {
+		conf := newConfiguration(bytes.NewBufferString(test.config))
+		if len(conf.Listen) != len(test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.config, test.expected, conf.Listen)
+			continue
+		}
+		for i, addr := range test.expected {
+			if conf.Listen[i] != addr {
+				t.Errorf("%q: expected %v, got %v", test.config, test.expected, conf.Listen)
+			}
+		}
+	}
+
+	var conf Configuration
+	if _, err := toml.Decode(`listen=[3128]`, &conf); err == nil {
+		t.Error("Expected error for non-string listen address")
+	}
+}
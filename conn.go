@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net"
 	"time"
 )
@@ -33,3 +34,19 @@ func (c TimedConn) Write(b []byte) (int, error) {
 
 	return c.Conn.Write(b)
 }
+
+// withDialTimeout bounds name resolution and connection establishment of dial by
+// timeout, in addition to the deadline of the caller's context. Zero timeout
+// leaves dial as is.
+func withDialTimeout(timeout time.Duration, dial dialContextFunc) dialContextFunc {
+	if timeout <= 0 {
+		return dial
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return dial(ctx, network, addr)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDialTimeout(t *testing.T) {
+	dial := withDialTimeout(50*time.Millisecond, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	started := time.Now()
+	if _, err := dial(context.Background(), "tcp", "192.0.2.1:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded error, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Dial wasn't cancelled after timeout, took %v", elapsed)
+	}
+
+	// the caller's context is still respected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dial(ctx, "tcp", "192.0.2.1:80"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected canceled error, got %v", err)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer background.Close()
+	defer close(release)
+
+	conf := &Configuration{ResponseHeaderTimeout: 100 * time.Millisecond}
+	proxy := createProxy(conf)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: func(*http.Request) (*url.URL, error) {
+		return url.Parse(proxyServer.URL)
+	}}}
+
+	for path, expected := range map[string]int{"/": http.StatusOK, "/slow": http.StatusInternalServerError} {
+		resp, err := client.Get(background.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%v: expected %v status code, got %v", path, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	for enabled, expected := range map[bool]string{false: "HTTP/1.1", true: "HTTP/2.0"} {
+		conf := &Configuration{UpstreamHTTP2: enabled}
+		proxy := createProxy(conf)
+		proxy.Tr.TLSClientConfig = newUpstreamTLSConfig(conf, true)
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, origin.URL, nil))
+		if w.Body.String() != expected {
+			t.Errorf("upstream_http2=%v: expected %v, got %q", enabled, expected, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// buckets which were refilled are dropped at most this often
+const connectRatePruneInterval = time.Minute
+
+// connectRateLimiter limits the rate of new CONNECT tunnels to each destination host
+// with a token bucket per host, so the proxy can't be used to flood a host with
+// connections.
+type connectRateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*connectBucket
+	pruned  time.Time
+}
+
+type connectBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newConnectRateLimiter(rate float64, burst int) *connectRateLimiter {
+	return &connectRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*connectBucket),
+		pruned:  time.Now(),
+	}
+}
+
+// refill adds tokens accumulated since the bucket was updated.
+func (l *connectRateLimiter) refill(b *connectBucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+}
+
+// allow takes a token of the host's bucket, false is returned if it's empty.
+func (l *connectRateLimiter) allow(host string) bool {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	b, exists := l.buckets[host]
+	if !exists {
+		b = &connectBucket{tokens: l.burst, updated: now}
+		l.buckets[host] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// prune removes full buckets, they are the same as new ones, so the map doesn't
+// grow with every host ever connected to.
+func (l *connectRateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < connectRatePruneInterval {
+		return
+	}
+
+	for host, b := range l.buckets {
+		if l.refill(b, now); b.tokens >= l.burst {
+			delete(l.buckets, host)
+		}
+	}
+	l.pruned = now
+}
+
+// setConnectRateHandler rejects CONNECT requests above connect_rate_per_destination.
+// It's installed after other checks, so only tunnels which would be established
+// take tokens.
+func setConnectRateHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if conf.ConnectRatePerDestination <= 0 {
+		return
+	}
+
+	l := newConnectRateLimiter(conf.ConnectRatePerDestination, conf.ConnectBurstPerDestination)
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			hostname, _, err := net.SplitHostPort(host)
+			if err != nil {
+				hostname = host
+			}
+			hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+			if l.allow(hostname) {
+				return nil, host
+			}
+
+			ctx.Warnf("too many new tunnels to %v, CONNECT is rejected", hostname)
+			denyRequest(ctx, "connect_rate_per_destination")
+			return goproxy.RejectConnect, host
+		})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestConnectRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newConnectRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("example.com") {
+			t.Fatalf("Expected tunnel %d within burst to be allowed", i+1)
+		}
+	}
+	if l.allow("example.com") {
+		t.Error("Expected tunnel above burst to be rejected")
+	}
+	if !l.allow("example.org") {
+		t.Error("Expected other hosts not to be affected")
+	}
+
+	// two tokens a second
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow("example.com") || l.allow("example.com") {
+		t.Error("Expected exactly one tunnel to be allowed after half a second")
+	}
+
+	now = now.Add(connectRatePruneInterval)
+	l.allow("example.net")
+	if _, exists := l.buckets["example.com"]; exists {
+		t.Error("Expected refilled bucket to be pruned")
+	}
+}
+
+func TestConnectRateHandler(t *testing.T) {
+	echo := startEchoServer(t)
+	conf := &Configuration{ConnectRatePerDestination: 0.001, ConnectBurstPerDestination: 1}
+	proxy := goproxy.NewProxyHttpServer()
+	setConnectRateHandler(conf, proxy)
+
+	server := httptest.NewServer(withRequestInfo(proxy))
+	defer server.Close()
+
+	for i, expected := range []bool{true, false} {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		addr := echo.Addr().String()
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if allowed := err == nil && resp.StatusCode == http.StatusOK; allowed != expected {
+			t.Errorf("tunnel %d: expected allowed=%v, got %v", i+1, expected, allowed)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events of connection_log entries.
+const (
+	connectionAccepted = "accept"
+	connectionClosed   = "close"
+)
+
+// connectionEvent is a connection_log entry.
+type connectionEvent struct {
+	action int
+	event  string
+	time   time.Time
+	local  string
+	remote string
+	// the rest is known only when the connection is closed
+	duration time.Duration
+	sent     int64
+	received int64
+	// set if the listener serves TLS, the state is read by the log's goroutine, so
+	// closing the connection doesn't wait for a handshake in progress
+	tls *tls.Conn
+}
+
+// connectionRecord is a connection_log entry in JSON format.
+type connectionRecord struct {
+	Time     string   `json:"time"`
+	Event    string   `json:"event"`
+	Client   string   `json:"client"`
+	Local    string   `json:"local"`
+	Duration *float64 `json:"duration,omitempty"`
+	Sent     *int64   `json:"sent,omitempty"`
+	Received *int64   `json:"received,omitempty"`
+	TLS      string   `json:"tls,omitempty"`
+	Cipher   string   `json:"cipher,omitempty"`
+	SNI      string   `json:"sni,omitempty"`
+	ALPN     string   `json:"alpn,omitempty"`
+}
+
+// tlsInfo returns TLS version, cipher suite, server name and negotiated application
+// protocol of the client's connection, ok is false if the handshake didn't complete.
+func (e *connectionEvent) tlsInfo() (version, cipher, sni, alpn string, ok bool) {
+	if e.tls == nil {
+		return "", "", "", "", false
+	}
+
+	state := e.tls.ConnectionState()
+	if !state.HandshakeComplete {
+		return "", "", "", "", false
+	}
+
+	sni, alpn = state.ServerName, state.NegotiatedProtocol
+	if sni == "" {
+		sni = "-"
+	}
+	if alpn == "" {
+		alpn = "http/1.1"
+	}
+
+	return strings.ReplaceAll(tls.VersionName(state.Version), " ", ""), tls.CipherSuiteName(state.CipherSuite),
+		sni, alpn, true
+}
+
+func (e *connectionEvent) writeTo(w io.Writer, tf *timeFormatter) (nr int64, err error) {
+	if e.event == connectionAccepted {
+		fprintf(&nr, &err, w, "%v %v %v %v\n", tf.format(e.time), e.event, e.remote, e.local)
+		return
+	}
+
+	tlsFields := ""
+	if version, cipher, sni, alpn, ok := e.tlsInfo(); ok {
+		tlsFields = fmt.Sprintf(" tls=%s cipher=%s sni=%s alpn=%s", version, cipher, sni, alpn)
+	}
+	fprintf(&nr, &err, w, "%v %v %v %v duration=%v sent=%v received=%v%v\n", tf.format(e.time), e.event, e.remote,
+		e.local, formatSeconds(e.duration), e.sent, e.received, tlsFields)
+
+	return
+}
+
+func (e *connectionEvent) writeJSONTo(w io.Writer, tf *timeFormatter) (int64, error) {
+	r := &connectionRecord{Time: tf.format(e.time), Event: e.event, Client: e.remote, Local: e.local}
+	if e.event == connectionClosed {
+		r.Duration, r.Sent, r.Received = seconds(e.duration), &e.sent, &e.received
+		if version, cipher, sni, alpn, ok := e.tlsInfo(); ok {
+			r.TLS, r.Cipher, r.SNI, r.ALPN = version, cipher, sni, alpn
+		}
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// connectionLogger writes accept and close events of TCP connections accepted by
+// the process' listeners to connection_log, so they can be correlated with
+// firewall logs. Addresses are those of the TCP connection, not the ones reported
+// by PROXY protocol headers.
+type connectionLogger struct {
+	events       chan *connectionEvent
+	errorChannel chan error
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newConnectionLogger returns nil if connection_log isn't set.
+func newConnectionLogger(conf *Configuration) *connectionLogger {
+	if conf.ConnectionLog == "" {
+		return nil
+	}
+
+	fh, err := os.OpenFile(conf.ConnectionLog, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		log.Fatalf("Couldn't open connection log file: %v", err)
+	}
+
+	tf, err := newTimeFormatter(conf.LogTimeFormat, conf.LogTimeZone, time.RFC3339)
+	if err != nil {
+		log.Fatalf("Couldn't set up log time format: %v", err)
+	}
+
+	logger := &connectionLogger{events: make(chan *connectionEvent, 1024), errorChannel: make(chan error)}
+
+	go func() {
+		for e := range logger.events {
+			switch e.action {
+			case AppendLog:
+				write := e.writeTo
+				if conf.AccessLogFormat == logFormatJSON {
+					write = e.writeJSONTo
+				}
+				if _, err := write(fh, tf); err != nil {
+					log.Println("Can't write connection log entry", err)
+				}
+			case ReopenLog:
+				err := fh.Close()
+				if err != nil {
+					log.Fatal(err)
+				}
+				fh, err = os.OpenFile(conf.ConnectionLog, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+				if err != nil {
+					log.Fatalf("Couldn't reopen connection log file: %v", err)
+				}
+			}
+		}
+		logger.errorChannel <- fh.Close()
+	}()
+
+	return logger
+}
+
+// write queues the entry, entries of connections closed after the log was closed
+// on exit are dropped.
+func (l *connectionLogger) write(e *connectionEvent) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.closed {
+		l.events <- e
+	}
+}
+
+func (l *connectionLogger) reopen() {
+	l.write(&connectionEvent{action: ReopenLog})
+}
+
+func (l *connectionLogger) close() error {
+	l.mu.Lock()
+	l.closed = true
+	close(l.events)
+	l.mu.Unlock()
+
+	return <-l.errorChannel
+}
+
+func (l *connectionLogger) listener(ln net.Listener) net.Listener {
+	return &connectionLogListener{Listener: ln, logger: l}
+}
+
+// connState remembers TLS connections of servers serving TLS, so close events get
+// their handshake details.
+func (l *connectionLogger) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateNew {
+		return
+	}
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		if conn := loggedConn(tlsConn.NetConn()); conn != nil {
+			conn.tls.Store(tlsConn)
+		}
+	}
+}
+
+type connectionLogListener struct {
+	net.Listener
+	logger *connectionLogger
+}
+
+func (ln *connectionLogListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &connectionLogConn{Conn: c, logger: ln.logger, accepted: time.Now()}
+	ln.logger.write(&connectionEvent{
+		action: AppendLog,
+		event:  connectionAccepted,
+		time:   conn.accepted,
+		local:  c.LocalAddr().String(),
+		remote: c.RemoteAddr().String(),
+	})
+	if _, ok := c.(halfCloser); ok {
+		return halfClosableConnectionLogConn{conn}, nil
+	}
+
+	return conn, nil
+}
+
+// connectionLogConn counts bytes exchanged with the client and logs the close event.
+type connectionLogConn struct {
+	net.Conn
+	logger   *connectionLogger
+	accepted time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	tls      atomic.Pointer[tls.Conn]
+	once     sync.Once
+}
+
+// halfClosableConnectionLogConn is used for connections supporting half-close, so
+// tunnels keep shutting down each direction separately.
+type halfClosableConnectionLogConn struct {
+	*connectionLogConn
+}
+
+func loggedConn(c net.Conn) *connectionLogConn {
+	switch conn := c.(type) {
+	case *connectionLogConn:
+		return conn
+	case halfClosableConnectionLogConn:
+		return conn.connectionLogConn
+	}
+
+	return nil
+}
+
+func (c *connectionLogConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+
+	return n, err
+}
+
+func (c *connectionLogConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+
+	return n, err
+}
+
+func (c *connectionLogConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.logger.write(&connectionEvent{
+			action:   AppendLog,
+			event:    connectionClosed,
+			time:     time.Now(),
+			local:    c.LocalAddr().String(),
+			remote:   c.RemoteAddr().String(),
+			duration: time.Since(c.accepted),
+			sent:     c.sent.Load(),
+			received: c.received.Load(),
+			tls:      c.tls.Load(),
+		})
+	})
+
+	return err
+}
+
+func (c halfClosableConnectionLogConn) CloseWrite() error {
+	return c.Conn.(halfCloser).CloseWrite()
+}
+
+func (c halfClosableConnectionLogConn) CloseRead() error {
+	return c.Conn.(halfCloser).CloseRead()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConnectionLog(t *testing.T) {
+	// the test server provides a certificate for the TLS listener
+	origin := httptest.NewTLSServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	for _, format := range []string{logFormatPlain, logFormatJSON} {
+		path := filepath.Join(t.TempDir(), "connections.log")
+		servers := newServerSet()
+		servers.connections = newConnectionLogger(&Configuration{ConnectionLog: path, AccessLogFormat: format})
+
+		ln, err := servers.listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "hello")
+		})
+		tlsConfig := &tls.Config{Certificates: origin.TLS.Certificates}
+		go servers.serve(ln, "127.0.0.1:0", handler, tlsConfig, nil)
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		servers.shutdown(context.Background())
+		if err := servers.connections.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("%v: expected accept and close entries, got %q", format, data)
+		}
+
+		if format == logFormatJSON {
+			var accepted, closed connectionRecord
+			if err := json.Unmarshal([]byte(lines[0]), &accepted); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(lines[1]), &closed); err != nil {
+				t.Fatal(err)
+			}
+			if accepted.Event != connectionAccepted || accepted.Local != ln.Addr().String() || accepted.Sent != nil {
+				t.Errorf("Unexpected accept record: %+v", accepted)
+			}
+			if closed.Event != connectionClosed || closed.Client != accepted.Client || closed.Sent == nil ||
+				*closed.Sent == 0 || closed.SNI != "example.com" || closed.TLS != "TLS1.3" {
+				t.Errorf("Unexpected close record: %+v", closed)
+			}
+			continue
+		}
+
+		fields := strings.Fields(lines[0])
+		if len(fields) != 4 || fields[1] != "accept" || fields[3] != ln.Addr().String() {
+			t.Errorf("Unexpected accept entry: %q", lines[0])
+		}
+		if !strings.Contains(lines[1], " close "+fields[2]+" "+fields[3]+" duration=") ||
+			!strings.Contains(lines[1], " tls=TLS1.3 ") || !strings.Contains(lines[1], " sni=example.com alpn=http/1.1") ||
+			strings.Contains(lines[1], " sent=0 ") {
+			t.Errorf("Unexpected close entry: %q", lines[1])
+		}
+	}
+}
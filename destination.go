@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const destinationResolveTimeout = 5 * time.Second
+
+// Values of connect_ip_literals setting.
+const (
+	connectIPLiteralsAllow = "allow"
+	connectIPLiteralsDeny  = "deny"
+	connectIPLiteralsACL   = "acl"
+)
+
+// Cloud metadata services' addresses and host names blocked by metadata_protection:
+// AWS, GCP, Azure, OpenStack and others at the link-local address, AWS over IPv6,
+// ECS task metadata and Alibaba Cloud.
+var (
+	metadataNetworks = []string{"169.254.169.254/32", "fd00:ec2::254/128", "169.254.170.2/32", "100.100.100.200/32"}
+	metadataHosts    = []string{"metadata.google.internal", "metadata.goog", "metadata"}
+)
+
+// resolveDestination returns IP addresses of the host. IP literals are returned
+// as is, host names are resolved only if resolve is set.
+func resolveDestination(host string, resolve bool) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+
+	if !resolve || host == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), destinationResolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	return ips
+}
+
+// destinationNetwork returns the first of the networks which contains any of the
+// destination's addresses or nil.
+func destinationNetwork(cidrs [](*net.IPNet), ips []net.IP) *net.IPNet {
+	for _, ip := range ips {
+		if network := matchingNetwork(cidrs, ip); network != nil {
+			return network
+		}
+	}
+
+	return nil
+}
+
+// destinationOutside reports whether the destination has known addresses and none
+// of them is in the networks.
+func destinationOutside(cidrs [](*net.IPNet), ips []net.IP) bool {
+	return len(ips) > 0 && destinationNetwork(cidrs, ips) == nil
+}
+
+// destinationIPMatches reports whether any of the requested host's addresses is in
+// the networks. Host names which aren't resolved never match.
+func destinationIPMatches(networks []string, resolve bool) goproxy.ReqConditionFunc {
+	cidrs := parseNetworks(networks)
+
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		network := destinationNetwork(cidrs, resolveDestination(req.URL.Hostname(), resolve))
+		if network == nil {
+			return false
+		}
+		denyRequest(ctx, "disallowed_destination_networks:"+network.String())
+		return true
+	}
+}
+
+// destinationIPOutside reports whether the requested host has known addresses and
+// none of them is in the networks.
+func destinationIPOutside(networks []string, resolve bool) goproxy.ReqConditionFunc {
+	cidrs := parseNetworks(networks)
+
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		if !destinationOutside(cidrs, resolveDestination(req.URL.Hostname(), resolve)) {
+			return false
+		}
+		denyRequest(ctx, "allowed_destination_networks")
+		return true
+	}
+}
+
+// connectIPLiteralDenied reports whether CONNECT request to an IP address has to
+// be rejected according to connect_ip_literals setting.
+func connectIPLiteralDenied(conf *Configuration) goproxy.ReqConditionFunc {
+	cidrs := parseNetworks(conf.AllowedDestinationNetworks)
+
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		ip := net.ParseIP(req.URL.Hostname())
+		if ip == nil {
+			return false
+		}
+
+		switch conf.ConnectIPLiterals {
+		case connectIPLiteralsDeny:
+			ctx.Logf("CONNECT to IP address %v is denied", ip)
+			denyRequest(ctx, "connect_ip_literals")
+			return true
+		case connectIPLiteralsACL:
+			if !networksContain(cidrs, ip) {
+				ctx.Logf("CONNECT to IP address %v is outside allowed_destination_networks", ip)
+				denyRequest(ctx, "connect_ip_literals")
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// metadataProtection decides which requests are sent to cloud metadata services.
+type metadataProtection struct {
+	networks [](*net.IPNet)
+	allowed  [](*net.IPNet)
+	resolve  bool
+}
+
+func newMetadataProtection(conf *Configuration) *metadataProtection {
+	return &metadataProtection{
+		networks: parseNetworks(metadataNetworks),
+		allowed:  parseNetworks(conf.MetadataAllowedNetworks),
+		resolve:  conf.ResolveDestinations,
+	}
+}
+
+// denied reports whether the client outside of metadata_allowed_networks requests
+// a metadata service at host.
+func (m *metadataProtection) denied(client net.IP, host string) bool {
+	if networksContain(m.allowed, client) {
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchesDomains(host, metadataHosts) {
+		return true
+	}
+
+	return destinationNetwork(m.networks, resolveDestination(host, m.resolve)) != nil
+}
+
+// metadataRequested reports whether the request is sent to a cloud metadata service
+// by a client outside of metadata_allowed_networks.
+func metadataRequested(conf *Configuration) goproxy.ReqConditionFunc {
+	protection := newMetadataProtection(conf)
+
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		var client net.IP
+		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			client = net.ParseIP(ip)
+		}
+
+		if !protection.denied(client, req.URL.Hostname()) {
+			return false
+		}
+		ctx.Logf("request to metadata service %v is denied", req.URL.Hostname())
+		denyRequest(ctx, "metadata_protection")
+		return true
+	}
+}
+
+// setMetadataProtectionHandler denies requests to cloud metadata services, so
+// clients can't get the instance's credentials through the proxy.
+func setMetadataProtectionHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if !conf.MetadataProtection {
+		return
+	}
+
+	cond := metadataRequested(conf)
+	proxy.OnRequest(cond).HandleConnect(goproxy.AlwaysReject)
+	proxy.OnRequest(cond).DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+		})
+}
+
+func setDestinationNetworksHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	deny := func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+	}
+
+	if conf.ConnectIPLiterals != connectIPLiteralsAllow {
+		proxy.OnRequest(connectIPLiteralDenied(conf)).HandleConnect(goproxy.AlwaysReject)
+	}
+
+	if len(conf.AllowedDestinationNetworks) > 0 {
+		cond := destinationIPOutside(conf.AllowedDestinationNetworks, conf.ResolveDestinations)
+		proxy.OnRequest(cond).HandleConnect(goproxy.AlwaysReject)
+		proxy.OnRequest(cond).DoFunc(deny)
+	}
+
+	if len(conf.DisallowedDestinationNetworks) > 0 {
+		cond := destinationIPMatches(conf.DisallowedDestinationNetworks, conf.ResolveDestinations)
+		proxy.OnRequest(cond).HandleConnect(goproxy.AlwaysReject)
+		proxy.OnRequest(cond).DoFunc(deny)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultDestinationQueueTimeout = 10 * time.Second
+
+// destinationLimiter limits the number of connections to each destination address,
+// dials above the limit wait for one of the connections to be closed.
+type destinationLimiter struct {
+	limit   int
+	timeout time.Duration
+
+	mu    sync.Mutex
+	slots map[string]*destinationSlots
+}
+
+// destinationSlots are removed once no connection holds or waits for them, so
+// the map doesn't grow with every destination ever seen.
+type destinationSlots struct {
+	ch    chan struct{}
+	users int
+}
+
+func newDestinationLimiter(limit int, timeout time.Duration) *destinationLimiter {
+	return &destinationLimiter{limit: limit, timeout: timeout, slots: make(map[string]*destinationSlots)}
+}
+
+// acquire waits for a free slot of addr until the queue timeout expires or ctx is
+// done.
+func (l *destinationLimiter) acquire(ctx context.Context, addr string) error {
+	l.mu.Lock()
+	s, exists := l.slots[addr]
+	if !exists {
+		s = &destinationSlots{ch: make(chan struct{}, l.limit)}
+		l.slots[addr] = s
+	}
+	s.users++
+	l.mu.Unlock()
+
+	select {
+	case s.ch <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case s.ch <- struct{}{}:
+		return nil
+	case <-timer.C:
+		l.leave(addr, s)
+		return fmt.Errorf("too many connections to %v", addr)
+	case <-ctx.Done():
+		l.leave(addr, s)
+		return ctx.Err()
+	}
+}
+
+func (l *destinationLimiter) release(addr string) {
+	l.mu.Lock()
+	s := l.slots[addr]
+	l.mu.Unlock()
+
+	<-s.ch
+	l.leave(addr, s)
+}
+
+func (l *destinationLimiter) leave(addr string, s *destinationSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s.users--; s.users == 0 {
+		delete(l.slots, addr)
+	}
+}
+
+// withDestinationLimit applies max_connections_per_destination to direct dials made
+// on behalf of requests, connections to upstream proxies aren't limited.
+func withDestinationLimit(l *destinationLimiter, dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+		if !ok || (info.upstream != "" && info.upstream != ruleDirect && info.upstream != upstreamDirectFallback) {
+			return dial(ctx, network, addr)
+		}
+
+		if err := l.acquire(ctx, addr); err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			l.release(addr)
+			return nil, err
+		}
+
+		c := &limitedConn{Conn: conn, release: func() { l.release(addr) }}
+		if _, ok := conn.(halfCloser); ok {
+			return halfClosableLimitedConn{c}, nil
+		}
+
+		return c, nil
+	}
+}
+
+// limitedConn frees its destination slot once closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+
+	return err
+}
+
+// halfClosableLimitedConn is used for connections supporting half-close, so goproxy
+// keeps shutting down each direction of tunnels separately.
+type halfClosableLimitedConn struct {
+	*limitedConn
+}
+
+func (c halfClosableLimitedConn) CloseWrite() error {
+	return c.Conn.(halfCloser).CloseWrite()
+}
+
+func (c halfClosableLimitedConn) CloseRead() error {
+	return c.Conn.(halfCloser).CloseRead()
+}
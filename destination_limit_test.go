@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDestinationLimit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	limiter := newDestinationLimiter(1, 50*time.Millisecond)
+	dial := withDestinationLimit(limiter, (&net.Dialer{}).DialContext)
+	addr := listener.Addr().String()
+	direct := withRequestInfoContext(context.Background(), newRequestInfo())
+
+	first, err := dial(direct, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.(halfCloser); !ok {
+		t.Error("Expected TCP connection to support half-close")
+	}
+
+	if _, err := dial(direct, "tcp", addr); err == nil {
+		t.Error("Expected dial above the limit to time out")
+	}
+
+	// connections to upstream proxies aren't limited
+	info := newRequestInfo()
+	info.upstream = "parent"
+	conn, err := dial(withRequestInfoContext(context.Background(), info), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		first.Close()
+	}()
+	second, err := dial(direct, "tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected queued dial to succeed once the connection is closed, got %v", err)
+	}
+	second.Close()
+	second.Close()
+
+	if len(limiter.slots) != 0 {
+		t.Errorf("Expected slots to be removed once unused, got %v", limiter.slots)
+	}
+}
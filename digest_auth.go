@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"strconv"
@@ -15,6 +17,7 @@ import (
 const (
 	chars                    = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 	maxNonceInactiveInterval = 12 * time.Hour
+	sharedNoncePrefix        = "microproxy:nonce:"
 )
 
 type NonceInfo struct {
@@ -27,6 +30,9 @@ type DigestAuth struct {
 	users map[string]string
 	// issued nonce values
 	nonces map[string](*NonceInfo)
+	// in cluster mode nonces are kept in Redis, so they are valid on all replicas
+	shared *redisClient
+	log    *moduleLogger
 }
 
 type DigestAuthData struct {
@@ -94,7 +100,7 @@ func (h *DigestAuth) validate(data *DigestAuthData) bool {
 		return false
 	}
 
-	nonceInfo, nonceExists := h.nonces[data.nonce]
+	nonceInfo, nonceExists := h.lookupNonce(data.nonce)
 	if !nonceExists {
 		return false
 	}
@@ -104,8 +110,8 @@ func (h *DigestAuth) validate(data *DigestAuthData) bool {
 		return false
 	}
 
-	// reply attack ?
-	if nc == nonceInfo.lastNonceCounter {
+	// replay attack ? clients have to increment the counter with every request
+	if nc <= nonceInfo.lastNonceCounter {
 		return false
 	}
 
@@ -114,13 +120,14 @@ func (h *DigestAuth) validate(data *DigestAuthData) bool {
 	s = ha1 + ":" + data.nonce + ":" + data.nc + ":" + data.cnonce + ":" + data.qop + ":" + ha2
 	realResponse := fmt.Sprintf("%x", md5.Sum([]byte(s)))
 
-	if data.response == realResponse {
-		nonceInfo.lastUsed = time.Now()
-		nonceInfo.lastNonceCounter = nc
-		return true
+	if data.response != realResponse {
+		return false
 	}
 
-	return false
+	nonceInfo.lastUsed = time.Now()
+	nonceInfo.lastNonceCounter = nc
+
+	return h.saveNonce(data.nonce, nonceInfo)
 }
 
 func (h *DigestAuth) newNonce() string {
@@ -129,6 +136,12 @@ func (h *DigestAuth) newNonce() string {
 	for {
 		rs := makeRandomString(100)
 		nonce = fmt.Sprintf("%x", md5.Sum([]byte(rs)))
+		if h.shared != nil {
+			if h.addSharedNonce(nonce) {
+				break
+			}
+			continue
+		}
 		_, exists := h.nonces[nonce]
 		if !exists {
 			h.addNonce(nonce)
@@ -139,6 +152,74 @@ func (h *DigestAuth) newNonce() string {
 	return nonce
 }
 
+// addSharedNonce stores the nonce in Redis unless it already exists there. If Redis
+// isn't available the nonce is issued anyway, it's rejected when used.
+func (h *DigestAuth) addSharedNonce(nonce string) bool {
+	reply, err := h.shared.do("SET", sharedNoncePrefix+nonce, "0", "NX", "EX", sharedNonceTTL())
+	if err != nil {
+		h.warnf("couldn't store digest auth nonce: %v", err)
+		return true
+	}
+
+	return reply != nil
+}
+
+func sharedNonceTTL() string {
+	return strconv.Itoa(int(maxNonceInactiveInterval / time.Second))
+}
+
+func (h *DigestAuth) lookupNonce(nonce string) (*NonceInfo, bool) {
+	if h.shared == nil {
+		info, exists := h.nonces[nonce]
+		return info, exists
+	}
+
+	reply, err := h.shared.do("GET", sharedNoncePrefix+nonce)
+	if err != nil {
+		h.warnf("couldn't look up digest auth nonce: %v", err)
+		return nil, false
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+
+	nc, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	return &NonceInfo{lastNonceCounter: nc}, true
+}
+
+// saveNonceScript updates the nonce's counter only if the new one is greater, so
+// the same counter can't be used by concurrent requests to different replicas.
+const saveNonceScript = `local last = redis.call('GET', KEYS[1])
+if not last or tonumber(last) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+return 1`
+
+// saveNonce writes the nonce's updated counter back to Redis and prolongs its
+// lifetime, nonces kept in memory are updated in place. It returns false if
+// another request already used the counter or a greater one.
+func (h *DigestAuth) saveNonce(nonce string, info *NonceInfo) bool {
+	if h.shared == nil {
+		return true
+	}
+
+	reply, err := h.shared.do("EVAL", saveNonceScript, "1", sharedNoncePrefix+nonce,
+		strconv.FormatUint(info.lastNonceCounter, 10), sharedNonceTTL())
+	if err != nil {
+		h.warnf("couldn't update digest auth nonce: %v", err)
+		return false
+	}
+
+	return reply == int64(1)
+}
+
 func (h *DigestAuth) addNonce(nonce string) {
 	h.nonces[nonce] = &NonceInfo{
 		issued:           time.Now(),
@@ -147,6 +228,8 @@ func (h *DigestAuth) addNonce(nonce string) {
 	}
 }
 
+// expireNonces removes nonces unused for maxNonceInactiveInterval, shared nonces
+// expire in Redis.
 func (h *DigestAuth) expireNonces() {
 	currentTime := time.Now()
 	limit := currentTime.Add(-maxNonceInactiveInterval)
@@ -156,3 +239,11 @@ func (h *DigestAuth) expireNonces() {
 		}
 	}
 }
+
+func (h *DigestAuth) warnf(format string, v ...interface{}) {
+	if h.log != nil {
+		h.log.logf(nil, slog.LevelWarn, format, v...)
+	} else {
+		log.Printf(logWarnPrefix+format, v...)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// upstreamDirectFallback is logged as the upstream of requests which were sent
+// directly after their upstream proxy failed.
+const upstreamDirectFallback = "DIRECT-FALLBACK"
+
+var defaultDirectFallbackStatuses = []int{http.StatusBadGateway, http.StatusGatewayTimeout}
+
+// directFallback decides whether a request which failed at its upstream proxy is
+// retried directly, according to direct_fallback_domains and direct_fallback_statuses.
+type directFallback struct {
+	domains  []string
+	statuses map[int]bool
+}
+
+// newDirectFallback returns nil if direct_fallback_domains isn't set.
+func newDirectFallback(conf *Configuration) *directFallback {
+	if len(conf.DirectFallbackDomains) == 0 {
+		return nil
+	}
+
+	f := &directFallback{statuses: make(map[int]bool, len(conf.DirectFallbackStatuses))}
+	for _, domain := range conf.DirectFallbackDomains {
+		f.domains = append(f.domains, strings.ToLower(strings.TrimPrefix(domain, ".")))
+	}
+	for _, status := range conf.DirectFallbackStatuses {
+		f.statuses[status] = true
+	}
+
+	return f
+}
+
+func (f *directFallback) allowed(host string) bool {
+	return f != nil && matchesDomains(strings.ToLower(host), f.domains)
+}
+
+// retryable reports whether the plain HTTP request can be sent again after the
+// upstream proxy returned resp or err. Requests with bodies aren't retried, the
+// body was already sent to the upstream.
+func (f *directFallback) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if !f.allowed(req.URL.Hostname()) || requestInfoFromRequest(req) == nil ||
+		(req.Body != nil && req.Body != http.NoBody) {
+		return false
+	}
+
+	return err != nil || f.statuses[resp.StatusCode]
+}
+
+// useDirectFallback makes the transport's Proxy function send req directly.
+func useDirectFallback(req *http.Request) {
+	if info := requestInfoFromRequest(req); info != nil {
+		info.directFallback = true
+		info.upstream = upstreamDirectFallback
+	}
+}
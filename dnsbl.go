@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of dnsbl_action setting.
+const (
+	dnsblBlock = "block"
+	dnsblLog   = "log"
+
+	defaultDNSBLCacheTTL = 5 * time.Minute
+	dnsblLookupTimeout   = 2 * time.Second
+)
+
+// Spamhaus answers with addresses in this network on errors, i.e. when queried
+// through a public resolver, such answers don't mean the name is listed.
+var _, dnsblErrorNetwork, _ = net.ParseCIDR("127.255.255.0/24")
+
+type dnsblResult struct {
+	listed  bool
+	expires time.Time
+}
+
+// dnsblChecker looks up destinations in DNS based blocklists, i.e. Spamhaus DBL for
+// host names or ZEN for IP addresses. Results are cached for the configured time.
+type dnsblChecker struct {
+	zones  []string
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+
+	mu    sync.Mutex
+	cache map[string]dnsblResult
+}
+
+func newDNSBLChecker(conf *Configuration) *dnsblChecker {
+	return &dnsblChecker{
+		zones: conf.DNSBLZones,
+		ttl:   conf.DNSBLCacheTTL,
+		lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		},
+		cache: make(map[string]dnsblResult),
+	}
+}
+
+// dnsblNames returns names to look up for the host: reversed address for IP
+// addresses, the host name and its parent domains except the top level one otherwise.
+func dnsblNames(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return []string{fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])}
+		}
+
+		nibbles := make([]string, 0, 2*net.IPv6len)
+		for i := net.IPv6len - 1; i >= 0; i-- {
+			nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip[i]&0x0f, ip[i]>>4))
+		}
+		return []string{strings.Join(nibbles, ".")}
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	labels := strings.Split(host, ".")
+
+	names := make([]string, 0, len(labels))
+	for i := 0; i < len(labels)-1; i++ {
+		names = append(names, strings.Join(labels[i:], "."))
+	}
+
+	return names
+}
+
+// check returns the zone the host is listed in or empty string if it isn't listed.
+// Lookup failures are treated as not listed.
+func (c *dnsblChecker) check(host string) string {
+	for _, name := range dnsblNames(host) {
+		for _, zone := range c.zones {
+			if c.listed(name + "." + zone) {
+				return zone
+			}
+		}
+	}
+
+	return ""
+}
+
+func (c *dnsblChecker) listed(query string) bool {
+	now := time.Now()
+
+	c.mu.Lock()
+	result, cached := c.cache[query]
+	c.mu.Unlock()
+
+	if cached && now.Before(result.expires) {
+		return result.listed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblLookupTimeout)
+	defer cancel()
+
+	listed := false
+	ips, err := c.lookup(ctx, query)
+	if err == nil {
+		for _, ip := range ips {
+			if ip.IsLoopback() && !dnsblErrorNetwork.Contains(ip) {
+				listed = true
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.cache[query] = dnsblResult{listed: listed, expires: now.Add(c.ttl)}
+	// drop expired entries, so the cache doesn't grow forever
+	if len(c.cache) > 10000 {
+		for name, r := range c.cache {
+			if now.After(r.expires) {
+				delete(c.cache, name)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	return listed
+}
+
+// setDNSBLHandler checks destinations against dnsbl_zones and, depending on
+// dnsbl_action, denies requests to listed destinations or only logs them.
+func setDNSBLHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if len(conf.DNSBLZones) == 0 {
+		return
+	}
+
+	newDNSBLChecker(conf).setHandlers(conf.DNSBLAction, proxy)
+}
+
+func (c *dnsblChecker) setHandlers(action string, proxy *goproxy.ProxyHttpServer) {
+	denied := func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		zone := c.check(req.URL.Hostname())
+		if zone == "" {
+			return false
+		}
+
+		ctx.Warnf("destination %v is listed in %v, client %v", req.URL.Hostname(), zone, req.RemoteAddr)
+		if action != dnsblBlock {
+			return false
+		}
+		denyRequest(ctx, "dnsbl_zones:"+zone)
+		return true
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if denied(ctx.Req, ctx) {
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Access denied")
+				return goproxy.RejectConnect, host
+			}
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if denied(req, ctx) {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+			}
+			return req, nil
+		})
+}
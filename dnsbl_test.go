@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestDNSBLNames(t *testing.T) {
+	tests := []struct {
+		host  string
+		names []string
+	}{
+		{"192.0.2.1", []string{"1.2.0.192"}},
+		{"www.Example.com.", []string{"www.example.com", "example.com"}},
+		{"localhost", []string{}},
+		{"2001:db8::1", []string{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"}},
+	}
+
+	for _, test := range tests {
+		if names := dnsblNames(test.host); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s: expected %v, got %v", test.host, test.names, names)
+		}
+	}
+}
+
+func newTestDNSBLChecker(listed map[string]string) (*dnsblChecker, *int) {
+	lookups := 0
+	checker := newDNSBLChecker(&Configuration{
+		DNSBLZones:    []string{"dbl.example.net", "zen.example.net"},
+		DNSBLCacheTTL: time.Minute,
+	})
+	checker.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		if answer, ok := listed[host]; ok {
+			return []net.IP{net.ParseIP(answer)}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	return checker, &lookups
+}
+
+func TestDNSBLChecker(t *testing.T) {
+	checker, lookups := newTestDNSBLChecker(map[string]string{
+		"example.com.zen.example.net":     "127.0.1.2",
+		"1.2.0.192.zen.example.net":       "127.0.0.2",
+		"example.org.dbl.example.net":     "127.255.255.254",
+		"www.example.org.dbl.example.net": "198.51.100.1",
+	})
+
+	tests := []struct {
+		host string
+		zone string
+	}{
+		{"www.example.com", "zen.example.net"},
+		{"192.0.2.1", "zen.example.net"},
+		{"www.example.org", ""},
+		{"192.0.2.2", ""},
+	}
+
+	for _, test := range tests {
+		if zone := checker.check(test.host); zone != test.zone {
+			t.Errorf("%s: expected zone %q, got %q", test.host, test.zone, zone)
+		}
+	}
+
+	n := *lookups
+	checker.check("www.example.com")
+	if *lookups != n {
+		t.Error("Expected cached result to be used, got", *lookups-n, "lookups")
+	}
+}
+
+func TestDNSBLHandler(t *testing.T) {
+	listed := map[string]string{"example.com.dbl.example.net": "127.0.1.2"}
+
+	for _, test := range []struct {
+		action string
+		code   int
+	}{
+		{dnsblBlock, http.StatusForbidden},
+		{dnsblLog, http.StatusOK},
+	} {
+		checker, _ := newTestDNSBLChecker(listed)
+		proxy := goproxy.NewProxyHttpServer()
+		checker.setHandlers(test.action, proxy)
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "ok")
+		})
+
+		req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d status code, got %d", test.action, test.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of egress_ip_family setting.
+const (
+	egressAny  = "any"
+	egressIPv4 = "ipv4"
+	egressIPv6 = "ipv6"
+)
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// restrictDialFamily wraps dial, so outgoing connections use only addresses of the
+// family regardless of DNS results. Destinations without such addresses fail with
+// an error naming the family instead of a generic dial error.
+func restrictDialFamily(family string, dial dialContextFunc) dialContextFunc {
+	network, lookupNetwork := "tcp4", "ip4"
+	if family == egressIPv6 {
+		network, lookupNetwork = "tcp6", "ip6"
+	}
+
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			if (ip.To4() != nil) == (family == egressIPv4) {
+				ips = []net.IP{ip}
+			}
+		} else {
+			ips, err = net.DefaultResolver.LookupIP(ctx, lookupNetwork, host)
+			if err != nil && !isNotFound(err) {
+				return nil, err
+			}
+		}
+
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("%s has no %s address, egress_ip_family is %s", host, family, family)
+		}
+
+		for _, ip := range ips {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+
+		return nil, err
+	}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// withUserEgress wraps dial, so connections made on behalf of users listed in
+// user_egress_ips use their source addresses. The user is taken from requestInfo
+// attached to the context of the request the connection is made for.
+func withUserEgress(ips map[string]string, dial dialContextFunc) dialContextFunc {
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: tcpKeepAliveInterval}).DialContext
+	}
+
+	dials := make(map[string]dialContextFunc, len(ips))
+	for user, ip := range ips {
+		// validated when configuration is loaded
+		dials[user] = makeCustomDialContext(&net.TCPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+			if userDial, exists := dials[info.user]; exists {
+				return userDial(ctx, network, addr)
+			}
+		}
+
+		return dial(ctx, network, addr)
+	}
+}
+
+type egressTransportKey struct{}
+
+// requestTransport returns the transport req has to be sent with.
+func requestTransport(req *http.Request, proxy *goproxy.ProxyHttpServer) *http.Transport {
+	if tr, ok := req.Context().Value(egressTransportKey{}).(*http.Transport); ok {
+		return tr
+	}
+
+	return proxy.Tr
+}
+
+// setUserEgressHandler sends plain HTTP requests of users listed in user_egress_ips
+// through transports of their source addresses, so idle connections made from one
+// address aren't reused for requests of other users. Has to be called after other
+// handlers replacing the round tripper.
+func setUserEgressHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if len(conf.UserEgressIPs) == 0 {
+		return
+	}
+
+	transports := make(map[string]*http.Transport)
+	users := make(map[string]*http.Transport, len(conf.UserEgressIPs))
+	for user, ip := range conf.UserEgressIPs {
+		if transports[ip] == nil {
+			transports[ip] = proxy.Tr.Clone()
+		}
+		users[user] = transports[ip]
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			next := ctx.RoundTripper
+			ctx.RoundTripper = goproxy.RoundTripperFunc(
+				func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+					// the user is known only after authentication handlers ran
+					if tr, exists := users[getRequestInfo(ctx).user]; exists {
+						req = req.WithContext(context.WithValue(req.Context(), egressTransportKey{}, tr))
+					}
+					if next != nil {
+						return next.RoundTrip(req, ctx)
+					}
+					return requestTransport(req, proxy).RoundTrip(req)
+				})
+			return req, nil
+		})
+}
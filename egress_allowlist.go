@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of egress_allowlist_mode setting.
+const (
+	egressAllowlistEnforce = "enforce"
+	egressAllowlistReport  = "report"
+)
+
+// egressAllowlist denies requests to all destinations except domains and networks
+// of egress_allowlist. Denied destinations are logged with the entry allowing them,
+// so the list can be built from the log, in report mode they are only logged.
+type egressAllowlist struct {
+	domains []string
+	cidrs   []*net.IPNet
+	resolve bool
+	report  bool
+	log     *moduleLogger
+}
+
+// newEgressAllowlist returns nil if egress_allowlist isn't set.
+func newEgressAllowlist(conf *Configuration, proxy *goproxy.ProxyHttpServer) *egressAllowlist {
+	if len(conf.EgressAllowlist) == 0 {
+		return nil
+	}
+
+	a := &egressAllowlist{
+		resolve: conf.ResolveDestinations,
+		report:  conf.EgressAllowlistMode == egressAllowlistReport,
+		log:     newModuleLogger(proxy, logModuleEgress),
+	}
+	for _, entry := range conf.EgressAllowlist {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			a.cidrs = append(a.cidrs, network)
+		} else {
+			a.domains = append(a.domains, strings.ToLower(strings.Trim(entry, ".")))
+		}
+	}
+
+	return a
+}
+
+// allowed reports whether the host is one of the domains or their subdomains, or
+// its address is in the networks. Host names are checked against the networks
+// only if resolve is set.
+func (a *egressAllowlist) allowed(host string, resolve bool) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchesDomains(host, a.domains) {
+		return true
+	}
+
+	for _, ip := range resolveDestination(host, resolve) {
+		if networksContain(a.cidrs, ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// egressAllowlistEntry returns the entry which would allow requests to the host.
+func egressAllowlistEntry(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// denied reports whether the request's destination isn't allowlisted, it's always
+// false in report mode.
+func (a *egressAllowlist) denied() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		host := req.URL.Hostname()
+		if a.allowed(host, a.resolve) {
+			return false
+		}
+
+		action := "denied"
+		if a.report {
+			action = "would deny"
+		}
+		a.log.logf(ctx, slog.LevelInfo, "egress_allowlist %s %s %s from %s, add %q to allow it",
+			action, req.Method, req.URL.Host, req.RemoteAddr, egressAllowlistEntry(host))
+
+		if a.report {
+			return false
+		}
+		denyRequest(ctx, "egress_allowlist")
+		return true
+	}
+}
+
+// setEgressAllowlistHandler makes the proxy a default-deny egress gateway, only
+// destinations in egress_allowlist are reachable.
+func setEgressAllowlistHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	a := newEgressAllowlist(conf, proxy)
+	if a == nil {
+		return
+	}
+
+	cond := a.denied()
+	proxy.OnRequest(cond).HandleConnect(goproxy.AlwaysReject)
+	proxy.OnRequest(cond).DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+		})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestEgressAllowlist(t *testing.T) {
+	conf := newConfiguration(bytes.NewBufferString(`egress_allowlist=[".example.com", "api.example.org", "10.0.0.0/8", "192.0.2.1"]`))
+	var out bytes.Buffer
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = log.New(&out, "", 0)
+	denied := newEgressAllowlist(conf, proxy).denied()
+
+	tests := []struct {
+		method, target string
+		denied         bool
+	}{
+		{http.MethodGet, "http://example.com/", false},
+		{http.MethodGet, "http://WWW.Example.com./", false},
+		{http.MethodConnect, "api.example.org:443", false},
+		{http.MethodConnect, "www.example.org:443", true},
+		{http.MethodGet, "http://badexample.com/", true},
+		{http.MethodGet, "http://10.1.2.3/", false},
+		{http.MethodConnect, "192.0.2.1:443", false},
+		{http.MethodConnect, "192.0.2.2:443", true},
+	}
+
+	for _, test := range tests {
+		ctx := &goproxy.ProxyCtx{Proxy: proxy}
+		req := httptest.NewRequest(test.method, test.target, nil)
+		if result := denied(req, ctx); result != test.denied {
+			t.Errorf("%s %s: expected denied=%v, got %v", test.method, test.target, test.denied, result)
+		}
+	}
+
+	expected := `egress_allowlist denied CONNECT www.example.org:443 from 192.0.2.1:1234, add "www.example.org" to allow it`
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("Expected %q in log:\n%v", expected, out.String())
+	}
+}
+
+func TestEgressAllowlistReport(t *testing.T) {
+	conf := newConfiguration(bytes.NewBufferString("egress_allowlist=[\"example.com\"]\negress_allowlist_mode=\"report\"\n"))
+	var out bytes.Buffer
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = log.New(&out, "", 0)
+	setEgressAllowlistHandler(conf, proxy)
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:1/", nil))
+	if w.Code == http.StatusForbidden {
+		t.Error("Expected request not to be denied in report mode")
+	}
+	if !strings.Contains(out.String(), `egress_allowlist would deny GET 127.0.0.1:1 from 192.0.2.1:1234, add "127.0.0.1" to allow it`) {
+		t.Errorf("Expected the request to be reported, got log:\n%v", out.String())
+	}
+
+	conf.EgressAllowlistMode = egressAllowlistEnforce
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.Logger = log.New(&out, "", 0)
+	setEgressAllowlistHandler(conf, proxy)
+
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:1/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 status code, got %v", w.Code)
+	}
+}
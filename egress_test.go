@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestRestrictDialFamily(t *testing.T) {
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	tests := []struct {
+		family string
+		addr   string
+		dialed string
+		err    string
+	}{
+		{egressIPv4, "192.0.2.1:80", "tcp4 192.0.2.1:80", ""},
+		{egressIPv4, "[2001:db8::1]:443", "", "2001:db8::1 has no ipv4 address"},
+		{egressIPv6, "[2001:db8::1]:443", "tcp6 [2001:db8::1]:443", ""},
+		{egressIPv6, "192.0.2.1:80", "", "192.0.2.1 has no ipv6 address"},
+		{egressIPv4, "localhost:80", "tcp4 127.0.0.1:80", ""},
+	}
+
+	for _, test := range tests {
+		dialed = nil
+		conn, err := restrictDialFamily(test.family, dial)(context.Background(), "tcp", test.addr)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %s: expected error %q, got %v", test.family, test.addr, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %v", test.family, test.addr, err)
+			continue
+		}
+		conn.Close()
+		if len(dialed) == 0 || dialed[0] != test.dialed {
+			t.Errorf("%s %s: expected %q dialed, got %v", test.family, test.addr, test.dialed, dialed)
+		}
+	}
+}
+
+func TestUserEgressIPs(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprint(w, host)
+	}))
+	defer background.Close()
+
+	conf := &Configuration{UserEgressIPs: map[string]string{"alice": "127.0.0.2"}}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.DialContext = withUserEgress(conf.UserEgressIPs, nil)
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			getRequestInfo(ctx).user = req.Header.Get("X-User")
+			return req, nil
+		})
+	setUserEgressHandler(conf, proxy)
+
+	proxyserver := httptest.NewServer(withRequestInfo(proxy))
+	defer proxyserver.Close()
+	proxyURL, _ := url.Parse(proxyserver.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// idle connections of one user must not be reused for the other one
+	for _, test := range []struct{ user, ip string }{
+		{"alice", "127.0.0.2"},
+		{"bob", "127.0.0.1"},
+		{"alice", "127.0.0.2"},
+	} {
+		req, _ := http.NewRequest("GET", background.URL, nil)
+		req.Header.Set("X-User", test.user)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(ip) != test.ip {
+			t.Errorf("Expected request of %s from %s, got %s", test.user, test.ip, ip)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// runEval implements "microproxy eval" subcommand which shows how the proxy configured
+// with the given configuration file would handle a request to the URL.
+func runEval(args []string) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	configFile := flags.String("config", "microproxy.toml", "proxy configuration file")
+	clientIP := flags.String("client", "127.0.0.1", "IP address of the client making the request")
+	user := flags.String("user", "", "name of the authenticated user making the request")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s eval [options] URL\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	target, err := url.Parse(flags.Arg(0))
+	if err != nil || target.Host == "" {
+		fmt.Fprintf(os.Stderr, "couldn't parse URL %v\n", flags.Arg(0))
+		return 2
+	}
+
+	client := net.ParseIP(*clientIP)
+	if client == nil {
+		fmt.Fprintf(os.Stderr, "incorrect client IP address %v\n", *clientIP)
+		return 2
+	}
+
+	conf := newConfigurationFromFile(*configFile)
+	evaluate(os.Stdout, conf, target, client, *user)
+
+	return 0
+}
+
+func evaluate(out io.Writer, conf *Configuration, target *url.URL, client net.IP, user string) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	tunnel := target.Scheme == "https"
+
+	method := "GET"
+	if tunnel {
+		method = "CONNECT"
+	}
+	fmt.Fprintf(w, "request:\t%s %s\n", method, net.JoinHostPort(target.Hostname(), port))
+
+	access := newClientAccess(conf)
+	access.refresh(nil)
+	fmt.Fprintf(w, "client access:\t%s\n", evalClientAccess(access, client))
+
+	if tunnel {
+		fmt.Fprintf(w, "connect port:\t%s\n", evalConnectPort(conf, port))
+		if ip := net.ParseIP(target.Hostname()); ip != nil {
+			fmt.Fprintf(w, "connect to IP address:\t%s\n", evalConnectIPLiteral(conf, ip))
+		}
+	}
+
+	if allowlist := newEgressAllowlist(conf, nil); allowlist != nil {
+		fmt.Fprintf(w, "egress allowlist:\t%s\n", evalEgressAllowlist(conf, allowlist, target.Hostname()))
+	}
+
+	if len(conf.AllowedDestinationNetworks) > 0 || len(conf.DisallowedDestinationNetworks) > 0 {
+		fmt.Fprintf(w, "destination networks:\t%s\n", evalDestinationNetworks(conf, target.Hostname()))
+	}
+
+	if conf.MetadataProtection {
+		fmt.Fprintf(w, "metadata protection:\t%s\n", evalMetadataProtection(conf, client, target.Hostname()))
+	}
+
+	if conf.authEnabled() {
+		fmt.Fprintf(w, "authentication:\t%s, realm \"%s\"\n", conf.AuthType, conf.AuthRealm)
+	} else {
+		fmt.Fprintf(w, "authentication:\tnone\n")
+	}
+
+	match := matchRoute(target.Hostname(), user, newRouter(conf).routing())
+	fmt.Fprintf(w, "route:\t%s\n", match)
+
+	if tunnel {
+		fmt.Fprintf(w, "header policies:\tnot applied to CONNECT tunnels\n")
+		return
+	}
+
+	fmt.Fprintf(w, "X-Forwarded-For:\t%s\n", conf.ForwardedForHeader)
+	if conf.ViaHeader == "on" {
+		fmt.Fprintf(w, "Via:\ton (1.1 %s)\n", conf.ViaProxyName)
+	} else {
+		fmt.Fprintf(w, "Via:\t%s\n", conf.ViaHeader)
+	}
+	for _, headerData := range conf.AddHeaders {
+		if len(headerData) == 2 && headerData[0] != "" && headerData[1] != "" {
+			fmt.Fprintf(w, "add header:\t%s: %s (unless already present)\n", headerData[0], headerData[1])
+		}
+	}
+}
+
+func evalClientAccess(access *clientAccess, client net.IP) string {
+	switch rule := access.check(client); {
+	case rule == "allowed_networks":
+		return fmt.Sprintf("denied, %v is not in allowed_networks", client)
+	case rule != "":
+		return fmt.Sprintf("denied, %v is in disallowed_networks (%s)", client, strings.TrimPrefix(rule, "disallowed_networks:"))
+	}
+
+	return "allowed"
+}
+
+func evalConnectPort(conf *Configuration, port string) string {
+	ports := make([]string, len(conf.AllowedConnectPorts))
+	for i, v := range conf.AllowedConnectPorts {
+		ports[i] = strconv.Itoa(v)
+		if ports[i] == port {
+			return "allowed"
+		}
+	}
+
+	return fmt.Sprintf("denied, allowed ports are %s", strings.Join(ports, ", "))
+}
+
+// evalEgressAllowlist doesn't resolve host names, the same as other checks.
+func evalEgressAllowlist(conf *Configuration, allowlist *egressAllowlist, host string) string {
+	switch {
+	case allowlist.allowed(host, false):
+		return "allowed"
+	case conf.EgressAllowlistMode == egressAllowlistReport:
+		return fmt.Sprintf("reported, add %q to allow it", egressAllowlistEntry(host))
+	}
+
+	return fmt.Sprintf("denied, add %q to allow it", egressAllowlistEntry(host))
+}
+
+// evalDestinationNetworks resolves the host only if resolve_destinations is set,
+// the same as the proxy.
+func evalDestinationNetworks(conf *Configuration, host string) string {
+	ips := resolveDestination(host, conf.ResolveDestinations)
+	switch {
+	case len(ips) == 0 && net.ParseIP(host) == nil && !conf.ResolveDestinations:
+		return "allowed, host names aren't resolved unless resolve_destinations is set"
+	case len(ips) == 0:
+		return fmt.Sprintf("allowed, %s couldn't be resolved", host)
+	case len(conf.AllowedDestinationNetworks) > 0 && destinationOutside(parseNetworks(conf.AllowedDestinationNetworks), ips):
+		return fmt.Sprintf("denied, %v is not in allowed_destination_networks", ips)
+	}
+
+	if network := destinationNetwork(parseNetworks(conf.DisallowedDestinationNetworks), ips); network != nil {
+		return fmt.Sprintf("denied, %v is in disallowed_destination_networks (%v)", ips, network)
+	}
+
+	return "allowed"
+}
+
+func evalMetadataProtection(conf *Configuration, client net.IP, host string) string {
+	if newMetadataProtection(conf).denied(client, host) {
+		return fmt.Sprintf("denied, %s is a cloud metadata service", host)
+	}
+
+	return "allowed"
+}
+
+func evalConnectIPLiteral(conf *Configuration, ip net.IP) string {
+	switch {
+	case conf.ConnectIPLiterals == connectIPLiteralsDeny:
+		return "denied, connect_ip_literals is deny"
+	case conf.ConnectIPLiterals == connectIPLiteralsACL && !networksContain(parseNetworks(conf.AllowedDestinationNetworks), ip):
+		return fmt.Sprintf("denied, %v is not in allowed_destination_networks", ip)
+	}
+
+	return "allowed"
+}
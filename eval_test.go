@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	s := `allowed_networks=["10.0.0.0/8"]
+allowed_connect_ports=[443]
+[proxies]
+parent="http://10.0.0.1:3128"
+[rules]
+"example.com"="parent"
+`
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	target, _ := url.Parse("https://www.example.com:8443")
+
+	var out bytes.Buffer
+	evaluate(&out, conf, target, net.ParseIP("192.168.1.1"), "")
+	result := out.String()
+
+	expected := []string{
+		"CONNECT www.example.com:8443",
+		"denied, 192.168.1.1 is not in allowed_networks",
+		"denied, allowed ports are 443",
+		"rule=example.com upstream=parent (http://10.0.0.1:3128)",
+	}
+	for _, e := range expected {
+		if !strings.Contains(result, e) {
+			t.Errorf("Expected '%s' in output:\n%s", e, result)
+		}
+	}
+}
+
+func TestEvaluateEgressAllowlist(t *testing.T) {
+	conf := newConfiguration(bytes.NewBufferString(`egress_allowlist=["example.com"]`))
+
+	for target, expected := range map[string]string{
+		"http://www.example.com/": "egress allowlist:  allowed",
+		"http://www.example.org/": `egress allowlist:  denied, add "www.example.org" to allow it`,
+	} {
+		u, _ := url.Parse(target)
+		var out bytes.Buffer
+		evaluate(&out, conf, u, net.ParseIP("127.0.0.1"), "")
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected '%s' in output:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestEvaluateDestinationNetworks(t *testing.T) {
+	s := `allowed_destination_networks=["10.0.0.0/8", "127.0.0.0/8"]
+disallowed_destination_networks=["10.1.0.0/16"]
+resolve_destinations=true
+`
+	conf := newConfiguration(bytes.NewBufferString(s))
+
+	for target, expected := range map[string]string{
+		"http://10.0.0.1/":       "allowed",
+		"http://192.168.1.1/":    "denied, [192.168.1.1] is not in allowed_destination_networks",
+		"https://10.1.0.1/":      "denied, [10.1.0.1] is in disallowed_destination_networks (10.1.0.0/16)",
+		"http://localhost:8080/": "allowed",
+	} {
+		u, _ := url.Parse(target)
+		var out bytes.Buffer
+		evaluate(&out, conf, u, net.ParseIP("127.0.0.1"), "")
+		if result := evalLine(out.String(), "destination networks"); result != expected {
+			t.Errorf("%v: expected '%s', got '%s'", target, expected, result)
+		}
+	}
+
+	conf.ResolveDestinations = false
+	u, _ := url.Parse("http://localhost/")
+	var out bytes.Buffer
+	evaluate(&out, conf, u, net.ParseIP("127.0.0.1"), "")
+	if expected := "host names aren't resolved"; !strings.Contains(out.String(), expected) {
+		t.Errorf("Expected '%s' in output:\n%s", expected, out.String())
+	}
+}
+
+// evalLine returns the value of the evaluation's result named name.
+func evalLine(output, name string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if value, found := strings.CutPrefix(line, name+":"); found {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+func TestEvaluateMetadataProtection(t *testing.T) {
+	conf := newConfiguration(bytes.NewBufferString("metadata_protection=true\nmetadata_allowed_networks=[\"10.0.0.0/8\"]\n"))
+
+	for _, test := range []struct {
+		target, client, expected string
+	}{
+		{"http://169.254.169.254/latest/meta-data/", "127.0.0.1", "denied, 169.254.169.254 is a cloud metadata service"},
+		{"https://metadata.google.internal/", "127.0.0.1", "denied, metadata.google.internal is a cloud metadata service"},
+		{"http://169.254.169.254/", "10.0.0.1", "allowed"},
+		{"http://www.example.com/", "127.0.0.1", "allowed"},
+	} {
+		u, _ := url.Parse(test.target)
+		var out bytes.Buffer
+		evaluate(&out, conf, u, net.ParseIP(test.client), "")
+		if result := evalLine(out.String(), "metadata protection"); result != test.expected {
+			t.Errorf("%v from %v: expected '%s', got '%s'", test.target, test.client, test.expected, result)
+		}
+	}
+}
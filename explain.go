@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	proxyExplainHeader = "X-Microproxy-Explain"
+	proxyRouteHeader   = "X-Microproxy-Route"
+)
+
+// setRouteExplainHandler reports routing decisions without changing them. With
+// explain_routing enabled every decision is written to the activity log, clients
+// from explain_networks can ask for it per request with the X-Microproxy-Explain
+// header, the decision is then returned in the X-Microproxy-Route response header.
+func setRouteExplainHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer, router *Router) {
+	if !conf.ExplainRouting && len(conf.ExplainNetworks) == 0 {
+		return
+	}
+
+	trusted := func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return false
+	}
+	if len(conf.ExplainNetworks) > 0 {
+		trusted = sourceIPMatches(conf.ExplainNetworks)
+	}
+
+	routingLog := newModuleLogger(proxy, logModuleRouting)
+	explain := func(req *http.Request, ctx *goproxy.ProxyCtx) (routeMatch, bool) {
+		requested := req.Header.Get(proxyExplainHeader) != ""
+		req.Header.Del(proxyExplainHeader)
+
+		requested = requested && trusted(req, ctx)
+		if !conf.ExplainRouting && !requested {
+			return routeMatch{}, false
+		}
+
+		match := findMatchingRoute(req, getRequestInfo(ctx), router)
+		routingLog.logf(ctx, slog.LevelInfo, "route: %v %v %v", req.Method, req.URL.Host, match)
+
+		return match, requested
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			explain(ctx.Req, ctx)
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if _, requested := explain(req, ctx); requested {
+				getRequestInfo(ctx).explain = true
+			}
+			return req, nil
+		})
+
+	proxy.OnResponse().DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp != nil && getRequestInfo(ctx).explain {
+				match := findMatchingRoute(ctx.Req, getRequestInfo(ctx), router)
+				resp.Header.Set(proxyRouteHeader, match.String())
+			}
+			return resp
+		})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	defaultFailoverInterval    = time.Second
+	defaultFailoverMaxFailures = 3
+)
+
+// runtimeState is the state a standby imports from the primary through the admin API.
+type runtimeState struct {
+	Health map[string]UpstreamHealth `json:"health"`
+	// nil if the primary doesn't ban clients
+	Bans []ClientBan `json:"bans"`
+}
+
+func (admin *adminServer) getState(w http.ResponseWriter, req *http.Request) {
+	state := &runtimeState{Health: admin.health.snapshot()}
+	if admin.bans != nil {
+		state.Bans = admin.bans.snapshot(time.Now())
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// fetchPeerState requests the primary's runtime state, admin_token is used to
+// authenticate the request, so both peers have to use the same token.
+func fetchPeerState(client *http.Client, conf *Configuration) (*runtimeState, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(conf.FailoverPeer, "/")+"/state", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+conf.AdminToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	var state runtimeState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// waitForTakeover runs the proxy as a standby: it polls the primary peer and
+// imports its runtime state until the primary fails failover_max_failures times in
+// a row, then runs failover_takeover_command and returns, so the caller starts
+// listening.
+func waitForTakeover(conf *Configuration, proxy *goproxy.ProxyHttpServer, health *ProxyHealth, bans *clientBans) {
+	client := &http.Client{Timeout: conf.FailoverInterval}
+
+	proxy.Logger.Printf("standing by for primary %v\n", conf.FailoverPeer)
+
+	failures := 0
+	for failures < conf.FailoverMaxFailures {
+		state, err := fetchPeerState(client, conf)
+		if err != nil {
+			failures++
+			proxy.Logger.Printf("WARN: primary %v check failed (%v/%v): %v\n",
+				conf.FailoverPeer, failures, conf.FailoverMaxFailures, err)
+		} else {
+			failures = 0
+			health.restore(state.Health)
+			if bans != nil && state.Bans != nil {
+				if err := bans.restore(state.Bans); err != nil {
+					proxy.Logger.Printf("WARN: couldn't save client bans: %v\n", err)
+				}
+			}
+		}
+
+		if failures < conf.FailoverMaxFailures {
+			time.Sleep(conf.FailoverInterval)
+		}
+	}
+
+	proxy.Logger.Printf("primary %v is down, taking over\n", conf.FailoverPeer)
+
+	if conf.FailoverTakeoverCommand != "" {
+		cmd := exec.Command(conf.FailoverTakeoverCommand)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			proxy.Logger.Printf("WARN: takeover command failed: %v\n", err)
+		}
+	}
+}
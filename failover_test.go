@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestFailoverTakeover(t *testing.T) {
+	primaryConf := &Configuration{AdminToken: "secret"}
+	primaryHealth := newProxyHealth(primaryConf)
+	primaryHealth.restore(map[string]UpstreamHealth{"proxy1:3128": {Failures: 5, LastError: "refused"}})
+	primaryBans := newClientBans(primaryConf)
+	primaryBans.add(ClientBan{IP: "192.0.2.1", Reason: "scanning", Created: time.Now()})
+	primary := httptest.NewServer(newAdminServer(primaryConf, "", nil, newRouter(primaryConf), primaryHealth,
+		newTunnelRegistry(), nil, primaryBans))
+
+	marker := filepath.Join(t.TempDir(), "taken-over")
+	script := filepath.Join(t.TempDir(), "takeover.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ntouch "+marker+"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Configuration{
+		AdminToken:              "secret",
+		FailoverPeer:            primary.URL,
+		FailoverInterval:        50 * time.Millisecond,
+		FailoverMaxFailures:     2,
+		FailoverTakeoverCommand: script,
+	}
+	health := newProxyHealth(conf)
+	bans := newClientBans(conf)
+	bans.add(ClientBan{IP: "192.0.2.2", Created: time.Now()})
+
+	done := make(chan struct{})
+	go func() {
+		waitForTakeover(conf, goproxy.NewProxyHttpServer(), health, bans)
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("Standby took over while the primary is alive")
+	default:
+	}
+
+	primary.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Standby didn't take over after the primary failed")
+	}
+
+	if state := health.snapshot()["proxy1:3128"]; state.Failures != 5 || state.LastError != "refused" {
+		t.Errorf("Expected primary's upstream health to be imported, got %+v", state)
+	}
+	if !bans.banned("192.0.2.1", time.Now()) || bans.banned("192.0.2.2", time.Now()) {
+		t.Errorf("Expected primary's client bans to be imported, got %+v", bans.snapshot(time.Now()))
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("Expected takeover command to be run:", err)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClientHello larger than that isn't fingerprinted, the tunnel is passed through as is.
+const maxClientHelloSize = 16 * 1024
+
+const (
+	tlsRecordHandshake    = 0x16
+	tlsClientHello        = 0x01
+	tlsExtServerName      = 0x0000
+	tlsExtSupportedGroups = 0x000a
+	tlsExtPointFormats    = 0x000b
+	tlsExtSignatureAlgs   = 0x000d
+	tlsExtALPN            = 0x0010
+	tlsExtSupportedVers   = 0x002b
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// clientHello holds ClientHello fields used by JA3 and JA4 fingerprints and the
+// requested host name, GREASE values are already removed.
+type clientHello struct {
+	version       uint16
+	ciphers       []uint16
+	extensions    []uint16
+	groups        []uint16
+	pointFormats  []uint8
+	signatureAlgs []uint16
+	versions      []uint16
+	alpn          []string
+	serverName    bool
+	hostName      string
+}
+
+// isGREASE reports whether the value is one of values reserved by RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsReader reads big-endian fields from the handshake message.
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errNotClientHello
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+
+	return b
+}
+
+func (r *tlsReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tlsReader) vector8() *tlsReader {
+	return &tlsReader{data: r.bytes(int(r.uint8())), err: r.err}
+}
+
+func (r *tlsReader) vector16() *tlsReader {
+	return &tlsReader{data: r.bytes(int(r.uint16())), err: r.err}
+}
+
+func (r *tlsReader) uint16s() []uint16 {
+	var values []uint16
+	for r.err == nil && len(r.data) >= 2 {
+		if v := r.uint16(); !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// clientHelloMessage extracts the ClientHello handshake message from TLS records at
+// the beginning of the stream. It returns nil message and nil error if more data is
+// needed.
+func clientHelloMessage(data []byte) ([]byte, error) {
+	var message []byte
+	for len(data) >= 5 {
+		if data[0] != tlsRecordHandshake || data[1] != 3 {
+			return nil, errNotClientHello
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			break
+		}
+		message = append(message, data[5:5+length]...)
+		data = data[5+length:]
+
+		if len(message) >= 4 {
+			if message[0] != tlsClientHello {
+				return nil, errNotClientHello
+			}
+			size := 4 + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+			if len(message) >= size {
+				return message[4:size], nil
+			}
+		}
+	}
+
+	if len(data) > 0 && data[0] != tlsRecordHandshake {
+		return nil, errNotClientHello
+	}
+
+	return nil, nil
+}
+
+func parseClientHello(message []byte) (*clientHello, error) {
+	r := &tlsReader{data: message}
+	h := &clientHello{version: r.uint16()}
+
+	r.bytes(32) // random
+	r.vector8() // session id
+	h.ciphers = r.vector16().uint16s()
+	r.vector8() // compression methods
+
+	extensions := r.vector16()
+	for extensions.err == nil && len(extensions.data) > 0 {
+		typ := extensions.uint16()
+		data := extensions.vector16()
+		if isGREASE(typ) {
+			continue
+		}
+		h.extensions = append(h.extensions, typ)
+
+		switch typ {
+		case tlsExtServerName:
+			h.serverName = true
+			names := data.vector16()
+			for names.err == nil && len(names.data) > 0 {
+				// host_name is the only defined name type
+				if nameType, name := names.uint8(), names.vector16(); nameType == 0 && names.err == nil {
+					h.hostName = string(name.data)
+				}
+			}
+		case tlsExtSupportedGroups:
+			h.groups = data.vector16().uint16s()
+		case tlsExtPointFormats:
+			h.pointFormats = data.vector8().data
+		case tlsExtSignatureAlgs:
+			h.signatureAlgs = data.vector16().uint16s()
+		case tlsExtSupportedVers:
+			h.versions = data.vector8().uint16s()
+		case tlsExtALPN:
+			protocols := data.vector16()
+			for protocols.err == nil && len(protocols.data) > 0 {
+				h.alpn = append(h.alpn, string(protocols.vector8().data))
+			}
+		}
+	}
+
+	if r.err != nil || extensions.err != nil {
+		return nil, errNotClientHello
+	}
+
+	return h, nil
+}
+
+func joinUint16s(values []uint16, format func(uint16) string, sep string) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = format(v)
+	}
+	return strings.Join(s, sep)
+}
+
+func decimal(v uint16) string {
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+func hex4(v uint16) string {
+	return fmt.Sprintf("%04x", v)
+}
+
+// ja3 returns MD5 hash of "version,ciphers,extensions,groups,point formats".
+func (h *clientHello) ja3() string {
+	formats := make([]string, len(h.pointFormats))
+	for i, v := range h.pointFormats {
+		formats[i] = strconv.Itoa(int(v))
+	}
+
+	s := strings.Join([]string{
+		decimal(h.version),
+		joinUint16s(h.ciphers, decimal, "-"),
+		joinUint16s(h.extensions, decimal, "-"),
+		joinUint16s(h.groups, decimal, "-"),
+		strings.Join(formats, "-"),
+	}, ",")
+
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4 returns JA4 fingerprint of the ClientHello received over TCP.
+func (h *clientHello) ja4() string {
+	// supported_versions extension takes precedence over the legacy version
+	version := h.version
+	if len(h.versions) > 0 {
+		version = 0
+		for _, v := range h.versions {
+			version = max(version, v)
+		}
+	}
+
+	sni := "i"
+	if h.serverName {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		p := h.alpn[0]
+		first, last := p[0], p[len(p)-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+
+	ciphers := append([]uint16(nil), h.ciphers...)
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+
+	var extensions []uint16
+	for _, ext := range h.extensions {
+		if ext != tlsExtServerName && ext != tlsExtALPN {
+			extensions = append(extensions, ext)
+		}
+	}
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+
+	extensionsText := joinUint16s(extensions, hex4, ",")
+	if len(extensions) > 0 && len(h.signatureAlgs) > 0 {
+		extensionsText += "_" + joinUint16s(h.signatureAlgs, hex4, ",")
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(version), sni, min(len(h.ciphers), 99), min(len(h.extensions), 99), alpn,
+		ja4Hash(joinUint16s(ciphers, hex4, ",")), ja4Hash(extensionsText))
+}
+
+// tlsFingerprint is JA3 and JA4 fingerprints of the client's TLS ClientHello.
+type tlsFingerprint struct {
+	ja3 string
+	ja4 string
+}
+
+// clientHelloCapture accumulates the beginning of the client's stream until the
+// ClientHello is complete or it's clear the stream isn't TLS.
+type clientHelloCapture struct {
+	data []byte
+	done bool
+}
+
+// feed returns the fingerprint once the ClientHello is received, nil is returned
+// if more data is needed or the stream can't be fingerprinted.
+func (c *clientHelloCapture) feed(b []byte) *tlsFingerprint {
+	if c.done {
+		return nil
+	}
+
+	c.data = append(c.data, b...)
+	message, err := clientHelloMessage(c.data)
+	if err == nil && message == nil && len(c.data) < maxClientHelloSize {
+		return nil
+	}
+
+	c.done, c.data = true, nil
+	if err != nil || message == nil {
+		return nil
+	}
+
+	hello, err := parseClientHello(message)
+	if err != nil {
+		return nil
+	}
+
+	return &tlsFingerprint{ja3: hello.ja3(), ja4: hello.ja4()}
+}
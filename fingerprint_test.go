@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"regexp"
+	"testing"
+)
+
+// clientHelloBytes returns the ClientHello crypto/tls sends with the configuration.
+func clientHelloBytes(t *testing.T, conf *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, conf).Handshake()
+		client.Close()
+	}()
+
+	buf := make([]byte, maxClientHelloSize)
+	n := 0
+	for {
+		m, err := server.Read(buf[n:])
+		n += m
+		if message, _ := clientHelloMessage(buf[:n]); message != nil || err != nil {
+			break
+		}
+	}
+
+	return buf[:n]
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	data := clientHelloBytes(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+
+	capture := &clientHelloCapture{}
+	var fp *tlsFingerprint
+	for i := 0; i < len(data) && fp == nil; i += 7 {
+		fp = capture.feed(data[i:min(i+7, len(data))])
+	}
+
+	if fp == nil {
+		t.Fatal("Expected fingerprint of ClientHello")
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(fp.ja3) {
+		t.Errorf("Unexpected JA3 fingerprint %q", fp.ja3)
+	}
+	if !regexp.MustCompile(`^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(fp.ja4) {
+		t.Errorf("Unexpected JA4 fingerprint %q", fp.ja4)
+	}
+
+	data = clientHelloBytes(t, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if fp := (&clientHelloCapture{}).feed(data); fp == nil || !regexp.MustCompile(`^t12i\d{4}00_`).MatchString(fp.ja4) {
+		t.Errorf("Unexpected fingerprint %+v of TLS 1.2 ClientHello without SNI and ALPN", fp)
+	}
+
+	capture = &clientHelloCapture{}
+	if fp := capture.feed([]byte("GET / HTTP/1.1\r\n")); fp != nil || !capture.done {
+		t.Error("Expected non-TLS stream not to be fingerprinted")
+	}
+}
+
+func TestClientHelloGREASE(t *testing.T) {
+	h := &clientHello{
+		version:    0x0303,
+		ciphers:    []uint16{0x1301, 0x1302},
+		extensions: []uint16{0x0000, 0x0010, 0x000d, 0x002b},
+		versions:   []uint16{0x0304, 0x0303},
+		alpn:       []string{"http/1.1"},
+		serverName: true,
+
+		signatureAlgs: []uint16{0x0403, 0x0804},
+	}
+
+	if ja4 := h.ja4(); ja4[:10] != "t13d0204h1" {
+		t.Errorf("Unexpected JA4 fingerprint %q", ja4)
+	}
+
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("Expected %04x to be GREASE value", v)
+		}
+	}
+	if isGREASE(0x0a1a) || isGREASE(0x1301) {
+		t.Error("Unexpected GREASE value")
+	}
+}
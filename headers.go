@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// headerRewriter applies forwarded_for_header, via_header and add_headers settings
+// to client requests in a single handler. Everything which doesn't depend on the
+// request is decided once when the rewriter is created.
+type headerRewriter struct {
+	forwardedFor string
+	// hop appended to the Via header, empty if the header isn't changed
+	via       string
+	deleteVia bool
+	// canonical header names and values added unless requests have them
+	add [][2]string
+}
+
+// newHeaderRewriter returns nil if the configuration leaves requests' headers as is.
+func newHeaderRewriter(conf *Configuration) *headerRewriter {
+	r := &headerRewriter{forwardedFor: conf.ForwardedForHeader}
+
+	switch conf.ViaHeader {
+	case "on":
+		r.via = "1.1 " + conf.ViaProxyName
+	case "delete":
+		r.deleteVia = true
+	}
+
+	for _, headerData := range conf.AddHeaders {
+		if len(headerData) == 2 && len(headerData[0]) > 0 && len(headerData[1]) > 0 {
+			r.add = append(r.add, [2]string{http.CanonicalHeaderKey(headerData[0]), headerData[1]})
+		}
+	}
+
+	if (r.forwardedFor == "" || r.forwardedFor == "off") && r.via == "" && !r.deleteVia && len(r.add) == 0 {
+		return nil
+	}
+
+	return r
+}
+
+func (r *headerRewriter) rewrite(req *http.Request, ctx *goproxy.ProxyCtx) {
+	switch r.forwardedFor {
+	case "on", "truncate":
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ctx.Warnf("coudn't parse remote address %v: %v", req.RemoteAddr, err)
+			break
+		}
+		if values := req.Header.Values(proxyForwardedForHeader); r.forwardedFor == "on" && len(values) > 0 {
+			ip = strings.Join(values, ", ") + ", " + ip
+		}
+		req.Header.Set(proxyForwardedForHeader, ip)
+	case "delete":
+		req.Header.Del(proxyForwardedForHeader)
+	}
+
+	if r.via != "" {
+		via := r.via
+		if values := req.Header.Values(proxyViaHeader); len(values) > 0 {
+			via = strings.Join(values, ", ") + ", " + via
+		}
+		req.Header.Set(proxyViaHeader, via)
+	} else if r.deleteVia {
+		req.Header.Del(proxyViaHeader)
+	}
+
+	for _, header := range r.add {
+		if values := req.Header[header[0]]; len(values) == 0 || values[0] == "" {
+			req.Header[header[0]] = append(values, header[1])
+		}
+	}
+}
+
+// setRequestHeadersHandler rewrites headers of client requests according to the
+// configuration, nothing is registered if there is nothing to rewrite.
+func setRequestHeadersHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	r := newHeaderRewriter(conf)
+	if r == nil {
+		return
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			r.rewrite(req, ctx)
+			return req, nil
+		})
+}
+
+// ResponseHeaderRule removes and sets headers of upstream responses from hosts and
+// their subdomains, rules without hosts apply to all responses.
+type ResponseHeaderRule struct {
+	Hosts  []string   `toml:"hosts"`
+	Remove []string   `toml:"remove"`
+	Set    [][]string `toml:"set"`
+}
+
+type compiledResponseHeaderRule struct {
+	hosts  []string
+	remove []string
+	set    [][2]string
+}
+
+func (rule *compiledResponseHeaderRule) matches(host string) bool {
+	return len(rule.hosts) == 0 || matchesDomains(host, rule.hosts)
+}
+
+func compileResponseHeaderRules(rules []ResponseHeaderRule) []compiledResponseHeaderRule {
+	compiled := make([]compiledResponseHeaderRule, 0, len(rules))
+	for _, rule := range rules {
+		c := compiledResponseHeaderRule{}
+		for _, host := range rule.Hosts {
+			c.hosts = append(c.hosts, strings.ToLower(strings.TrimPrefix(host, ".")))
+		}
+		for _, header := range rule.Remove {
+			c.remove = append(c.remove, http.CanonicalHeaderKey(header))
+		}
+		// validated when configuration is loaded
+		for _, header := range rule.Set {
+			c.set = append(c.set, [2]string{http.CanonicalHeaderKey(header[0]), header[1]})
+		}
+		compiled = append(compiled, c)
+	}
+
+	return compiled
+}
+
+// setResponseHeadersHandler applies response_header_rules to upstream responses,
+// rules are applied in the order they are configured.
+func setResponseHeadersHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if len(conf.ResponseHeaderRules) == 0 {
+		return
+	}
+
+	rules := compileResponseHeaderRules(conf.ResponseHeaderRules)
+
+	proxy.OnResponse().DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil || ctx.Req == nil {
+				return resp
+			}
+
+			host := strings.ToLower(ctx.Req.URL.Hostname())
+			for i := range rules {
+				if !rules[i].matches(host) {
+					continue
+				}
+				for _, header := range rules[i].remove {
+					delete(resp.Header, header)
+				}
+				for _, header := range rules[i].set {
+					resp.Header.Set(header[0], header[1])
+				}
+			}
+
+			return resp
+		})
+}
+
+const (
+	defaultAnnotationUserHeader = "X-Proxy-User"
+	defaultAnnotationZoneHeader = "X-Client-Zone"
+)
+
+type clientZone struct {
+	name     string
+	networks []*net.IPNet
+}
+
+// annotator adds headers carrying the authenticated user and the client's zone to
+// requests to annotation_domains, so internal services can apply their own per-user
+// logic. The headers are removed from all other requests, so clients can't forge
+// them and they don't leak to outside destinations.
+type annotator struct {
+	domains    []string
+	userHeader string
+	zoneHeader string
+	// checked in the order of the zones' names
+	zones []clientZone
+}
+
+// newAnnotator returns nil if annotation_domains isn't set.
+func newAnnotator(conf *Configuration) *annotator {
+	if len(conf.AnnotationDomains) == 0 {
+		return nil
+	}
+
+	a := &annotator{
+		userHeader: http.CanonicalHeaderKey(conf.AnnotationUserHeader),
+		zoneHeader: http.CanonicalHeaderKey(conf.AnnotationZoneHeader),
+	}
+	for _, domain := range conf.AnnotationDomains {
+		a.domains = append(a.domains, strings.ToLower(strings.TrimPrefix(domain, ".")))
+	}
+
+	names := make([]string, 0, len(conf.ClientZones))
+	for name := range conf.ClientZones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a.zones = append(a.zones, clientZone{name: name, networks: parseNetworks(conf.ClientZones[name])})
+	}
+
+	return a
+}
+
+// zone returns the name of the first zone containing the client's address.
+func (a *annotator) zone(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+
+	addr := net.ParseIP(ip)
+	for _, zone := range a.zones {
+		if networksContain(zone.networks, addr) {
+			return zone.name
+		}
+	}
+
+	return ""
+}
+
+func (a *annotator) annotate(req *http.Request, ctx *goproxy.ProxyCtx) {
+	req.Header.Del(a.userHeader)
+	req.Header.Del(a.zoneHeader)
+
+	if !matchesDomains(strings.ToLower(req.URL.Hostname()), a.domains) {
+		return
+	}
+
+	if user := getRequestInfo(ctx).user; user != "" {
+		req.Header.Set(a.userHeader, user)
+	}
+	if zone := a.zone(req); zone != "" {
+		req.Header.Set(a.zoneHeader, zone)
+	}
+}
+
+// setAnnotationHandler annotates requests once they are authenticated, CONNECT
+// tunnels can't be annotated unless they are inspected.
+func setAnnotationHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	a := newAnnotator(conf)
+	if a == nil {
+		return
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			a.annotate(req, ctx)
+			return req, nil
+		})
+}
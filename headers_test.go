@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/elazarl/goproxy"
 )
 
 type myHandler struct {
@@ -47,7 +51,7 @@ func TestCustomHeaders(t *testing.T) {
 
 	s := `add_headers=[["X-Custom-Header-1", "Value-1"], ["X-Custom-Header-2", "Value-2"]]`
 	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
-	setAddCustomHeadersHandler(conf, proxy)
+	setRequestHeadersHandler(conf, proxy)
 
 	resp, err := client.Get(background.URL)
 	if err != nil {
@@ -85,7 +89,7 @@ func TestViaHeaders(t *testing.T) {
 
 	s := "via_header=\"on\"\nvia_proxy_name=\"octopus\"\n"
 	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
-	setViaHeaderHandler(conf, proxy)
+	setRequestHeadersHandler(conf, proxy)
 
 	resp, err := client.Get(background.URL)
 	if err != nil {
@@ -106,3 +110,371 @@ func TestViaHeaders(t *testing.T) {
 		t.Errorf("Expected '%s', actual '%s'", expectedResponse, actualResponse)
 	}
 }
+
+func TestHeaderLimits(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			for i := 0; i < 10; i++ {
+				w.Header().Add("X-Response", "value")
+			}
+		}
+		fmt.Fprint(w, "OK")
+	}))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	s := `max_header_count=5
+max_header_size=50`
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	setHeaderLimitsHandler(conf, proxy)
+
+	tests := []struct {
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"/", map[string]string{"X-Custom": "value"}, http.StatusOK},
+		{"/", map[string]string{"X-Custom": string(bytes.Repeat([]byte("a"), 50))}, http.StatusRequestHeaderFieldsTooLarge},
+		{"/", map[string]string{"X-1": "1", "X-2": "2", "X-3": "3", "X-4": "4", "X-5": "5"}, http.StatusRequestHeaderFieldsTooLarge},
+		{"/large", nil, http.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", background.URL+test.path, nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s with %v: expected status %d, got %d", test.path, test.headers, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestURLLimits(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	s := `max_url_length=100
+max_query_length=20
+max_path_depth=3`
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	setURLLimitsHandler(conf, proxy)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/a/b/c?q=1", http.StatusOK},
+		{"/a/b/c/d", http.StatusRequestURITooLong},
+		{"/?q=" + string(bytes.Repeat([]byte("a"), 20)), http.StatusRequestURITooLong},
+		{"/" + string(bytes.Repeat([]byte("a"), 100)), http.StatusRequestURITooLong},
+	}
+
+	for _, test := range tests {
+		resp, err := client.Get(background.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestAllowedSchemes(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	conf := newConfiguration(bytes.NewBuffer([]byte("")))
+	setAllowedSchemesHandler(conf, proxy)
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"ftp://ftp.example.com/file.txt", http.StatusBadRequest},
+		{"gopher://example.com/", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+	setAllowedSchemesHandler(conf, proxy)
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Expected 200 status code, got", resp.StatusCode)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "expect=%s body=%s", r.Header.Get("Expect"), body)
+	}))
+	defer background.Close()
+
+	tests := []struct {
+		policy, path string
+		interim      bool
+		status       int
+		body         string
+	}{
+		{expectContinueForward, "/reject", false, http.StatusUnauthorized, ""},
+		{expectContinueForward, "/", true, http.StatusOK, "expect=100-continue body=hello"},
+		{expectContinueLocal, "/", true, http.StatusOK, "expect= body=hello"},
+	}
+
+	for _, test := range tests {
+		_, proxy, proxyserver := oneShotProxy()
+		conf := newConfiguration(bytes.NewBuffer([]byte(`expect_continue="` + test.policy + `"`)))
+		setExpectContinueHandler(conf, proxy)
+
+		conn, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "POST %s%s HTTP/1.1\r\nHost: %s\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n",
+			background.URL, test.path, background.Listener.Addr())
+
+		// the body is sent only after "100 Continue"
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interim := resp.StatusCode == http.StatusContinue; interim != test.interim {
+			t.Errorf("%s %s: expected interim response %v, got status %d", test.policy, test.path, test.interim, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusContinue {
+			io.WriteString(conn, "hello")
+			if resp, err = http.ReadResponse(r, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		proxyserver.Close()
+
+		if resp.StatusCode != test.status || string(body) != test.body {
+			t.Errorf("%s %s: expected %d '%s', got %d '%s'", test.policy, test.path, test.status, test.body, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprintf(w, "body=%s trailer=%s", body, r.Trailer.Get("X-Request-Checksum"))
+		w.Header().Set("X-Checksum", "42")
+	}))
+	defer background.Close()
+
+	tests := []struct {
+		action, body, trailer string
+	}{
+		{trailersPass, "body=hello trailer=abc", "42"},
+		{trailersStrip, "body=hello trailer=", ""},
+	}
+
+	for _, test := range tests {
+		proxy := goproxy.NewProxyHttpServer()
+		conf := newConfiguration(bytes.NewBuffer([]byte(`trailers="` + test.action + `"`)))
+		setTrailersHandler(conf, proxy)
+		proxyserver := httptest.NewServer(withRequestInfo(proxy))
+
+		conn, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "POST %s/ HTTP/1.1\r\nHost: %s\r\nTransfer-Encoding: chunked\r\nTrailer: X-Request-Checksum\r\n\r\n"+
+			"5;ext=1\r\nhello\r\n0\r\nX-Request-Checksum: abc\r\n\r\n", background.URL, background.Listener.Addr())
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		proxyserver.Close()
+
+		if string(body) != test.body {
+			t.Errorf("%s: expected body '%s', got '%s'", test.action, test.body, body)
+		}
+		if trailer := resp.Trailer.Get("X-Checksum"); trailer != test.trailer {
+			t.Errorf("%s: expected response trailer '%s', got '%s'", test.action, test.trailer, trailer)
+		}
+	}
+}
+
+func TestResponseHeaderRules(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "id=1")
+		w.Header().Set("Server", "nginx")
+		w.Header().Set("X-Powered-By", "PHP")
+		fmt.Fprint(w, "OK")
+	}))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	s := `
+[[response_header_rules]]
+remove=["server", "X-Powered-By"]
+set=[["x-content-type-options", "nosniff"]]
+
+[[response_header_rules]]
+hosts=["127.0.0.1"]
+remove=["Set-Cookie"]
+
+[[response_header_rules]]
+hosts=["example.com"]
+set=[["X-Frame-Options", "DENY"]]
+`
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	setResponseHeadersHandler(conf, proxy)
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, header := range []string{"Set-Cookie", "Server", "X-Powered-By", "X-Frame-Options"} {
+		if value := resp.Header.Get(header); value != "" {
+			t.Errorf("Expected no %s header, got '%s'", header, value)
+		}
+	}
+	if value := resp.Header.Get("X-Content-Type-Options"); value != "nosniff" {
+		t.Errorf("Expected 'nosniff' X-Content-Type-Options header, got '%s'", value)
+	}
+}
+
+func TestHeaderRewriter(t *testing.T) {
+	tests := []struct {
+		config   string
+		headers  http.Header
+		expected http.Header
+	}{
+		{
+			"",
+			http.Header{"X-Forwarded-For": {"10.0.0.1"}, "Via": {"1.0 fred"}},
+			http.Header{"X-Forwarded-For": {"10.0.0.1, 192.0.2.1"}, "Via": {"1.0 fred, 1.1 octopus"}},
+		},
+		{
+			"forwarded_for_header=\"truncate\"\nvia_header=\"delete\"\n",
+			http.Header{"X-Forwarded-For": {"10.0.0.1"}, "Via": {"1.0 fred"}},
+			http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+		},
+		{
+			"forwarded_for_header=\"delete\"\nvia_header=\"off\"\nadd_headers=[[\"x-custom\", \"new\"], [\"X-Other\", \"new\"]]\n",
+			http.Header{"X-Forwarded-For": {"10.0.0.1"}, "Via": {"1.0 fred"}, "X-Custom": {"old"}},
+			http.Header{"Via": {"1.0 fred"}, "X-Custom": {"old"}, "X-Other": {"new"}},
+		},
+	}
+
+	for _, test := range tests {
+		conf := newConfiguration(bytes.NewBufferString("via_proxy_name=\"octopus\"\n" + test.config))
+		req := &http.Request{RemoteAddr: "192.0.2.1:1234", Header: test.headers}
+		newHeaderRewriter(conf).rewrite(req, &goproxy.ProxyCtx{})
+
+		if fmt.Sprint(req.Header) != fmt.Sprint(test.expected) {
+			t.Errorf("config %q: expected headers %v, got %v", test.config, test.expected, req.Header)
+		}
+	}
+
+	conf := newConfiguration(bytes.NewBufferString("forwarded_for_header=\"off\"\nvia_header=\"off\"\n"))
+	if newHeaderRewriter(conf) != nil {
+		t.Error("Expected no rewriter when headers aren't changed")
+	}
+}
+
+func TestAnnotator(t *testing.T) {
+	conf := newConfiguration(bytes.NewBufferString(`annotation_domains=[".corp.example", "api.example.com"]
+client_zones={vpn=["10.8.0.0/16"], office=["10.0.0.0/8"]}
+`))
+	a := newAnnotator(conf)
+
+	tests := []struct {
+		url      string
+		client   string
+		user     string
+		expected http.Header
+	}{
+		{"http://wiki.corp.example/", "10.8.1.1:1234", "alice", http.Header{"X-Proxy-User": {"alice"}, "X-Client-Zone": {"office"}}},
+		{"http://corp.example/", "10.1.1.1:1234", "", http.Header{"X-Client-Zone": {"office"}}},
+		{"http://API.example.com/", "192.0.2.1:1234", "bob", http.Header{"X-Proxy-User": {"bob"}}},
+		{"http://www.example.com/", "10.8.1.1:1234", "alice", http.Header{}},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		req.RemoteAddr = test.client
+		// forged by the client
+		req.Header.Set("X-Proxy-User", "admin")
+		req.Header.Set("X-Client-Zone", "dmz")
+
+		ctx := &goproxy.ProxyCtx{Req: req}
+		getRequestInfo(ctx).user = test.user
+		a.annotate(req, ctx)
+
+		if fmt.Sprint(req.Header) != fmt.Sprint(test.expected) {
+			t.Errorf("%v from %v: expected headers %v, got %v", test.url, test.client, test.expected, req.Header)
+		}
+	}
+
+	if newAnnotator(newConfiguration(bytes.NewBufferString(""))) != nil {
+		t.Error("Expected no annotator without annotation_domains")
+	}
+}
+
+func BenchmarkHeaderRewriter(b *testing.B) {
+	conf := newConfiguration(bytes.NewBufferString(`add_headers=[["X-Custom", "value"]]`))
+	r := newHeaderRewriter(conf)
+	ctx := &goproxy.ProxyCtx{}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := &http.Request{RemoteAddr: "192.0.2.1:1234", Header: http.Header{"Via": {"1.0 fred"}}}
+		r.rewrite(req, ctx)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUpstreamMaxFailures   = 3
+	defaultUpstreamRetryInterval = 30 * time.Second
+	healthStateFile              = "health.json"
+)
+
+var errUpstreamDown = errors.New("upstream proxy is marked down")
+
+type UpstreamHealth struct {
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	DownUntil   time.Time `json:"down_until,omitempty"`
+}
+
+// ProxyHealth keeps track of upstream proxies' failures. An upstream which failed
+// maxFailures times in a row is considered down for retryInterval, requests routed
+// to it during that time fail immediately instead of waiting for a connect timeout.
+type ProxyHealth struct {
+	mu            sync.Mutex
+	upstreams     map[string]*UpstreamHealth
+	maxFailures   int
+	retryInterval time.Duration
+}
+
+func newProxyHealth(conf *Configuration) *ProxyHealth {
+	return &ProxyHealth{
+		upstreams:     make(map[string]*UpstreamHealth),
+		maxFailures:   conf.UpstreamMaxFailures,
+		retryInterval: conf.UpstreamRetryInterval,
+	}
+}
+
+func (h *ProxyHealth) available(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, exists := h.upstreams[host]
+	if !exists {
+		return true
+	}
+
+	return time.Now().After(state.DownUntil)
+}
+
+// check returns errUpstreamDown if the upstream shouldn't be used at the moment.
+func (h *ProxyHealth) check(host string) error {
+	if h == nil || h.available(host) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", errUpstreamDown, host)
+}
+
+func (h *ProxyHealth) markFailure(host string, err error) {
+	if h == nil || errors.Is(err, errUpstreamDown) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state, exists := h.upstreams[host]
+	if !exists {
+		state = &UpstreamHealth{}
+		h.upstreams[host] = state
+	}
+
+	now := time.Now()
+	state.Failures++
+	state.LastFailure = now
+	if err != nil {
+		state.LastError = err.Error()
+	}
+	if state.Failures >= h.maxFailures {
+		state.DownUntil = now.Add(h.retryInterval)
+	}
+}
+
+func (h *ProxyHealth) markSuccess(host string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.upstreams, host)
+}
+
+func (h *ProxyHealth) snapshot() map[string]UpstreamHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make(map[string]UpstreamHealth, len(h.upstreams))
+	for host, state := range h.upstreams {
+		result[host] = *state
+	}
+
+	return result
+}
+
+func (h *ProxyHealth) saveState(dir string) error {
+	return saveState(dir, healthStateFile, h.snapshot())
+}
+
+func (h *ProxyHealth) loadState(dir string) error {
+	var saved map[string]UpstreamHealth
+	if err := loadState(dir, healthStateFile, &saved); err != nil {
+		return err
+	}
+
+	h.restore(saved)
+
+	return nil
+}
+
+// restore replaces upstreams' health with the saved one.
+func (h *ProxyHealth) restore(saved map[string]UpstreamHealth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.upstreams = make(map[string]*UpstreamHealth, len(saved))
+	for host, state := range saved {
+		s := state
+		h.upstreams[host] = &s
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProxyHealthMarkDown(t *testing.T) {
+	conf := &Configuration{UpstreamMaxFailures: 2, UpstreamRetryInterval: time.Hour}
+	health := newProxyHealth(conf)
+
+	health.markFailure("10.0.0.1:3128", errors.New("connection refused"))
+	if !health.available("10.0.0.1:3128") {
+		t.Error("upstream must be available after a single failure")
+	}
+
+	health.markFailure("10.0.0.1:3128", errors.New("connection refused"))
+	if health.available("10.0.0.1:3128") {
+		t.Error("upstream must be marked down after reaching failures limit")
+	}
+
+	if err := health.check("10.0.0.1:3128"); !errors.Is(err, errUpstreamDown) {
+		t.Errorf("Expected %v, got %v", errUpstreamDown, err)
+	}
+
+	health.markSuccess("10.0.0.1:3128")
+	if !health.available("10.0.0.1:3128") {
+		t.Error("upstream must be available after a successful request")
+	}
+}
+
+func TestProxyHealthState(t *testing.T) {
+	dir := t.TempDir()
+	conf := &Configuration{UpstreamMaxFailures: 1, UpstreamRetryInterval: time.Hour}
+
+	health := newProxyHealth(conf)
+	health.markFailure("10.0.0.1:3128", errors.New("connection refused"))
+	if err := health.saveState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newProxyHealth(conf)
+	if err := restored.loadState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.available("10.0.0.1:3128") {
+		t.Error("upstream must stay down after state was restored")
+	}
+
+	if !restored.available("10.0.0.2:3128") {
+		t.Error("unknown upstream must be available")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// healthServer answers liveness probes at /healthz and readiness probes at /readyz
+// on health_listen address, both report the same state as JSON.
+type healthServer struct {
+	conf       *Configuration
+	configPath string
+	loaded     time.Time
+	servers    *serverSet
+	router     *Router
+	health     *ProxyHealth
+}
+
+type healthResponse struct {
+	Status    string           `json:"status"`
+	Listeners map[string]bool  `json:"listeners"`
+	Config    healthConfig     `json:"config"`
+	Upstreams []upstreamStatus `json:"upstreams"`
+}
+
+// healthConfig describes the loaded configuration file, the proxy doesn't start
+// with an invalid one.
+type healthConfig struct {
+	File   string    `json:"file"`
+	Loaded time.Time `json:"loaded"`
+}
+
+type upstreamStatus struct {
+	Alias     string `json:"alias"`
+	Upstream  string `json:"upstream"`
+	Up        bool   `json:"up"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func newHealthServer(conf *Configuration, configPath string, servers *serverSet, router *Router,
+	health *ProxyHealth,
+) *healthServer {
+	return &healthServer{
+		conf:       conf,
+		configPath: configPath,
+		loaded:     time.Now(),
+		servers:    servers,
+		router:     router,
+		health:     health,
+	}
+}
+
+// check returns the proxy's state and whether it's ready to handle requests: all
+// proxy listeners accept connections and, if upstream proxies are configured, at
+// least one of them isn't marked down.
+func (h *healthServer) check() (*healthResponse, bool) {
+	resp := &healthResponse{
+		Listeners: make(map[string]bool),
+		Config:    healthConfig{File: h.configPath, Loaded: h.loaded},
+		Upstreams: []upstreamStatus{},
+	}
+	for _, addr := range h.conf.Listen {
+		resp.Listeners[addr] = h.servers.serving(addr)
+	}
+	if h.conf.ListenSOCKS != "" {
+		resp.Listeners[h.conf.ListenSOCKS] = h.servers.serving(h.conf.ListenSOCKS)
+	}
+	if h.conf.ListenTransparent != "" {
+		resp.Listeners[h.conf.ListenTransparent] = h.servers.serving(h.conf.ListenTransparent)
+	}
+
+	ready := true
+	for _, serving := range resp.Listeners {
+		ready = ready && serving
+	}
+
+	upstreams := configuredUpstreams(h.router.routing())
+	health := h.health.snapshot()
+	available := len(upstreams) == 0
+	for _, u := range upstreams {
+		status := upstreamStatus{
+			Alias:     u[0],
+			Upstream:  u[1],
+			Up:        h.health.check(u[1]) == nil,
+			Failures:  health[u[1]].Failures,
+			LastError: health[u[1]].LastError,
+		}
+		available = available || status.Up
+		resp.Upstreams = append(resp.Upstreams, status)
+	}
+	ready = ready && available
+
+	resp.Status = "ok"
+	if !ready {
+		resp.Status = "unavailable"
+	}
+
+	return resp, ready
+}
+
+func (h *healthServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	resp, ready := h.check()
+
+	switch req.URL.Path {
+	case "/healthz":
+		// the process is alive as long as it responds, failing upstreams are
+		// not fixed by restarting it
+		writeJSON(w, http.StatusOK, resp)
+	case "/readyz":
+		if ready {
+			writeJSON(w, http.StatusOK, resp)
+		} else {
+			writeJSON(w, http.StatusServiceUnavailable, resp)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(t *testing.T) {
+	conf := &Configuration{
+		Listen:                listenAddresses{"127.0.0.1:0"},
+		Proxies:               map[string]string{"parent": "http://127.0.0.1:1"},
+		UpstreamMaxFailures:   1,
+		UpstreamRetryInterval: time.Minute,
+	}
+	servers := newServerSet()
+	health := newProxyHealth(conf)
+	checks := newHealthServer(conf, "microproxy.toml", servers, newRouter(conf), health)
+
+	probe := func(path string) (int, *healthResponse) {
+		w := httptest.NewRecorder()
+		checks.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp healthResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Couldn't decode %s response: %v", path, err)
+		}
+		return w.Code, &resp
+	}
+
+	if code, _ := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 before the listener is served, got %d", code)
+	}
+
+	ln, err := servers.listen(conf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	go servers.serve(ln, conf.Listen[0], http.NotFoundHandler(), nil, nil)
+	for deadline := time.Now().Add(5 * time.Second); !servers.serving(conf.Listen[0]) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, resp := probe("/readyz")
+	if code != http.StatusOK || resp.Status != "ok" || !resp.Listeners[conf.Listen[0]] || resp.Config.File != "microproxy.toml" {
+		t.Errorf("Expected ready proxy, got %d %+v", code, resp)
+	}
+	if len(resp.Upstreams) != 1 || resp.Upstreams[0].Alias != "parent" || !resp.Upstreams[0].Up {
+		t.Errorf("Unexpected upstreams: %+v", resp.Upstreams)
+	}
+
+	health.markFailure("127.0.0.1:1", io.EOF)
+	if code, resp := probe("/readyz"); code != http.StatusServiceUnavailable || resp.Upstreams[0].LastError != "EOF" {
+		t.Errorf("Expected 503 with all upstreams down, got %d %+v", code, resp)
+	}
+	if code, _ := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected live proxy, got %d", code)
+	}
+
+	health.markSuccess("127.0.0.1:1")
+	servers.shutdown(context.Background())
+	if code, _ := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after shutdown, got %d", code)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// the CONNECT response of an HTTPS upstream proxy has to arrive within this time
+const httpsProxyConnectTimeout = 30 * time.Second
+
+// UpstreamTLS holds TLS settings of connections to an HTTPS upstream proxy.
+type UpstreamTLS struct {
+	CA                 string `toml:"ca"`
+	Cert               string `toml:"cert"`
+	Key                string `toml:"key"`
+	ServerName         string `toml:"server_name"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+}
+
+func isHTTPSProxy(proxyURL *url.URL) bool {
+	return proxyURL.Scheme == "https"
+}
+
+// httpsProxyAddr returns host:port of the proxy, upstream_tls entries are looked
+// up by it.
+func httpsProxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() == "" {
+		return net.JoinHostPort(proxyURL.Hostname(), "443")
+	}
+
+	return proxyURL.Host
+}
+
+// newHTTPSProxyTLSConfigs returns TLS configurations of upstream_tls entries by
+// their addresses, base is the configuration they are derived from and may be nil.
+func newHTTPSProxyTLSConfigs(conf *Configuration, base *tls.Config) (map[string]*tls.Config, error) {
+	configs := make(map[string]*tls.Config, len(conf.UpstreamTLS))
+	for addr, settings := range conf.UpstreamTLS {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("'upstream_tls' entry '%s' isn't host:port", addr)
+		}
+
+		c := &tls.Config{}
+		if base != nil {
+			c = base.Clone()
+		}
+		c.ServerName = settings.ServerName
+		c.InsecureSkipVerify = c.InsecureSkipVerify || settings.InsecureSkipVerify
+
+		if settings.CA != "" {
+			data, err := os.ReadFile(settings.CA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %v", settings.CA)
+			}
+			c.RootCAs = pool
+		}
+
+		if (settings.Cert == "") != (settings.Key == "") {
+			return nil, fmt.Errorf("both 'cert' and 'key' of upstream_tls entry '%s' have to be set", addr)
+		}
+		if settings.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(settings.Cert, settings.Key)
+			if err != nil {
+				return nil, err
+			}
+			c.Certificates = []tls.Certificate{cert}
+		}
+
+		configs[addr] = c
+	}
+
+	return configs, nil
+}
+
+// httpsProxies connects to HTTPS upstream proxies with their upstream_tls settings,
+// or with the TLS configuration of origins if there are none. Plain HTTP requests
+// are sent by transports which talk to the proxy as to a plain HTTP one over
+// connections they get already encrypted, so the proxy's TLS settings don't
+// apply to origins of requests tunneled through it and vice versa.
+type httpsProxies struct {
+	proxy   *goproxy.ProxyHttpServer
+	configs map[string]*tls.Config
+
+	mu         sync.Mutex
+	transports map[httpsProxyTransportKey]*http.Transport
+}
+
+type httpsProxyTransportKey struct {
+	base     *http.Transport
+	proxyURL string
+}
+
+func newHTTPSProxies(conf *Configuration, proxy *goproxy.ProxyHttpServer) *httpsProxies {
+	configs, err := newHTTPSProxyTLSConfigs(conf, proxy.Tr.TLSClientConfig)
+	if err != nil {
+		proxy.Logger.Printf("couldn't load upstream TLS settings: %v\n", err)
+		os.Exit(1)
+	}
+
+	return &httpsProxies{proxy: proxy, configs: configs, transports: make(map[httpsProxyTransportKey]*http.Transport)}
+}
+
+// tlsConfig returns the configuration of connections to the proxy at addr.
+func (p *httpsProxies) tlsConfig(addr string) *tls.Config {
+	c, exists := p.configs[addr]
+	if !exists {
+		c = p.proxy.Tr.TLSClientConfig
+	}
+	if c == nil {
+		c = &tls.Config{}
+	}
+
+	c = c.Clone()
+	if c.ServerName == "" {
+		c.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	return c
+}
+
+// dial connects to the proxy with dial, or with the transport's dialer if it's
+// nil, and completes the TLS handshake.
+func (p *httpsProxies) dial(ctx context.Context, dial dialContextFunc, proxyURL *url.URL) (net.Conn, error) {
+	addr := httpsProxyAddr(proxyURL)
+
+	var conn net.Conn
+	var err error
+	if dial != nil {
+		conn, err = dial(ctx, "tcp", addr)
+	} else {
+		conn, err = dialDirect(ctx, p.proxy, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout := p.proxy.Tr.TLSHandshakeTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(conn, p.tlsConfig(addr))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTPS proxy %s: %w", proxyURL.Host, err)
+	}
+
+	return tlsConn, nil
+}
+
+// dialConnect connects to addr through a CONNECT tunnel of the proxy.
+func (p *httpsProxies) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := p.dial(ctx, nil, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil && user.Username() != "" {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set(ProxyAuthorizatonHeader, "Basic "+credentials)
+	}
+
+	conn.SetDeadline(time.Now().Add(httpsProxyConnectTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTPS proxy %s: %w", proxyURL.Host, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTPS proxy %s: %w", proxyURL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTPS proxy %s refused connection: %s", proxyURL.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the destination may have spoken first, i.e. SMTP or SSH servers
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn returns data read ahead of the CONNECT response before reading from
+// the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// transport returns a clone of base sending plain HTTP requests through the proxy.
+// The route is still chosen by base's Proxy function, so the upstream and rule of
+// requests are recorded and unavailable upstreams aren't used.
+func (p *httpsProxies) transport(base *http.Transport, proxyURL *url.URL) *http.Transport {
+	key := httpsProxyTransportKey{base: base, proxyURL: proxyURL.String()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if tr, exists := p.transports[key]; exists {
+		return tr
+	}
+
+	plain := &url.URL{Scheme: "http", Host: httpsProxyAddr(proxyURL), User: proxyURL.User}
+	tr := base.Clone()
+	tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		if base.Proxy != nil {
+			if _, err := base.Proxy(req); err != nil {
+				return nil, err
+			}
+		}
+		return plain, nil
+	}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dial(ctx, base.DialContext, proxyURL)
+	}
+	p.transports[key] = tr
+
+	return tr
+}
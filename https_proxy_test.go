@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func startHTTPSProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(ProxyAuthorizatonHeader) != "Basic dXNlcjpzZWNyZXQ=" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if req.Method != http.MethodConnect {
+			io.WriteString(w, req.URL.String())
+			return
+		}
+
+		dst, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(dst, conn)
+			dst.Close()
+		}()
+		io.Copy(conn, dst)
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	echo := startEchoServer(t)
+	srv := startHTTPSProxy(t)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(ca, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyURL, _ := url.Parse("https://user:secret@" + srv.Listener.Addr().String())
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.Proxy = nil
+	proxy.Tr.TLSClientConfig = newUpstreamTLSConfig(&Configuration{}, false)
+	https := newHTTPSProxies(&Configuration{
+		UpstreamTLS: map[string]UpstreamTLS{srv.Listener.Addr().String(): {CA: ca}},
+	}, proxy)
+
+	conn, err := https.dialConnect(context.Background(), proxyURL, echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected echoed message, got %q (%v)", buf, err)
+	}
+	conn.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/path", nil)
+	resp, err := https.transport(proxy.Tr, proxyURL).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "http://www.example.com/path" {
+		t.Errorf("Expected request to be sent through the proxy, got %v %q", resp.StatusCode, body)
+	}
+	if https.transport(proxy.Tr, proxyURL) != https.transport(proxy.Tr, proxyURL) {
+		t.Error("Expected transports to be reused")
+	}
+
+	// without upstream_tls entry the proxy's certificate isn't trusted
+	https = newHTTPSProxies(&Configuration{}, proxy)
+	if _, err := https.dialConnect(context.Background(), proxyURL, echo.Addr().String()); err == nil {
+		t.Error("Expected the proxy's certificate to be rejected")
+	}
+
+	// wrong credentials
+	proxyURL.User = url.UserPassword("user", "wrong")
+	https = newHTTPSProxies(&Configuration{
+		UpstreamTLS: map[string]UpstreamTLS{srv.Listener.Addr().String(): {InsecureSkipVerify: true}},
+	}, proxy)
+	if _, err := https.dialConnect(context.Background(), proxyURL, echo.Addr().String()); err == nil {
+		t.Error("Expected CONNECT with wrong credentials to fail")
+	}
+}
+
+func TestHTTPSProxyTLSConfigs(t *testing.T) {
+	tests := []struct {
+		settings map[string]UpstreamTLS
+		valid    bool
+	}{
+		{map[string]UpstreamTLS{"proxy.example.com:443": {ServerName: "proxy"}}, true},
+		{map[string]UpstreamTLS{"proxy.example.com": {}}, false},
+		{map[string]UpstreamTLS{"proxy.example.com:443": {Cert: "client.pem"}}, false},
+		{map[string]UpstreamTLS{"proxy.example.com:443": {CA: "/nonexistent/ca.pem"}}, false},
+	}
+
+	for _, test := range tests {
+		_, err := newHTTPSProxyTLSConfigs(&Configuration{UpstreamTLS: test.settings}, nil)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: expected valid=%v, got %v", test.settings, test.valid, err)
+		}
+	}
+
+	if addr := httpsProxyAddr(&url.URL{Scheme: "https", Host: "proxy.example.com"}); addr != "proxy.example.com:443" {
+		t.Errorf("Expected default port 443, got %v", addr)
+	}
+}
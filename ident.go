@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// identPort is the port of clients' ident services, changed only by tests.
+var identPort = "113"
+
+const (
+	defaultIdentTimeout  = time.Second
+	defaultIdentCacheTTL = time.Minute
+	// RFC 1413 limits user IDs to 512 octets
+	identMaxResponse = 1024
+)
+
+type identResult struct {
+	user    string
+	expires time.Time
+}
+
+// identResolver looks up users of clients' connections with RFC 1413 ident
+// protocol. Results, including failures, are cached per connection for the
+// configured time, so requests sent over a kept alive connection are looked up once.
+type identResolver struct {
+	networks []*net.IPNet
+	timeout  time.Duration
+	ttl      time.Duration
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	cache map[string]identResult
+}
+
+func newIdentResolver(conf *Configuration) *identResolver {
+	return &identResolver{
+		networks: parseNetworks(conf.IdentNetworks),
+		timeout:  conf.IdentTimeout,
+		ttl:      conf.IdentCacheTTL,
+		dial:     (&net.Dialer{}).DialContext,
+		cache:    make(map[string]identResult),
+	}
+}
+
+// parseIdentResponse returns the user of "port, port : USERID : OS : user" response,
+// ERROR responses and users which can't be written to the access log as a single
+// field are ignored.
+func parseIdentResponse(line string) string {
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(parts) != 4 || strings.TrimSpace(parts[1]) != "USERID" {
+		return ""
+	}
+
+	user := strings.TrimSpace(parts[3])
+	for _, r := range user {
+		if r <= ' ' || r == 0x7f {
+			return ""
+		}
+	}
+
+	return user
+}
+
+// lookup returns the user of the request's connection or empty string if it's
+// unknown. Only clients in ident_networks are queried.
+func (r *identResolver) lookup(req *http.Request) string {
+	clientIP, clientPort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || !networksContain(r.networks, net.ParseIP(clientIP)) {
+		return ""
+	}
+
+	local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, serverPort, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return ""
+	}
+
+	key := req.RemoteAddr + "," + serverPort
+	now := time.Now()
+
+	r.mu.Lock()
+	result, cached := r.cache[key]
+	r.mu.Unlock()
+
+	if cached && now.Before(result.expires) {
+		return result.user
+	}
+
+	user := r.query(clientIP, clientPort, serverPort)
+
+	r.mu.Lock()
+	r.cache[key] = identResult{user: user, expires: now.Add(r.ttl)}
+	// drop expired entries, so the cache doesn't grow forever
+	if len(r.cache) > 10000 {
+		for k, result := range r.cache {
+			if now.After(result.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	return user
+}
+
+// query asks the client's ident service, failures are treated as unknown user.
+func (r *identResolver) query(clientIP, clientPort, serverPort string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	conn, err := r.dial(ctx, "tcp", net.JoinHostPort(clientIP, identPort))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := fmt.Fprintf(conn, "%s, %s\r\n", clientPort, serverPort); err != nil {
+		return ""
+	}
+
+	line, err := bufio.NewReader(io.LimitReader(conn, identMaxResponse)).ReadString('\n')
+	if err != nil {
+		return ""
+	}
+
+	return parseIdentResponse(line)
+}
+
+// setIdentHandler looks up users of unauthenticated requests from ident_networks,
+// they are written to the access log only and aren't used for user_rules or any
+// other policies, as ident responses are controlled by the clients. CONNECT requests
+// are logged by the handler accepting them, so it has to be registered before
+// setAuthenticationHandler and after the handlers taking the user from elsewhere.
+func setIdentHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	// with proxy authentication every request which isn't rejected has its user
+	if len(conf.IdentNetworks) == 0 || conf.authEnabled() {
+		return
+	}
+
+	r := newIdentResolver(conf)
+	lookup := func(req *http.Request, ctx *goproxy.ProxyCtx) {
+		if info := getRequestInfo(ctx); info.user == "" {
+			info.ident = r.lookup(req)
+		}
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if ctx.Req != nil {
+				lookup(ctx.Req, ctx)
+			}
+			return nil, host
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			lookup(req, ctx)
+			return req, nil
+		})
+}
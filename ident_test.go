@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIdentResponse(t *testing.T) {
+	tests := []struct {
+		line, user string
+	}{
+		{"6193, 3128 : USERID : UNIX : alice\r\n", "alice"},
+		{"6193,3128:USERID:WIN32,UTF-8:bob\r\n", "bob"},
+		{"6193, 3128 : USERID : UNIX : user:with:colons\r\n", "user:with:colons"},
+		{"6193, 3128 : ERROR : NO-USER\r\n", ""},
+		{"6193, 3128 : USERID : UNIX : two words\r\n", ""},
+		{"garbage\r\n", ""},
+	}
+
+	for _, test := range tests {
+		if user := parseIdentResponse(test.line); user != test.user {
+			t.Errorf("%q: expected user %q, got %q", test.line, test.user, user)
+		}
+	}
+}
+
+func TestIdentLookup(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	queries := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			query, _ := bufio.NewReader(conn).ReadString('\n')
+			queries <- query
+			io.WriteString(conn, "51234, 3128 : USERID : UNIX : alice\r\n")
+			conn.Close()
+		}
+	}()
+
+	conf := &Configuration{IdentNetworks: []string{"10.0.0.0/8"}, IdentTimeout: time.Second, IdentCacheTTL: time.Minute}
+	r := newIdentResolver(conf)
+	r.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr != "10.0.0.1:113" {
+			t.Errorf("Unexpected ident service address %v", addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, ln.Addr().String())
+	}
+
+	newRequest := func(client string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		req.RemoteAddr = client
+		local := &net.TCPAddr{IP: net.ParseIP("10.0.0.254"), Port: 3128}
+		return req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	}
+
+	for i := 0; i < 2; i++ {
+		if user := r.lookup(newRequest("10.0.0.1:51234")); user != "alice" {
+			t.Fatalf("Expected user alice, got %q", user)
+		}
+	}
+	if user := r.lookup(newRequest("192.168.0.1:51234")); user != "" {
+		t.Errorf("Expected no lookup outside of ident_networks, got %q", user)
+	}
+
+	if query := <-queries; query != "51234, 3128\r\n" {
+		t.Errorf("Unexpected ident query %q", query)
+	}
+	if len(queries) != 0 {
+		t.Error("Expected the connection's user to be cached")
+	}
+}
+
+func TestIdentConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			io.WriteString(conn, "51234, 3128 : USERID : UNIX : alice\r\n")
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	defer func(saved string) { identPort = saved }(identPort)
+	identPort = port
+
+	echo := startEchoServer(t)
+	addr := echo.Addr().String()
+	_, echoPort, _ := net.SplitHostPort(addr)
+
+	conf := newConfiguration(strings.NewReader("allowed_connect_ports = [" + echoPort + "]\nident_networks = [\"127.0.0.0/8\"]\n"))
+	conf.AccessLog = filepath.Join(t.TempDir(), "access.log")
+	proxy := createProxy(conf)
+	setProxyHandlers(conf, proxy, newProxyLogger(conf), newRouter(conf), newProxyHealth(conf), newTunnelRegistry(), nil, nil, nil)
+	srv := httptest.NewServer(withRequestInfo(proxy))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected tunnel to be established, got", resp.StatusCode)
+	}
+
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err = os.ReadFile(conf.AccessLog); err == nil && len(data) > 0 {
+			break
+		}
+	}
+	if !strings.Contains(string(data), " CONNECT //"+addr+" - - alice ") {
+		t.Errorf("Expected ident user in the access log, got %q", data)
+	}
+}
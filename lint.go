@@ -0,0 +1,261 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// runLint implements "microproxy lint" subcommand which reports suspicious but
+// otherwise valid configuration settings.
+func runLint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	configFile := flags.String("config", "microproxy.toml", "proxy configuration file")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	conf := newConfigurationFromFile(*configFile)
+
+	warnings := lintConfiguration(conf)
+	for _, w := range warnings {
+		fmt.Printf("WARN: %s\n", w)
+	}
+
+	if len(warnings) > 0 {
+		return 1
+	}
+
+	fmt.Println("No issues found.")
+
+	return 0
+}
+
+func lintConfiguration(conf *Configuration) []string {
+	var warnings []string
+
+	warnings = append(warnings, lintRules(conf)...)
+	warnings = append(warnings, lintNetworks("allowed_networks", conf.AllowedNetworks)...)
+	warnings = append(warnings, lintNetworks("disallowed_networks", conf.DisallowedNetworks)...)
+	warnings = append(warnings, lintNetworks("allowed_destination_networks", conf.AllowedDestinationNetworks)...)
+	warnings = append(warnings, lintNetworks("disallowed_destination_networks", conf.DisallowedDestinationNetworks)...)
+	warnings = append(warnings, lintNetworks("metadata_allowed_networks", conf.MetadataAllowedNetworks)...)
+
+	allowed := parseNetworks(conf.AllowedNetworks)
+	for _, denied := range parseNetworks(conf.DisallowedNetworks) {
+		for _, network := range allowed {
+			if network.Contains(denied.IP) || denied.Contains(network.IP) {
+				warnings = append(warnings, fmt.Sprintf(
+					"disallowed network %v overlaps allowed network %v, denial takes precedence", denied, network))
+			}
+		}
+	}
+
+	warnings = append(warnings, lintSecurity(conf)...)
+
+	names := make([]string, 0, len(conf.Tenants))
+	for name := range conf.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, w := range lintConfiguration(conf.Tenants[name]) {
+			warnings = append(warnings, fmt.Sprintf("tenant '%s': %s", name, w))
+		}
+	}
+
+	return warnings
+}
+
+func lintRules(conf *Configuration) []string {
+	var warnings []string
+
+	domains := make([]string, 0, len(conf.Rules))
+	for domain := range conf.Rules {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	used := make(map[string]bool)
+	for _, domain := range domains {
+		alias := conf.Rules[domain]
+
+		if pattern, ok := strings.CutPrefix(domain, ruleExclusionPrefix); ok {
+			if !hasRuleWithValue(conf.Rules, alias) {
+				warnings = append(warnings, fmt.Sprintf(
+					"exclusion '%s' has no effect, no rule routes to '%s'", domain, alias))
+			} else if pattern == "" || pattern == "." {
+				warnings = append(warnings, fmt.Sprintf(
+					"exclusion '%s' matches every host, rules routing to '%s' are never used", domain, alias))
+			}
+			continue
+		}
+
+		used[alias] = true
+
+		if !conf.knownProxy(alias) {
+			warnings = append(warnings, fmt.Sprintf("rule '%s' refers to unknown proxy '%s' and is never used", domain, alias))
+			continue
+		}
+
+		if domain == "." {
+			if conf.ForwardProxyURL != "" {
+				warnings = append(warnings, "rule '.' is shadowed by forward_proxy_url and is never used")
+			}
+			continue
+		}
+
+		// network rules match destination addresses, not host names
+		if parseNetwork(domain) != nil {
+			continue
+		}
+
+		if !strings.HasPrefix(domain, ".") {
+			warnings = append(warnings, fmt.Sprintf(
+				"rule '%s' also matches hosts which merely end with it, e.g. 'x%s'", domain, domain))
+		}
+
+		// the closest shorter rule covering this one routes to the same proxy
+		if parent := closestCoveringRule(domain, domains); parent != "" && conf.Rules[parent] == alias {
+			warnings = append(warnings, fmt.Sprintf(
+				"rule '%s' is redundant, rule '%s' already routes it to '%s'", domain, parent, alias))
+		}
+	}
+
+	identities := make([]string, 0, len(conf.UserRules))
+	for identity := range conf.UserRules {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+
+	for _, identity := range identities {
+		for domain, alias := range conf.UserRules[identity] {
+			used[alias] = true
+			if !conf.knownProxy(alias) {
+				warnings = append(warnings, fmt.Sprintf(
+					"rule '%s:%s' refers to unknown proxy '%s' and is never used", identity, domain, alias))
+			}
+		}
+	}
+
+	aliases := make([]string, 0, len(conf.Proxies)+len(conf.SRVProxies))
+	for alias := range conf.Proxies {
+		aliases = append(aliases, alias)
+	}
+	for alias := range conf.SRVProxies {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	for _, alias := range aliases {
+		if !used[alias] {
+			warnings = append(warnings, fmt.Sprintf("proxy '%s' isn't used by any rule", alias))
+		}
+	}
+
+	return warnings
+}
+
+// knownProxy reports whether the rule's value refers to a configured proxy, pool
+// of discovered proxies or is a special one.
+func (conf *Configuration) knownProxy(alias string) bool {
+	_, exists := conf.Proxies[alias]
+	_, pool := conf.SRVProxies[alias]
+
+	return exists || pool || alias == ruleDirect || alias == ruleDeny
+}
+
+func hasRuleWithValue(rules map[string]string, value string) bool {
+	for domain, v := range rules {
+		if v == value && !strings.HasPrefix(domain, ruleExclusionPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func closestCoveringRule(domain string, domains []string) string {
+	closest := ""
+	for _, other := range domains {
+		if other != domain && other != "." && parseNetwork(other) == nil &&
+			!strings.HasPrefix(other, ruleExclusionPrefix) && strings.HasSuffix(domain, other) && len(other) > len(closest) {
+			closest = other
+		}
+	}
+
+	return closest
+}
+
+func lintNetworks(option string, networks []string) []string {
+	var warnings []string
+
+	cidrs := parseNetworks(networks)
+	for i, a := range cidrs {
+		for _, b := range cidrs[i+1:] {
+			if a.Contains(b.IP) || b.Contains(a.IP) {
+				warnings = append(warnings, fmt.Sprintf("%s: networks %v and %v overlap", option, a, b))
+			}
+		}
+	}
+
+	return warnings
+}
+
+func lintSecurity(conf *Configuration) []string {
+	var warnings []string
+
+	if conf.InsecureSkipVerify {
+		warnings = append(warnings, "insecure_skip_verify disables TLS certificates verification for all upstream connections")
+	}
+
+	if !conf.MetadataProtection && len(conf.MetadataAllowedNetworks) > 0 {
+		warnings = append(warnings, "metadata_allowed_networks has no effect without metadata_protection")
+	}
+
+	upstreams := map[string]string{"forward_proxy_url": conf.ForwardProxyURL}
+	for alias, proxyURL := range conf.Proxies {
+		upstreams["proxy '"+alias+"'"] = proxyURL
+	}
+
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		u, err := url.Parse(upstreams[name])
+		if err != nil || u.User == nil {
+			continue
+		}
+		if u.Scheme == "http" || u.Scheme == "socks5" {
+			warnings = append(warnings, fmt.Sprintf("%s sends credentials to the upstream proxy in plaintext", name))
+		}
+		if _, hasPassword := u.User.Password(); hasPassword {
+			warnings = append(warnings, fmt.Sprintf("%s has a password stored in the configuration file", name))
+		}
+	}
+
+	if !conf.authEnabled() {
+		for _, network := range parseNetworks(conf.AllowedNetworks) {
+			if ones, _ := network.Mask.Size(); ones == 0 {
+				warnings = append(warnings, fmt.Sprintf("proxy without authentication is open to everyone (%v)", network))
+			}
+		}
+	}
+
+	if conf.StatsListen != "" {
+		host, _, err := net.SplitHostPort(conf.StatsListen)
+		if ip := net.ParseIP(host); err == nil && (ip == nil || !ip.IsLoopback()) {
+			warnings = append(warnings, "stats dashboard without authentication listens on a non-loopback address")
+		}
+	}
+
+	return warnings
+}
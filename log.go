@@ -1,11 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -16,6 +24,10 @@ const (
 	ReopenLog int = iota
 )
 
+// Value of access_log_format setting, other formats are shared with
+// activity_log_format.
+const logFormatSquid = "squid"
+
 var (
 	emptyResp = &http.Response{}
 	emptyReq  = &http.Request{}
@@ -28,12 +40,54 @@ type LogData struct {
 	user   string
 	err    error
 	time   time.Time
+	tunnel *tunnelStats
+	timing requestTiming
+	// upstream proxy alias, DIRECT or proxy URL the request was sent to
+	upstream string
+	// destination's autonomous system, empty if asn_database isn't set
+	asn string
+	// TLS connection to the origin, set only if log_tls_metadata is enabled
+	tls *tls.ConnectionState
+	// status to log instead of the response's one, i.e. if the response was aborted
+	status int
+	// the request's span exported by tracer
+	trace *traceContext
+	// configuration rule which allowed, denied or routed the request
+	rule string
+}
+
+// tunnelStats is logged when a CONNECT tunnel or WebSocket connection is closed
+type tunnelStats struct {
+	sent      int64
+	received  int64
+	websocket bool
+	// client's TLS fingerprint, nil if it isn't captured
+	fingerprint *tlsFingerprint
+}
+
+// requestTiming holds durations measured from the moment the request was received
+// (except connect), negative values are written as "-".
+type requestTiming struct {
+	// total time spent on the request
+	duration time.Duration
+	// time spent on getting a connection to the upstream server or proxy
+	connect time.Duration
+	// time to the first byte received from the upstream server or proxy
+	firstByte time.Duration
 }
 
 type ProxyLogger struct {
-	path         string
-	logChannel   chan *LogData
-	errorChannel chan error
+	path       string
+	timeFormat *timeFormatter
+	logTLS     bool
+	// logFingerprints enables JA3/JA4 fingerprints of clients' TLS in tunnels
+	logFingerprints bool
+	logChannel      chan *LogData
+	errorChannel    chan error
+	// exports spans of the entries, nil unless tracing_endpoint is set
+	tracer *tracer
+	// counts the entries for the dashboard, nil unless stats_listen is set
+	stats *proxyStats
 }
 
 func fprintf(nr *int64, err *error, w io.Writer, pat string, a ...interface{}) {
@@ -46,56 +100,352 @@ func fprintf(nr *int64, err *error, w io.Writer, pat string, a ...interface{}) {
 }
 
 func getAuthenticatedUserName(ctx *goproxy.ProxyCtx) string {
-	user, ok := ctx.UserData.(string)
-	if !ok {
-		user = "-"
+	return getRequestInfo(ctx).logUser()
+}
+
+// logUser returns the authenticated user, the user reported by ident or "-".
+func (info *requestInfo) logUser() string {
+	switch {
+	case info.user != "":
+		return info.user
+	case info.ident != "":
+		return info.ident
+	}
+
+	return "-"
+}
+
+func formatSeconds(d time.Duration) string {
+	if d < 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func formatUpstream(upstream string) string {
+	if upstream == "" {
+		return "-"
+	}
+
+	return upstream
+}
+
+func (m *LogData) statusCode() int {
+	if m.status != 0 {
+		return m.status
+	}
+
+	return m.resp.StatusCode
+}
+
+// asnField returns " asn=N" field if the destination's autonomous system is looked up.
+func (m *LogData) asnField() string {
+	if m.asn == "" {
+		return ""
+	}
+
+	return " asn=" + m.asn
+}
+
+// ruleField returns " rule=name" field if the request was allowed, denied or
+// routed by a configuration rule.
+func (m *LogData) ruleField() string {
+	if m.rule == "" {
+		return ""
+	}
+
+	return " rule=" + m.rule
+}
+
+// event returns the status written in place of the response's one.
+func (t *tunnelStats) event() string {
+	if t.websocket {
+		return "websocket"
+	}
+
+	return "closed"
+}
+
+// fingerprintField returns " ja3=hash ja4=fingerprint" fields if the tunnel's client
+// TLS fingerprint is captured.
+func (t *tunnelStats) fingerprintField() string {
+	if t.fingerprint == nil {
+		return ""
+	}
+
+	return " ja3=" + t.fingerprint.ja3 + " ja4=" + t.fingerprint.ja4
+}
+
+// tlsInfo returns TLS version, cipher suite, negotiated application protocol and
+// the origin's certificate subject of the connection to the origin.
+func (m *LogData) tlsInfo() (version, cipher, alpn, subject string) {
+	alpn = m.tls.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "http/1.1"
 	}
 
-	return user
+	subject = "-"
+	if len(m.tls.PeerCertificates) > 0 {
+		subject = m.tls.PeerCertificates[0].Subject.String()
+	}
+
+	return strings.ReplaceAll(tls.VersionName(m.tls.Version), " ", ""), tls.CipherSuiteName(m.tls.CipherSuite),
+		alpn, subject
+}
+
+// tlsField returns TLS fields if the proxy connected to the origin over TLS.
+func (m *LogData) tlsField() string {
+	if m.tls == nil {
+		return ""
+	}
+
+	version, cipher, alpn, subject := m.tlsInfo()
+
+	return fmt.Sprintf(" tls=%s cipher=%s alpn=%s cert=%q", version, cipher, alpn, subject)
 }
 
-func (m *LogData) writeTo(w io.Writer) (nr int64, err error) {
-	if m.resp != nil {
+func (t *requestTiming) String() string {
+	return fmt.Sprintf("duration=%s connect=%s ttfb=%s",
+		formatSeconds(t.duration), formatSeconds(t.connect), formatSeconds(t.firstByte))
+}
+
+func (m *LogData) writeTo(w io.Writer, tf *timeFormatter) (nr int64, err error) {
+	if m.tunnel != nil {
+		fprintf(&nr, &err, w,
+			"%v %v %v %v %v %v %v sent=%v received=%v upstream=%v%v%v%v %v\n",
+			tf.format(m.time),
+			m.req.RemoteAddr,
+			m.req.Method,
+			m.req.URL,
+			m.tunnel.event(),
+			"-",
+			m.user,
+			m.tunnel.sent,
+			m.tunnel.received,
+			formatUpstream(m.upstream),
+			m.asnField(),
+			m.ruleField(),
+			m.tunnel.fingerprintField(),
+			&m.timing)
+	} else if m.resp != nil {
 		if m.resp.Request != nil {
 			fprintf(&nr, &err, w,
-				"%v %v %v %v %v %v %v\n",
-				m.time.Format(time.RFC3339),
+				"%v %v %v %v %v %v %v upstream=%v%v%v%v %v\n",
+				tf.format(m.time),
 				m.resp.Request.RemoteAddr,
 				m.resp.Request.Method,
 				m.resp.Request.URL,
-				m.resp.StatusCode,
+				m.statusCode(),
 				m.resp.ContentLength,
-				m.user)
+				m.user,
+				formatUpstream(m.upstream),
+				m.asnField(),
+				m.ruleField(),
+				m.tlsField(),
+				&m.timing)
 		} else {
 			fprintf(&nr, &err, w,
-				"%v %v %v %v %v %v %v\n",
-				m.time.Format(time.RFC3339),
+				"%v %v %v %v %v %v %v upstream=%v%v%v %v\n",
+				tf.format(m.time),
 				"-",
 				"-",
 				"-",
-				m.resp.StatusCode,
+				m.statusCode(),
 				m.resp.ContentLength,
-				m.user)
+				m.user,
+				formatUpstream(m.upstream),
+				m.asnField(),
+				m.ruleField(),
+				&m.timing)
 		}
 	} else if m.req != nil {
 		fprintf(&nr, &err, w,
-			"%v %v %v %v %v %v %v\n",
-			m.time.Format(time.RFC3339),
+			"%v %v %v %v %v %v %v upstream=%v%v%v %v\n",
+			tf.format(m.time),
 			m.req.RemoteAddr,
 			m.req.Method,
 			m.req.URL,
 			"-",
 			"-",
-			m.user)
+			m.user,
+			formatUpstream(m.upstream),
+			m.asnField(),
+			m.ruleField(),
+			&m.timing)
 	}
 
 	return
 }
 
+// accessLogRecord is an access log entry in JSON format, fields have the same meaning
+// as in the plain format, unknown values are omitted.
+type accessLogRecord struct {
+	Time   string `json:"time"`
+	Client string `json:"client,omitempty"`
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Status int    `json:"status,omitempty"`
+	// "closed" for entries written when CONNECT tunnels are closed, "websocket"
+	// when WebSocket connections are closed
+	Event    string   `json:"event,omitempty"`
+	Size     *int64   `json:"size,omitempty"`
+	User     string   `json:"user"`
+	Sent     *int64   `json:"sent,omitempty"`
+	Received *int64   `json:"received,omitempty"`
+	Upstream string   `json:"upstream"`
+	ASN      string   `json:"asn,omitempty"`
+	Rule     string   `json:"rule,omitempty"`
+	TLS      string   `json:"tls,omitempty"`
+	Cipher   string   `json:"cipher,omitempty"`
+	ALPN     string   `json:"alpn,omitempty"`
+	Cert     string   `json:"cert,omitempty"`
+	JA3      string   `json:"ja3,omitempty"`
+	JA4      string   `json:"ja4,omitempty"`
+	Duration *float64 `json:"duration,omitempty"`
+	Connect  *float64 `json:"connect,omitempty"`
+	TTFB     *float64 `json:"ttfb,omitempty"`
+}
+
+func seconds(d time.Duration) *float64 {
+	if d < 0 {
+		return nil
+	}
+
+	s := math.Round(d.Seconds()*1000) / 1000
+	return &s
+}
+
+func (m *LogData) record(tf *timeFormatter) *accessLogRecord {
+	r := &accessLogRecord{
+		Time:     tf.format(m.time),
+		User:     m.user,
+		Upstream: formatUpstream(m.upstream),
+		ASN:      m.asn,
+		Rule:     m.rule,
+		Duration: seconds(m.timing.duration),
+		Connect:  seconds(m.timing.connect),
+		TTFB:     seconds(m.timing.firstByte),
+	}
+
+	req := m.req
+	switch {
+	case m.tunnel != nil:
+		r.Event = m.tunnel.event()
+		r.Sent, r.Received = &m.tunnel.sent, &m.tunnel.received
+		if m.tunnel.fingerprint != nil {
+			r.JA3, r.JA4 = m.tunnel.fingerprint.ja3, m.tunnel.fingerprint.ja4
+		}
+	case m.resp != nil:
+		req = m.resp.Request
+		r.Status, r.Size = m.statusCode(), &m.resp.ContentLength
+		if m.tls != nil && req != nil {
+			r.TLS, r.Cipher, r.ALPN, r.Cert = m.tlsInfo()
+		}
+	}
+
+	if req != nil {
+		r.Client, r.Method = req.RemoteAddr, req.Method
+		if req.URL != nil {
+			r.URL, r.Host = req.URL.String(), req.URL.Hostname()
+		}
+	}
+
+	return r
+}
+
+// writeJSONTo writes the entry as a single line JSON object.
+func (m *LogData) writeJSONTo(w io.Writer, tf *timeFormatter) (int64, error) {
+	b, err := json.Marshal(m.record(tf))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// writeSquidTo writes the entry in Squid's native access.log format: time, elapsed
+// milliseconds, client address, result code/status, size, method, URL, user,
+// hierarchy code/peer and content type. Squid tools expect unix timestamps, so
+// log_time_format doesn't apply. CONNECT requests are written once their tunnels
+// are closed.
+func (m *LogData) writeSquidTo(w io.Writer, tf *timeFormatter) (nr int64, err error) {
+	req := m.req
+	result, status, size, contentType := "TCP_MISS", "-", int64(0), "-"
+
+	switch {
+	case m.tunnel != nil:
+		result, status, size = "TCP_TUNNEL", strconv.Itoa(http.StatusOK), m.tunnel.received
+		if m.tunnel.websocket {
+			status = strconv.Itoa(http.StatusSwitchingProtocols)
+		}
+	case m.resp != nil:
+		req = m.resp.Request
+		code := m.statusCode()
+		status = fmt.Sprintf("%03d", code)
+		if code == http.StatusForbidden || code == http.StatusProxyAuthRequired {
+			result = "TCP_DENIED"
+		}
+		if m.resp.ContentLength > 0 {
+			size = m.resp.ContentLength
+		}
+		if value := m.resp.Header.Get("Content-Type"); value != "" {
+			contentType = strings.ReplaceAll(value, " ", "")
+		}
+	case req != nil && req.Method == http.MethodConnect:
+		return 0, nil
+	}
+
+	client, method, requestURL := "-", "-", "-"
+	if req != nil {
+		client = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			client = host
+		}
+		method = req.Method
+		if req.URL != nil {
+			requestURL = req.URL.String()
+			if req.Method == http.MethodConnect {
+				requestURL = req.URL.Host
+			}
+		}
+	}
+
+	hierarchy := "HIER_NONE/-"
+	switch m.upstream {
+	case "", ruleDeny:
+	case ruleDirect, upstreamDirectFallback:
+		if req != nil && req.URL != nil {
+			hierarchy = "HIER_DIRECT/" + req.URL.Hostname()
+		}
+	default:
+		peer := m.upstream
+		if u, err := url.Parse(peer); err == nil && u.Host != "" {
+			peer = u.Hostname()
+		}
+		hierarchy = "FIRSTUP_PARENT/" + peer
+	}
+
+	elapsed := int64(0)
+	if m.timing.duration > 0 {
+		elapsed = m.timing.duration.Milliseconds()
+	}
+
+	fprintf(&nr, &err, w, "%d.%03d %6d %s %s/%s %d %s %s %s %s %s\n",
+		m.time.Unix(), m.time.Nanosecond()/int(time.Millisecond), elapsed, client, result, status, size,
+		method, requestURL, m.user, hierarchy, contentType)
+
+	return
+}
+
 func newProxyLogger(conf *Configuration) *ProxyLogger {
 	var fh *os.File
 
-	if conf.AccessLog != "" {
+	if conf.LogToStdout {
+		fh = os.Stdout
+	} else if conf.AccessLog != "" {
 		var err error
 		fh, err = os.OpenFile(conf.AccessLog, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 		if err != nil {
@@ -103,21 +453,48 @@ func newProxyLogger(conf *Configuration) *ProxyLogger {
 		}
 	}
 
+	tf, err := newTimeFormatter(conf.LogTimeFormat, conf.LogTimeZone, time.RFC3339)
+	if err != nil {
+		log.Fatalf("Couldn't set up log time format: %v", err)
+	}
+
 	logger := &ProxyLogger{
-		path:         conf.AccessLog,
-		logChannel:   make(chan *LogData),
-		errorChannel: make(chan error),
+		path:            conf.AccessLog,
+		timeFormat:      tf,
+		logTLS:          conf.LogTLSMetadata,
+		logFingerprints: conf.LogTLSFingerprints,
+		logChannel:      make(chan *LogData),
+		errorChannel:    make(chan error),
+		tracer:          newTracer(conf),
+		stats:           newProxyStats(conf),
 	}
 
 	go func() {
 		for m := range logger.logChannel {
+			if logger.tracer != nil && m.action == AppendLog {
+				logger.tracer.record(m)
+			}
+			if logger.stats != nil && m.action == AppendLog {
+				logger.stats.record(m)
+			}
 			if fh != nil {
 				switch m.action {
 				case AppendLog:
-					if _, err := m.writeTo(fh); err != nil {
+					write := m.writeTo
+					switch conf.AccessLogFormat {
+					case logFormatJSON:
+						write = m.writeJSONTo
+					case logFormatSquid:
+						write = m.writeSquidTo
+					}
+					if _, err := write(fh, logger.timeFormat); err != nil {
 						log.Println("Can't write meta", err)
 					}
 				case ReopenLog:
+					if conf.LogToStdout {
+						// standard streams are collected by the container platform
+						continue
+					}
 					err := fh.Close()
 					if err != nil {
 						log.Fatal(err)
@@ -129,23 +506,177 @@ func newProxyLogger(conf *Configuration) *ProxyLogger {
 				}
 			}
 		}
+		if logger.tracer != nil {
+			logger.tracer.close()
+		}
+		if fh == os.Stdout {
+			logger.errorChannel <- nil
+			return
+		}
 		logger.errorChannel <- fh.Close()
 	}()
 
 	return logger
 }
 
+// timing returns request's timings known so far.
+func (info *requestInfo) timing() requestTiming {
+	return requestTiming{
+		duration:  time.Since(info.started),
+		connect:   info.connect,
+		firstByte: info.firstByte,
+	}
+}
+
+// logResponse writes the entry once the response body was copied to the client
+// if the request came through withAccessLog, otherwise it's written immediately.
 func (logger *ProxyLogger) logResponse(resp *http.Response, ctx *goproxy.ProxyCtx) {
 	if resp == nil {
 		resp = emptyResp
 	}
 
-	logger.writeLogEntry(&LogData{
+	info := getRequestInfo(ctx)
+	data := &LogData{
 		action: AppendLog,
 		resp:   resp,
 		user:   getAuthenticatedUserName(ctx),
 		err:    ctx.Error,
 		time:   time.Now(),
+		timing: info.timing(),
+
+		upstream: info.upstream,
+		asn:      info.asn,
+		trace:    info.trace,
+		rule:     info.rule,
+	}
+	if logger.logTLS {
+		data.tls = resp.TLS
+	}
+
+	if requestInfoFromRequest(ctx.Req) == info {
+		info.pendingLog = data
+		return
+	}
+
+	logger.writeLogEntry(data)
+}
+
+// withAccessLog traces timings of outgoing requests and writes access log entries
+// of plain HTTP requests after their responses were sent, so the whole transfer
+// time is accounted. Has to be wrapped by withRequestInfo.
+func withAccessLog(handler http.Handler, logger *ProxyLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info := requestInfoFromRequest(req)
+		if info == nil {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		// rejected CONNECT requests get no response goproxy would log
+		if req.Method == http.MethodConnect {
+			handler.ServeHTTP(w, req)
+			if info.denied {
+				logger.writeLogEntry(&LogData{
+					action: AppendLog,
+					resp:   &http.Response{StatusCode: http.StatusForbidden, Request: req},
+					user:   info.logUser(),
+					time:   time.Now(),
+					timing: info.timing(),
+
+					upstream: info.upstream,
+					asn:      info.asn,
+					trace:    info.trace,
+					rule:     info.rule,
+				})
+			}
+			return
+		}
+
+		var getConn time.Time
+		trace := &httptrace.ClientTrace{
+			GetConn: func(hostPort string) {
+				getConn = time.Now()
+			},
+			GotConn: func(httptrace.GotConnInfo) {
+				info.connect = time.Since(getConn)
+			},
+			GotFirstResponseByte: func() {
+				info.firstByte = time.Since(info.started)
+			},
+		}
+
+		handler.ServeHTTP(w, req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+		if data := info.pendingLog; data != nil {
+			data.time = time.Now()
+			data.timing = info.timing()
+			data.upstream = info.upstream
+			data.asn = info.asn
+			data.rule = info.rule
+			if info.stalled.Load() {
+				data.status = http.StatusGatewayTimeout
+			}
+			logger.writeLogEntry(data)
+		}
+
+		// the server mustn't finish a truncated chunked response as if it was complete
+		if info.stalled.Load() {
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// setUpstreamLoggingHandler records the upstream of plain HTTP requests which weren't
+// routed by rules. Has to be called after all other handlers replacing proxy function.
+func setUpstreamLoggingHandler(proxy *goproxy.ProxyHttpServer) {
+	proxyFunc := proxy.Tr.Proxy
+
+	proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		var proxyURL *url.URL
+		var err error
+
+		if proxyFunc != nil {
+			if proxyURL, err = proxyFunc(req); err != nil {
+				return nil, err
+			}
+		}
+
+		if proxyURL != nil {
+			setRequestUpstream(req, proxyURL.Redacted(), false)
+		} else {
+			setRequestUpstream(req, ruleDirect, false)
+		}
+
+		return proxyURL, nil
+	}
+}
+
+func (logger *ProxyLogger) logTunnel(req *http.Request, c *tunnelConn) {
+	user, upstream, asn, rule := "-", "", "", ""
+	var trace *traceContext
+	if info := requestInfoFromRequest(req); info != nil {
+		user = info.logUser()
+		upstream, asn, rule, trace = info.upstream, info.asn, info.rule, info.trace
+	}
+
+	logger.writeLogEntry(&LogData{
+		action: AppendLog,
+		req:    req,
+		user:   user,
+		time:   time.Now(),
+		tunnel: &tunnelStats{
+			sent:      c.sent.Load(),
+			received:  c.received.Load(),
+			websocket: c.websocket,
+
+			fingerprint: c.fingerprint.Load(),
+		},
+		timing: c.timing(),
+
+		upstream: upstream,
+		asn:      asn,
+		trace:    trace,
+		rule:     rule,
 	})
 }
 
@@ -154,6 +685,7 @@ func (logger *ProxyLogger) writeLogEntry(data *LogData) {
 }
 
 func (logger *ProxyLogger) log(ctx *goproxy.ProxyCtx) {
+	info := getRequestInfo(ctx)
 	data := &LogData{
 		action: AppendLog,
 		req:    ctx.Req,
@@ -161,6 +693,12 @@ func (logger *ProxyLogger) log(ctx *goproxy.ProxyCtx) {
 		user:   getAuthenticatedUserName(ctx),
 		err:    ctx.Error,
 		time:   time.Now(),
+		timing: info.timing(),
+
+		upstream: info.upstream,
+		asn:      info.asn,
+		trace:    info.trace,
+		rule:     info.rule,
 	}
 	logger.writeLogEntry(data)
 }
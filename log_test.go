@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestAccessLogTiming(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger := newProxyLogger(&Configuration{AccessLog: path})
+	proxy := goproxy.NewProxyHttpServer()
+	setHTTPLoggingHandler(proxy, logger)
+	setUpstreamLoggingHandler(proxy)
+
+	req := httptest.NewRequest("GET", origin.URL+"/path", nil)
+	w := httptest.NewRecorder()
+	withRequestInfo(withAccessLog(proxy, logger)).ServeHTTP(w, req)
+
+	if w.Body.String() != "hello" {
+		t.Fatalf("Unexpected response body: %q", w.Body.String())
+	}
+
+	var data []byte
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err = os.ReadFile(path); err == nil && len(data) > 0 {
+			break
+		}
+	}
+
+	line := string(data)
+	if !strings.Contains(line, "/path 200 5 - upstream=DIRECT duration=") || strings.Contains(line, "connect=-") || strings.Contains(line, "ttfb=-") {
+		t.Errorf("Unexpected access log entry: %q", line)
+	}
+}
+
+func TestAccessLogFormatJSON(t *testing.T) {
+	origin := httptest.NewServer(ConstantHanlder("hello"))
+	defer origin.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger := newProxyLogger(&Configuration{AccessLog: path, AccessLogFormat: logFormatJSON})
+	proxy := goproxy.NewProxyHttpServer()
+	setHTTPLoggingHandler(proxy, logger)
+	setUpstreamLoggingHandler(proxy)
+
+	req := httptest.NewRequest("GET", origin.URL+"/path", nil)
+	withRequestInfo(withAccessLog(proxy, logger)).ServeHTTP(httptest.NewRecorder(), req)
+
+	var data []byte
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err = os.ReadFile(path); err == nil && len(data) > 0 {
+			break
+		}
+	}
+
+	var record accessLogRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Expected JSON access log entry, got %q: %v", data, err)
+	}
+	if record.Method != "GET" || record.Host != "127.0.0.1" || record.Status != http.StatusOK ||
+		record.Upstream != ruleDirect || record.Duration == nil {
+		t.Errorf("Unexpected access log entry: %q", data)
+	}
+}
+
+func TestTimeFormatter(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		format, zone, expected string
+	}{
+		{"", "utc", "2024-03-01T12:30:00Z"},
+		{"epoch", "", "1709296200"},
+		{"epoch_ms", "", "1709296200000"},
+		{"2006-01-02 15:04:05 MST", "Europe/Berlin", "2024-03-01 13:30:00 CET"},
+	}
+
+	for _, test := range tests {
+		tf, err := newTimeFormatter(test.format, test.zone, time.RFC3339)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := tf.format(ts); result != test.expected {
+			t.Errorf("Expected '%s' for format '%s', got '%s'", test.expected, test.format, result)
+		}
+	}
+
+	if _, err := newTimeFormatter("iso", "", time.RFC3339); err == nil {
+		t.Error("Expected error for invalid time format")
+	}
+}
+
+func TestAccessLogTLSMetadata(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger := newProxyLogger(&Configuration{AccessLog: path, LogTLSMetadata: true})
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr = origin.Client().Transport.(*http.Transport).Clone()
+	setHTTPLoggingHandler(proxy, logger)
+
+	req := httptest.NewRequest("GET", origin.URL+"/path", nil)
+	w := httptest.NewRecorder()
+	withRequestInfo(withAccessLog(proxy, logger)).ServeHTTP(w, req)
+
+	var data []byte
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err = os.ReadFile(path); err == nil && len(data) > 0 {
+			break
+		}
+	}
+
+	line := string(data)
+	if !strings.Contains(line, " tls=TLS1.3 cipher=TLS_") || !strings.Contains(line, ` alpn=http/1.1 cert="O=Acme Co" `) {
+		t.Errorf("Unexpected access log entry: %q", line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	tf, err := newTimeFormatter("epoch", "utc", time.RFC3339)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &http.Request{Method: "CONNECT", URL: &url.URL{Host: "example.com:443"}, RemoteAddr: "192.0.2.1:1234"}
+
+	tests := []struct {
+		data     *LogData
+		expected string
+	}{
+		{
+			&LogData{
+				req: req, user: "alice", time: time.Unix(1700000000, 0), upstream: ruleDirect,
+				tunnel: &tunnelStats{sent: 10, received: 20},
+				timing: requestTiming{duration: 1500 * time.Millisecond, connect: 20 * time.Millisecond, firstByte: -1},
+			},
+			`{"time":"1700000000","client":"192.0.2.1:1234","method":"CONNECT","url":"//example.com:443",` +
+				`"host":"example.com","event":"closed","user":"alice","sent":10,"received":20,"upstream":"DIRECT","duration":1.5,"connect":0.02}`,
+		},
+		{
+			&LogData{
+				resp: &http.Response{StatusCode: 200, ContentLength: 5, Request: req}, user: "-",
+				time: time.Unix(1700000000, 0), status: 504, timing: requestTiming{duration: -1, connect: -1, firstByte: -1},
+			},
+			`{"time":"1700000000","client":"192.0.2.1:1234","method":"CONNECT","url":"//example.com:443",` +
+				`"host":"example.com","status":504,"size":5,"user":"-","upstream":"-"}`,
+		},
+	}
+
+	for _, test := range tests {
+		var b strings.Builder
+		if _, err := test.data.writeJSONTo(&b, tf); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected+"\n" {
+			t.Errorf("Expected %s, got %s", test.expected, b.String())
+		}
+	}
+}
+
+func TestAccessLogSquid(t *testing.T) {
+	connect := &http.Request{Method: "CONNECT", URL: &url.URL{Host: "example.com:443"}, RemoteAddr: "192.0.2.1:1234"}
+	get := &http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}, RemoteAddr: "192.0.2.1:1234"}
+
+	tests := []struct {
+		data     *LogData
+		expected string
+	}{
+		{
+			&LogData{
+				req: connect, user: "alice", time: time.Unix(1700000000, 250000000), upstream: ruleDirect,
+				tunnel: &tunnelStats{sent: 10, received: 20}, timing: requestTiming{duration: 1500 * time.Millisecond},
+			},
+			"1700000000.250   1500 192.0.2.1 TCP_TUNNEL/200 20 CONNECT example.com:443 alice HIER_DIRECT/example.com -\n",
+		},
+		{
+			&LogData{
+				resp: &http.Response{StatusCode: 200, ContentLength: 5, Request: get, Header: http.Header{"Content-Type": {"text/html; charset=utf-8"}}},
+				user: "-", time: time.Unix(1700000000, 0), upstream: "http://parent.example.com:3128", timing: requestTiming{duration: 42 * time.Millisecond},
+			},
+			"1700000000.000     42 192.0.2.1 TCP_MISS/200 5 GET http://example.com/ - FIRSTUP_PARENT/parent.example.com text/html;charset=utf-8\n",
+		},
+		{
+			&LogData{
+				resp: &http.Response{StatusCode: 200, ContentLength: -1, Request: get}, status: http.StatusForbidden,
+				user: "-", time: time.Unix(1700000000, 0), timing: requestTiming{duration: -1},
+			},
+			"1700000000.000      0 192.0.2.1 TCP_DENIED/403 0 GET http://example.com/ - HIER_NONE/- -\n",
+		},
+		// CONNECT requests are written once closed
+		{&LogData{req: connect, user: "-", time: time.Unix(1700000000, 0)}, ""},
+	}
+
+	for _, test := range tests {
+		var b strings.Builder
+		if _, err := test.data.writeSquidTo(&b, nil); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, b.String())
+		}
+	}
+}
+
+func TestAccessLogRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	logger := newProxyLogger(&Configuration{AccessLog: path})
+	proxy := goproxy.NewProxyHttpServer()
+	setHTTPLoggingHandler(proxy, logger)
+	setDestinationNetworksHandler(&Configuration{DisallowedDestinationNetworks: []string{"10.0.0.0/8"}}, proxy)
+	handler := withRequestInfo(withAccessLog(proxy, logger))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://10.1.2.3/path", nil))
+
+	// rejected tunnels are closed by hijacking the connection
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "CONNECT 10.1.2.3:443 HTTP/1.1\r\nHost: 10.1.2.3:443\r\n\r\n")
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	var lines []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && len(lines) < 2; time.Sleep(10 * time.Millisecond) {
+		if data, err := os.ReadFile(path); err == nil {
+			lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+		}
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 access log entries, got %q", lines)
+	}
+	for i, method := range []string{"GET", "CONNECT"} {
+		if !strings.Contains(lines[i], " "+method+" ") || !strings.Contains(lines[i], " 403 ") ||
+			!strings.Contains(lines[i], " rule=disallowed_destination_networks:10.0.0.0/8 ") {
+			t.Errorf("Unexpected access log entry: %q", lines[i])
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of activity_log_format setting.
+const (
+	logFormatPlain = "plain"
+	logFormatText  = "text"
+	logFormatJSON  = "json"
+)
+
+// Modules which can have their own activity_log_levels, messages of other parts of
+// the proxy use activity_log_level.
+const (
+	logModuleAuth    = "auth"
+	logModuleRouting = "routing"
+	logModuleTunnel  = "tunnel"
+	logModuleShadow  = "shadow"
+	logModuleEgress  = "egress"
+)
+
+var logModules = map[string]bool{
+	logModuleAuth:    true,
+	logModuleRouting: true,
+	logModuleTunnel:  true,
+	logModuleShadow:  true,
+	logModuleEgress:  true,
+}
+
+const logWarnPrefix = "WARN: "
+
+// goproxy prefixes messages of ctx.Logf and ctx.Warnf with the session number
+var logSessionRegexp = regexp.MustCompile(`^\[(\d+)\] `)
+
+// activityLogger is the proxy's goproxy.Logger. Messages are filtered by level and
+// written as plain lines or as slog records in text or JSON formats. Level of
+// messages written with Printf is derived from their text: "WARN: " prefix means
+// warning, messages of goproxy's sessions are debug ones, since goproxy writes them
+// only in verbose mode, everything else is informational.
+type activityLogger struct {
+	handler slog.Handler
+	levels  *logLevels
+}
+
+// logLevels keeps the default level and levels of modules, they can be changed at
+// runtime and are shared by the proxy's loggers, so changes survive reopening of the
+// log.
+type logLevels struct {
+	level slog.LevelVar
+	// level the default one is restored to when debug mode is toggled off
+	saved   slog.LevelVar
+	modules map[string]*moduleLevel
+}
+
+type moduleLevel struct {
+	// unset if the module uses the default level
+	own   atomic.Bool
+	level slog.LevelVar
+}
+
+// logLevelsStatus is the representation of levels in the admin API, modules
+// without their own level are omitted.
+type logLevelsStatus struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
+func newLogLevels(conf *Configuration) *logLevels {
+	// validated when configuration is loaded
+	levels := &logLevels{modules: make(map[string]*moduleLevel, len(logModules))}
+	levels.level.Set(parseLogLevel(conf.ActivityLogLevel))
+
+	for module := range logModules {
+		levels.modules[module] = &moduleLevel{}
+	}
+	for module, level := range conf.ActivityLogLevels {
+		levels.modules[module].own.Store(true)
+		levels.modules[module].level.Set(parseLogLevel(level))
+	}
+
+	return levels
+}
+
+func newActivityLogger(conf *Configuration, w io.Writer, tf *timeFormatter) *activityLogger {
+	l := &activityLogger{levels: newLogLevels(conf)}
+
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if conf.LogTimeFormat != "" || conf.LogTimeZone != "" {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.String(slog.TimeKey, tf.format(a.Value.Time()))
+			}
+			return a
+		}
+	}
+
+	switch conf.ActivityLogFormat {
+	case logFormatText:
+		l.handler = slog.NewTextHandler(w, opts)
+	case logFormatJSON:
+		l.handler = slog.NewJSONHandler(w, opts)
+	default:
+		l.handler = &plainLogHandler{w: &timestampWriter{w: w, tf: tf}}
+	}
+
+	return l
+}
+
+// parseLogLevel accepts debug, info, warn and error, empty level means info.
+func parseLogLevel(s string) slog.Level {
+	var level slog.Level
+	if s != "" {
+		level.UnmarshalText([]byte(s))
+	}
+
+	return level
+}
+
+// get returns the level of the module, modules without their own level and
+// messages of other parts of the proxy use the default one.
+func (l *logLevels) get(module string) slog.Level {
+	if m, exists := l.modules[module]; exists && m.own.Load() {
+		return m.level.Level()
+	}
+
+	return l.level.Level()
+}
+
+// debugEnabled reports whether any module logs debug messages.
+func (l *logLevels) debugEnabled() bool {
+	if l.level.Level() <= slog.LevelDebug {
+		return true
+	}
+
+	for _, m := range l.modules {
+		if m.own.Load() && m.level.Level() <= slog.LevelDebug {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *logLevels) status() *logLevelsStatus {
+	status := &logLevelsStatus{Level: strings.ToLower(l.level.Level().String()), Modules: make(map[string]string)}
+	for module, m := range l.modules {
+		if m.own.Load() {
+			status.Modules[module] = strings.ToLower(m.level.Level().String())
+		}
+	}
+
+	return status
+}
+
+// update changes levels set in status, empty default level is left as is and empty
+// levels of modules make them use the default level. Nothing is changed if any of
+// the levels is invalid.
+func (l *logLevels) update(status *logLevelsStatus) error {
+	var level slog.Level
+	if status.Level != "" {
+		if err := level.UnmarshalText([]byte(status.Level)); err != nil {
+			return fmt.Errorf("invalid level '%s'", status.Level)
+		}
+	}
+
+	levels := make(map[string]slog.Level, len(status.Modules))
+	for module, value := range status.Modules {
+		if !logModules[module] {
+			return fmt.Errorf("unknown module '%s'", module)
+		}
+		var moduleLevel slog.Level
+		if value != "" {
+			if err := moduleLevel.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("invalid level '%s' of module '%s'", value, module)
+			}
+		}
+		levels[module] = moduleLevel
+	}
+
+	if status.Level != "" {
+		l.level.Set(level)
+	}
+	for module, value := range status.Modules {
+		l.modules[module].level.Set(levels[module])
+		l.modules[module].own.Store(value != "")
+	}
+
+	return nil
+}
+
+// toggleDebug switches the default level to debug or back to the level it had
+// before, it returns the new level.
+func (l *logLevels) toggleDebug() slog.Level {
+	if l.level.Level() > slog.LevelDebug {
+		l.saved.Set(l.level.Level())
+		l.level.Set(slog.LevelDebug)
+	} else {
+		l.level.Set(l.saved.Level())
+	}
+
+	return l.level.Level()
+}
+
+func (l *activityLogger) Printf(format string, v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+
+	session := -1
+	if m := logSessionRegexp.FindStringSubmatch(msg); m != nil {
+		session, _ = strconv.Atoi(m[1])
+		msg = msg[len(m[0]):]
+	}
+
+	level := slog.LevelInfo
+	if session >= 0 {
+		level = slog.LevelDebug
+	}
+	if rest, ok := strings.CutPrefix(msg, logWarnPrefix); ok {
+		level, msg = slog.LevelWarn, rest
+	}
+
+	l.log("", level, session, msg)
+}
+
+func (l *activityLogger) log(module string, level slog.Level, session int, msg string) {
+	if level < l.levels.get(module) {
+		return
+	}
+
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	if module != "" {
+		r.AddAttrs(slog.String("module", module))
+	}
+	if session >= 0 {
+		r.AddAttrs(slog.Int("session", session))
+	}
+
+	l.handler.Handle(context.Background(), r)
+}
+
+// plainLogHandler writes records in the activity log's original format: timestamp,
+// goproxy's session number and "WARN: " prefix for warnings and errors.
+type plainLogHandler struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (h *plainLogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *plainLogHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "session" {
+			fmt.Fprintf(&b, "[%03d] ", a.Value.Int64())
+		}
+		return true
+	})
+	if r.Level >= slog.LevelWarn {
+		b.WriteString(logWarnPrefix)
+	}
+	b.WriteString(r.Message)
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+
+	return err
+}
+
+func (h *plainLogHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *plainLogHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// moduleLogger writes messages of a module to the proxy's activity log, so they
+// are filtered by the module's level.
+type moduleLogger struct {
+	proxy  *goproxy.ProxyHttpServer
+	module string
+}
+
+func newModuleLogger(proxy *goproxy.ProxyHttpServer, module string) *moduleLogger {
+	return &moduleLogger{proxy: proxy, module: module}
+}
+
+// logf writes the message, ctx is used for goproxy's session number and may be nil.
+func (m *moduleLogger) logf(ctx *goproxy.ProxyCtx, level slog.Level, format string, v ...interface{}) {
+	if m.proxy == nil {
+		return
+	}
+
+	session := -1
+	if ctx != nil {
+		session = int(ctx.Session & 0xFF)
+	}
+
+	// the logger is replaced when logs are reopened
+	if l, ok := m.proxy.Logger.(*activityLogger); ok {
+		if level >= l.levels.get(m.module) {
+			l.log(m.module, level, session, fmt.Sprintf(format, v...))
+		}
+		return
+	}
+
+	if level < slog.LevelInfo && !m.proxy.Verbose {
+		return
+	}
+	if level >= slog.LevelWarn {
+		format = logWarnPrefix + format
+	}
+	if session >= 0 {
+		format = fmt.Sprintf("[%03d] ", session) + format
+	}
+	m.proxy.Logger.Printf(format+"\n", v...)
+}
+
+// setVerbose sets the proxy's verbose mode, which enables debug messages of all
+// modules without their own level.
+func setVerbose(proxy *goproxy.ProxyHttpServer, verbose bool) {
+	if l, ok := proxy.Logger.(*activityLogger); ok {
+		if verbose {
+			l.levels.level.Set(slog.LevelDebug)
+		}
+		refreshVerbose(proxy)
+	} else {
+		proxy.Verbose = verbose
+	}
+}
+
+// refreshVerbose enables goproxy's verbose mode if any module logs debug messages,
+// goproxy writes its own debug messages only in verbose mode.
+func refreshVerbose(proxy *goproxy.ProxyHttpServer) {
+	if l, ok := proxy.Logger.(*activityLogger); ok {
+		proxy.Verbose = l.levels.debugEnabled()
+	}
+}
+
+// activityLogLevels returns levels of the proxy's activity log, nil is returned if
+// the proxy doesn't use activityLogger.
+func activityLogLevels(proxy *goproxy.ProxyHttpServer) *logLevels {
+	if l, ok := proxy.Logger.(*activityLogger); ok {
+		return l.levels
+	}
+
+	return nil
+}
+
+// toggleDebugLog switches the proxy's activity log to debug level and back.
+func toggleDebugLog(proxy *goproxy.ProxyHttpServer) {
+	if levels := activityLogLevels(proxy); levels != nil {
+		level := levels.toggleDebug()
+		refreshVerbose(proxy)
+		proxy.Logger.Printf("activity log level is %v\n", strings.ToLower(level.String()))
+	}
+}
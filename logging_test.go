@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func newTestActivityLogger(t *testing.T, conf *Configuration) (*activityLogger, *bytes.Buffer) {
+	tf, err := newTimeFormatter("epoch", "", activityLogTimeLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	return newActivityLogger(conf, &buf, tf), &buf
+}
+
+func TestPlainActivityLog(t *testing.T) {
+	l, buf := newTestActivityLogger(t, &Configuration{})
+
+	l.Printf("starting proxy\n")
+	l.Printf("[%03d] WARN: "+"failed attempt"+"\n", 7)
+	// goproxy's verbose messages are debug ones
+	l.Printf("[%03d] "+"Got request"+"\n", 7)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", buf.String())
+	}
+	for i, expected := range []string{" starting proxy", " [007] WARN: failed attempt"} {
+		if !strings.HasSuffix(lines[i], expected) {
+			t.Errorf("Expected line ending with %q, got %q", expected, lines[i])
+		}
+	}
+}
+
+func TestJSONActivityLog(t *testing.T) {
+	conf := &Configuration{
+		ActivityLogFormat: logFormatJSON,
+		ActivityLogLevel:  "warn",
+		ActivityLogLevels: map[string]string{logModuleRouting: "debug"},
+	}
+	l, buf := newTestActivityLogger(t, conf)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = l
+	setVerbose(proxy, false)
+	if !proxy.Verbose {
+		t.Error("Expected verbose mode for debug messages of routing module")
+	}
+
+	l.Printf("starting proxy\n")
+	newModuleLogger(proxy, logModuleAuth).logf(nil, slog.LevelInfo, "auth info")
+	newModuleLogger(proxy, logModuleRouting).logf(&goproxy.ProxyCtx{Session: 3}, slog.LevelDebug, "route %v", "DIRECT")
+	l.Printf("WARN: something happened\n")
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %q", buf.String())
+	}
+	if records[0]["msg"] != "route DIRECT" || records[0]["level"] != "DEBUG" ||
+		records[0]["module"] != logModuleRouting || records[0]["session"] != float64(3) {
+		t.Errorf("Unexpected routing record %v", records[0])
+	}
+	if records[1]["msg"] != "something happened" || records[1]["level"] != "WARN" {
+		t.Errorf("Unexpected warning record %v", records[1])
+	}
+}
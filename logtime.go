@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout used by the standard log package, it's kept for the activity log by default
+const activityLogTimeLayout = "2006/01/02 15:04:05"
+
+// timeFormatter formats logs' timestamps according to log_time_format and
+// log_time_zone options.
+type timeFormatter struct {
+	layout   string
+	epoch    bool
+	millis   bool
+	location *time.Location
+}
+
+// newTimeFormatter accepts "rfc3339", "rfc3339nano", "epoch", "epoch_ms" or a custom
+// Go time layout, defaultLayout is used if format is empty. Zone is either "local",
+// "utc" or IANA time zone name, empty zone means local time.
+func newTimeFormatter(format, zone, defaultLayout string) (*timeFormatter, error) {
+	tf := &timeFormatter{}
+
+	switch strings.ToLower(format) {
+	case "":
+		tf.layout = defaultLayout
+	case "rfc3339":
+		tf.layout = time.RFC3339
+	case "rfc3339nano":
+		tf.layout = time.RFC3339Nano
+	case "epoch":
+		tf.epoch = true
+	case "epoch_ms":
+		tf.epoch, tf.millis = true, true
+	default:
+		// a layout has to contain at least one element of the reference time
+		if time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(format) == format {
+			return nil, fmt.Errorf("invalid time format '%s'", format)
+		}
+		tf.layout = format
+	}
+
+	switch strings.ToLower(zone) {
+	case "", "local":
+		tf.location = time.Local
+	case "utc":
+		tf.location = time.UTC
+	default:
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone '%s': %w", zone, err)
+		}
+		tf.location = location
+	}
+
+	return tf, nil
+}
+
+func (tf *timeFormatter) format(t time.Time) string {
+	switch {
+	case tf.millis:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case tf.epoch:
+		return strconv.FormatInt(t.Unix(), 10)
+	default:
+		return t.In(tf.location).Format(tf.layout)
+	}
+}
+
+// timestampWriter prefixes every write with the current time, it's used as the
+// activity log's output with log.Logger flags set to zero.
+type timestampWriter struct {
+	w  io.Writer
+	tf *timeFormatter
+}
+
+func (tw *timestampWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(tw.w, tw.tf.format(time.Now())+" "); err != nil {
+		return 0, err
+	}
+
+	return tw.w.Write(p)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	defaultMemoryShedRatio = 0.9
+	memoryCheckInterval    = time.Second
+)
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseByteSize parses sizes like "512MiB", "1GB" or "1048576".
+func parseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// memoryGuard sets the Go runtime's soft memory limit and puts the proxy under
+// memory pressure while memory usage stays above the configured share of the limit.
+// Under pressure request bodies aren't buffered and, if memory_shed_requests is
+// set, new requests are rejected.
+type memoryGuard struct {
+	limit        int64
+	threshold    int64
+	shedRequests bool
+	pressure     atomic.Bool
+	// usage at the last check, buffers taken since are accounted on top of it
+	usage    atomic.Int64
+	buffered atomic.Int64
+	samples  []metrics.Sample
+}
+
+func newMemoryGuard(conf *Configuration) *memoryGuard {
+	if conf.MemoryLimit == "" {
+		return nil
+	}
+
+	limit, err := parseByteSize(conf.MemoryLimit)
+	if err != nil {
+		panic(err) // validated when configuration is loaded
+	}
+
+	return &memoryGuard{
+		limit:        limit,
+		threshold:    int64(float64(limit) * conf.MemoryShedRatio),
+		shedRequests: conf.MemoryShedRequests,
+		samples: []metrics.Sample{
+			{Name: "/memory/classes/total:bytes"},
+			{Name: "/memory/classes/heap/released:bytes"},
+		},
+	}
+}
+
+// readUsage returns memory accounted by the runtime against the memory limit.
+func (g *memoryGuard) readUsage() int64 {
+	metrics.Read(g.samples)
+	return int64(g.samples[0].Value.Uint64() - g.samples[1].Value.Uint64())
+}
+
+// update switches memory pressure on or off depending on the current memory usage.
+func (g *memoryGuard) update(usage int64, proxy *goproxy.ProxyHttpServer) {
+	g.usage.Store(usage)
+
+	pressure := usage > g.threshold
+	if g.pressure.Swap(pressure) != pressure {
+		action := "not buffering request bodies"
+		if g.shedRequests {
+			action = "rejecting new requests"
+		}
+		if pressure {
+			proxy.Logger.Printf("WARN: memory usage %v bytes is above %v bytes, %v\n", usage, g.threshold, action)
+		} else {
+			proxy.Logger.Printf("memory usage %v bytes is back to normal\n", usage)
+		}
+	}
+}
+
+// reserve accounts n bytes about to be buffered, false is returned if they don't
+// fit under the threshold and the data has to be skipped. A nil guard reserves
+// everything.
+func (g *memoryGuard) reserve(n int64) bool {
+	if g == nil {
+		return true
+	}
+	if g.pressure.Load() {
+		return false
+	}
+
+	if g.usage.Load()+g.buffered.Add(n) > g.threshold {
+		g.buffered.Add(-n)
+		return false
+	}
+
+	return true
+}
+
+// release returns n bytes reserved earlier.
+func (g *memoryGuard) release(n int64) {
+	if g != nil {
+		g.buffered.Add(-n)
+	}
+}
+
+// bufferedBody returns the body read into memory, its size is released once it's
+// closed or ctx is done, whichever happens first.
+func (g *memoryGuard) bufferedBody(ctx context.Context, body []byte) io.ReadCloser {
+	b := &bufferedBody{Reader: bytes.NewReader(body)}
+	b.release = func() {
+		b.once.Do(func() { g.release(int64(len(body))) })
+	}
+	b.stop = context.AfterFunc(ctx, b.release)
+
+	return b
+}
+
+type bufferedBody struct {
+	*bytes.Reader
+	once    sync.Once
+	release func()
+	stop    func() bool
+}
+
+func (b *bufferedBody) Close() error {
+	b.stop()
+	b.release()
+
+	return nil
+}
+
+// start applies the memory limit and begins monitoring memory usage.
+func (g *memoryGuard) start(proxy *goproxy.ProxyHttpServer) {
+	if g == nil {
+		return
+	}
+
+	debug.SetMemoryLimit(g.limit)
+
+	go func() {
+		for range time.Tick(memoryCheckInterval) {
+			g.update(g.readUsage(), proxy)
+		}
+	}()
+}
+
+// memoryPressureResponse asks the client to retry once memory usage is back to normal.
+func memoryPressureResponse(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(memoryCheckInterval.Seconds())))
+	http.Error(w, "Proxy is overloaded, try again later", http.StatusServiceUnavailable)
+}
+
+// withMemoryGuard rejects requests with 503 status code under memory pressure if
+// memory_shed_requests is set.
+func withMemoryGuard(handler http.Handler, guard *memoryGuard) http.Handler {
+	if guard == nil || !guard.shedRequests {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if guard.pressure.Load() {
+			memoryPressureResponse(w)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]int64{
+		"1048576": 1 << 20,
+		"512MiB":  512 << 20,
+		"2 GB":    2000000000,
+		"64kb":    64000,
+	}
+
+	for s, expected := range tests {
+		if n, err := parseByteSize(s); err != nil || n != expected {
+			t.Errorf("Expected %v for '%s', got %v (%v)", expected, s, n, err)
+		}
+	}
+
+	if _, err := parseByteSize("lots"); err == nil {
+		t.Error("Expected error for invalid size")
+	}
+}
+
+func TestMemoryGuardShedding(t *testing.T) {
+	for _, shed := range []bool{false, true} {
+		guard := newMemoryGuard(&Configuration{MemoryLimit: "100MiB", MemoryShedRatio: 0.5, MemoryShedRequests: shed})
+		proxy := goproxy.NewProxyHttpServer()
+		handler := withMemoryGuard(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), guard)
+
+		expected := http.StatusOK
+		if shed {
+			expected = http.StatusServiceUnavailable
+		}
+		guard.update(60<<20, proxy)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if w.Code != expected {
+			t.Errorf("memory_shed_requests=%v: expected %v status code above the threshold, got %v", shed, expected, w.Code)
+		}
+		if guard.reserve(1) {
+			t.Errorf("memory_shed_requests=%v: expected buffering to be refused under pressure", shed)
+		}
+
+		guard.update(10<<20, proxy)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("memory_shed_requests=%v: expected 200 status code below the threshold, got %v", shed, w.Code)
+		}
+	}
+}
+
+func TestMemoryGuardBuffers(t *testing.T) {
+	guard := newMemoryGuard(&Configuration{MemoryLimit: "100MiB", MemoryShedRatio: 0.5})
+	guard.update(10<<20, goproxy.NewProxyHttpServer())
+
+	// buffers are accounted on top of the measured usage
+	if !guard.reserve(30 << 20) {
+		t.Fatal("Expected the buffer to fit under the threshold")
+	}
+	if guard.reserve(20 << 20) {
+		t.Error("Expected the buffer above the threshold to be refused")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body := guard.bufferedBody(ctx, make([]byte, 30<<20))
+	cancel()
+	body.Close()
+	if n := guard.buffered.Load(); n != 0 {
+		t.Errorf("Expected buffer to be released once, %v bytes are reserved", n)
+	}
+}
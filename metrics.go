@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elazarl/goproxy"
+)
+
+// methods reported as they are, others are reported as OTHER to keep the number
+// of time series bounded
+var metricsMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodConnect: true,
+}
+
+type requestLabels struct {
+	method string
+	code   string
+}
+
+// proxyMetrics counts requests handled by the proxy's listener and reports them
+// with tunnels and upstreams' health in Prometheus text format at /metrics.
+type proxyMetrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]int64
+
+	authFailures atomic.Int64
+	// handlers' panics recovered by withPanicRecovery
+	panics atomic.Int64
+	// bytes of request and response bodies and of tunnels' data exchanged
+	// with clients
+	received atomic.Int64
+	sent     atomic.Int64
+
+	// connections to origins and upstream proxies taken by requests and TLS
+	// handshakes of the new ones
+	connections       atomic.Int64
+	reusedConnections atomic.Int64
+	tlsHandshakes     atomic.Int64
+	resumedHandshakes atomic.Int64
+
+	tunnels *tunnelRegistry
+	router  *Router
+	health  *ProxyHealth
+}
+
+func newProxyMetrics(conf *Configuration, router *Router, health *ProxyHealth, tunnels *tunnelRegistry) *proxyMetrics {
+	if conf.MetricsListen == "" {
+		return nil
+	}
+
+	return &proxyMetrics{
+		requests: make(map[requestLabels]int64),
+		tunnels:  tunnels,
+		router:   router,
+		health:   health,
+	}
+}
+
+// observe counts the finished request, status is zero if nothing was sent to the
+// client. Rejected credentials are counted as authentication failures, requests
+// without credentials are just challenged.
+func (m *proxyMetrics) observe(method string, status int, credentials bool) {
+	labels := requestLabels{method: method, code: "-"}
+	if !metricsMethods[labels.method] {
+		labels.method = "OTHER"
+	}
+	if status > 0 {
+		labels.code = strconv.Itoa(status)
+	}
+
+	m.mu.Lock()
+	m.requests[labels]++
+	m.mu.Unlock()
+
+	if status == http.StatusProxyAuthRequired && credentials {
+		m.authFailures.Add(1)
+	}
+}
+
+// withMetrics counts requests, their status codes and traffic of the handler.
+func withMetrics(handler http.Handler, m *proxyMetrics) http.Handler {
+	if m == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mw := &metricsWriter{ResponseWriter: w, metrics: m}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &countingBody{ReadCloser: req.Body, counter: &m.received}
+		}
+
+		// authentication handlers remove the header
+		credentials := req.Header.Get(ProxyAuthorizatonHeader) != ""
+
+		handler.ServeHTTP(mw, req)
+
+		m.observe(req.Method, mw.status, credentials)
+	})
+}
+
+// setConnectionMetricsHandler counts connections used by plain HTTP and inspected
+// requests and their TLS handshakes. CONNECT tunnels always use new connections
+// and their TLS sessions are established by the clients, so they aren't counted.
+func setConnectionMetricsHandler(proxy *goproxy.ProxyHttpServer, m *proxyMetrics) {
+	if m == nil {
+		return
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			m.connections.Add(1)
+			if info.Reused {
+				m.reusedConnections.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			m.tlsHandshakes.Add(1)
+			if state.DidResume {
+				m.resumedHandshakes.Add(1)
+			}
+		},
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), nil
+		})
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.Add(int64(n))
+	return n, err
+}
+
+// metricsWriter records the response's status and counts bytes of its body. The
+// status of hijacked connections, i.e. CONNECT tunnels, is taken from the status
+// line written to the connection.
+type metricsWriter struct {
+	http.ResponseWriter
+	metrics *proxyMetrics
+	status  int
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.metrics.sent.Add(int64(n))
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *metricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &metricsConn{Conn: conn, writer: w}
+	if _, ok := conn.(halfCloser); ok {
+		return halfClosableMetricsConn{c}, rw, nil
+	}
+
+	return c, rw, nil
+}
+
+// metricsConn counts bytes of a hijacked connection. The status line is parsed
+// from the first write, which is done by the handler's goroutine before the
+// tunnel's data is copied.
+type metricsConn struct {
+	net.Conn
+	writer  *metricsWriter
+	started bool
+}
+
+func (c *metricsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.writer.metrics.received.Add(int64(n))
+	return n, err
+}
+
+func (c *metricsConn) Write(b []byte) (int, error) {
+	if !c.started {
+		c.started = true
+		var proto string
+		var status int
+		if _, err := fmt.Sscanf(string(b), "%s %d", &proto, &status); err == nil && c.writer.status == 0 {
+			c.writer.status = status
+		}
+	}
+
+	n, err := c.Conn.Write(b)
+	c.writer.metrics.sent.Add(int64(n))
+	return n, err
+}
+
+// halfClosableMetricsConn is used for connections supporting half-close, so goproxy
+// keeps shutting down each direction of the tunnel separately.
+type halfClosableMetricsConn struct {
+	*metricsConn
+}
+
+func (c halfClosableMetricsConn) CloseWrite() error {
+	return c.Conn.(halfCloser).CloseWrite()
+}
+
+func (c halfClosableMetricsConn) CloseRead() error {
+	return c.Conn.(halfCloser).CloseRead()
+}
+
+func (m *proxyMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/metrics" {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeTo writes the metrics in Prometheus text exposition format.
+func (m *proxyMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	labels := make([]requestLabels, 0, len(m.requests))
+	counts := make(map[requestLabels]int64, len(m.requests))
+	for l, n := range m.requests {
+		labels = append(labels, l)
+		counts[l] = n
+	}
+	m.mu.Unlock()
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].code < labels[j].code
+	})
+
+	writeMetricHeader(w, "microproxy_requests_total", "counter", "Requests handled by the proxy by method and status code.")
+	for _, l := range labels {
+		fmt.Fprintf(w, "microproxy_requests_total{method=%q,code=%q} %d\n", l.method, l.code, counts[l])
+	}
+
+	writeMetricHeader(w, "microproxy_auth_failures_total", "counter", "Requests with rejected credentials.")
+	fmt.Fprintf(w, "microproxy_auth_failures_total %d\n", m.authFailures.Load())
+
+	writeMetricHeader(w, "microproxy_panics_total", "counter", "Panics recovered while handling requests.")
+	fmt.Fprintf(w, "microproxy_panics_total %d\n", m.panics.Load())
+
+	writeMetricHeader(w, "microproxy_received_bytes_total", "counter", "Bytes received from clients.")
+	fmt.Fprintf(w, "microproxy_received_bytes_total %d\n", m.received.Load())
+
+	writeMetricHeader(w, "microproxy_sent_bytes_total", "counter", "Bytes sent to clients.")
+	fmt.Fprintf(w, "microproxy_sent_bytes_total %d\n", m.sent.Load())
+
+	writeMetricHeader(w, "microproxy_upstream_connections_total", "counter",
+		"Connections to origins and upstream proxies taken by requests by whether they were reused.")
+	connections, reused := m.connections.Load(), m.reusedConnections.Load()
+	fmt.Fprintf(w, "microproxy_upstream_connections_total{reused=\"false\"} %d\n", connections-reused)
+	fmt.Fprintf(w, "microproxy_upstream_connections_total{reused=\"true\"} %d\n", reused)
+
+	writeMetricHeader(w, "microproxy_upstream_tls_handshakes_total", "counter",
+		"TLS handshakes with origins and upstream proxies by whether the session was resumed.")
+	handshakes, resumed := m.tlsHandshakes.Load(), m.resumedHandshakes.Load()
+	fmt.Fprintf(w, "microproxy_upstream_tls_handshakes_total{resumed=\"false\"} %d\n", handshakes-resumed)
+	fmt.Fprintf(w, "microproxy_upstream_tls_handshakes_total{resumed=\"true\"} %d\n", resumed)
+
+	writeMetricHeader(w, "microproxy_active_tunnels", "gauge", "Active CONNECT tunnels.")
+	fmt.Fprintf(w, "microproxy_active_tunnels %d\n", m.tunnels.count())
+
+	upstreams := configuredUpstreams(m.router.routing())
+	health := m.health.snapshot()
+
+	writeMetricHeader(w, "microproxy_upstream_up", "gauge", "Whether the upstream proxy is available.")
+	for _, u := range upstreams {
+		up := 0
+		if m.health.check(u[1]) == nil {
+			up = 1
+		}
+		fmt.Fprintf(w, "microproxy_upstream_up{alias=%q,upstream=%q} %d\n", u[0], u[1], up)
+	}
+
+	writeMetricHeader(w, "microproxy_upstream_failures", "gauge", "Consecutive failures of the upstream proxy.")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "microproxy_upstream_failures{alias=%q,upstream=%q} %d\n", u[0], u[1], health[u[1]].Failures)
+	}
+}
+
+// configuredUpstreams returns aliases and hosts of the configured upstream proxies,
+// the forward proxy and members of upstream pools, ordered by alias.
+func configuredUpstreams(routing *Routing) [][2]string {
+
+	var upstreams [][2]string
+	add := func(alias, rawURL string) {
+		if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+			upstreams = append(upstreams, [2]string{alias, u.Host})
+		}
+	}
+
+	for alias, rawURL := range routing.Proxies {
+		add(alias, rawURL)
+	}
+	if routing.ForwardProxyURL != "" {
+		add("forward_proxy_url", routing.ForwardProxyURL)
+	}
+	for alias, members := range routing.Pools {
+		for _, member := range members {
+			add(alias, member.URL)
+		}
+	}
+
+	sort.Slice(upstreams, func(i, j int) bool {
+		return strings.Join(upstreams[i][:], " ") < strings.Join(upstreams[j][:], " ")
+	})
+
+	return upstreams
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestMetrics(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+	echo := startEchoServer(t)
+
+	conf := &Configuration{
+		AuthType: "basic", AuthUser: "user", AuthPassword: "secret", AuthRealm: "test",
+		MetricsListen: "127.0.0.1:0",
+		Proxies:       map[string]string{"parent": "http://127.0.0.1:1"},
+	}
+	health := newProxyHealth(&Configuration{UpstreamMaxFailures: 1, UpstreamRetryInterval: time.Minute})
+	health.markFailure("127.0.0.1:1", io.EOF)
+	metrics := newProxyMetrics(conf, newRouter(conf), health, newTunnelRegistry())
+
+	proxy := goproxy.NewProxyHttpServer()
+	setAuthenticationHandler(conf, proxy, nil)
+	proxyserver := httptest.NewServer(withMetrics(withRequestInfo(proxy), metrics))
+	defer proxyserver.Close()
+
+	for _, credentials := range []*url.Userinfo{url.UserPassword("user", "secret"), url.UserPassword("user", "wrong"), nil} {
+		proxyURL, _ := url.Parse(proxyserver.URL)
+		proxyURL.User = credentials
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	conn, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := echo.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n"+ProxyAuthorizatonHeader+": Basic "+
+		base64.StdEncoding.EncodeToString([]byte("user:secret"))+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected established tunnel, got %v", err)
+	}
+	io.WriteString(conn, "ping")
+	io.ReadFull(r, make([]byte, 4))
+	conn.Close()
+
+	expected := []string{
+		`microproxy_requests_total{method="CONNECT",code="200"} 1`,
+		`microproxy_requests_total{method="GET",code="200"} 1`,
+		`microproxy_requests_total{method="GET",code="407"} 2`,
+		`microproxy_auth_failures_total 1`,
+		`microproxy_upstream_up{alias="parent",upstream="127.0.0.1:1"} 0`,
+		`microproxy_upstream_failures{alias="parent",upstream="127.0.0.1:1"} 1`,
+	}
+
+	// requests are counted once their handlers return, which may happen after
+	// the client got the response
+	var body string
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body = w.Body.String()
+		if strings.Contains(body, expected[0]) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected '%s' in metrics:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "microproxy_sent_bytes_total 0\n") {
+		t.Error("Expected sent bytes to be counted")
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	origin := httptest.NewTLSServer(ConstantHanlder("OK"))
+	defer origin.Close()
+
+	metrics := newProxyMetrics(&Configuration{MetricsListen: "127.0.0.1:0"}, newRouter(&Configuration{}),
+		newProxyHealth(&Configuration{}), newTunnelRegistry())
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.TLSClientConfig = newUpstreamTLSConfig(&Configuration{TLSSessionCacheSize: 16}, true)
+	setConnectionMetricsHandler(proxy, metrics)
+
+	for i := 0; i < 3; i++ {
+		// the last request has to open a new connection and resume the session
+		if i == 2 {
+			proxy.Tr.CloseIdleConnections()
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, origin.URL, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %v", w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`microproxy_upstream_connections_total{reused="false"} 2`,
+		`microproxy_upstream_connections_total{reused="true"} 1`,
+		`microproxy_upstream_tls_handshakes_total{resumed="false"} 1`,
+		`microproxy_upstream_tls_handshakes_total{resumed="true"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Expected %q in metrics:\n%v", line, w.Body.String())
+		}
+	}
+}
@@ -6,16 +6,15 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
-	"sort"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
@@ -138,149 +137,112 @@ func makeDigestAuthValidator(auth *DigestAuth) DigestAuthFunc {
 	return authFunc
 }
 
+// setAllowedNetworksHandler denies requests from clients outside of allowed_networks
+// or inside disallowed_networks. Both lists are checked by a single handler, so the
+// client's address is parsed once per request or tunnel.
 func setAllowedNetworksHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
-	if conf.AllowedNetworks != nil && len(conf.AllowedNetworks) > 0 {
-		proxy.OnRequest(goproxy.Not(sourceIPMatches(conf.AllowedNetworks))).HandleConnect(goproxy.AlwaysReject)
-		proxy.OnRequest(goproxy.Not(sourceIPMatches(conf.AllowedNetworks))).DoFunc(
-			func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-				return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
-			})
-	}
-
-	if conf.DisallowedNetworks != nil && len(conf.DisallowedNetworks) > 0 {
-		proxy.OnRequest(sourceIPMatches(conf.DisallowedNetworks)).HandleConnect(goproxy.AlwaysReject)
-		proxy.OnRequest(sourceIPMatches(conf.DisallowedNetworks)).DoFunc(
-			func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-				return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
-			})
+	if len(conf.AllowedNetworks) == 0 && len(conf.DisallowedNetworks) == 0 {
+		return
 	}
-}
 
-func sourceIPMatches(networks []string) goproxy.ReqConditionFunc {
-	cidrs := make([](*net.IPNet), len(networks))
-	for idx, network := range networks {
-		_, cidrnet, _ := net.ParseCIDR(network)
-		cidrs[idx] = cidrnet
-	}
+	access := newClientAccess(conf)
+	access.start(conf, proxy)
 
-	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	denied := func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
 		ip, _, err := net.SplitHostPort(req.RemoteAddr)
 		if err != nil {
 			ctx.Warnf("couldn't parse remote address %v: %v", req.RemoteAddr, err)
-			return false
+			return !access.allowed.empty()
 		}
-		addr := net.ParseIP(ip)
-		for _, network := range cidrs {
-			if network.Contains(addr) {
-				return true
-			}
+
+		if rule := access.check(net.ParseIP(ip)); rule != "" {
+			denyRequest(ctx, rule)
+			return true
 		}
 		return false
 	}
+
+	proxy.OnRequest(goproxy.ReqConditionFunc(denied)).HandleConnect(goproxy.AlwaysReject)
+	proxy.OnRequest(goproxy.ReqConditionFunc(denied)).DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+		})
 }
 
-func setAllowedConnectPortsHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
-	if conf.AllowedConnectPorts != nil && len(conf.AllowedConnectPorts) > 0 {
-		ports := make([]string, len(conf.AllowedConnectPorts))
-		for i, v := range conf.AllowedConnectPorts {
-			ports[i] = ":" + strconv.Itoa(v)
+// parseNetworks parses validated networks, host names allowed in client access
+// lists are skipped.
+func parseNetworks(networks []string) [](*net.IPNet) {
+	cidrs := make([](*net.IPNet), 0, len(networks))
+	for _, network := range networks {
+		if _, cidrnet, err := net.ParseCIDR(network); err == nil {
+			cidrs = append(cidrs, cidrnet)
 		}
-		rx := "(" + strings.Join(ports, "|") + ")$"
-		proxy.OnRequest(goproxy.Not(goproxy.ReqHostMatches(regexp.MustCompile(rx)))).HandleConnect(goproxy.AlwaysReject)
 	}
+
+	return cidrs
 }
 
-func setForwardedForHeaderHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
-	f := func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		ip, _, err := net.SplitHostPort(req.RemoteAddr)
-		if err != nil {
-			ctx.Warnf("coudn't parse remote address %v: %v", req.RemoteAddr, err)
-			return req, nil
-		}
+func networksContain(cidrs [](*net.IPNet), addr net.IP) bool {
+	return matchingNetwork(cidrs, addr) != nil
+}
 
-		switch conf.ForwardedForHeader {
-		case "on":
-			header := req.Header.Get(proxyForwardedForHeader)
-			if header == "" {
-				req.Header.Add(proxyForwardedForHeader, ip)
-			} else {
-				header = header + ", " + ip
-				req.Header.Del(proxyForwardedForHeader)
-				req.Header.Add(proxyForwardedForHeader, header)
-			}
-		case "delete":
-			req.Header.Del(proxyForwardedForHeader)
-		case "truncate":
-			req.Header.Del(proxyForwardedForHeader)
-			req.Header.Add(proxyForwardedForHeader, ip)
+// matchingNetwork returns the first network containing addr or nil.
+func matchingNetwork(cidrs [](*net.IPNet), addr net.IP) *net.IPNet {
+	for _, network := range cidrs {
+		if network.Contains(addr) {
+			return network
 		}
-
-		return req, nil
 	}
 
-	proxy.OnRequest().DoFunc(f)
+	return nil
 }
 
-func setViaHeaderHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
-	handler := func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		switch conf.ViaHeader {
-		case "on":
-			header := req.Header.Get(proxyViaHeader)
-			if header == "" {
-				header = fmt.Sprintf("1.1 %s", conf.ViaProxyName)
-			} else {
-				header = fmt.Sprintf("%s, 1.1 %s", header, conf.ViaProxyName)
-			}
-			req.Header.Add(proxyViaHeader, header)
-		case "delete":
-			req.Header.Del(proxyViaHeader)
+func sourceIPMatches(networks []string) goproxy.ReqConditionFunc {
+	cidrs := parseNetworks(networks)
+
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ctx.Warnf("couldn't parse remote address %v: %v", req.RemoteAddr, err)
+			return false
 		}
-		return req, nil
+		return networksContain(cidrs, net.ParseIP(ip))
 	}
-
-	proxy.OnRequest().DoFunc(handler)
 }
 
-func setAddCustomHeadersHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
-	handler := func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		for _, headerData := range conf.AddHeaders {
-			if len(headerData) == 2 {
-				header := headerData[0]
-				value := headerData[1]
-				if len(header) > 0 && len(value) > 0 {
-					headerExists := (req.Header.Get(header) != "")
-					if !headerExists {
-						req.Header.Add(header, value)
-					}
-				}
-			}
+// connectPortAllowed matches CONNECT requests to allowed_connect_ports. It's checked
+// for every tunnel, so ports are looked up in a set instead of matching a regexp.
+func connectPortAllowed(ports []int) goproxy.ReqConditionFunc {
+	allowed := make(map[string]bool, len(ports))
+	for _, port := range ports {
+		allowed[strconv.Itoa(port)] = true
+	}
+
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		_, port, err := net.SplitHostPort(req.URL.Host)
+		if err == nil && allowed[port] {
+			return true
 		}
-		return req, nil
+		denyRequest(ctx, "allowed_connect_ports")
+		return false
 	}
+}
 
-	if len(conf.AddHeaders) > 0 {
-		proxy.OnRequest().DoFunc(handler)
+func setAllowedConnectPortsHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if len(conf.AllowedConnectPorts) > 0 {
+		proxy.OnRequest(goproxy.Not(connectPortAllowed(conf.AllowedConnectPorts))).HandleConnect(goproxy.AlwaysReject)
 	}
 }
 
 func makeCustomDialContext(localAddr *net.TCPAddr) func(context.Context, string, string) (net.Conn, error) {
-	return func(ctx context.Context, network, addr string) (net.Conn, error) {
-		remoteAddr, err := net.ResolveTCPAddr(network, addr)
-		if err != nil {
-			return nil, err
-		}
-
-		conn, err := net.DialTCP(network, localAddr, remoteAddr)
-		if err != nil {
-			return nil, err
-		}
-
-		err = conn.SetKeepAlive(true)
-		if err != nil {
-			return nil, err
-		}
+	dialer := &net.Dialer{KeepAlive: tcpKeepAliveInterval}
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
 
-		err = conn.SetKeepAlivePeriod(tcpKeepAliveInterval)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// the context bounds both name resolution and connection establishment
+		conn, err := dialer.DialContext(ctx, network, addr)
 		if err != nil {
 			return nil, err
 		}
@@ -310,6 +272,20 @@ func checkBindAddressOK(conf *Configuration) (bool, string, error) {
 	return false, "", nil
 }
 
+// newUpstreamTLSConfig returns TLS configuration of connections to origins and HTTPS
+// upstream proxies. Sessions are cached, so new connections to the same servers
+// skip full handshakes.
+func newUpstreamTLSConfig(conf *Configuration, insecure bool) *tls.Config {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecure || conf.InsecureSkipVerify,
+	}
+	if conf.TLSSessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(conf.TLSSessionCacheSize)
+	}
+
+	return tlsConfig
+}
+
 func createProxy(conf *Configuration) *goproxy.ProxyHttpServer {
 	proxy := goproxy.NewProxyHttpServer()
 	setActivityLog(conf, proxy)
@@ -331,39 +307,133 @@ func createProxy(conf *Configuration) *goproxy.ProxyHttpServer {
 		}
 	}
 
+	if len(conf.UserEgressIPs) > 0 {
+		proxy.Tr.DialContext = withUserEgress(conf.UserEgressIPs, proxy.Tr.DialContext)
+	}
+
+	if conf.EgressIPFamily == egressIPv4 || conf.EgressIPFamily == egressIPv6 || conf.ConnectTimeout > 0 {
+		dial := proxy.Tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		if conf.EgressIPFamily == egressIPv4 || conf.EgressIPFamily == egressIPv6 {
+			dial = restrictDialFamily(conf.EgressIPFamily, dial)
+		}
+		proxy.Tr.DialContext = withDialTimeout(conf.ConnectTimeout, dial)
+		// goproxy dials upstream proxies for CONNECT requests with Tr.Dial
+		proxy.Tr.Dial = func(network, addr string) (net.Conn, error) {
+			return proxy.Tr.DialContext(context.Background(), network, addr)
+		}
+	}
+
+	if conf.MaxConnectionsPerDestination > 0 {
+		dial := proxy.Tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		limiter := newDestinationLimiter(conf.MaxConnectionsPerDestination, conf.DestinationQueueTimeout)
+		proxy.Tr.DialContext = withDestinationLimit(limiter, dial)
+	}
+
+	proxy.Tr.TLSHandshakeTimeout = conf.TLSHandshakeTimeout
+	// the transport's dialer and TLS configuration are customized, so HTTP/2 is
+	// offered with ALPN only when forced
+	proxy.Tr.ForceAttemptHTTP2 = conf.UpstreamHTTP2
+	proxy.Tr.ResponseHeaderTimeout = conf.ResponseHeaderTimeout
+
 	return proxy
 }
 
 func setActivityLog(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	var w io.Writer = os.Stderr
+
 	if conf.ActivityLog != "" {
 		fh, err := os.OpenFile(conf.ActivityLog, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 		if err != nil {
 			log.Fatalf("couldn't open activity log file %v: %v", conf.ActivityLog, err)
 		}
-		proxy.Logger = log.New(fh, "", log.LstdFlags)
+		w = fh
+	}
+
+	tf, err := newTimeFormatter(conf.LogTimeFormat, conf.LogTimeZone, activityLogTimeLayout)
+	if err != nil {
+		log.Fatalf("couldn't set up log time format: %v", err)
+	}
+
+	l := newActivityLogger(conf, w, tf)
+	// levels changed at runtime survive reopening of the log
+	if levels := activityLogLevels(proxy); levels != nil {
+		l.levels = levels
 	}
+	proxy.Logger = l
 }
 
-func setSignalHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer, logger *ProxyLogger) {
+func setSignalHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer, logger *ProxyLogger, health *ProxyHealth,
+	servers *serverSet, tunnels *tunnelRegistry, tenants []*tenant,
+) {
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+
+	// the state is saved before a graceful restart, it isn't overwritten afterwards
+	// since the new process may have changed it already
+	exit := func(saveState bool) {
+		if saveState {
+			saveRuntimeState(conf, proxy, health)
+		}
+		err := logger.close()
+		if err != nil {
+			proxy.Logger.Printf("WARN: close error: %v\n", err)
+		}
+		if servers.connections != nil {
+			if err := servers.connections.close(); err != nil {
+				proxy.Logger.Printf("WARN: close error: %v\n", err)
+			}
+		}
+		for _, t := range tenants {
+			if err := t.logger.close(); err != nil {
+				t.proxy.Logger.Printf("WARN: close error: %v\n", err)
+			}
+		}
+		os.Exit(0)
+	}
 
 	signalHandler := func() {
 		for sig := range signalChannel {
 			switch sig {
 			case os.Interrupt, syscall.SIGTERM:
 				proxy.Logger.Printf("got interrupt signal, exiting\n")
-				err := logger.close()
-				if err != nil {
-					log.Printf("Close error: %v", err)
-				}
-				os.Exit(0)
+				exit(true)
 			case syscall.SIGUSR1:
-				proxy.Logger.Printf("got USR1 signal, reopening logs\n")
-				// reopen access log
-				logger.reopen()
-				// reopen activity log
-				setActivityLog(conf, proxy)
+				if conf.LogToStdout {
+					proxy.Logger.Printf("got USR1 signal, logs are written to standard streams, nothing to reopen\n")
+				} else {
+					proxy.Logger.Printf("got USR1 signal, reopening logs\n")
+					// reopen access log
+					logger.reopen()
+					// reopen activity log
+					setActivityLog(conf, proxy)
+					if servers.connections != nil {
+						servers.connections.reopen()
+					}
+				}
+				for _, t := range tenants {
+					t.reopenLogs()
+				}
+			case syscall.SIGUSR2:
+				toggleDebugLog(proxy)
+				for _, t := range tenants {
+					toggleDebugLog(t.proxy)
+				}
+			case syscall.SIGHUP:
+				proxy.Logger.Printf("got HUP signal, restarting\n")
+				// the new process loads the state at startup
+				saveRuntimeState(conf, proxy, health)
+				if err := servers.restart(); err != nil {
+					proxy.Logger.Printf("WARN: couldn't restart: %v\n", err)
+					continue
+				}
+				gracefulExit(conf, proxy, servers, tunnels, tenants)
+				exit(false)
 			}
 		}
 	}
@@ -371,8 +441,65 @@ func setSignalHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer, logge
 	go signalHandler()
 }
 
+// gracefulExit stops accepting new connections and waits until active requests
+// and tunnels are finished or restart_drain_timeout expires.
+func gracefulExit(conf *Configuration, proxy *goproxy.ProxyHttpServer, servers *serverSet, tunnels *tunnelRegistry,
+	tenants []*tenant,
+) {
+	ctx := context.Background()
+	if conf.RestartDrainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.RestartDrainTimeout)
+		defer cancel()
+	}
+
+	if err := servers.shutdown(ctx); err != nil {
+		proxy.Logger.Printf("WARN: couldn't finish active requests: %v\n", err)
+	}
+
+	tunnelLog := newModuleLogger(proxy, logModuleTunnel)
+	tunnelLog.logf(nil, slog.LevelInfo, "waiting for %v active tunnels to finish", tunnels.count())
+	if err := tunnels.wait(ctx); err != nil {
+		proxy.Logger.Printf("WARN: %v tunnels are still active: %v\n", tunnels.count(), err)
+	}
+
+	for _, t := range tenants {
+		if err := t.tunnels.wait(ctx); err != nil {
+			t.proxy.Logger.Printf("WARN: %v tunnels are still active: %v\n", t.tunnels.count(), err)
+		}
+	}
+}
+
+func loadRuntimeState(conf *Configuration, proxy *goproxy.ProxyHttpServer, health *ProxyHealth, bans *clientBans) {
+	if conf.StateDir == "" {
+		return
+	}
+
+	if err := health.loadState(conf.StateDir); err != nil {
+		proxy.Logger.Printf("WARN: couldn't load upstream health state: %v\n", err)
+	}
+	if bans != nil {
+		if err := bans.loadState(conf.StateDir); err != nil {
+			proxy.Logger.Printf("WARN: couldn't load bans: %v\n", err)
+		}
+	}
+}
+
+func saveRuntimeState(conf *Configuration, proxy *goproxy.ProxyHttpServer, health *ProxyHealth) {
+	if conf.StateDir == "" {
+		return
+	}
+
+	if err := health.saveState(conf.StateDir); err != nil {
+		proxy.Logger.Printf("WARN: couldn't save upstream health state: %v\n", err)
+	}
+}
+
 func setAuthenticationHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer, logger *ProxyLogger) {
-	if conf.AuthFile != "" {
+	if conf.AuthFile == "" && conf.AuthUser != "" {
+		auth := &basicAuth{users: map[string]string{conf.AuthUser: conf.AuthPassword}}
+		setProxyBasicAuth(proxy, conf.AuthRealm, makeBasicAuthValidator(auth), logger)
+	} else if conf.AuthFile != "" {
 		if conf.AuthType == "basic" {
 			auth, err := newBasicAuthFromFile(conf.AuthFile)
 			if err != nil {
@@ -386,6 +513,11 @@ func setAuthenticationHandler(conf *Configuration, proxy *goproxy.ProxyHttpServe
 				proxy.Logger.Printf("couldn't create digest auth structure: %v\n", err)
 				os.Exit(1)
 			}
+			auth.log = newModuleLogger(proxy, logModuleAuth)
+			if conf.ClusterRedisURL != "" {
+				// validated when configuration is loaded
+				auth.shared, _ = newRedisClient(conf.ClusterRedisURL)
+			}
 			setProxyDigestAuth(proxy, conf.AuthRealm, makeDigestAuthValidator(auth), logger)
 		}
 	} else {
@@ -406,7 +538,7 @@ func setHTTPSLoggingHandler(proxy *goproxy.ProxyHttpServer, logger *ProxyLogger)
 				logger.log(ctx)
 			}
 
-			return goproxy.OkConnect, host
+			return connectAction(ctx), host
 		})
 }
 
@@ -418,125 +550,266 @@ func setHTTPLoggingHandler(proxy *goproxy.ProxyHttpServer, logger *ProxyLogger)
 		})
 }
 
-func findMatchingProxy(host string, conf *Configuration) *url.URL {
-	var genericProxy *url.URL
-	var mostSpecificMatch *url.URL
-	mostSpecificLength := -1
-
-	// Get all rules keys and sort them by length in descending order
-	keys := make([]string, 0, len(conf.Rules))
-	for k := range conf.Rules {
-		keys = append(keys, k)
-	}
-
-	sort.Slice(keys, func(i, j int) bool {
-		return len(keys[i]) > len(keys[j])
-	})
-
-	// Iterate over sorted keys and find the most specific match
-	for _, domain := range keys {
-		proxyURL, exists := conf.Proxies[conf.Rules[domain]]
-		if !exists {
-			continue // Skip if the alias does not exist in the proxies map
-		}
-		parsedURL, _ := url.Parse(proxyURL)
-
-		if domain == "." {
-			genericProxy = parsedURL
-		} else if strings.HasSuffix(host, domain) && len(domain) > mostSpecificLength {
-			mostSpecificMatch = parsedURL
-			mostSpecificLength = len(domain)
+func connectDialWrapper(proxyURL *url.URL, proxy *goproxy.ProxyHttpServer, https *httpsProxies,
+	auth *upstreamAuth,
+) ConnectDialFunc {
+	if isSOCKSProxy(proxyURL) {
+		return func(network string, addr string) (net.Conn, error) {
+			return dialSOCKS5(context.Background(), proxy, proxyURL, network, addr)
 		}
 	}
-
-	if mostSpecificMatch != nil {
-		return mostSpecificMatch
+	if auth.ntlmScheme(proxyURL) != "" {
+		return func(network string, addr string) (net.Conn, error) {
+			return auth.dialConnect(context.Background(), proxyURL, addr)
+		}
 	}
-
-	if len(conf.ForwardProxyURL) > 0 {
-		genericProxy, _ = url.Parse(conf.ForwardProxyURL)
+	if isHTTPSProxy(proxyURL) {
+		return func(network string, addr string) (net.Conn, error) {
+			return https.dialConnect(context.Background(), proxyURL, addr)
+		}
 	}
 
-	return genericProxy
-}
-
-func findMatchingForwardProxyURL(req *http.Request, conf *Configuration) *url.URL {
-	hostname := req.URL.Hostname()
-	proxyURL := findMatchingProxy(hostname, conf)
-	return proxyURL
-}
-
-func findMatchingProxyString(req *http.Request, conf *Configuration) string {
-	proxyURL := findMatchingForwardProxyURL(req, conf)
-	return proxyURL.String()
-}
-
-func connectDialWrapper(proxyURLString string, proxy *goproxy.ProxyHttpServer) ConnectDialFunc {
 	return func(network string, addr string) (net.Conn, error) {
 		var cp ConnectDialFunc
 
-		proxyURL, err := url.Parse(proxyURLString)
-		if err != nil {
-			return nil, err
-		}
-
 		if len(proxyURL.User.String()) > 0 {
 			connectHandler := func(req *http.Request) {
 				req.Header.Del(ProxyAuthorizatonHeader)
 				if len(proxyURL.User.Username()) > 0 {
 					creds, err := url.QueryUnescape(proxyURL.User.String())
 					if err != nil {
-						proxy.Logger.Printf("can't decode the user credentials: %v", err)
+						newModuleLogger(proxy, logModuleRouting).logf(nil, slog.LevelWarn,
+							"can't decode the user credentials: %v", err)
 					}
 					req.Header.Set(ProxyAuthorizatonHeader, "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
 				}
 			}
-			cp = proxy.NewConnectDialToProxyWithHandler(proxyURLString, connectHandler)
+			cp = proxy.NewConnectDialToProxyWithHandler(proxyURL.String(), connectHandler)
 		} else {
-			cp = proxy.NewConnectDialToProxy(proxyURLString)
+			cp = proxy.NewConnectDialToProxy(proxyURL.String())
+		}
+
+		if cp == nil {
+			return nil, fmt.Errorf("unsupported upstream proxy scheme '%s'", proxyURL.Scheme)
 		}
 
 		return cp(network, addr)
 	}
 }
 
-func setForwardProxy(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
-	if len(conf.ForwardProxyURL) == 0 && len(conf.Rules) == 0 {
+// dialDirect connects to addr using the transport's dialer, so bind_ip and
+// connect_timeout settings apply. The dial is cancelled once ctx is done.
+func dialDirect(ctx context.Context, proxy *goproxy.ProxyHttpServer, network, addr string) (net.Conn, error) {
+	if proxy.Tr.DialContext != nil {
+		return proxy.Tr.DialContext(ctx, network, addr)
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func setForwardProxy(conf *Configuration, proxy *goproxy.ProxyHttpServer, router *Router, health *ProxyHealth) {
+	// forward proxies can be added at runtime through the admin API
+	if len(conf.ForwardProxyURL) == 0 && len(conf.Rules) == 0 && len(conf.UserRules) == 0 &&
+		conf.AdminListen == "" && conf.RouteFallback != routeFallbackDeny {
 		return
 	}
 
 	proxy.Logger.Printf("Setting up proxy transport\n")
+	router.health = health
+	fallback := newDirectFallback(conf)
+	routingLog := newModuleLogger(proxy, logModuleRouting)
+	https := newHTTPSProxies(conf, proxy)
+	auth := newUpstreamAuth(conf, proxy, https)
+
+	// Setup the Proxy function to dynamically select the proxy based on the request
+	proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		info := requestInfoFromRequest(req)
+		if info != nil && info.directFallback {
+			return nil, nil
+		}
+		match := findMatchingRoute(req, info, router)
+		setRequestUpstream(req, match.upstream(), true)
+		setRequestRule(req, match.ruleID())
+		switch match.kind {
+		case routeDeny:
+			return nil, errRouteDenied
+		case routeProxy:
+			if err := health.check(match.url.Host); err != nil {
+				return nil, err
+			}
+		}
+		return match.url, nil
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if match := findMatchingRoute(ctx.Req, getRequestInfo(ctx), router); match.kind == routeDeny {
+				denyRequest(ctx, match.ruleID())
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Access denied")
+				return goproxy.RejectConnect, host
+			}
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if match := findMatchingRoute(req, getRequestInfo(ctx), router); match.kind == routeDeny {
+				denyRequest(ctx, match.ruleID())
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+			}
 
-	proxy.Tr = &http.Transport{
-		// Setup the Proxy function to dynamically select the proxy based on the request
-		Proxy: func(req *http.Request) (*url.URL, error) {
-			return findMatchingForwardProxyURL(req, conf), nil
-		},
+			// Keep track of the upstream proxies' failures for plain HTTP requests
+			ctx.RoundTripper = goproxy.RoundTripperFunc(
+				func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+					// users' rules are known only after authentication handlers ran
+					info := getRequestInfo(ctx)
+					match := findMatchingRoute(req, info, router)
+					if match.kind == routeDeny {
+						denyRequest(ctx, match.ruleID())
+						return goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied"), nil
+					}
+					// the transport's Proxy function gets only the request
+					if requestInfoFromRequest(req) == nil {
+						req = req.WithContext(withRequestInfoContext(req.Context(), info))
+					}
+					base := requestTransport(req, proxy)
+					var tr http.RoundTripper = base
+					if match.kind == routeProxy && auth.ntlmScheme(match.url) != "" {
+						tr = auth.transport(base, match.url)
+					} else if match.kind == routeProxy && isHTTPSProxy(match.url) {
+						tr = https.transport(base, match.url)
+					}
+					resp, err := tr.RoundTrip(req)
+					if match.kind == routeProxy {
+						if err != nil {
+							health.markFailure(match.url.Host, err)
+						} else {
+							health.markSuccess(match.url.Host)
+						}
+						if fallback.retryable(req, resp, err) {
+							if err == nil {
+								resp.Body.Close()
+								err = fmt.Errorf("status %v", resp.StatusCode)
+							}
+							routingLog.logf(ctx, slog.LevelWarn, "upstream %v failed for %v: %v, falling back to DIRECT",
+								match.upstream(), req.URL.Host, err)
+							useDirectFallback(req)
+							return requestTransport(req, proxy).RoundTrip(req)
+						}
+					}
+					return resp, err
+				})
+			return req, nil
+		})
+
+	// CONNECT requests to direct_fallback_domains are dialed directly if their
+	// upstream proxy is down or refuses to connect
+	dialFallback := func(req *http.Request, match routeMatch, network, addr string, err error) (net.Conn, error) {
+		if !fallback.allowed(req.URL.Hostname()) {
+			return nil, err
+		}
+		routingLog.logf(nil, slog.LevelWarn, "upstream %v failed for %v: %v, falling back to DIRECT", match.upstream(), addr, err)
+		useDirectFallback(req)
+
+		return dialDirect(req.Context(), proxy, network, addr)
 	}
 
 	proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
-		// Check if addr needs to be proxied
-		proxyURL := findMatchingProxyString(req, conf)
+		match := findMatchingRoute(req, requestInfoFromRequest(req), router)
+		setRequestUpstream(req, match.upstream(), true)
+		setRequestRule(req, match.ruleID())
+
+		switch match.kind {
+		case routeDeny:
+			return nil, errRouteDenied
+		case routeDirect:
+			newModuleLogger(proxy, logModuleRouting).logf(nil, slog.LevelDebug, "Dialing directly to %v", addr)
+			return dialDirect(req.Context(), proxy, network, addr)
+		}
+
+		if err := health.check(match.url.Host); err != nil {
+			return dialFallback(req, match, network, addr, err)
+		}
 
-		// If no proxy is needed, dial directly
-		if proxyURL == "" {
-			proxy.Logger.Printf("Dialing directly to %v\n", addr)
-			return net.Dial(network, addr)
+		conn, err := connectDialWrapper(match.url, proxy, https, auth)(network, addr)
+		if err != nil {
+			health.markFailure(match.url.Host, err)
+			return dialFallback(req, match, network, addr, err)
 		}
+		health.markSuccess(match.url.Host)
 
-		return connectDialWrapper(proxyURL, proxy)(network, addr)
+		return conn, nil
 	}
 }
 
-func startServer(addr string, handler http.Handler) error {
-	err := http.ListenAndServe(addr, handler)
-	if err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
-	}
-	return nil
+// setProxyHandlers installs request handlers implementing the configured policies.
+func setProxyHandlers(conf *Configuration, proxy *goproxy.ProxyHttpServer, logger *ProxyLogger, router *Router,
+	health *ProxyHealth, tunnels *tunnelRegistry, feeds *threatFeeds, bans *clientBans, memory *memoryGuard,
+) {
+	setHTTPLoggingHandler(proxy, logger)
+	// requests read from decrypted tunnels get their requestInfo before other
+	// handlers look at it
+	setMITMHandler(conf, proxy)
+	setTracingHandler(conf, proxy)
+	// cheap checks of the client's address and CONNECT port go first, so unwanted
+	// tunnels are rejected before routing rules and destination lookups
+	setAllowedConnectPortsHandler(conf, proxy)
+	setAllowedNetworksHandler(conf, proxy)
+	setClientBansHandler(bans, proxy)
+	setForwardProxy(conf, proxy, router, health)
+	setRouteExplainHandler(conf, proxy, router)
+	setPACHandler(conf, proxy, router)
+	setEgressAllowlistHandler(conf, proxy)
+	setDestinationNetworksHandler(conf, proxy)
+	setMetadataProtectionHandler(conf, proxy)
+	setDestinationASNHandler(conf, proxy)
+	setDNSBLHandler(conf, proxy)
+	setThreatFeedsHandler(feeds, proxy)
+	setConnectRateHandler(conf, proxy)
+	setWebSocketHandler(conf, proxy)
+	setRequestHeadersHandler(conf, proxy)
+	setResponseHeadersHandler(conf, proxy)
+	setHostHeaderHandler(conf, proxy)
+	setStrictParsingHandler(conf, proxy)
+	setHeaderLimitsHandler(conf, proxy)
+	setURLLimitsHandler(conf, proxy)
+	setAllowedSchemesHandler(conf, proxy)
+	setExpectContinueHandler(conf, proxy)
+	setTrailersHandler(conf, proxy)
+	setResponseWatchdogHandler(conf, proxy)
+	setUserEgressHandler(conf, proxy)
+	setTrustedUserHandler(conf, proxy)
+	setIdentHandler(conf, proxy)
+
+	// To be called first while processing handlers' stack,
+	// has to be placed last in the source code.
+	setAuthenticationHandler(conf, proxy, logger)
+	// tokens are requested and bodies are buffered and signed only for
+	// authenticated requests, the signature covers headers as they are sent
+	setOAuthHandler(conf, proxy)
+	setAnnotationHandler(conf, proxy)
+	setRequestSigningHandler(conf, proxy, memory)
+
+	// wraps whatever CONNECT dialer was installed by the handlers above
+	setTunnelLoggingHandler(proxy, logger, tunnels)
+	setClientHelloFragmentHandler(conf, proxy)
+	setUpstreamLoggingHandler(proxy)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "eval":
+			os.Exit(runEval(os.Args[2:]))
+		case "lint":
+			os.Exit(runLint(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		case "config-schema":
+			os.Exit(runConfigSchema(os.Args[2:]))
+		}
+	}
+
 	configFile := flag.String("config", "microproxy.toml", "proxy configuration file")
 	proxyInsecure := flag.Bool("i", false, "allow insecure forward proxy connections")
 	testConfigOnly := flag.Bool("t", false, "only test configuration file")
@@ -552,30 +825,195 @@ func main() {
 	}
 
 	proxy := createProxy(conf)
-	proxy.Verbose = *verboseMode
+	setVerbose(proxy, *verboseMode)
 
 	logger := newProxyLogger(conf)
 
-	setHTTPLoggingHandler(proxy, logger)
-	setForwardProxy(conf, proxy)
-	setAllowedConnectPortsHandler(conf, proxy)
-	setAllowedNetworksHandler(conf, proxy)
-	setForwardedForHeaderHandler(conf, proxy)
-	setViaHeaderHandler(conf, proxy)
-	setAddCustomHeadersHandler(conf, proxy)
-	setSignalHandler(conf, proxy, logger)
+	servers := newServerSet()
+	servers.connections = newConnectionLogger(conf)
+	tunnels := newTunnelRegistry()
 
-	// To be called first while processing handlers' stack,
-	// has to be placed last in the source code.
-	setAuthenticationHandler(conf, proxy, logger)
+	health := newProxyHealth(conf)
+	// clients are banned through the admin API
+	var bans *clientBans
+	if conf.AdminListen != "" {
+		bans = newClientBans(conf)
+	}
+	loadRuntimeState(conf, proxy, health, bans)
+
+	router := newRouter(conf)
+
+	feeds := newThreatFeeds(conf)
+	feeds.start(proxy)
+
+	newSRVDiscovery(conf, router).start(proxy)
+
+	memory := newMemoryGuard(conf)
+	memory.start(proxy)
+
+	setProxyHandlers(conf, proxy, logger, router, health, tunnels, feeds, bans, memory)
+	shadow := newShadowEvaluator(conf, router, proxy)
+
+	tenants := newTenants(conf, memory, *verboseMode, *proxyInsecure)
+	setSignalHandler(conf, proxy, logger, health, servers, tunnels, tenants)
+	startIdleTunnelReaper(conf, proxy, tunnels)
+	startUpstreamPrewarming(conf, proxy, router)
 
-	proxy.Tr.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: *proxyInsecure,
+	proxy.Tr.TLSClientConfig = newUpstreamTLSConfig(conf, *proxyInsecure)
+
+	// listeners are inherited only until they are taken
+	restarted := servers.restarted()
+
+	// a restarted standby has already taken over
+	if conf.FailoverPeer != "" && !restarted {
+		waitForTakeover(conf, proxy, health, bans)
 	}
 
 	proxy.Logger.Printf("starting proxy\n")
-	proxy.Logger.Printf("listening on %v\n", conf.Listen)
 	proxy.Logger.Printf("using configuration file %v\n", *configFile)
 
-	log.Fatal(startServer(conf.Listen, proxy))
+	var err error
+	listeners := make([]*net.TCPListener, len(conf.Listen))
+	for i, addr := range conf.Listen {
+		if listeners[i], err = servers.listen(addr); err != nil {
+			log.Fatal(err)
+		}
+		proxy.Logger.Printf("listening on %v\n", addr)
+	}
+
+	if conf.AdminListen != "" {
+		var tlsConfig *tls.Config
+		if conf.AdminTLSCert != "" {
+			if tlsConfig, err = newAdminTLSConfig(conf, proxy); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		adminListener, err := servers.listen(conf.AdminListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		admin := newAdminServer(conf, *configFile, proxy, router, health, tunnels, feeds, bans)
+		admin.stats = logger.stats
+		go func() {
+			if err := servers.serve(adminListener, conf.AdminListen, admin, tlsConfig, nil); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		proxy.Logger.Printf("admin API listening on %v\n", conf.AdminListen)
+	}
+
+	metrics := newProxyMetrics(conf, router, health, tunnels)
+	setConnectionMetricsHandler(proxy, metrics)
+	if metrics != nil {
+		metricsListener, err := servers.listen(conf.MetricsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := servers.serve(metricsListener, conf.MetricsListen, metrics, nil, nil); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		proxy.Logger.Printf("metrics listening on %v\n", conf.MetricsListen)
+	}
+
+	if conf.HealthListen != "" {
+		healthListener, err := servers.listen(conf.HealthListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		checks := newHealthServer(conf, *configFile, servers, router, health)
+		go func() {
+			if err := servers.serve(healthListener, conf.HealthListen, checks, nil, nil); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		proxy.Logger.Printf("health checks listening on %v\n", conf.HealthListen)
+	}
+
+	if conf.StatsListen != "" {
+		statsListener, err := servers.listen(conf.StatsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		page := newStatsPage(logger.stats, tunnels)
+		go func() {
+			if err := servers.serve(statsListener, conf.StatsListen, page, nil, nil); err != nil {
+				log.Fatal(err)
+			}
+		}()
+		proxy.Logger.Printf("stats dashboard listening on %v\n", conf.StatsListen)
+	}
+
+	var socksListener *net.TCPListener
+	if conf.ListenSOCKS != "" {
+		if socksListener, err = servers.listen(conf.ListenSOCKS); err != nil {
+			log.Fatal(err)
+		}
+		proxy.Logger.Printf("SOCKS5 listening on %v\n", conf.ListenSOCKS)
+	}
+
+	var transparentListener *net.TCPListener
+	if conf.ListenTransparent != "" {
+		if transparentListener, err = servers.listen(conf.ListenTransparent); err != nil {
+			log.Fatal(err)
+		}
+		if err = allowTPROXY(transparentListener); err != nil {
+			proxy.Logger.Printf("WARN: connections intercepted by TPROXY won't be accepted: %v\n", err)
+		}
+		proxy.Logger.Printf("transparent proxy listening on %v\n", conf.ListenTransparent)
+	}
+
+	for _, t := range tenants {
+		t.serve(servers, memory)
+	}
+
+	// listening addresses might have been changed before restart
+	servers.closeInherited()
+
+	handler := withRequestInfo(withShadowEvaluation(withAccessLog(proxy, logger), shadow))
+	handler = withMemoryGuard(withAdmissionControl(handler, conf), memory)
+	handler = withMetrics(withPanicRecovery(handler, conf, proxy, metrics), metrics)
+
+	if socksListener != nil {
+		go func() {
+			if err := servers.serve(socksListener, conf.ListenSOCKS, withSOCKS(withRequestHeads(handler, conf), conf), nil, conf); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if transparentListener != nil {
+		go func() {
+			if err := servers.serve(transparentListener, conf.ListenTransparent, withTransparent(withRequestHeads(handler, conf)), nil, conf); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go notifySystemd(conf, proxy, servers, restarted)
+	go servers.notifyParent(conf.Listen)
+
+	// additional addresses are served in background, the first one blocks
+	for i := len(listeners) - 1; i > 0; i-- {
+		ln, addr := listeners[i], conf.Listen[i]
+		go func() {
+			if err := servers.serve(ln, addr, withRequestHeads(handler, conf), nil, conf); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if err := servers.serve(listeners[0], conf.Listen[0], withRequestHeads(handler, conf), nil, conf); err != nil {
+		log.Fatal(err)
+	}
+
+	// the server was shut down for a graceful restart, the signal handler exits
+	// once active tunnels are finished
+	select {}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// loadMITMCA loads the CA certificate and key which sign certificates of inspected
+// hosts.
+func loadMITMCA(certFile, keyFile string) (*tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if !ca.Leaf.IsCA {
+		return nil, errors.New("certificate is not a CA certificate")
+	}
+
+	return &ca, nil
+}
+
+const (
+	// maximal number of certificates kept by certCache, the least recently used
+	// ones are dropped first
+	mitmCertCacheSize = 1000
+	// certificates are generated again this long before they expire
+	mitmCertRenewBefore = 24 * time.Hour
+)
+
+// certCache keeps certificates generated for inspected hosts, so they are signed
+// once per host rather than for every tunnel. Certificates are generated outside
+// of the lock, concurrent tunnels to the same host wait for a single generation.
+type certCache struct {
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List // of *cachedCert, the most recently used first
+	certs   map[string]*list.Element
+	pending map[string]*certGeneration
+}
+
+type cachedCert struct {
+	hostname string
+	cert     *tls.Certificate
+	expires  time.Time
+}
+
+type certGeneration struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func newCertCache(size int) *certCache {
+	return &certCache{
+		size:    size,
+		lru:     list.New(),
+		certs:   make(map[string]*list.Element),
+		pending: make(map[string]*certGeneration),
+	}
+}
+
+func (c *certCache) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if elem, exists := c.certs[hostname]; exists {
+		if cached := elem.Value.(*cachedCert); time.Now().Before(cached.expires) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return cached.cert, nil
+		}
+		c.lru.Remove(elem)
+		delete(c.certs, hostname)
+	}
+	if generation, exists := c.pending[hostname]; exists {
+		c.mu.Unlock()
+		<-generation.done
+		return generation.cert, generation.err
+	}
+	generation := &certGeneration{done: make(chan struct{})}
+	c.pending[hostname] = generation
+	c.mu.Unlock()
+
+	generation.cert, generation.err = gen()
+	var expires time.Time
+	if generation.err == nil {
+		var leaf *x509.Certificate
+		if leaf, generation.err = x509.ParseCertificate(generation.cert.Certificate[0]); generation.err == nil {
+			expires = leaf.NotAfter.Add(-mitmCertRenewBefore)
+		}
+	}
+	if generation.err != nil {
+		generation.cert = nil
+	}
+
+	c.mu.Lock()
+	delete(c.pending, hostname)
+	if generation.err == nil {
+		c.certs[hostname] = c.lru.PushFront(&cachedCert{hostname: hostname, cert: generation.cert, expires: expires})
+		for c.lru.Len() > c.size {
+			oldest := c.lru.Remove(c.lru.Back()).(*cachedCert)
+			delete(c.certs, oldest.hostname)
+		}
+	}
+	c.mu.Unlock()
+	close(generation.done)
+
+	return generation.cert, generation.err
+}
+
+// matchesDomains reports whether host is one of domains or their subdomain,
+// domains are expected in lower case without the leading dot.
+func matchesDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setMITMHandler decrypts tunnels to mitm_domains with certificates signed by the
+// configured CA, so requests inside them go through the same handlers as plain
+// HTTP ones. The decision is made before authentication and applied by the last
+// CONNECT handler (see connectAction), so only authenticated tunnels are inspected.
+// Requests read from the tunnel get their own requestInfo with the user who
+// opened it.
+func setMITMHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if len(conf.MITMDomains) == 0 {
+		return
+	}
+
+	ca, err := loadMITMCA(conf.MITMCACert, conf.MITMCAKey)
+	if err != nil {
+		proxy.Logger.Printf("couldn't load MITM CA: %v\n", err)
+		os.Exit(1)
+	}
+
+	domains := make([]string, 0, len(conf.MITMDomains))
+	for _, domain := range conf.MITMDomains {
+		domains = append(domains, strings.ToLower(strings.TrimPrefix(domain, ".")))
+	}
+
+	proxy.CertStore = newCertCache(mitmCertCacheSize)
+	action := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(ca)}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			hostname := host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				hostname = h
+			}
+			if matchesDomains(strings.ToLower(hostname), domains) {
+				getRequestInfo(ctx).mitm = action
+			}
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			// goproxy passes the tunnel's UserData to requests read from it and
+			// drops requests returned by handlers, so the request's info is kept
+			// only in UserData
+			tunnel, ok := ctx.UserData.(*requestInfo)
+			if !ok || tunnel.mitm == nil || requestInfoFromRequest(req) != nil {
+				return req, nil
+			}
+
+			info := newRequestInfo()
+			info.user = tunnel.user
+			info.inspected = true
+			ctx.UserData = info
+
+			return req, nil
+		})
+}
+
+// connectAction returns the action for an accepted CONNECT request, tunnels chosen
+// for inspection by setMITMHandler are decrypted.
+func connectAction(ctx *goproxy.ProxyCtx) *goproxy.ConnectAction {
+	if info, ok := ctx.UserData.(*requestInfo); ok && info.mitm != nil {
+		return info.mitm
+	}
+
+	return goproxy.OkConnect
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestMITM(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "MITM CA"},
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	ca.writePEM(t, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+
+	background := httptest.NewTLSServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	conf := &Configuration{
+		AuthType: "basic", AuthUser: "user", AuthPassword: "secret", AuthRealm: "test",
+		MITMDomains: []string{"127.0.0.1"},
+		MITMCACert:  filepath.Join(dir, "ca.pem"),
+		MITMCAKey:   filepath.Join(dir, "ca.key"),
+		ResponseHeaderRules: []ResponseHeaderRule{
+			{Set: [][]string{{"X-Inspected", "yes"}}},
+		},
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	setMITMHandler(conf, proxy)
+	setResponseHeadersHandler(conf, proxy)
+	var user string
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		user = getRequestInfo(ctx).user
+		return resp
+	})
+	setAuthenticationHandler(conf, proxy, nil)
+
+	proxyserver := httptest.NewServer(withRequestInfo(proxy))
+	defer proxyserver.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(credentials *url.Userinfo) *http.Client {
+		proxyURL, _ := url.Parse(proxyserver.URL)
+		proxyURL.User = credentials
+		return &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	resp, err := newClient(url.UserPassword("user", "secret")).Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(msg) != "OK" {
+		t.Errorf("Expected 200 OK response, got %v '%s'", resp.StatusCode, msg)
+	}
+	if resp.Header.Get("X-Inspected") != "yes" {
+		t.Error("Expected response header rules to apply inside the tunnel")
+	}
+	if user != "user" {
+		t.Errorf("Expected tunnel's user for inspected request, got '%s'", user)
+	}
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer != "MITM CA" {
+		t.Errorf("Expected certificate signed by MITM CA, got one issued by '%s'", issuer)
+	}
+
+	if resp, err := newClient(url.UserPassword("user", "wrong")).Get(background.URL); err == nil {
+		resp.Body.Close()
+		t.Error("Expected tunnel to be rejected without valid credentials")
+	}
+}
+
+func TestMITMUserRules(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "MITM CA"},
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	ca.writePEM(t, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+
+	background := httptest.NewTLSServer(ConstantHanlder("OK"))
+	defer background.Close()
+	_, port, _ := net.SplitHostPort(background.Listener.Addr().String())
+
+	// the tunnel is allowed, requests read from it are denied by the user's rule
+	s := fmt.Sprintf("allowed_connect_ports = [%s]\nmitm_domains = [\"127.0.0.1\"]\n"+
+		"mitm_ca_cert = %q\nmitm_ca_key = %q\n[user_rules.user]\n\"127.0.0.1\" = \"DENY\"\n",
+		port, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	t.Setenv("AUTH_USER", "user")
+	t.Setenv("AUTH_PASS", "secret")
+	conf := newConfiguration(strings.NewReader(s))
+	conf.AccessLog = filepath.Join(dir, "access.log")
+
+	proxy := createProxy(conf)
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	setProxyHandlers(conf, proxy, newProxyLogger(conf), newRouter(conf), newProxyHealth(conf), newTunnelRegistry(), nil, nil, nil)
+	proxyserver := httptest.NewServer(withRequestInfo(proxy))
+	defer proxyserver.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	proxyURL, _ := url.Parse(proxyserver.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 status code of inspected request, got %v", resp.StatusCode)
+	}
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer != "MITM CA" {
+		t.Errorf("Expected the request to be inspected, got certificate issued by '%s'", issuer)
+	}
+}
+
+func TestLoadMITMCA(t *testing.T) {
+	dir := t.TempDir()
+	leaf := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}, nil)
+	leaf.writePEM(t, filepath.Join(dir, "leaf.pem"), filepath.Join(dir, "leaf.key"))
+
+	if _, err := loadMITMCA(filepath.Join(dir, "leaf.pem"), filepath.Join(dir, "leaf.key")); err == nil {
+		t.Error("Expected error for non-CA certificate")
+	}
+	if _, err := loadMITMCA(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("Expected error for missing files")
+	}
+}
+
+func TestCertCache(t *testing.T) {
+	var generated atomic.Int32
+	gen := func(notAfter time.Time) func() (*tls.Certificate, error) {
+		return func() (*tls.Certificate, error) {
+			generated.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			cert := newTestCertificate(t, &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				NotAfter:     notAfter,
+			}, nil).tlsCertificate()
+			return &cert, nil
+		}
+	}
+	valid := gen(time.Now().Add(365 * 24 * time.Hour))
+
+	cache := newCertCache(2)
+
+	// concurrent tunnels to the same host wait for a single generation
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Fetch("a.example.com", valid); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := generated.Load(); n != 1 {
+		t.Errorf("Expected 1 generated certificate, got %v", n)
+	}
+
+	// the least recently used certificate is dropped
+	cache.Fetch("b.example.com", valid)
+	cache.Fetch("a.example.com", valid)
+	cache.Fetch("c.example.com", valid)
+	cache.Fetch("a.example.com", valid)
+	if n := generated.Load(); n != 3 {
+		t.Errorf("Expected 3 generated certificates, got %v", n)
+	}
+	cache.Fetch("b.example.com", valid)
+	if n := generated.Load(); n != 4 {
+		t.Errorf("Expected evicted certificate to be generated again, got %v generations", n)
+	}
+
+	// certificates close to their expiry are generated again
+	expiring := gen(time.Now().Add(time.Hour))
+	cache.Fetch("d.example.com", expiring)
+	cache.Fetch("d.example.com", expiring)
+	if n := generated.Load(); n != 6 {
+		t.Errorf("Expected expiring certificate to be generated again, got %v generations", n)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// MaxMind DB format, see https://maxmind.github.io/MaxMind-DB/
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	mmdbDataSeparatorSize = 16
+	mmdbMaxMetadataSize   = 128 * 1024
+)
+
+// Types of data section fields.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBInvalid = errors.New("invalid MaxMind database")
+
+// mmdbReader looks up records of IP addresses in a MaxMind DB file, i.e. GeoLite2 ASN
+// database. Records are decoded to map[string]interface{}, []interface{}, string,
+// uint64, int64, float64, bool and []byte values.
+type mmdbReader struct {
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	treeSize     uint
+	ipv4Start    uint
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMMDBReader(data)
+}
+
+func newMMDBReader(data []byte) (*mmdbReader, error) {
+	searchFrom := 0
+	if len(data) > mmdbMaxMetadataSize {
+		searchFrom = len(data) - mmdbMaxMetadataSize
+	}
+
+	i := bytes.LastIndex(data[searchFrom:], mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", errMMDBInvalid)
+	}
+	metadataStart := searchFrom + i + len(mmdbMetadataMarker)
+
+	d := mmdbDecoder{data: data[metadataStart:]}
+	value, _, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata isn't a map", errMMDBInvalid)
+	}
+
+	r := &mmdbReader{data: data}
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	r.databaseType, _ = metadata["database_type"].(string)
+	r.nodeCount, r.recordSize, r.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", errMMDBInvalid, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", errMMDBInvalid, r.ipVersion)
+	}
+
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	if r.treeSize+mmdbDataSeparatorSize > uint(len(data)) {
+		return nil, fmt.Errorf("%w: search tree is truncated", errMMDBInvalid)
+	}
+
+	// IPv4 addresses are stored as ::a.b.c.d in IPv6 databases
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// readNode returns the left (bit is 0) or right (bit is 1) record of the node.
+func (r *mmdbReader) readNode(node uint, bit uint) uint {
+	offset := node * r.recordSize / 4
+	b := r.data[offset : offset+r.recordSize/4]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record of the IP address or nil if there is none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("%w: search tree is too deep", errMMDBInvalid)
+	}
+
+	offset := node - r.nodeCount - mmdbDataSeparatorSize
+	d := mmdbDecoder{data: r.data[r.treeSize+mmdbDataSeparatorSize:]}
+	value, _, err := d.decode(offset)
+
+	return value, err
+}
+
+// mmdbDecoder decodes fields of the data section, pointers are offsets from the
+// beginning of the section.
+type mmdbDecoder struct {
+	data []byte
+}
+
+func (d *mmdbDecoder) byteAt(offset uint) (byte, error) {
+	if offset >= uint(len(d.data)) {
+		return 0, fmt.Errorf("%w: unexpected end of data", errMMDBInvalid)
+	}
+
+	return d.data[offset], nil
+}
+
+func (d *mmdbDecoder) bytes(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.data)) {
+		return nil, fmt.Errorf("%w: unexpected end of data", errMMDBInvalid)
+	}
+
+	return d.data[offset : offset+size], nil
+}
+
+// decode returns the field at the offset and the offset of the next field.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	ctrl, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	kind := uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+
+	if kind == mmdbExtended {
+		extended, err := d.byteAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(extended)
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+
+		size = 0
+		for _, v := range b {
+			size = size<<8 | uint(v)
+		}
+		size += [...]uint{29, 285, 65821}[n-1]
+	}
+
+	return d.decodeValue(kind, size, offset)
+}
+
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pointer := uint(0)
+	if n < 4 {
+		pointer = uint(ctrl & 7)
+	}
+	for _, v := range b {
+		pointer = pointer<<8 | uint(v)
+	}
+	pointer += [...]uint{0, 2048, 526336, 0}[n-1]
+
+	return pointer, offset + n, nil
+}
+
+func (d *mmdbDecoder) decodeValue(kind, size, offset uint) (interface{}, uint, error) {
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key isn't a string", errMMDBInvalid)
+			}
+			m[name], offset, err = d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+
+	case mmdbArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			var err error
+			a[i], offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return b, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: invalid double size %d", errMMDBInvalid, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: invalid float size %d", errMMDBInvalid, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: invalid integer size %d", errMMDBInvalid, size)
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: invalid integer size %d", errMMDBInvalid, size)
+		}
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(v)), offset, nil
+		}
+		return int64(v), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: unsupported field type %d", errMMDBInvalid, kind)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	defaultNetworkHostsRefresh = time.Minute
+	networkHostsLookupTimeout  = 5 * time.Second
+)
+
+// isNetworkHost reports whether the allowed_networks or disallowed_networks entry is
+// a host name rather than an IP address or CIDR.
+func isNetworkHost(entry string) bool {
+	if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+		return false
+	}
+
+	letters := false
+	for _, label := range strings.Split(strings.TrimSuffix(entry, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+				letters = true
+			case r >= '0' && r <= '9', r == '-':
+			default:
+				return false
+			}
+		}
+	}
+
+	return letters
+}
+
+// networkList matches addresses against CIDRs and host names of a client access
+// list. Addresses of host names are resolved by refresh, they are kept if a lookup
+// fails and are removed only if the name doesn't exist anymore.
+type networkList struct {
+	cidrs  []*net.IPNet
+	hosts  []string
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+	// host name's addresses, replaced as a whole by refresh
+	resolved atomic.Pointer[map[string][]net.IP]
+}
+
+func newNetworkList(entries []string) *networkList {
+	l := &networkList{
+		lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+	}
+	for _, entry := range entries {
+		if isNetworkHost(entry) {
+			l.hosts = append(l.hosts, entry)
+		} else if _, network, err := net.ParseCIDR(entry); err == nil {
+			l.cidrs = append(l.cidrs, network)
+		}
+	}
+	l.resolved.Store(&map[string][]net.IP{})
+
+	return l
+}
+
+func (l *networkList) empty() bool {
+	return len(l.cidrs) == 0 && len(l.hosts) == 0
+}
+
+// match returns the first CIDR or host name containing addr or empty string.
+func (l *networkList) match(addr net.IP) string {
+	if network := matchingNetwork(l.cidrs, addr); network != nil {
+		return network.String()
+	}
+
+	resolved := *l.resolved.Load()
+	for _, host := range l.hosts {
+		for _, ip := range resolved[host] {
+			if ip.Equal(addr) {
+				return host
+			}
+		}
+	}
+
+	return ""
+}
+
+// refresh resolves all host names, an error is returned for every failed lookup.
+func (l *networkList) refresh() []error {
+	previous := *l.resolved.Load()
+	resolved := make(map[string][]net.IP, len(l.hosts))
+
+	var errs []error
+	for _, host := range l.hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), networkHostsLookupTimeout)
+		ips, err := l.lookup(ctx, host)
+		cancel()
+
+		switch {
+		case err == nil:
+			resolved[host] = ips
+		case isNotFound(err):
+			errs = append(errs, fmt.Errorf("%v doesn't exist anymore: %w", host, err))
+		default:
+			resolved[host] = previous[host]
+			errs = append(errs, fmt.Errorf("keeping %v addresses %v: %w", host, previous[host], err))
+		}
+	}
+	l.resolved.Store(&resolved)
+
+	return errs
+}
+
+// clientAccess checks clients' addresses against allowed_networks and
+// disallowed_networks.
+type clientAccess struct {
+	allowed    *networkList
+	disallowed *networkList
+}
+
+func newClientAccess(conf *Configuration) *clientAccess {
+	return &clientAccess{
+		allowed:    newNetworkList(conf.AllowedNetworks),
+		disallowed: newNetworkList(conf.DisallowedNetworks),
+	}
+}
+
+// check returns the rule denying the client, i.e. "allowed_networks" or
+// "disallowed_networks:10.0.0.0/8", or empty string if the client is allowed.
+func (a *clientAccess) check(addr net.IP) string {
+	if !a.allowed.empty() && a.allowed.match(addr) == "" {
+		return "allowed_networks"
+	}
+	if entry := a.disallowed.match(addr); entry != "" {
+		return "disallowed_networks:" + entry
+	}
+
+	return ""
+}
+
+// refresh resolves host names of both lists, failed lookups are written to the
+// proxy's activity log unless proxy is nil.
+func (a *clientAccess) refresh(proxy *goproxy.ProxyHttpServer) {
+	for _, list := range []struct {
+		option string
+		*networkList
+	}{{"allowed_networks", a.allowed}, {"disallowed_networks", a.disallowed}} {
+		for _, err := range list.refresh() {
+			if proxy != nil {
+				proxy.Logger.Printf("WARN: couldn't resolve host name of %s: %v\n", list.option, err)
+			}
+		}
+	}
+}
+
+// start resolves host names before returning, so admins on dynamic addresses aren't
+// denied right after start, and keeps re-resolving them every network_hosts_refresh.
+func (a *clientAccess) start(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if len(a.allowed.hosts) == 0 && len(a.disallowed.hosts) == 0 {
+		return
+	}
+
+	a.refresh(proxy)
+	go func() {
+		for {
+			time.Sleep(conf.NetworkHostsRefresh)
+			a.refresh(proxy)
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestIsNetworkHost(t *testing.T) {
+	tests := []struct {
+		entry string
+		host  bool
+	}{
+		{"admin.dyndns.example.com", true},
+		{"home-1.example.net.", true},
+		{"localhost", true},
+		{"10.0.0.0/8", false},
+		{"192.168.0.1", false},
+		{"2001:db8::/32", false},
+		{"10.0.0", false},
+		{"-bad.example.com", false},
+		{"under_score.example.com", false},
+	}
+
+	for _, test := range tests {
+		if host := isNetworkHost(test.entry); host != test.host {
+			t.Errorf("%s: expected host=%v, got %v", test.entry, test.host, host)
+		}
+	}
+}
+
+func TestClientAccessHostNames(t *testing.T) {
+	access := newClientAccess(&Configuration{
+		AllowedNetworks:    []string{"10.0.0.0/8", "admin.example.com"},
+		DisallowedNetworks: []string{"blocked.example.com"},
+	})
+
+	answers := map[string][]net.IP{
+		"admin.example.com":   {net.ParseIP("192.0.2.1")},
+		"blocked.example.com": {net.ParseIP("10.0.0.5")},
+	}
+	var lookupErr error
+	lookup := func(ctx context.Context, host string) ([]net.IP, error) {
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return answers[host], nil
+	}
+	access.allowed.lookup, access.disallowed.lookup = lookup, lookup
+	access.refresh(nil)
+
+	tests := []struct {
+		client, rule string
+	}{
+		{"10.0.0.1", ""},
+		{"192.0.2.1", ""},
+		{"192.0.2.2", "allowed_networks"},
+		{"10.0.0.5", "disallowed_networks:blocked.example.com"},
+	}
+	for _, test := range tests {
+		if rule := access.check(net.ParseIP(test.client)); rule != test.rule {
+			t.Errorf("%s: expected rule %q, got %q", test.client, test.rule, rule)
+		}
+	}
+
+	// the last known addresses are kept on temporary failures
+	lookupErr = errors.New("timeout")
+	access.refresh(nil)
+	if rule := access.check(net.ParseIP("192.0.2.1")); rule != "" {
+		t.Errorf("Expected the admin to stay allowed after a failed lookup, got %q", rule)
+	}
+
+	lookupErr = &net.DNSError{Err: "no such host", Name: "admin.example.com", IsNotFound: true}
+	access.refresh(nil)
+	if rule := access.check(net.ParseIP("192.0.2.1")); rule != "allowed_networks" {
+		t.Errorf("Expected the admin to be denied once the name doesn't exist, got %q", rule)
+	}
+}
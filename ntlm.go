@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLM messages' flags (MS-NLMP 2.2.2.5)
+const (
+	ntlmNegotiateUnicode         = 0x00000001
+	ntlmNegotiateOEM             = 0x00000002
+	ntlmRequestTarget            = 0x00000004
+	ntlmNegotiateNTLM            = 0x00000200
+	ntlmNegotiateAlwaysSign      = 0x00008000
+	ntlmNegotiateExtendedSession = 0x00080000
+	ntlmNegotiateTargetInfo      = 0x00800000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSession | ntlmNegotiateTargetInfo
+)
+
+// AV_PAIR id of the server's time in the challenge's target information
+const ntlmAvTimestamp = 7
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+var errNTLMChallenge = errors.New("malformed NTLM challenge")
+
+// ntlmNegotiateMessage returns the first message of the handshake.
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+
+	return msg
+}
+
+// ntlmChallenge is the server's CHALLENGE_MESSAGE.
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 48 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errNTLMChallenge
+	}
+
+	c := &ntlmChallenge{flags: binary.LittleEndian.Uint32(msg[20:]), challenge: msg[24:32]}
+	length, offset := int(binary.LittleEndian.Uint16(msg[40:])), int(binary.LittleEndian.Uint32(msg[44:]))
+	if offset > len(msg) || length > len(msg)-offset {
+		return nil, errNTLMChallenge
+	}
+	c.targetInfo = msg[offset : offset+length]
+
+	return c, nil
+}
+
+// timestamp returns the server's time from the target information, nil if it
+// isn't there.
+func (c *ntlmChallenge) timestamp() []byte {
+	for info := c.targetInfo; len(info) >= 4; {
+		id, length := binary.LittleEndian.Uint16(info), int(binary.LittleEndian.Uint16(info[2:]))
+		if len(info) < 4+length {
+			return nil
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+
+	return nil
+}
+
+// ntlmCredentials splits user of "DOMAIN\user" form, user names without domain
+// are sent as is, i.e. "user@domain" ones.
+func ntlmCredentials(user, password string) (domain, name, pass string) {
+	if d, u, found := strings.Cut(user, `\`); found {
+		return d, u, password
+	}
+
+	return "", user, password
+}
+
+func utf16le(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+
+	return b
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+// ntowfv2 returns NTLMv2 response key of the user.
+func ntowfv2(domain, user, password string) []byte {
+	return hmacMD5(md4(utf16le(password)), utf16le(strings.ToUpper(user)+domain))
+}
+
+// ntlmv2Responses returns LMv2 and NTLMv2 responses to the challenge, timestamp
+// is the server's time or the client's one in FILETIME format.
+func ntlmv2Responses(key []byte, c *ntlmChallenge, timestamp, clientChallenge []byte) (lm, nt []byte) {
+	temp := make([]byte, 0, 28+len(c.targetInfo)+4)
+	temp = append(temp, 1, 1, 0, 0, 0, 0, 0, 0)
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, c.targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	nt = append(hmacMD5(key, c.challenge, temp), temp...)
+	lm = append(hmacMD5(key, c.challenge, clientChallenge), clientChallenge...)
+
+	return lm, nt
+}
+
+// ntlmAuthenticateMessage returns the last message of the handshake answering the
+// server's challenge.
+func ntlmAuthenticateMessage(challenge []byte, user, password string) ([]byte, error) {
+	c, err := parseNTLMChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	timestamp := c.timestamp()
+	serverTime := timestamp != nil
+	if !serverTime {
+		timestamp = make([]byte, 8)
+		// 100ns intervals since January 1, 1601
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+
+	domain, name, password := ntlmCredentials(user, password)
+	lm, nt := ntlmv2Responses(ntowfv2(domain, name, password), c, timestamp, clientChallenge)
+	// LMv2 response is omitted when the server provides its time (MS-NLMP 3.1.5.1.2)
+	if serverTime {
+		lm = make([]byte, 24)
+	}
+
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(name), nil, nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		if len(field) > 0xffff {
+			return nil, fmt.Errorf("NTLM message field is too long")
+		}
+		// LmChallengeResponse, NtChallengeResponse, DomainName, UserName, Workstation
+		// and EncryptedRandomSessionKey fields
+		header := msg[12+8*i:]
+		binary.LittleEndian.PutUint16(header, uint16(len(field)))
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], ntlmNegotiateFlags&c.flags|ntlmNegotiateUnicode)
+
+	return msg, nil
+}
+
+// ntlmToken returns NTLM message from the header's value of the scheme, nil if
+// there is none.
+func ntlmToken(values []string, scheme string) []byte {
+	for _, value := range values {
+		name, token, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if !strings.EqualFold(name, scheme) {
+			continue
+		}
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token)); err == nil && len(b) > 0 {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// md4 implements MD4 hash function (RFC 1320), it's used only to derive NTLM keys
+// from passwords.
+func md4(data []byte) []byte {
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	length := uint64(len(data)) * 8
+	msg := append(append([]byte{}, data...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, length)
+
+	var x [16]uint32
+	for block := msg; len(block) > 0; block = block[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(block[4*i:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+
+		for _, i := range []int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+(b&c|^b&d)+x[i], 3)
+			d = bits.RotateLeft32(d+(a&b|^a&c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+(d&a|^d&b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+(c&d|^c&a)+x[i+3], 19)
+		}
+		for _, i := range []int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+(b&c|b&d|c&d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+(a&b|a&c|b&c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+(d&a|d&b|a&b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+(c&d|c&a|d&a)+x[i+12]+0x5a827999, 13)
+		}
+		for _, i := range []int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	sum := make([]byte, 0, 16)
+	for _, v := range []uint32{a, b, c, d} {
+		sum = binary.LittleEndian.AppendUint32(sum, v)
+	}
+
+	return sum
+}
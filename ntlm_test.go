@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestNTLMResponses(t *testing.T) {
+	// test vectors of MS-NLMP 4.2.4
+	if sum := hex.EncodeToString(md4(nil)); sum != "31d6cfe0d16ae931b73c59d7e0c089c0" {
+		t.Errorf("Unexpected MD4 of empty string %v", sum)
+	}
+	if sum := hex.EncodeToString(md4(utf16le("Password"))); sum != "a4f49c406510bdcab6824ee7c30fd852" {
+		t.Errorf("Unexpected NT hash %v", sum)
+	}
+
+	key := ntowfv2("Domain", "User", "Password")
+	if hex.EncodeToString(key) != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("Unexpected NTOWFv2 %x", key)
+	}
+
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	challenge, _ := hex.DecodeString("0123456789abcdef")
+	c := &ntlmChallenge{challenge: challenge, targetInfo: targetInfo}
+	lm, nt := ntlmv2Responses(key, c, make([]byte, 8), bytes.Repeat([]byte{0xaa}, 8))
+	if hex.EncodeToString(lm) != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("Unexpected LMv2 response %x", lm)
+	}
+	if hex.EncodeToString(nt[:16]) != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("Unexpected NTProofStr %x", nt[:16])
+	}
+
+	if _, err := ntlmAuthenticateMessage([]byte("NTLMSSP\x00"), "user", "secret"); err == nil {
+		t.Error("Expected truncated challenge to be rejected")
+	}
+	if domain, user, _ := ntlmCredentials(`CORP\user`, ""); domain != "CORP" || user != "user" {
+		t.Errorf("Unexpected credentials %v %v", domain, user)
+	}
+}
+
+// ntlmField returns the field of NTLM message with the header at offset.
+func ntlmField(msg []byte, offset int) []byte {
+	length, start := int(binary.LittleEndian.Uint16(msg[offset:])), int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start > len(msg) || length > len(msg)-start {
+		return nil
+	}
+
+	return msg[start : start+length]
+}
+
+// startNTLMProxy starts a proxy authenticating connections with NTLM of the scheme,
+// the number of handshakes is returned along with the server. The first request
+// for /reauthenticate path makes the proxy forget the connection's authentication.
+func startNTLMProxy(t *testing.T, scheme, user, password string) (*httptest.Server, func() int) {
+	t.Helper()
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmNegotiateFlags)
+	copy(msg[24:], challenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+	msg = append(msg, targetInfo...)
+	key := ntowfv2("", user, password)
+
+	var mu sync.Mutex
+	authenticated := make(map[string]bool)
+	handshakes := 0
+	forgotten := false
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		ok := authenticated[req.RemoteAddr]
+		if ok && req.URL.Path == "/reauthenticate" && !forgotten {
+			forgotten, ok = true, false
+			delete(authenticated, req.RemoteAddr)
+		}
+		mu.Unlock()
+
+		if !ok {
+			token := ntlmToken(req.Header.Values(ProxyAuthorizatonHeader), scheme)
+			switch {
+			case len(token) > 8 && binary.LittleEndian.Uint32(token[8:]) == 1:
+				mu.Lock()
+				handshakes++
+				mu.Unlock()
+				w.Header().Set("Proxy-Authenticate", scheme+" "+base64.StdEncoding.EncodeToString(msg))
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			case len(token) > 64 && binary.LittleEndian.Uint32(token[8:]) == 3:
+				nt := ntlmField(token, 20)
+				if len(nt) > 16 && bytes.Equal(hmacMD5(key, challenge, nt[16:]), nt[:16]) {
+					mu.Lock()
+					authenticated[req.RemoteAddr] = true
+					mu.Unlock()
+					break
+				}
+				fallthrough
+			default:
+				w.Header().Set("Proxy-Authenticate", scheme)
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+
+		if req.Method != http.MethodConnect {
+			body, _ := io.ReadAll(req.Body)
+			io.WriteString(w, req.URL.String()+" "+string(body))
+			return
+		}
+
+		dst, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(dst, conn)
+			dst.Close()
+		}()
+		io.Copy(conn, dst)
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return handshakes
+	}
+}
+
+func TestUpstreamNTLMAuth(t *testing.T) {
+	echo := startEchoServer(t)
+	srv, handshakes := startNTLMProxy(t, "NTLM", "user", "secret")
+	addr := srv.Listener.Addr().String()
+
+	proxyURL, _ := url.Parse("http://user:secret@" + addr)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.Proxy = nil
+	conf := &Configuration{UpstreamAuth: map[string]string{addr: upstreamAuthNTLM}}
+	auth := newUpstreamAuth(conf, proxy, newHTTPSProxies(conf, proxy))
+
+	conn, err := connectDialWrapper(proxyURL, proxy, auth.https, auth)("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected echoed message, got %q (%v)", buf, err)
+	}
+	conn.Close()
+
+	tr := auth.transport(proxy.Tr, proxyURL)
+	for _, body := range []string{"", "", "data"} {
+		var reader io.Reader
+		method := http.MethodGet
+		if body != "" {
+			reader, method = strings.NewReader(body), http.MethodPost
+		}
+		req, _ := http.NewRequest(method, "http://www.example.com/path", reader)
+		req.Header.Set(ProxyAuthorizatonHeader, "Basic client")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "http://www.example.com/path "+body {
+			t.Errorf("Expected request to be sent through the proxy, got %v %q", resp.StatusCode, b)
+		}
+	}
+	// CONNECT, the first request and the request with body, the second one reuses
+	// the authenticated connection
+	if n := handshakes(); n != 3 {
+		t.Errorf("Expected 3 handshakes, got %v", n)
+	}
+	if auth.transport(proxy.Tr, proxyURL) != tr {
+		t.Error("Expected transports to be reused")
+	}
+
+	// wrong credentials
+	proxyURL.User = url.UserPassword("user", "wrong")
+	if _, err := auth.dialConnect(context.Background(), proxyURL, echo.Addr().String()); err == nil {
+		t.Error("Expected CONNECT with wrong credentials to fail")
+	}
+
+	// proxies without upstream_auth entry use Basic authentication
+	proxyURL.Host = "proxy.example.com:3128"
+	if scheme := auth.ntlmScheme(proxyURL); scheme != "" {
+		t.Errorf("Expected Basic authentication, got %v", scheme)
+	}
+}
+
+func TestNTLMTransportReauthentication(t *testing.T) {
+	srv, handshakes := startNTLMProxy(t, "NTLM", "user", "secret")
+	addr := srv.Listener.Addr().String()
+
+	proxyURL, _ := url.Parse("http://user:secret@" + addr)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.Proxy = nil
+	conf := &Configuration{UpstreamAuth: map[string]string{addr: upstreamAuthNTLM}}
+	auth := newUpstreamAuth(conf, proxy, newHTTPSProxies(conf, proxy))
+	tr := auth.transport(proxy.Tr, proxyURL).(*ntlmTransport)
+
+	get := func(path string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://www.example.com"+path, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: expected 200 status code, got %v", path, resp.StatusCode)
+		}
+	}
+
+	get("/")
+	if len(tr.idle) != 1 {
+		t.Fatalf("Expected authenticated connection to be kept, got %v", len(tr.idle))
+	}
+	stale := tr.idle[0]
+
+	// the proxy asks the idle connection to authenticate again, the request is
+	// retried over a new connection
+	get("/reauthenticate")
+	if n := handshakes(); n != 2 {
+		t.Errorf("Expected 2 handshakes, got %v", n)
+	}
+	if len(tr.idle) != 1 || tr.idle[0] == stale {
+		t.Fatal("Expected only the new connection to be kept")
+	}
+	if _, err := stale.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected the stale connection to be closed, got %v", err)
+	}
+}
+
+func TestUpstreamNegotiateAuth(t *testing.T) {
+	echo := startEchoServer(t)
+	srv, _ := startNTLMProxy(t, "Negotiate", `user`, "secret")
+	addr := srv.Listener.Addr().String()
+
+	proxyURL, _ := url.Parse(`http://CORP%5Cuser:secret@` + addr)
+	proxy := goproxy.NewProxyHttpServer()
+	conf := &Configuration{UpstreamAuth: map[string]string{addr: upstreamAuthNegotiate}}
+	auth := newUpstreamAuth(conf, proxy, newHTTPSProxies(conf, proxy))
+
+	// the proxy verifies responses of users without domain
+	if _, err := auth.dialConnect(context.Background(), proxyURL, echo.Addr().String()); err == nil {
+		t.Error("Expected response with the domain to be rejected")
+	}
+
+	proxyURL.User = url.UserPassword("user", "secret")
+	conn, err := auth.dialConnect(context.Background(), proxyURL, echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
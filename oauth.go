@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	oauthTokenTimeout = 30 * time.Second
+	// tokens are refreshed a bit earlier, so they don't expire on the way
+	oauthRefreshMargin = 30 * time.Second
+	// used if the token response has no expires_in
+	defaultOAuthTokenLifetime = 5 * time.Minute
+)
+
+// OAuthRule injects access tokens obtained with the client credentials grant
+// (RFC 6749, section 4.4) into requests to hosts and their subdomains.
+type OAuthRule struct {
+	Hosts        []string `toml:"hosts"`
+	TokenURL     string   `toml:"token_url"`
+	ClientID     string   `toml:"client_id"`
+	ClientSecret string   `toml:"client_secret"`
+	Scopes       []string `toml:"scopes"`
+}
+
+// oauthTokenSource caches the rule's token and fetches a new one when it's about
+// to expire, concurrent requests wait for the same fetch.
+type oauthTokenSource struct {
+	rule   OAuthRule
+	hosts  []string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (s *oauthTokenSource) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Add(oauthRefreshMargin).Before(s.expires) {
+		return s.token, nil
+	}
+
+	token, lifetime, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expires = token, time.Now().Add(lifetime)
+
+	return s.token, nil
+}
+
+// fetch requests a new token, client's credentials are sent with basic auth.
+func (s *oauthTokenSource) fetch() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.rule.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.rule.Scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.rule.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.rule.ClientID), url.QueryEscape(s.rule.ClientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint returned %v: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, fmt.Errorf("couldn't parse token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type '%s'", token.TokenType)
+	}
+
+	lifetime := defaultOAuthTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+
+	return token.AccessToken, lifetime, nil
+}
+
+// setOAuthHandler sets Authorization header of requests to hosts of oauth_tokens
+// rules to a bearer token of the first matching rule, requests which already have
+// the header are left as they are. Tokens are requested through the proxy's
+// transport, so bind_ip and routing rules apply to the token endpoints as well.
+// Only plain HTTP requests and requests in inspected tunnels (mitm_domains) get
+// tokens.
+func setOAuthHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if len(conf.OAuthTokens) == 0 {
+		return
+	}
+
+	client := &http.Client{Transport: proxy.Tr, Timeout: oauthTokenTimeout}
+	sources := make([]*oauthTokenSource, 0, len(conf.OAuthTokens))
+	for _, rule := range conf.OAuthTokens {
+		s := &oauthTokenSource{rule: rule, client: client}
+		for _, host := range rule.Hosts {
+			s.hosts = append(s.hosts, strings.ToLower(strings.TrimPrefix(host, ".")))
+		}
+		sources = append(sources, s)
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if req.Header.Get("Authorization") != "" {
+				return req, nil
+			}
+
+			host := strings.ToLower(req.URL.Hostname())
+			for _, s := range sources {
+				if !matchesDomains(host, s.hosts) {
+					continue
+				}
+
+				token, err := s.get()
+				if err != nil {
+					proxy.Logger.Printf("WARN: couldn't obtain access token from %v: %v\n", s.rule.TokenURL, err)
+					return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway,
+						"Couldn't obtain access token")
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+				break
+			}
+
+			return req, nil
+		})
+}
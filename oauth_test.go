@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOAuthTokens(t *testing.T) {
+	var issued atomic.Int64
+	var expiresIn atomic.Int64
+	expiresIn.Store(3600)
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "client" || secret != "secret" || req.FormValue("grant_type") != "client_credentials" ||
+			req.FormValue("scope") != "read write" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		n := issued.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token" + strconv.FormatInt(n, 10),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn.Load(),
+		})
+	}))
+	defer tokens.Close()
+
+	authorization := make(chan string, 1)
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization <- req.Header.Get("Authorization")
+	}))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	conf := &Configuration{OAuthTokens: []OAuthRule{
+		{Hosts: []string{"127.0.0.1"}, TokenURL: tokens.URL, ClientID: "client", ClientSecret: "secret", Scopes: []string{"read", "write"}},
+	}}
+	setOAuthHandler(conf, proxy)
+
+	get := func(header string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, ""
+		}
+		return resp.StatusCode, <-authorization
+	}
+
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", "Bearer token1"},
+		// cached until it's about to expire
+		{"", "Bearer token1"},
+		{"Basic dXNlcjpwYXNz", "Basic dXNlcjpwYXNz"},
+	}
+	for _, test := range tests {
+		if _, auth := get(test.header); auth != test.expected {
+			t.Errorf("Expected '%s' header, got '%s'", test.expected, auth)
+		}
+	}
+
+	// tokens expiring within the refresh margin are requested every time
+	expiresIn.Store(1)
+	client, proxy, proxyserver = oneShotProxy()
+	defer proxyserver.Close()
+	setOAuthHandler(conf, proxy)
+	for _, expected := range []string{"Bearer token2", "Bearer token3"} {
+		if _, auth := get(""); auth != expected {
+			t.Errorf("Expected '%s' header, got '%s'", expected, auth)
+		}
+	}
+
+	conf.OAuthTokens[0].ClientSecret = "wrong"
+	client, proxy, proxyserver = oneShotProxy()
+	defer proxyserver.Close()
+	setOAuthHandler(conf, proxy)
+	if status, _ := get(""); status != http.StatusBadGateway {
+		t.Errorf("Expected 502 status if the token can't be obtained, got %v", status)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+const pacPath = "/proxy.pac"
+
+// setPACHandler serves a proxy auto-config file at /proxy.pac of the proxy's
+// listener. The file is generated from the current routing on every request, so
+// changes made through the admin API or by restart with a new configuration are
+// picked up by browsers when they reload it. Clients which aren't allowed to use
+// the proxy get a file sending everything directly.
+func setPACHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer, router *Router) {
+	if !conf.ServePAC {
+		return
+	}
+
+	access := newClientAccess(conf)
+	access.start(conf, proxy)
+
+	next := proxy.NonproxyHandler
+	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != pacPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+		addr := net.ParseIP(ip)
+		if access.check(addr) != "" {
+			io.WriteString(w, "function FindProxyForURL(url, host) {\n\treturn \"DIRECT\";\n}\n")
+			return
+		}
+
+		io.WriteString(w, generatePAC(router.routing(), pacProxyAddress(conf, req)))
+	})
+}
+
+// pacProxyAddress returns pac_proxy_address or the first listening address,
+// unspecified IP address is replaced by the host the client fetched the file from.
+func pacProxyAddress(conf *Configuration, req *http.Request) string {
+	if conf.PACProxyAddress != "" {
+		return conf.PACProxyAddress
+	}
+
+	host, port, err := net.SplitHostPort(conf.Listen[0])
+	if err != nil {
+		return conf.Listen[0]
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if reqHost, _, err := net.SplitHostPort(req.Host); err == nil {
+			host = reqHost
+		} else {
+			host = req.Host
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// generatePAC converts routing rules to a PAC file. Hosts which host rules route
+// DIRECT are connected to directly by browsers, everything else goes through the
+// proxy, so it can be routed by users' rules, forward_proxy_url or denied. Network
+// rules are checked only for IPv4 literals, browsers don't resolve host names for
+// them.
+func generatePAC(routing *Routing, proxyAddr string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "\tvar proxy = %q;\n", "PROXY "+proxyAddr)
+	fmt.Fprintf(&b, "\tvar ip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+	fmt.Fprintf(&b, "\thost = host.toLowerCase();\n")
+
+	// users' rules have priority over host rules and aren't known until the
+	// user is authenticated by the proxy
+	identities := make([]string, 0, len(routing.identityRules))
+	for identity := range routing.identityRules {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+
+	for _, identity := range identities {
+		set := routing.identityRules[identity]
+		if set.generic != nil {
+			b.WriteString("\treturn proxy;\n}\n")
+			return b.String()
+		}
+		// exclusions are ignored, sending more hosts to the proxy is harmless
+		for _, rule := range append(append([]compiledRule{}, set.rules...), set.networks...) {
+			if cond := pacMatch(&rule); cond != "" {
+				fmt.Fprintf(&b, "\tif (%s) return proxy;\n", cond)
+			}
+		}
+	}
+
+	set := &routing.hostRules
+	rules := append(append([]compiledRule{}, set.rules...), set.networks...)
+	// the generic rule is used only if there is no forward_proxy_url
+	if set.generic != nil && routing.forward == nil {
+		rules = append(rules, *set.generic)
+	}
+
+	for i := range rules {
+		cond := pacCondition(&rules[i])
+		if cond == "" {
+			continue
+		}
+		result := "proxy"
+		if rules[i].kind == routeDirect {
+			result = `"DIRECT"`
+		}
+		if cond == "true" {
+			fmt.Fprintf(&b, "\treturn %s;\n}\n", result)
+			return b.String()
+		}
+		fmt.Fprintf(&b, "\tif (%s) return %s;\n", cond, result)
+	}
+
+	b.WriteString("\treturn proxy;\n}\n")
+
+	return b.String()
+}
+
+// pacCondition returns JavaScript expression matching the same hosts as the rule
+// or empty string if the rule can't be expressed.
+func pacCondition(rule *compiledRule) string {
+	cond := pacMatch(rule)
+	if cond == "" {
+		return ""
+	}
+
+	for i := range rule.excludes {
+		if exclude := pacMatch(&rule.excludes[i]); exclude != "" {
+			cond += " && !(" + exclude + ")"
+		}
+	}
+
+	return cond
+}
+
+func pacMatch(rule *compiledRule) string {
+	if rule.network == nil {
+		if rule.domain == "." {
+			return "true"
+		}
+		return fmt.Sprintf("dnsDomainIs(host, %q)", strings.ToLower(rule.domain))
+	}
+
+	ip := rule.network.IP.To4()
+	if ip == nil || len(rule.network.Mask) != net.IPv4len {
+		return ""
+	}
+
+	return fmt.Sprintf("ip && isInNet(host, %q, %q)", ip.String(), net.IP(rule.network.Mask).String())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	conf := &Configuration{
+		Proxies: map[string]string{"parent": "http://10.0.0.1:3128"},
+		Rules: map[string]string{
+			".corp.example.com":      "DIRECT",
+			"!.dev.corp.example.com": "DIRECT",
+			"vpn.corp.example.com":   "parent",
+			"10.0.0.0/8":             "DIRECT",
+			"2001:db8::/32":          "DIRECT",
+			".":                      "parent",
+		},
+		UserRules: map[string]map[string]string{"alice": {".internal": "parent"}},
+	}
+
+	pac := generatePAC(newRouter(conf).routing(), "proxy.example.com:3128")
+
+	expected := []string{
+		`var proxy = "PROXY proxy.example.com:3128";`,
+		`if (dnsDomainIs(host, ".internal")) return proxy;`,
+		`if (dnsDomainIs(host, "vpn.corp.example.com")) return proxy;`,
+		`if (dnsDomainIs(host, ".corp.example.com") && !(dnsDomainIs(host, ".dev.corp.example.com"))) return "DIRECT";`,
+		`if (ip && isInNet(host, "10.0.0.0", "255.0.0.0") && !(dnsDomainIs(host, ".dev.corp.example.com"))) return "DIRECT";`,
+		"return proxy;\n}",
+	}
+
+	last := -1
+	for _, line := range expected {
+		idx := strings.Index(pac, line)
+		if idx < 0 || idx < last {
+			t.Fatalf("Expected %q in the right order, got\n%s", line, pac)
+		}
+		last = idx
+	}
+
+	if strings.Contains(pac, "2001:db8") {
+		t.Errorf("IPv6 networks must be skipped, got\n%s", pac)
+	}
+}
+
+func TestPACHandler(t *testing.T) {
+	conf := &Configuration{
+		Listen:          listenAddresses{"0.0.0.0:3128"},
+		ServePAC:        true,
+		AllowedNetworks: []string{"192.0.2.0/24"},
+		Rules:           map[string]string{".example.com": "DIRECT"},
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	setPACHandler(conf, proxy, newRouter(conf))
+
+	tests := []struct {
+		remote   string
+		expected string
+	}{
+		{"192.0.2.1:1234", `"PROXY proxy.example.org:3128"`},
+		{"198.51.100.1:1234", "return \"DIRECT\";\n}"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://proxy.example.org:3128/proxy.pac", nil)
+		req.RequestURI = "/proxy.pac"
+		req.URL.Scheme, req.URL.Host = "", ""
+		req.RemoteAddr = test.remote
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		body, _ := io.ReadAll(w.Body)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ns-proxy-autoconfig" ||
+			!strings.Contains(string(body), test.expected) {
+			t.Errorf("%s: unexpected response %v %v\n%s", test.remote, w.Code, w.Header(), body)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// withPanicRecovery keeps a panic in one request's handlers from being handled as
+// a broken connection only: it's logged with the stack trace, counted in metrics
+// and written to crash_report_dir, and the client gets 502 response if nothing
+// was sent yet. Panics in tunnels' and other background goroutines aren't
+// recovered. metrics may be nil.
+func withPanicRecovery(handler http.Handler, conf *Configuration, proxy *goproxy.ProxyHttpServer,
+	metrics *proxyMetrics,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rw := &recoveryWriter{ResponseWriter: w}
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			// deliberate aborts of the response, i.e. by response_stall_timeout
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+
+			stack := debug.Stack()
+			proxy.Logger.Printf("WARN: panic while handling %v %v from %v: %v\n%s", req.Method, req.URL, req.RemoteAddr,
+				value, stack)
+			if metrics != nil {
+				metrics.panics.Add(1)
+			}
+			if conf.CrashReportDir != "" {
+				if path, err := writeCrashReport(conf.CrashReportDir, req, value, stack); err != nil {
+					proxy.Logger.Printf("WARN: couldn't write crash report: %v\n", err)
+				} else {
+					proxy.Logger.Printf("WARN: crash report written to %v\n", path)
+				}
+			}
+
+			if rw.started {
+				// the client mustn't take a truncated response as complete
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(rw, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}()
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// writeCrashReport saves the panic with the request's description and the stack
+// trace, the report's path is returned.
+func writeCrashReport(dir string, req *http.Request, value interface{}, stack []byte) (string, error) {
+	now := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("microproxy-crash-%s-%d.txt", now.Format("20060102-150405.000000"), os.Getpid()))
+
+	report := fmt.Sprintf("time: %s\npanic: %v\nrequest: %s %s %s\nclient: %s\n\n%s",
+		now.Format(time.RFC3339Nano), value, req.Method, req.URL, req.Proto, req.RemoteAddr, stack)
+
+	return path, os.WriteFile(path, []byte(report), 0o600)
+}
+
+// recoveryWriter records whether the response was started, so a panicking
+// handler's client doesn't get a second one. Responses written after the
+// connection was hijacked, i.e. by goproxy after WebSocket connections, are
+// dropped instead of being reported by the server.
+type recoveryWriter struct {
+	http.ResponseWriter
+	started  bool
+	hijacked bool
+}
+
+func (w *recoveryWriter) WriteHeader(status int) {
+	if w.hijacked {
+		return
+	}
+	// informational responses are followed by the final one
+	if status >= http.StatusOK {
+		w.started = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoveryWriter) Write(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoveryWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.hijacked {
+		w.started = true
+		f.Flush()
+	}
+}
+
+func (w *recoveryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	w.started = true
+	conn, rw, err := hijacker.Hijack()
+	w.hijacked = err == nil
+	return conn, rw, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	dir := t.TempDir()
+	conf := &Configuration{CrashReportDir: dir}
+	metrics := newProxyMetrics(&Configuration{MetricsListen: "127.0.0.1:0"}, newRouter(&Configuration{}),
+		newProxyHealth(&Configuration{}), newTunnelRegistry())
+	var out bytes.Buffer
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = log.New(&out, "", 0)
+
+	handler := withPanicRecovery(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/started" {
+			io.WriteString(w, "partial")
+			w.(http.Flusher).Flush()
+		}
+		var m map[string]int
+		m["boom"]++
+	}), conf, proxy, metrics)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %v", resp.StatusCode)
+	}
+
+	// the response can't be replaced once started, the connection is aborted
+	if resp, err := http.Get(server.URL + "/started"); err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Error("Expected started response to be aborted")
+		}
+	}
+
+	if n := metrics.panics.Load(); n != 2 {
+		t.Errorf("Expected 2 panics counted, got %v", n)
+	}
+	if !strings.Contains(out.String(), "panic while handling GET / from") || !strings.Contains(out.String(), "panic_test.go") {
+		t.Errorf("Expected panic with stack trace in log, got:\n%v", out.String())
+	}
+
+	reports, _ := filepath.Glob(filepath.Join(dir, "microproxy-crash-*.txt"))
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 crash reports, got %v", reports)
+	}
+	report, _ := os.ReadFile(reports[0])
+	if !strings.Contains(string(report), "panic: assignment to entry in nil map") || !strings.Contains(string(report), "request: GET ") {
+		t.Errorf("Unexpected crash report:\n%s", report)
+	}
+}
+
+func TestPanicRecoveryAbort(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	handler := withPanicRecovery(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic(http.ErrAbortHandler)
+	}), &Configuration{}, proxy, nil)
+
+	defer func() {
+		if value := recover(); value != http.ErrAbortHandler {
+			t.Errorf("Expected http.ErrAbortHandler to be passed through, got %v", value)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const defaultPrewarmMaxIdle = 30 * time.Second
+
+type warmConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+// warmPool keeps pre-established TCP connections to upstream proxies, dials to
+// their addresses take an idle connection instead of waiting for a new handshake.
+// Connections idle longer than maxIdle are closed, upstreams would drop them anyway.
+type warmPool struct {
+	size    int
+	maxIdle time.Duration
+	dial    dialContextFunc
+
+	mu   sync.Mutex
+	idle map[string][]warmConn
+}
+
+func newWarmPool(size int, maxIdle time.Duration, dial dialContextFunc) *warmPool {
+	return &warmPool{size: size, maxIdle: maxIdle, dial: dial, idle: make(map[string][]warmConn)}
+}
+
+func (p *warmPool) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn := p.take(addr); conn != nil {
+		return conn, nil
+	}
+
+	return p.dial(ctx, network, addr)
+}
+
+// take returns an idle connection to addr or nil if there is none.
+func (p *warmPool) take(addr string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[addr]
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		p.idle[addr] = conns
+		if time.Since(c.dialed) < p.maxIdle {
+			return c.Conn
+		}
+		c.Close()
+	}
+
+	return nil
+}
+
+// fill closes expired connections and dials new ones until each address has size
+// idle connections, addresses not in addrs anymore are dropped. It returns the
+// number of failed dials.
+func (p *warmPool) fill(addrs []string) int {
+	wanted := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		wanted[addr] = true
+	}
+
+	p.mu.Lock()
+	missing := make(map[string]int, len(addrs))
+	for addr, conns := range p.idle {
+		var kept []warmConn
+		for _, c := range conns {
+			if wanted[addr] && time.Since(c.dialed) < p.maxIdle {
+				kept = append(kept, c)
+			} else {
+				c.Close()
+			}
+		}
+		p.idle[addr] = kept
+	}
+	for _, addr := range addrs {
+		missing[addr] = p.size - len(p.idle[addr])
+	}
+	p.mu.Unlock()
+
+	failures := 0
+	for _, addr := range addrs {
+		for i := 0; i < missing[addr]; i++ {
+			conn, err := p.dial(context.Background(), "tcp", addr)
+			if err != nil {
+				// the upstream is probably down, try again on the next round
+				failures++
+				break
+			}
+			p.mu.Lock()
+			p.idle[addr] = append(p.idle[addr], warmConn{Conn: conn, dialed: time.Now()})
+			p.mu.Unlock()
+		}
+	}
+
+	return failures
+}
+
+// upstreamAddrs returns addresses of upstream proxies in the routing, in the form
+// the transport dials them.
+func upstreamAddrs(routing *Routing) []string {
+	urls := make([]string, 0, len(routing.Proxies)+1)
+	for alias, proxyURL := range routing.Proxies {
+		if !routing.Draining[alias] {
+			urls = append(urls, proxyURL)
+		}
+	}
+	if routing.ForwardProxyURL != "" {
+		urls = append(urls, routing.ForwardProxyURL)
+	}
+
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[u.Scheme]
+		}
+		addr := net.JoinHostPort(u.Hostname(), port)
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// startUpstreamPrewarming keeps prewarm_connections idle connections to each upstream
+// proxy. Pools are refilled periodically, so upstreams which recovered from failures
+// and upstreams added through the admin API get connections too.
+func startUpstreamPrewarming(conf *Configuration, proxy *goproxy.ProxyHttpServer, router *Router) {
+	if conf.PrewarmConnections <= 0 {
+		return
+	}
+
+	dial := proxy.Tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	pool := newWarmPool(conf.PrewarmConnections, conf.PrewarmMaxIdle, dial)
+	proxy.Tr.DialContext = pool.dialContext
+	// goproxy dials upstream proxies for CONNECT requests with Tr.Dial
+	proxy.Tr.Dial = func(network, addr string) (net.Conn, error) {
+		return pool.dialContext(context.Background(), network, addr)
+	}
+
+	routingLog := newModuleLogger(proxy, logModuleRouting)
+	go func() {
+		for {
+			if failures := pool.fill(upstreamAddrs(router.routing())); failures > 0 {
+				routingLog.logf(nil, slog.LevelDebug, "couldn't pre-warm connections to %v upstream proxies", failures)
+			}
+			time.Sleep(conf.PrewarmMaxIdle / 2)
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamAddrs(t *testing.T) {
+	routing := &Routing{
+		Proxies: map[string]string{
+			"a": "http://proxy1:3128",
+			"b": "https://proxy2",
+			"c": "http://proxy3:8080",
+			"d": "http://proxy1:3128",
+		},
+		ForwardProxyURL: "http://proxy4",
+		Draining:        map[string]bool{"c": true},
+	}
+
+	expected := []string{"proxy1:3128", "proxy2:443", "proxy4:80"}
+	if addrs := upstreamAddrs(routing); !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected %v, got %v", expected, addrs)
+	}
+}
+
+func TestWarmPool(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			defer conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().String()
+	pool := newWarmPool(2, time.Minute, (&net.Dialer{}).DialContext)
+	if failures := pool.fill([]string{addr, "127.0.0.1:1"}); failures != 1 {
+		t.Error("Expected one failed upstream, got", failures)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := pool.dialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	waitFor := func(n int32) {
+		for deadline := time.Now().Add(5 * time.Second); accepted.Load() != n && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if accepted.Load() != n {
+			t.Errorf("Expected %v connections, got %v", n, accepted.Load())
+		}
+	}
+	waitFor(2)
+
+	// the pool is empty, new connections are dialed
+	conn, err := pool.dialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitFor(3)
+
+	pool.maxIdle = 0
+	pool.fill([]string{addr})
+	if pool.take(addr) != nil {
+		t.Error("Expected expired connections not to be used")
+	}
+}
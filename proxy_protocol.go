@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the whole header has to arrive within this time after the connection is accepted
+	proxyProtocolTimeout = 10 * time.Second
+	// the longest v1 header including CRLF
+	proxyProtocolV1MaxLength = 107
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener reads PROXY protocol headers of connections from
+// proxy_protocol_networks, i.e. load balancers, other connections are served as is.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtocolListener(ln net.Listener, conf *Configuration) net.Listener {
+	return &proxyProtocolListener{Listener: ln, trusted: parseNetworks(conf.ProxyProtocolNetworks)}
+}
+
+func (ln *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); !ok || !networksContain(ln.trusted, addr.IP) {
+		return c, nil
+	}
+
+	return &proxyProtocolConn{Conn: c, reader: bufio.NewReader(c)}, nil
+}
+
+// proxyProtocolConn reads the header when the server asks for the client's address,
+// which is done by the connection's goroutine before reading the first request, so
+// a slow load balancer doesn't block accepting other connections. Connections with
+// a missing or malformed header are closed.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remote, c.err = readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			c.Conn.Close()
+		}
+		// LOCAL and UNKNOWN connections are made by the load balancer itself
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+// readProxyProtocolHeader returns the client's address from v1 or v2 header, nil
+// address means the connection wasn't proxied.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read PROXY protocol header: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(signature, proxyProtocolV2Signature):
+		return readProxyProtocolV2(r)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		return readProxyProtocolV1(r)
+	}
+
+	return nil, errors.New("PROXY protocol header is missing")
+}
+
+// readProxyProtocolV1 parses "PROXY TCP4 192.0.2.1 198.51.100.1 51234 3128\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol v1 header is too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 parses the binary header, TLVs are skipped.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("couldn't read PROXY protocol header: %w", err)
+	}
+
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("couldn't read PROXY protocol header: %w", err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0F {
+	case 0x00:
+		// LOCAL
+		return nil, nil
+	case 0x01:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", versionCommand&0x0F)
+	}
+
+	var size int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		size = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		size = net.IPv6len
+	default:
+		// UDP and UNIX sockets aren't expected in front of a proxy
+		return nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, errors.New("PROXY protocol v2 addresses are truncated")
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyProtocolV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v4 := append(append(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4()...), 0xC8, 0x22, 0x0C, 0x38)
+	v6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xC8, 0x22, 0x0C, 0x38)
+	// a TLV after the addresses
+	v4TLV := append(append([]byte{}, v4...), 0x04, 0x00, 0x01, 0x00)
+
+	tests := []struct {
+		header   []byte
+		expected string
+		fails    bool
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 51234 3128\r\n"), "192.0.2.1:51234", false},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 51234 3128\r\n"), "[2001:db8::1]:51234", false},
+		{[]byte("PROXY UNKNOWN\r\n"), "", false},
+		{[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 51234 3128\r\n"), "", true},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 51234\r\n"), "", true},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 51234 3128 " + strings.Repeat("x", 100) + "\r\n"), "", true},
+		{[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", true},
+		{proxyProtocolV2Header(0x01, 0x11, v4), "192.0.2.1:51234", false},
+		{proxyProtocolV2Header(0x01, 0x11, v4TLV), "192.0.2.1:51234", false},
+		{proxyProtocolV2Header(0x01, 0x21, v6), "[2001:db8::1]:51234", false},
+		{proxyProtocolV2Header(0x00, 0x00, nil), "", false},
+		{proxyProtocolV2Header(0x01, 0x11, v4[:6]), "", true},
+	}
+
+	for _, test := range tests {
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(test.header), strings.NewReader("data")))
+		addr, err := readProxyProtocolHeader(r)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.header, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.header, err)
+			continue
+		}
+
+		if (addr == nil && test.expected != "") || (addr != nil && addr.String() != test.expected) {
+			t.Errorf("%q: expected %q, got %v", test.header, test.expected, addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "data" {
+			t.Errorf("%q: expected the rest of the stream to be kept, got %q", test.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	// heads are captured after the PROXY protocol header
+	conf := &Configuration{ProxyProtocolNetworks: []string{"127.0.0.1/32"}, StrictParsing: true}
+	servers := newServerSet()
+	ln, err := servers.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.RemoteAddr)
+	})
+	go servers.serve(ln, addr, withRequestHeads(handler, conf), nil, conf)
+
+	request := func(header string) (string, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if remote, err := request("PROXY TCP4 192.0.2.1 198.51.100.1 51234 3128\r\n"); err != nil || remote != "192.0.2.1:51234" {
+		t.Errorf("Expected the client's address from the header, got %q, %v", remote, err)
+	}
+
+	if remote, err := request(""); err == nil {
+		t.Errorf("Expected connection without header to be closed, got %q", remote)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 2 * time.Second
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisClient is a minimal client of Redis protocol (RESP2) used to share state
+// between replicas in cluster mode. Commands are sent one at a time over a single
+// connection, which is reestablished after network errors.
+type redisClient struct {
+	addr     string
+	user     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// newRedisClient parses redis://[user:password@]host[:port][/db] URL, connections
+// are established on the first command.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, errors.New("expected redis://[user:password@]host[:port][/db] URL")
+	}
+
+	c := &redisClient{addr: u.Host}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database number '%s'", db)
+		}
+	}
+
+	return c, nil
+}
+
+// do sends the command and returns its reply: string, int64, nil or []interface{}.
+// Error replies are returned as redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return reply, err
+}
+
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.rd = conn, bufio.NewReader(conn)
+
+	var commands [][]string
+	if c.password != "" {
+		if c.user != "" {
+			commands = append(commands, []string{"AUTH", c.user, c.password})
+		} else {
+			commands = append(commands, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+
+	for _, args := range commands {
+		if _, err := c.roundTrip(args); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.rd)
+}
+
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis serves GET and SET [NX|XX] [EX seconds] commands and the EVAL of
+// saveNonceScript from memory.
+func fakeRedis(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	data := make(map[string]string)
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		for {
+			reply, err := readRedisReply(rd)
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, arg := range reply.([]interface{}) {
+				args = append(args, arg.(string))
+			}
+
+			mu.Lock()
+			value, exists := data[args[1]]
+			if strings.ToUpper(args[0]) == "EVAL" && args[1] == saveNonceScript {
+				value, exists = data[args[3]]
+				last, _ := strconv.ParseUint(value, 10, 64)
+				nc, _ := strconv.ParseUint(args[4], 10, 64)
+				if exists && nc > last {
+					data[args[3]] = args[4]
+					fmt.Fprint(conn, ":1\r\n")
+				} else {
+					fmt.Fprint(conn, ":0\r\n")
+				}
+				mu.Unlock()
+				continue
+			}
+			switch strings.ToUpper(args[0]) {
+			case "AUTH":
+				fmt.Fprint(conn, "+OK\r\n")
+			case "GET":
+				if exists {
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+				} else {
+					fmt.Fprint(conn, "$-1\r\n")
+				}
+			case "SET":
+				options := strings.ToUpper(strings.Join(args[3:], " "))
+				if strings.Contains(options, "NX") && exists || strings.Contains(options, "XX") && !exists {
+					fmt.Fprint(conn, "$-1\r\n")
+				} else {
+					data[args[1]] = args[2]
+					fmt.Fprint(conn, "+OK\r\n")
+				}
+			default:
+				fmt.Fprint(conn, "-ERR unknown command\r\n")
+			}
+			mu.Unlock()
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestRedisClient(t *testing.T) {
+	if _, err := newRedisClient("http://localhost"); err == nil {
+		t.Error("Expected error for non-redis URL")
+	}
+
+	c, err := newRedisClient("redis://:secret@localhost/2")
+	if err != nil || c.addr != "localhost:6379" || c.password != "secret" || c.db != 2 {
+		t.Fatalf("Unexpected client %+v, %v", c, err)
+	}
+
+	c, _ = newRedisClient("redis://:secret@" + fakeRedis(t))
+	if reply, err := c.do("SET", "key", "value"); reply != "OK" || err != nil {
+		t.Errorf("Unexpected SET reply %v, %v", reply, err)
+	}
+	if reply, err := c.do("GET", "key"); reply != "value" || err != nil {
+		t.Errorf("Unexpected GET reply %v, %v", reply, err)
+	}
+	if reply, err := c.do("GET", "missing"); reply != nil || err != nil {
+		t.Errorf("Unexpected GET reply %v, %v", reply, err)
+	}
+	if _, err := c.do("DEL", "key"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Error("Expected error reply, got", err)
+	}
+}
+
+func TestSharedDigestNonces(t *testing.T) {
+	addr := fakeRedis(t)
+
+	replicas := make([]*DigestAuth, 2)
+	for i := range replicas {
+		auth, err := newDigestAuth(bytes.NewBufferString(user + ":" + realm + ":" + ha1 + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth.shared, _ = newRedisClient("redis://" + addr)
+		replicas[i] = auth
+	}
+
+	data := &DigestAuthData{
+		user: user, realm: realm, method: "GET", uri: "/", qop: "auth", nc: "00000001", cnonce: "0a4f113b",
+		nonce: replicas[0].newNonce(),
+	}
+	ha2 := fmt.Sprintf("%x", md5.Sum([]byte(data.method+":"+data.uri)))
+	s := ha1 + ":" + data.nonce + ":" + data.nc + ":" + data.cnonce + ":" + data.qop + ":" + ha2
+	data.response = fmt.Sprintf("%x", md5.Sum([]byte(s)))
+
+	if !replicas[1].validate(data) {
+		t.Error("Expected nonce issued by another replica to be valid")
+	}
+	if replicas[0].validate(data) {
+		t.Error("Expected replayed request to be rejected by another replica")
+	}
+
+	sign := func(nc string) {
+		data.nc = nc
+		s := ha1 + ":" + data.nonce + ":" + data.nc + ":" + data.cnonce + ":" + data.qop + ":" + ha2
+		data.response = fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+	sign("00000003")
+	if !replicas[0].validate(data) {
+		t.Error("Expected request with the next counter to be valid")
+	}
+	sign("00000002")
+	if replicas[1].validate(data) {
+		t.Error("Expected request with an old counter to be rejected")
+	}
+
+	// the counter is checked atomically when another replica passed the lookup
+	// with the same counter
+	nonceInfo := &NonceInfo{lastNonceCounter: 3}
+	if replicas[1].saveNonce(data.nonce, nonceInfo) {
+		t.Error("Expected the used counter to be rejected")
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxRequestHeadSize returns the size of the largest head the server with the
+// given MaxHeaderBytes accepts. Larger heads aren't captured, the server rejects
+// them and closes the connection anyway.
+func maxRequestHeadSize(maxHeaderBytes int) int {
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+
+	return maxHeaderBytes + 4096
+}
+
+type requestHeadKey struct{}
+
+type requestHeadConnKey struct{}
+
+// requestHead is the request line and header fields of a request as they were
+// received from the client. net/http normalizes requests while parsing them, i.e.
+// drops Host header of requests with absolute URI and joins folded lines, so policies
+// which need to see the original request use the captured head.
+type requestHead struct {
+	raw []byte
+	// raw split into lines once the head is complete
+	split []string
+}
+
+func newRequestHead(raw []byte) *requestHead {
+	lines := strings.Split(string(raw), "\n")
+	for len(lines) > 0 && strings.TrimRight(lines[len(lines)-1], "\r") == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	return &requestHead{raw: raw, split: lines}
+}
+
+// lines returns the head's lines without line terminators, the final empty line
+// isn't included. The result must not be modified.
+func (h *requestHead) lines() []string {
+	return h.split
+}
+
+// values returns values of the header field, the name is case-insensitive.
+// Folded continuation lines are joined with the preceding field's value.
+func (h *requestHead) values(name string) []string {
+	var result []string
+
+	matched := false
+	for _, line := range h.lines()[1:] {
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			if matched {
+				result[len(result)-1] += " " + strings.TrimSpace(line)
+			}
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		matched = strings.EqualFold(field, name)
+		if matched {
+			result = append(result, strings.TrimSpace(value))
+		}
+	}
+
+	return result
+}
+
+// requestHeadsNeeded reports whether policies configured in conf check requests'
+// original heads, the parser costs every byte read from clients, so heads aren't
+// captured otherwise.
+func requestHeadsNeeded(conf *Configuration) bool {
+	return conf.HostHeaderMismatch == hostHeaderDeny || conf.StrictParsing || conf.MaxHeaderBytes > 0
+}
+
+// withRequestHeads makes the request's head available to the handler through
+// requestHeadFromRequest if policies configured in conf need it, otherwise the
+// handler is returned as is. Heads are captured only on connections of servers
+// set up with the returned handler's serve method, i.e. by serverSet.serve.
+func withRequestHeads(handler http.Handler, conf *Configuration) http.Handler {
+	if !requestHeadsNeeded(conf) {
+		return handler
+	}
+
+	return &requestHeadHandler{handler: handler}
+}
+
+type requestHeadHandler struct {
+	handler http.Handler
+}
+
+func (h *requestHeadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c, ok := req.Context().Value(requestHeadConnKey{}).(*requestHeadConn)
+	if !ok {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+
+	if head := c.next(); head != nil {
+		req = req.WithContext(context.WithValue(req.Context(), requestHeadKey{}, head))
+	}
+
+	h.handler.ServeHTTP(w, req)
+
+	// the connection is still HTTP unless it was hijacked by a tunnel or upgrade
+	c.finish()
+}
+
+// serve sets the server up to capture heads of requests read from the listener's
+// connections, the listener to serve is returned.
+func (h *requestHeadHandler) serve(srv *http.Server, ln net.Listener) net.Listener {
+	srv.ConnContext = h.connContext
+
+	connState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		if conn, ok := c.(*requestHeadConn); ok && state == http.StateHijacked {
+			conn.hijacked()
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+
+	return &requestHeadListener{Listener: ln, maxSize: maxRequestHeadSize(srv.MaxHeaderBytes)}
+}
+
+func (h *requestHeadHandler) connContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*requestHeadConn); ok {
+		return context.WithValue(ctx, requestHeadConnKey{}, conn)
+	}
+
+	return ctx
+}
+
+// requestHeadFromRequest returns the captured head of the request or nil if it
+// isn't known.
+func requestHeadFromRequest(req *http.Request) *requestHead {
+	if req != nil {
+		if head, ok := req.Context().Value(requestHeadKey{}).(*requestHead); ok {
+			return head
+		}
+	}
+
+	return nil
+}
+
+// requestHeadUnknown reports whether the request was read from a connection
+// capturing heads, but its head couldn't be captured, i.e. it was too large or the
+// connection's stream couldn't be parsed. Such requests can't be checked by
+// policies which need the original head.
+func requestHeadUnknown(req *http.Request) bool {
+	_, capturing := req.Context().Value(requestHeadConnKey{}).(*requestHeadConn)
+
+	return capturing && requestHeadFromRequest(req) == nil
+}
+
+type requestHeadListener struct {
+	net.Listener
+	maxSize int
+}
+
+func (ln *requestHeadListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestHeadConn{Conn: c, parser: requestHeadParser{maxSize: ln.maxSize}}, nil
+}
+
+// requestHeadConn captures heads of requests read from the connection. Pipelined
+// requests may be read before the previous ones are handled, so heads are queued
+// and handlers take them in order.
+type requestHeadConn struct {
+	net.Conn
+	mu     sync.Mutex
+	heads  []*requestHead
+	parser requestHeadParser
+}
+
+func (c *requestHeadConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.heads = append(c.heads, c.parser.feed(b[:n])...)
+		c.mu.Unlock()
+	}
+
+	return n, err
+}
+
+func (c *requestHeadConn) next() *requestHead {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.heads) == 0 {
+		return nil
+	}
+
+	head := c.heads[0]
+	c.heads = c.heads[1:]
+
+	return head
+}
+
+// finish resumes parsing once the request is handled, if it was a CONNECT or
+// upgrade request the server didn't switch protocols for.
+func (c *requestHeadConn) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.heads = append(c.heads, c.parser.resume()...)
+}
+
+// hijacked stops parsing, the rest of the connection is a tunnel or another protocol.
+func (c *requestHeadConn) hijacked() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.parser.state, c.parser.pending = parseDone, nil
+}
+
+const (
+	parseHead = iota
+	parseBody
+	parseChunkSize
+	parseChunkData
+	parseChunkEnd
+	parseTrailers
+	// CONNECT or upgrade request is handled, data received in the meantime is kept
+	// until it's known whether the connection switched protocols
+	parseSwitch
+	// the rest of the connection isn't HTTP requests (tunnel) or it couldn't be parsed
+	parseDone
+)
+
+// requestHeadParser splits the stream of requests into heads and bodies, bodies
+// are skipped according to their framing.
+type requestHeadParser struct {
+	state     int
+	head      []byte
+	line      []byte
+	remaining int64
+	// the request asked to switch protocols once its body is skipped
+	upgrade bool
+	pending []byte
+	// 0 means maxRequestHeadSize of net/http defaults
+	maxSize int
+}
+
+func (p *requestHeadParser) feed(data []byte) []*requestHead {
+	var heads []*requestHead
+
+	for len(data) > 0 && p.state != parseDone {
+		switch p.state {
+		case parseHead:
+			var line []byte
+			var complete bool
+			line, data, complete = p.readLine(data)
+			if !complete {
+				break
+			}
+			p.line = nil
+			if !isEmptyLine(line) {
+				p.head = append(p.head, line...)
+				break
+			}
+			if len(p.head) == 0 {
+				// empty lines before the request line are ignored
+				break
+			}
+			p.head = append(p.head, line...)
+			head := newRequestHead(p.head)
+			heads = append(heads, head)
+			p.head = nil
+			p.startBody(head)
+
+		case parseBody, parseChunkData:
+			n := int64(len(data))
+			if n > p.remaining {
+				n = p.remaining
+			}
+			data = data[n:]
+			p.remaining -= n
+			if p.remaining == 0 {
+				if p.state == parseBody {
+					p.endRequest()
+				} else {
+					p.state = parseChunkEnd
+				}
+			}
+
+		case parseChunkSize:
+			var line []byte
+			var complete bool
+			line, data, complete = p.readLine(data)
+			if !complete {
+				break
+			}
+			p.line = nil
+			sizeText, _, _ := strings.Cut(strings.TrimSpace(string(line)), ";")
+			size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+			switch {
+			case err != nil || size < 0:
+				p.state = parseDone
+			case size == 0:
+				p.state = parseTrailers
+			default:
+				p.state, p.remaining = parseChunkData, size
+			}
+
+		case parseChunkEnd, parseTrailers:
+			var line []byte
+			var complete bool
+			line, data, complete = p.readLine(data)
+			if !complete {
+				break
+			}
+			p.line = nil
+			if p.state == parseChunkEnd {
+				p.state = parseChunkSize
+			} else if isEmptyLine(line) {
+				p.endRequest()
+			}
+
+		case parseSwitch:
+			p.pending = append(p.pending, data...)
+			data = nil
+			if len(p.pending) > p.headSizeLimit() {
+				p.state, p.pending = parseDone, nil
+			}
+		}
+	}
+
+	return heads
+}
+
+// resume parses data received while waiting for the response to CONNECT or
+// upgrade request, the connection didn't switch protocols.
+func (p *requestHeadParser) resume() []*requestHead {
+	if p.state != parseSwitch {
+		return nil
+	}
+
+	data := p.pending
+	p.state, p.pending = parseHead, nil
+
+	return p.feed(data)
+}
+
+func (p *requestHeadParser) endRequest() {
+	p.state = parseHead
+	if p.upgrade {
+		p.state, p.upgrade = parseSwitch, false
+	}
+}
+
+func (p *requestHeadParser) headSizeLimit() int {
+	if p.maxSize > 0 {
+		return p.maxSize
+	}
+
+	return maxRequestHeadSize(0)
+}
+
+// readLine accumulates data up to the end of the line, the line is complete if
+// it ends with LF.
+func (p *requestHeadParser) readLine(data []byte) ([]byte, []byte, bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		p.line = append(p.line, data...)
+		p.checkSize()
+		return nil, nil, false
+	}
+
+	p.line = append(p.line, data[:i+1]...)
+	p.checkSize()
+
+	return p.line, data[i+1:], p.state != parseDone
+}
+
+func (p *requestHeadParser) checkSize() {
+	if len(p.head)+len(p.line) > p.headSizeLimit() {
+		p.state, p.head, p.line = parseDone, nil, nil
+	}
+}
+
+// startBody sets up skipping of the request's body, bodies are framed the same
+// way net/http does: chunked transfer coding takes precedence over Content-Length.
+// Parsing of CONNECT and upgrade requests' connections is suspended until they
+// are handled, see parseSwitch.
+func (p *requestHeadParser) startBody(head *requestHead) {
+	method, _, _ := strings.Cut(head.lines()[0], " ")
+	if method == http.MethodConnect {
+		p.state = parseSwitch
+		return
+	}
+	p.upgrade = len(head.values("Upgrade")) > 0
+
+	for _, value := range head.values("Transfer-Encoding") {
+		if strings.Contains(strings.ToLower(value), "chunked") {
+			p.state = parseChunkSize
+			return
+		}
+	}
+
+	if values := head.values("Content-Length"); len(values) > 0 {
+		n, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil || n < 0 {
+			p.state = parseDone
+			return
+		}
+		if n > 0 {
+			p.state, p.remaining = parseBody, n
+			return
+		}
+	}
+
+	p.endRequest()
+}
+
+func isEmptyLine(line []byte) bool {
+	return len(line) == 1 || len(line) == 2 && line[0] == '\r'
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func newRequestHeadServer(handler http.Handler) *httptest.Server {
+	heads := &requestHeadHandler{handler: handler}
+	srv := httptest.NewUnstartedServer(heads)
+	srv.Listener = heads.serve(srv.Config, srv.Listener)
+	srv.Start()
+
+	return srv
+}
+
+func TestRequestHeadParser(t *testing.T) {
+	stream := "GET http://a.example.com/ HTTP/1.1\r\nHost: a.example.com\r\nX-Folded: one\r\n two\r\n\r\n" +
+		"POST http://b.example.com/ HTTP/1.1\r\nHost: b.example.com\r\nContent-Length: 18\r\n\r\n" +
+		"Host: not.a.header" +
+		"POST http://c.example.com/ HTTP/1.1\nHost: c.example.com\nTransfer-Encoding: chunked\n\n" +
+		"5;ext=1\r\nHost:\r\n0\r\nTrailer: x\r\n\r\n" +
+		"CONNECT d.example.com:443 HTTP/1.1\r\nHost: d.example.com:443\r\n\r\n" +
+		"GET http://e.example.com/ HTTP/1.1\r\n\r\n"
+
+	// feed the stream in small pieces to check that state is kept between reads
+	var p requestHeadParser
+	var heads []*requestHead
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		heads = append(heads, p.feed([]byte(stream[i:end]))...)
+	}
+
+	expected := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com:443"}
+	if len(heads) != len(expected) {
+		t.Fatalf("Expected %d heads, got %d", len(expected), len(heads))
+	}
+
+	for i, head := range heads {
+		if hosts := head.values("host"); len(hosts) != 1 || hosts[0] != expected[i] {
+			t.Errorf("Expected Host %v, got %v", expected[i], hosts)
+		}
+	}
+
+	if folded := heads[0].values("X-Folded"); len(folded) != 1 || folded[0] != "one two" {
+		t.Errorf("Expected folded value to be joined, got %v", folded)
+	}
+
+	// the request following CONNECT is parsed once it's known the tunnel wasn't
+	// established
+	if heads = p.resume(); len(heads) != 1 || heads[0].lines()[0] != "GET http://e.example.com/ HTTP/1.1" {
+		t.Errorf("Expected the request after CONNECT, got %v", heads)
+	}
+}
+
+func TestHostHeaderMismatch(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Host)
+	}))
+	defer background.Close()
+
+	tests := []struct {
+		action, host string
+		status       int
+	}{
+		{hostHeaderRewrite, "evil.example.com", http.StatusOK},
+		{hostHeaderDeny, "evil.example.com", http.StatusBadRequest},
+		{hostHeaderDeny, "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		proxy := goproxy.NewProxyHttpServer()
+		setHostHeaderHandler(&Configuration{HostHeaderMismatch: test.action}, proxy)
+		proxyserver := newRequestHeadServer(proxy)
+
+		conn, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		host := test.host
+		if host == "" {
+			host = background.Listener.Addr().String()
+		}
+		fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", background.URL, host)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		proxyserver.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s with Host %s: expected status %d, got %d", test.action, host, test.status, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK && !strings.HasPrefix(background.URL, "http://"+string(body)) {
+			t.Errorf("Expected the request URI's host to be sent, got %s", body)
+		}
+	}
+
+	// requests whose head couldn't be captured can't be checked
+	proxy := goproxy.NewProxyHttpServer()
+	setHostHeaderHandler(&Configuration{HostHeaderMismatch: hostHeaderDeny}, proxy)
+	req := httptest.NewRequest(http.MethodGet, background.URL, nil)
+	req = req.WithContext(context.WithValue(req.Context(), requestHeadConnKey{}, &requestHeadConn{}))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 status code of request with unknown head, got %v", w.Code)
+	}
+}
+
+func TestStrictParsingViolation(t *testing.T) {
+	tests := []struct {
+		head, reason string
+	}{
+		{"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\n", ""},
+		{"GET http://example.com/ HTTP/1.1\nHost: example.com\n\n", "bare LF"},
+		{"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-A: 1\r2\r\n\r\n", "bare CR"},
+		{"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-A: 1\r\n 2\r\n\r\n", "obsolete line folding"},
+		{"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nhost: example.org\r\n\r\n", "duplicate Host header"},
+		{"POST http://example.com/ HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\n", "duplicate Content-Length header"},
+		{"POST http://example.com/ HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n",
+			"both Content-Length and Transfer-Encoding headers"},
+		{"POST http://example.com/ HTTP/1.1\r\nContent-Length: 3, 3\r\n\r\n", "invalid Content-Length header"},
+	}
+
+	for _, test := range tests {
+		if reason := strictParsingViolation(newRequestHead([]byte(test.head))); reason != test.reason {
+			t.Errorf("%q: expected '%s', got '%s'", test.head, test.reason, reason)
+		}
+	}
+}
+
+func TestStrictParsing(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	setStrictParsingHandler(&Configuration{StrictParsing: true}, proxy)
+	proxyserver := newRequestHeadServer(proxy)
+	defer proxyserver.Close()
+
+	conn, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "POST %s/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", background.URL)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected 400 status code, got", resp.StatusCode)
+	}
+}
+
+func TestStrictParsingAfterUpgrade(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	setStrictParsingHandler(&Configuration{StrictParsing: true}, proxy)
+	proxyserver := newRequestHeadServer(proxy)
+	defer proxyserver.Close()
+
+	conn, err := net.Dial("tcp", proxyserver.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// the server didn't switch protocols, so the next request on the connection
+	// is still checked
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: example.com\r\nUpgrade: foo\r\nConnection: upgrade\r\n\r\n", background.URL)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected 200 status code of upgrade request, got", resp.StatusCode)
+	}
+
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\nHost: example.com\n\n", background.URL)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected 400 status code of request with bare LF, got", resp.StatusCode)
+	}
+}
+
+func TestWithRequestHeads(t *testing.T) {
+	handler := http.NotFoundHandler()
+
+	if _, ok := withRequestHeads(handler, &Configuration{HostHeaderMismatch: hostHeaderRewrite}).(*requestHeadHandler); ok {
+		t.Error("Expected heads not to be captured without policies needing them")
+	}
+
+	for _, conf := range []*Configuration{
+		{HostHeaderMismatch: hostHeaderDeny},
+		{StrictParsing: true},
+		{MaxHeaderBytes: 1024},
+	} {
+		if _, ok := withRequestHeads(handler, conf).(*requestHeadHandler); !ok {
+			t.Errorf("Expected heads to be captured with %+v", conf)
+		}
+	}
+}
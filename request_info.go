@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo is kept in goproxy.ProxyCtx.UserData and carries per request data
+// between request, response and logging handlers. The same structure is attached to
+// the request's context, so it's also reachable from the transport's Proxy function
+// and CONNECT dialer, which only get the request.
+type requestInfo struct {
+	user    string
+	explain bool
+	route   cachedRoute
+
+	// timings are measured from the moment the request was received,
+	// negative durations are unknown
+	started   time.Time
+	connect   time.Duration
+	firstByte time.Duration
+	// access log entry written once the response was sent to the client
+	pendingLog *LogData
+	// upstream proxy alias, DIRECT or proxy URL the request was sent to
+	upstream string
+	// destination's autonomous system for the access log
+	asn string
+	// the client's response writer, used to send response trailers
+	writer http.ResponseWriter
+	// set if the origin stalled while sending the response body
+	stalled atomic.Bool
+	// action for the tunnel if it's going to be decrypted, see setMITMHandler
+	mitm *goproxy.ConnectAction
+	// set for requests read from a decrypted tunnel, they were authenticated
+	// by the tunnel's CONNECT request
+	inspected bool
+	// set if the user was taken from trusted_user_header of a front proxy
+	trusted bool
+	// set once the upstream proxy failed and the request is sent directly
+	directFallback bool
+	// the request's span, nil unless tracing_endpoint is set
+	trace *traceContext
+	// configuration rule which allowed, denied or routed the request for the
+	// access log, i.e. "disallowed_networks:10.0.0.0/8" or "rules:.example.com"
+	rule string
+	// set if the request was denied by the rule
+	denied bool
+	// user reported by the client's ident service, logged if the request
+	// isn't authenticated
+	ident string
+}
+
+// authenticated reports whether the request's user is already known and proxy
+// authentication has to be skipped.
+func (info *requestInfo) authenticated() bool {
+	return info.inspected || info.trusted
+}
+
+// cachedRoute is valid as long as routing, host and user didn't change.
+type cachedRoute struct {
+	routing *Routing
+	host    string
+	user    string
+	match   routeMatch
+}
+
+func newRequestInfo() *requestInfo {
+	return &requestInfo{started: time.Now(), connect: -1, firstByte: -1}
+}
+
+// withRequestInfo attaches an empty requestInfo to every incoming request.
+func withRequestInfo(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info := newRequestInfo()
+		info.writer = w
+		handler.ServeHTTP(w, req.WithContext(withRequestInfoContext(req.Context(), info)))
+	})
+}
+
+func withRequestInfoContext(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFromRequest(req *http.Request) *requestInfo {
+	if req != nil {
+		if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			return info
+		}
+	}
+
+	return nil
+}
+
+func getRequestInfo(ctx *goproxy.ProxyCtx) *requestInfo {
+	info, ok := ctx.UserData.(*requestInfo)
+	if !ok {
+		info = requestInfoFromRequest(ctx.Req)
+		if info == nil {
+			info = newRequestInfo()
+		}
+		ctx.UserData = info
+	}
+
+	return info
+}
+
+// setRequestRule records the rule the request was routed by.
+func setRequestRule(req *http.Request, rule string) {
+	if info := requestInfoFromRequest(req); info != nil {
+		info.rule = rule
+	}
+}
+
+// denyRequest records the rule the request is denied by.
+func denyRequest(ctx *goproxy.ProxyCtx, rule string) {
+	info := getRequestInfo(ctx)
+	info.rule, info.denied = rule, true
+}
+
+// setRequestUpstream records where the request was sent to, overwrite is false
+// for defaults which don't replace the upstream chosen by routing rules.
+func setRequestUpstream(req *http.Request, upstream string, overwrite bool) {
+	if info := requestInfoFromRequest(req); info != nil && (overwrite || info.upstream == "") {
+		info.upstream = upstream
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of expect_continue setting.
+const (
+	expectContinueForward = "forward"
+	expectContinueLocal   = "local"
+
+	defaultExpectContinueTimeout = time.Second
+)
+
+// Values of host_header_mismatch setting.
+const (
+	hostHeaderRewrite = "rewrite"
+	hostHeaderDeny    = "deny"
+)
+
+// sameAuthority reports whether the Host header names the same host and port as
+// the request URI, default ports may be omitted.
+func sameAuthority(host string, u *url.URL) bool {
+	defaultPort := "80"
+	if u.Scheme == "https" {
+		defaultPort = "443"
+	}
+
+	split := func(authority string) (string, string) {
+		hostname, port, err := net.SplitHostPort(authority)
+		if err != nil {
+			hostname, port = strings.Trim(authority, "[]"), ""
+		}
+		if port == "" {
+			port = defaultPort
+		}
+		return strings.TrimSuffix(strings.ToLower(hostname), "."), port
+	}
+
+	headerHost, headerPort := split(host)
+	uriHost, uriPort := split(u.Host)
+
+	return headerHost == uriHost && headerPort == uriPort
+}
+
+// setHostHeaderHandler checks that Host header of plain HTTP requests matches the
+// request URI. The request is always sent with the URI's authority in Host header,
+// so a mismatch either is rewritten or the request is rejected. Requests whose
+// head couldn't be captured are treated as mismatching.
+func setHostHeaderHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			var host string
+			if head := requestHeadFromRequest(req); head != nil {
+				hosts := head.values("Host")
+				if len(hosts) == 0 || sameAuthority(hosts[0], req.URL) {
+					return req, nil
+				}
+				host = hosts[0]
+			} else if !requestHeadUnknown(req) {
+				return req, nil
+			}
+
+			if conf.HostHeaderMismatch == hostHeaderDeny {
+				ctx.Warnf("Host header '%v' doesn't match request URI %v", host, req.URL.Host)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest,
+					"Host header doesn't match request URI")
+			}
+
+			ctx.Logf("rewriting Host header '%v' to %v", host, req.URL.Host)
+			req.Host = req.URL.Host
+
+			return req, nil
+		})
+}
+
+// strictParsingViolation returns the reason why the request's head is ambiguous
+// and could be interpreted differently by the proxy and the upstream servers, empty
+// string is returned for valid heads.
+func strictParsingViolation(head *requestHead) string {
+	for i, c := range head.raw {
+		switch {
+		case c == '\r' && (i+1 == len(head.raw) || head.raw[i+1] != '\n'):
+			return "bare CR"
+		case c == '\n' && (i == 0 || head.raw[i-1] != '\r'):
+			return "bare LF"
+		}
+	}
+
+	for _, line := range head.lines()[1:] {
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			return "obsolete line folding"
+		}
+	}
+
+	for _, name := range []string{"Host", "Content-Length", "Transfer-Encoding"} {
+		if len(head.values(name)) > 1 {
+			return "duplicate " + name + " header"
+		}
+	}
+
+	contentLength := head.values("Content-Length")
+	transferEncoding := head.values("Transfer-Encoding")
+
+	if len(contentLength) > 0 && len(transferEncoding) > 0 {
+		return "both Content-Length and Transfer-Encoding headers"
+	}
+
+	if len(contentLength) > 0 && strings.Trim(contentLength[0], "0123456789") != "" {
+		return "invalid Content-Length header"
+	}
+
+	return ""
+}
+
+// setStrictParsingHandler rejects requests with ambiguous framing or malformed
+// headers, which could be used for request smuggling. Requests whose head couldn't
+// be captured are rejected as well, they can't be checked.
+func setStrictParsingHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if !conf.StrictParsing {
+		return
+	}
+
+	violation := func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+		var reason string
+		if head := requestHeadFromRequest(req); head != nil {
+			reason = strictParsingViolation(head)
+		} else if requestHeadUnknown(req) {
+			reason = "request head couldn't be parsed"
+		}
+
+		if reason != "" {
+			ctx.Warnf("rejected malformed request from %v: %v", req.RemoteAddr, reason)
+		}
+
+		return reason
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if reason := violation(ctx.Req, ctx); reason != "" {
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadRequest, "Malformed request: "+reason)
+				return goproxy.RejectConnect, host
+			}
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if reason := violation(req, ctx); reason != "" {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, "Malformed request: "+reason)
+			}
+			return req, nil
+		})
+}
+
+// headerLimitViolation returns the reason why the header exceeds max_header_count,
+// max_header_size or max_header_bytes limits, size is the header's total size if
+// it's known or 0 if it has to be estimated from the parsed header.
+func headerLimitViolation(conf *Configuration, header http.Header, size int) string {
+	count, total := 0, 0
+	for name, values := range header {
+		for _, value := range values {
+			fieldSize := len(name) + len(": ") + len(value)
+			if conf.MaxHeaderSize > 0 && fieldSize > conf.MaxHeaderSize {
+				return fmt.Sprintf("%s header is larger than %d bytes", name, conf.MaxHeaderSize)
+			}
+			count++
+			total += fieldSize + len("\r\n")
+		}
+	}
+
+	if conf.MaxHeaderCount > 0 && count > conf.MaxHeaderCount {
+		return fmt.Sprintf("more than %d headers", conf.MaxHeaderCount)
+	}
+
+	if size == 0 {
+		size = total
+	}
+	if conf.MaxHeaderBytes > 0 && size > conf.MaxHeaderBytes {
+		return fmt.Sprintf("headers are larger than %d bytes", conf.MaxHeaderBytes)
+	}
+
+	return ""
+}
+
+// setHeaderLimitsHandler rejects client requests with headers exceeding configured
+// limits with 431 status code, upstream responses exceeding them are replaced with
+// 502 status code.
+func setHeaderLimitsHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if conf.MaxHeaderBytes <= 0 && conf.MaxHeaderSize <= 0 && conf.MaxHeaderCount <= 0 {
+		return
+	}
+
+	if conf.MaxHeaderBytes > 0 {
+		proxy.Tr.MaxResponseHeaderBytes = int64(conf.MaxHeaderBytes)
+	}
+
+	violation := func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+		size := 0
+		if head := requestHeadFromRequest(req); head != nil {
+			size = len(head.raw)
+		}
+
+		reason := headerLimitViolation(conf, req.Header, size)
+		if reason != "" {
+			ctx.Logf("rejected request from %v: %v", req.RemoteAddr, reason)
+		}
+
+		return reason
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if reason := violation(ctx.Req, ctx); reason != "" {
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText,
+					http.StatusRequestHeaderFieldsTooLarge, "Request headers too large: "+reason)
+				return goproxy.RejectConnect, host
+			}
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if reason := violation(req, ctx); reason != "" {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText,
+					http.StatusRequestHeaderFieldsTooLarge, "Request headers too large: "+reason)
+			}
+			return req, nil
+		})
+
+	proxy.OnResponse().DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil {
+				return resp
+			}
+
+			if reason := headerLimitViolation(conf, resp.Header, 0); reason != "" {
+				ctx.Warnf("rejected response from %v: %v", ctx.Req.URL.Host, reason)
+				resp.Body.Close()
+				return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway,
+					"Upstream response headers too large: "+reason)
+			}
+			return resp
+		})
+}
+
+// urlLimitViolation returns the reason why the request URI exceeds max_url_length,
+// max_query_length or max_path_depth limits.
+func urlLimitViolation(conf *Configuration, req *http.Request) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.String()
+	}
+
+	if conf.MaxURLLength > 0 && len(uri) > conf.MaxURLLength {
+		return fmt.Sprintf("URL is longer than %d bytes", conf.MaxURLLength)
+	}
+
+	if conf.MaxQueryLength > 0 && len(req.URL.RawQuery) > conf.MaxQueryLength {
+		return fmt.Sprintf("query is longer than %d bytes", conf.MaxQueryLength)
+	}
+
+	if conf.MaxPathDepth > 0 {
+		if path := strings.Trim(req.URL.EscapedPath(), "/"); path != "" && strings.Count(path, "/")+1 > conf.MaxPathDepth {
+			return fmt.Sprintf("path has more than %d segments", conf.MaxPathDepth)
+		}
+	}
+
+	return ""
+}
+
+// setURLLimitsHandler rejects plain HTTP requests with too long URLs with 414
+// status code.
+func setURLLimitsHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if conf.MaxURLLength <= 0 && conf.MaxQueryLength <= 0 && conf.MaxPathDepth <= 0 {
+		return
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if reason := urlLimitViolation(conf, req); reason != "" {
+				ctx.Logf("rejected request from %v: %v", req.RemoteAddr, reason)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusRequestURITooLong,
+					"Request URI too long: "+reason)
+			}
+			return req, nil
+		})
+}
+
+// setAllowedSchemesHandler rejects absolute-URI requests with schemes other than
+// allowed_schemes, the transport would fail to send them anyway unless an upstream
+// proxy supports them.
+func setAllowedSchemesHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	allowed := make(map[string]bool, len(conf.AllowedSchemes))
+	for _, scheme := range conf.AllowedSchemes {
+		allowed[strings.ToLower(scheme)] = true
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if !allowed[strings.ToLower(req.URL.Scheme)] {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest,
+					fmt.Sprintf("Unsupported URL scheme '%s'", req.URL.Scheme))
+			}
+			return req, nil
+		})
+}
+
+// setExpectContinueHandler sets up handling of "Expect: 100-continue" requests. The
+// client gets "100 Continue" once the proxy starts sending the body: with "forward"
+// policy it happens after the upstream server answered "100 Continue" itself or the
+// timeout expired, with "local" policy right after the request passed access checks,
+// the expectation isn't sent upstream then.
+func setExpectContinueHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	switch conf.ExpectContinue {
+	case expectContinueForward:
+		proxy.Tr.ExpectContinueTimeout = conf.ExpectContinueTimeout
+	case expectContinueLocal:
+		proxy.OnRequest().DoFunc(
+			func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+					req.Header.Del("Expect")
+				}
+				return req, nil
+			})
+	}
+}
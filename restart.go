@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variable passing listeners' addresses to the restarted process, the
+// listeners themselves are passed as file descriptors starting from 3 in the same order.
+const inheritedListenersEnv = "MICROPROXY_LISTENERS"
+
+// Environment variable passing the file descriptor of the pipe the restarted process
+// closes once it serves its listeners.
+const restartReadyEnv = "MICROPROXY_READY_FD"
+
+// the old process keeps serving if the new one isn't ready in time
+const restartReadyTimeout = 30 * time.Second
+
+// serverSet keeps track of the process' HTTP servers and their listeners, so they can
+// be handed over to a new process on graceful restart.
+type serverSet struct {
+	mu        sync.Mutex
+	servers   []*http.Server
+	listeners []*net.TCPListener
+	addrs     []string
+	inherited map[string]*net.TCPListener
+	// logs connections of all servers if connection_log is set
+	connections *connectionLogger
+	// set once the servers are shut down
+	stopped bool
+	// the parent process waits for it to be written to, nil unless restarted
+	readyPipe *os.File
+}
+
+func newServerSet() *serverSet {
+	return &serverSet{inherited: inheritedListeners(), readyPipe: inheritedReadyPipe()}
+}
+
+func inheritedReadyPipe() *os.File {
+	value := os.Getenv(restartReadyEnv)
+	if value == "" {
+		return nil
+	}
+	os.Unsetenv(restartReadyEnv)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid %v value %v\n", restartReadyEnv, value)
+		return nil
+	}
+
+	return os.NewFile(uintptr(fd), "ready")
+}
+
+// notifyParent tells the parent process, which is waiting in restart, that the
+// listeners are served, so it can stop serving them itself.
+func (s *serverSet) notifyParent(addrs []string) {
+	if s.readyPipe == nil {
+		return
+	}
+
+	for _, addr := range addrs {
+		for !s.serving(addr) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err := s.readyPipe.Write([]byte{1}); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't notify the parent process: %v\n", err)
+	}
+	s.readyPipe.Close()
+}
+
+// inheritedListeners returns listeners passed by the parent process keyed by address.
+func inheritedListeners() map[string]*net.TCPListener {
+	listeners := make(map[string]*net.TCPListener)
+
+	value := os.Getenv(inheritedListenersEnv)
+	if value == "" {
+		return listeners
+	}
+	os.Unsetenv(inheritedListenersEnv)
+
+	for i, addr := range strings.Split(value, ",") {
+		f := os.NewFile(uintptr(3+i), "listener-"+strconv.Itoa(i))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't use inherited listener for %v: %v\n", addr, err)
+			continue
+		}
+		if tcpListener, ok := ln.(*net.TCPListener); ok {
+			listeners[addr] = tcpListener
+		} else {
+			ln.Close()
+		}
+	}
+
+	return listeners
+}
+
+// restarted reports whether listeners were passed by the parent process.
+func (s *serverSet) restarted() bool {
+	return len(s.inherited) > 0
+}
+
+// listen returns the listener inherited from the parent process or creates a new one.
+func (s *serverSet) listen(addr string) (*net.TCPListener, error) {
+	s.mu.Lock()
+	ln, exists := s.inherited[addr]
+	delete(s.inherited, addr)
+	s.mu.Unlock()
+
+	if exists {
+		return ln, nil
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+
+	ln, err = net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+
+	return ln, nil
+}
+
+// serve accepts connections on the listener created by listen(addr) until the server
+// is shut down, TLS is used if tlsConfig isn't nil. Client timeouts and header limit
+// are taken from conf unless it's nil. Connections are served as SOCKS5 ones if the
+// handler was wrapped by withSOCKS, and as redirected ones if it was wrapped by
+// withTransparent. Requests' heads are captured if the handler (or the one wrapped
+// by withSOCKS or withTransparent) was wrapped by withRequestHeads. Connections are
+// written to the connection log if it's set.
+func (s *serverSet) serve(ln *net.TCPListener, addr string, handler http.Handler, tlsConfig *tls.Config,
+	conf *Configuration,
+) error {
+	var err error
+	var l net.Listener = ln
+	srv := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+
+	if conf != nil {
+		srv.ReadHeaderTimeout = conf.ReadHeaderTimeout
+		srv.IdleTimeout = conf.IdleTimeout
+		// the server allows 4096 more bytes, so max_header_bytes policy still gets
+		// to reply to requests slightly above the limit
+		srv.MaxHeaderBytes = conf.MaxHeaderBytes
+	}
+
+	// the log gets addresses and bytes of the TCP connection itself
+	if s.connections != nil {
+		l = s.connections.listener(l)
+		srv.ConnState = s.connections.connState
+	}
+
+	// the header precedes everything else sent by the load balancer
+	if conf != nil && len(conf.ProxyProtocolNetworks) > 0 {
+		l = newProxyProtocolListener(l, conf)
+	}
+
+	inner := handler
+	if socks, ok := handler.(*socksHandler); ok {
+		l = socks.listener(l)
+		inner = socks.handler
+	}
+	if transparent, ok := handler.(*transparentHandler); ok {
+		l = transparent.listener(l)
+		inner = transparent.handler
+	}
+
+	if heads, ok := inner.(*requestHeadHandler); ok {
+		l = heads.serve(srv, l)
+	}
+
+	s.mu.Lock()
+	s.servers = append(s.servers, srv)
+	s.listeners = append(s.listeners, ln)
+	s.addrs = append(s.addrs, addr)
+	s.mu.Unlock()
+
+	if tlsConfig != nil {
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to start server: %w", err)
+	}
+
+	return nil
+}
+
+// serving reports whether a server accepts connections on addr.
+func (s *serverSet) serving(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return false
+	}
+	for _, a := range s.addrs {
+		if a == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// closeInherited closes inherited listeners which are not used anymore, i.e. when
+// listening address was changed in the configuration file.
+func (s *serverSet) closeInherited() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for addr, ln := range s.inherited {
+		ln.Close()
+		delete(s.inherited, addr)
+	}
+}
+
+// restart starts a new copy of the process, which reads the configuration file
+// again and inherits all listeners. It returns once the new process serves them,
+// a process which fails to start or isn't ready within restartReadyTimeout is
+// killed and an error is returned, the listeners are still served by this process.
+func (s *serverSet) restart() error {
+	s.mu.Lock()
+	addrs := s.addrs
+	files := make([]*os.File, 0, len(s.listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, ln := range s.listeners {
+		f, err := ln.File()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), inheritedListenersEnv+"="+strings.Join(addrs, ","),
+		restartReadyEnv+"="+strconv.Itoa(3+len(files)-1))
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// only the new process holds the pipe's writing end, so reading fails once it exits
+	readyWriter.Close()
+	files = files[:len(files)-1]
+
+	if err := waitReady(ready, restartReadyTimeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process isn't ready: %w", err)
+	}
+
+	return nil
+}
+
+// waitReady waits until the new process writes to the pipe.
+func waitReady(ready *os.File, timeout time.Duration) error {
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1)
+	if _, err := ready.Read(buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("it exited")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// shutdown stops accepting new connections and waits for active requests to
+// complete, hijacked connections (CONNECT tunnels) are not waited for.
+func (s *serverSet) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.servers
+	s.stopped = true
+	s.mu.Unlock()
+
+	var result error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServerClientTimeouts(t *testing.T) {
+	servers := newServerSet()
+	ln, err := servers.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Configuration{ReadHeaderTimeout: 100 * time.Millisecond, IdleTimeout: 100 * time.Millisecond}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	go servers.serve(ln, "127.0.0.1:0", handler, nil, conf)
+	defer servers.shutdown(context.Background())
+
+	for _, request := range []string{
+		// the client never finishes the request's headers
+		"GET / HTTP/1.1\r\nHost: example.com\r\n",
+		// the client keeps an idle connection after the response
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		for {
+			if _, err = conn.Read(buf); err != nil {
+				break
+			}
+		}
+		conn.Close()
+
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("connection with request %q wasn't closed by the server", request)
+		}
+	}
+}
+
+func TestRestartReadiness(t *testing.T) {
+	// the new process is ready once it serves its listeners
+	ready, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := newServerSet()
+	servers.readyPipe = w
+	ln, err := servers.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go servers.notifyParent([]string{"127.0.0.1:0"})
+	go servers.serve(ln, "127.0.0.1:0", http.NotFoundHandler(), nil, nil)
+	defer servers.shutdown(context.Background())
+	if err := waitReady(ready, 5*time.Second); err != nil {
+		t.Errorf("Expected the process to be ready, got %v", err)
+	}
+	ready.Close()
+
+	// the new process exited before serving
+	ready, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := waitReady(ready, 5*time.Second); err == nil {
+		t.Error("Expected an error if the process exited")
+	}
+	ready.Close()
+
+	// the new process hangs
+	ready, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := waitReady(ready, 50*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	ready.Close()
+}
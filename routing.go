@@ -0,0 +1,565 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type routeKind int
+
+const (
+	routeDirect routeKind = iota
+	routeProxy
+	routeDeny
+)
+
+const (
+	routeFallbackDirect = "direct"
+	routeFallbackDeny   = "deny"
+)
+
+// Reserved rules' values which can be used instead of a proxy alias
+const (
+	ruleDirect = "DIRECT"
+	ruleDeny   = "DENY"
+)
+
+// ruleExclusionPrefix marks rules which exclude destinations from other rules
+// with the same value.
+const ruleExclusionPrefix = "!"
+
+var errRouteDenied = errors.New("destination is denied by routing rules")
+
+// Routing holds forward proxies settings, it's treated as immutable once published
+// by the Router, updates always create a new copy.
+type Routing struct {
+	Proxies         map[string]string `json:"proxies"`
+	Rules           map[string]string `json:"rules"`
+	ForwardProxyURL string            `json:"forward_proxy_url"`
+	// what to do with requests which match neither rules nor forward_proxy_url
+	Fallback string `json:"fallback"`
+	// rules for particular users ("name") or groups ("@name")
+	UserRules map[string]map[string]string `json:"user_rules"`
+	Groups    map[string][]string          `json:"groups"`
+	// aliases which don't get new requests
+	Draining map[string]bool `json:"draining"`
+	// resolve host names to match them against network rules
+	ResolveDestinations bool `json:"resolve_destinations"`
+	// aliases of upstream pools discovered through DNS SRV records and their
+	// current members
+	SRVProxies map[string]string       `json:"srv_proxies"`
+	Pools      map[string][]PoolMember `json:"pools"`
+
+	// precompiled from the fields above by compile()
+	hostRules       ruleSet
+	identityRules   map[string]*ruleSet
+	userGroups      map[string][]string
+	forward         *url.URL
+	pools           map[string][]poolMember
+	hasNetworkRules bool
+}
+
+// ruleSet keeps host suffix and network rules ordered from the most specific to
+// the least specific one, the generic "." rule is kept separately.
+type ruleSet struct {
+	rules []compiledRule
+	// indexes of host suffix rules by their domains, lookups check every suffix of
+	// the host from the longest one, which is the same order rules are sorted in
+	bySuffix map[string]int
+	networks []compiledRule
+	generic  *compiledRule
+	// whether destinations' IP addresses are needed to match the rules
+	hasNetworks bool
+}
+
+type compiledRule struct {
+	kind   routeKind
+	domain string
+	// set for rules matching destination IP addresses
+	network *net.IPNet
+	alias   string
+	url     *url.URL
+	// members of SRV discovered pool, url is the pool's SRV name
+	pool []poolMember
+	// "!" rules with the same value, destinations matching them skip this rule
+	excludes []compiledRule
+}
+
+// destination is a requested host together with its IP addresses, which are
+// known for IP literals and for resolved host names.
+type destination struct {
+	host string
+	ips  []net.IP
+}
+
+// routeMatch describes how a request to some host is going to be routed.
+type routeMatch struct {
+	kind routeKind
+	// matched rules key, empty if no rule matched
+	rule string
+	// user or "@group" of the matched user_rules
+	identity string
+	// upstream proxy alias, empty for forward_proxy_url and direct connections
+	alias string
+	// upstream proxy, nil unless kind is routeProxy
+	url *url.URL
+	// members of SRV discovered pool the upstream is chosen from
+	pool []poolMember
+}
+
+type Router struct {
+	mu      sync.Mutex
+	current atomic.Pointer[Routing]
+	// used to skip unavailable members of upstream pools, set by setForwardProxy
+	health *ProxyHealth
+}
+
+func newRouter(conf *Configuration) *Router {
+	routing := &Routing{
+		Proxies:         copyStringMap(conf.Proxies),
+		Rules:           copyStringMap(conf.Rules),
+		ForwardProxyURL: conf.ForwardProxyURL,
+		Fallback:        conf.RouteFallback,
+		UserRules:       conf.UserRules,
+		Groups:          conf.Groups,
+		Draining:        make(map[string]bool),
+
+		ResolveDestinations: conf.ResolveDestinations,
+		SRVProxies:          copyStringMap(conf.SRVProxies),
+		Pools:               make(map[string][]PoolMember),
+	}
+	if err := routing.compile(); err != nil {
+		panic(err) // proxies' URLs are validated when configuration is loaded
+	}
+
+	router := &Router{}
+	router.current.Store(routing)
+
+	return router
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+
+	return result
+}
+
+func (r *Routing) clone() *Routing {
+	draining := make(map[string]bool, len(r.Draining))
+	for k, v := range r.Draining {
+		draining[k] = v
+	}
+
+	// members' slices are replaced, never modified
+	pools := make(map[string][]PoolMember, len(r.Pools))
+	for k, v := range r.Pools {
+		pools[k] = v
+	}
+
+	return &Routing{
+		Proxies:         copyStringMap(r.Proxies),
+		Rules:           copyStringMap(r.Rules),
+		ForwardProxyURL: r.ForwardProxyURL,
+		Fallback:        r.Fallback,
+		UserRules:       r.UserRules,
+		Groups:          r.Groups,
+		Draining:        draining,
+
+		ResolveDestinations: r.ResolveDestinations,
+		SRVProxies:          r.SRVProxies,
+		Pools:               pools,
+	}
+}
+
+// compile parses proxies' URLs and orders rules from the most specific to the least
+// specific one, so no work except the lookup itself is left for request time.
+func (r *Routing) compile() error {
+	parsed := make(map[string]*url.URL, len(r.Proxies))
+	for alias, proxyURL := range r.Proxies {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return fmt.Errorf("couldn't parse URL of proxy '%s': %w", alias, err)
+		}
+		parsed[alias] = u
+	}
+
+	r.pools = make(map[string][]poolMember, len(r.SRVProxies))
+	for alias, name := range r.SRVProxies {
+		u, err := parseSRVProxyURL(name)
+		if err != nil {
+			return fmt.Errorf("couldn't parse SRV name of upstream pool '%s': %w", alias, err)
+		}
+		parsed[alias] = u
+
+		if r.pools[alias], err = compilePool(r.Pools[alias]); err != nil {
+			return fmt.Errorf("couldn't parse member of upstream pool '%s': %w", alias, err)
+		}
+	}
+
+	r.hostRules = r.compileRules(r.Rules, parsed)
+	r.hasNetworkRules = r.hostRules.hasNetworks
+
+	r.identityRules = make(map[string]*ruleSet, len(r.UserRules))
+	for identity, rules := range r.UserRules {
+		set := r.compileRules(rules, parsed)
+		r.identityRules[identity] = &set
+		r.hasNetworkRules = r.hasNetworkRules || set.hasNetworks
+	}
+
+	r.userGroups = make(map[string][]string)
+	for group, users := range r.Groups {
+		for _, user := range users {
+			r.userGroups[user] = append(r.userGroups[user], group)
+		}
+	}
+	for _, groups := range r.userGroups {
+		sort.Strings(groups)
+	}
+
+	r.forward = nil
+	if r.ForwardProxyURL != "" {
+		u, err := url.Parse(r.ForwardProxyURL)
+		if err != nil {
+			return fmt.Errorf("couldn't parse forward proxy URL: %w", err)
+		}
+		r.forward = u
+	}
+
+	return nil
+}
+
+func (r *Routing) compileRules(rules map[string]string, parsed map[string]*url.URL) ruleSet {
+	var set ruleSet
+
+	excludes := make(map[string][]compiledRule)
+	for domain, alias := range rules {
+		if pattern, ok := strings.CutPrefix(domain, ruleExclusionPrefix); ok {
+			exclude := compiledRule{domain: pattern, network: parseNetwork(pattern)}
+			excludes[alias] = append(excludes[alias], exclude)
+			set.hasNetworks = set.hasNetworks || exclude.network != nil
+		}
+	}
+
+	for domain, alias := range rules {
+		if strings.HasPrefix(domain, ruleExclusionPrefix) {
+			continue
+		}
+
+		var rule compiledRule
+		switch alias {
+		case ruleDirect:
+			rule = compiledRule{kind: routeDirect, domain: domain}
+		case ruleDeny:
+			rule = compiledRule{kind: routeDeny, domain: domain}
+		default:
+			u, exists := parsed[alias]
+			if !exists || r.Draining[alias] {
+				continue // Skip if the alias does not exist in the proxies map or is being drained
+			}
+			rule = compiledRule{kind: routeProxy, domain: domain, alias: alias, url: u, pool: r.pools[alias]}
+		}
+		rule.excludes = excludes[alias]
+
+		if domain == "." {
+			set.generic = &rule
+		} else if network := parseNetwork(domain); network != nil {
+			rule.network = network
+			set.networks = append(set.networks, rule)
+			set.hasNetworks = true
+		} else {
+			set.rules = append(set.rules, rule)
+		}
+	}
+
+	sort.Slice(set.rules, func(i, j int) bool {
+		if len(set.rules[i].domain) != len(set.rules[j].domain) {
+			return len(set.rules[i].domain) > len(set.rules[j].domain)
+		}
+		return set.rules[i].domain < set.rules[j].domain
+	})
+
+	sort.Slice(set.networks, func(i, j int) bool {
+		return set.networks[i].rank() > set.networks[j].rank()
+	})
+
+	set.bySuffix = make(map[string]int, len(set.rules))
+	for i, rule := range set.rules {
+		set.bySuffix[rule.domain] = i
+	}
+
+	return set
+}
+
+// parseNetwork parses CIDR or a single IP address, nil is returned for anything else.
+func parseNetwork(s string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network
+	}
+
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	return nil
+}
+
+// rank orders rules by specificity, host suffix rules are always considered more
+// specific than network rules.
+func (rule *compiledRule) rank() int {
+	if rule.network != nil {
+		ones, _ := rule.network.Mask.Size()
+		return ones
+	}
+
+	return 1000 + len(rule.domain)
+}
+
+// matchSpecific returns the most specific rule matching the destination, the
+// generic rule isn't considered.
+func (set *ruleSet) matchSpecific(dst *destination) *compiledRule {
+	for i := 0; i <= len(dst.host); i++ {
+		if idx, exists := set.bySuffix[dst.host[i:]]; exists && !set.rules[idx].excluded(dst) {
+			return &set.rules[idx]
+		}
+	}
+
+	for i := range set.networks {
+		if set.networks[i].matches(dst) && !set.networks[i].excluded(dst) {
+			return &set.networks[i]
+		}
+	}
+
+	return nil
+}
+
+// matchGeneric returns the generic rule unless the destination is excluded from it.
+func (set *ruleSet) matchGeneric(dst *destination) *compiledRule {
+	if set.generic != nil && !set.generic.excluded(dst) {
+		return set.generic
+	}
+
+	return nil
+}
+
+func (rule *compiledRule) matches(dst *destination) bool {
+	if rule.network == nil {
+		return strings.HasSuffix(dst.host, rule.domain)
+	}
+
+	for _, ip := range dst.ips {
+		if rule.network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *compiledRule) excluded(dst *destination) bool {
+	for i := range rule.excludes {
+		if rule.excludes[i].matches(dst) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Router) routing() *Routing {
+	return r.current.Load()
+}
+
+// update applies f to a copy of the current routing and publishes the result
+// unless f returns an error.
+func (r *Router) update(f func(routing *Routing) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routing := r.current.Load().clone()
+	if err := f(routing); err != nil {
+		return err
+	}
+	if err := routing.compile(); err != nil {
+		return err
+	}
+	r.current.Store(routing)
+
+	return nil
+}
+
+// upstream returns the name of the upstream the request is routed to: DIRECT, DENY,
+// proxy alias or forward_proxy_url.
+func (m routeMatch) upstream() string {
+	switch {
+	case m.kind == routeDirect:
+		return ruleDirect
+	case m.kind == routeDeny:
+		return ruleDeny
+	case m.alias == "":
+		return "forward_proxy_url"
+	default:
+		return m.alias
+	}
+}
+
+func (m routeMatch) String() string {
+	rule := m.rule
+	if rule == "" {
+		rule = "-"
+	}
+
+	if m.kind == routeProxy {
+		return fmt.Sprintf("rule=%s upstream=%s (%s)", rule, m.upstream(), m.url.Redacted())
+	}
+
+	return fmt.Sprintf("rule=%s upstream=%s", rule, m.upstream())
+}
+
+// ruleID identifies the configuration setting the request was routed by in the
+// access log, i.e. "rules:.example.com" or "user_rules.alice:.example.com".
+func (m routeMatch) ruleID() string {
+	switch {
+	case m.rule == "" && m.kind == routeProxy:
+		return "forward_proxy_url"
+	case m.rule == "":
+		return "route_fallback"
+	case m.identity != "":
+		return "user_rules." + m.rule
+	}
+
+	return "rules:" + m.rule
+}
+
+// matchRoute picks the first match from: user's own rules, rules of the user's
+// groups, the most specific host rule, forward_proxy_url and the generic "." rule.
+// If nothing matches the configured fallback is used.
+func matchRoute(host, user string, routing *Routing) routeMatch {
+	dst := &destination{host: host}
+	if routing.hasNetworkRules {
+		dst.ips = resolveDestination(host, routing.ResolveDestinations)
+	}
+
+	if user != "" {
+		if match, ok := routing.matchIdentity(dst, user); ok {
+			return match
+		}
+	}
+
+	if rule := routing.hostRules.matchSpecific(dst); rule != nil {
+		return rule.match("")
+	}
+
+	if routing.forward != nil {
+		return routeMatch{kind: routeProxy, url: routing.forward}
+	}
+
+	if rule := routing.hostRules.matchGeneric(dst); rule != nil {
+		return rule.match("")
+	}
+
+	if routing.Fallback == routeFallbackDeny {
+		return routeMatch{kind: routeDeny}
+	}
+
+	return routeMatch{kind: routeDirect}
+}
+
+func (r *Routing) matchIdentity(dst *destination, user string) (routeMatch, bool) {
+	if set, exists := r.identityRules[user]; exists {
+		if rule := set.matchSpecific(dst); rule != nil {
+			return rule.match(user), true
+		}
+		if rule := set.matchGeneric(dst); rule != nil {
+			return rule.match(user), true
+		}
+	}
+
+	// the most specific rule among all user's groups wins, ties are resolved
+	// in favor of the group which name sorts first
+	var best *compiledRule
+	var bestGroup string
+	for _, group := range r.userGroups[user] {
+		if set, exists := r.identityRules["@"+group]; exists {
+			if rule := set.matchSpecific(dst); rule != nil && (best == nil || rule.rank() > best.rank()) {
+				best, bestGroup = rule, group
+			}
+		}
+	}
+
+	if best == nil {
+		for _, group := range r.userGroups[user] {
+			if set, exists := r.identityRules["@"+group]; exists && set.matchGeneric(dst) != nil {
+				best, bestGroup = set.generic, group
+				break
+			}
+		}
+	}
+
+	if best != nil {
+		return best.match("@" + bestGroup), true
+	}
+
+	return routeMatch{}, false
+}
+
+// match converts the rule to routeMatch, identity is prepended to the rule's name
+// for users' and groups' rules.
+func (rule *compiledRule) match(identity string) routeMatch {
+	name := rule.domain
+	if identity != "" {
+		name = identity + ":" + name
+	}
+
+	return routeMatch{kind: rule.kind, rule: name, identity: identity, alias: rule.alias, url: rule.url, pool: rule.pool}
+}
+
+// findMatchingProxy returns the upstream proxy for the host or nil if the request
+// doesn't go through an upstream proxy.
+func findMatchingProxy(host string, routing *Routing) *url.URL {
+	return matchRoute(host, "", routing).url
+}
+
+// findMatchingRoute returns the route for the request, the result is cached in the
+// request's info since it's needed several times while the request is processed.
+// Handlers pass the info of goproxy.ProxyCtx, requests read from decrypted tunnels
+// don't carry it in their context. Without the info users' rules don't apply.
+func findMatchingRoute(req *http.Request, info *requestInfo, router *Router) routeMatch {
+	routing := router.routing()
+	host := req.URL.Hostname()
+
+	if info == nil {
+		return router.pickUpstream(matchRoute(host, "", routing))
+	}
+
+	// the pool member is chosen once, so the request's upstream stays the same
+	cache := &info.route
+	if cache.routing != routing || cache.host != host || cache.user != info.user {
+		cache.match = router.pickUpstream(matchRoute(host, info.user, routing))
+		cache.routing, cache.host, cache.user = routing, host, info.user
+	}
+
+	return cache.match
+}
+
+// pickUpstream chooses the upstream for matches of upstream pools.
+func (r *Router) pickUpstream(match routeMatch) routeMatch {
+	if len(match.pool) > 0 {
+		match.url = r.pickPoolMember(match.pool)
+	}
+
+	return match
+}
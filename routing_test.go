@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestMatchRoute(t *testing.T) {
+	conf := &Configuration{
+		Proxies: map[string]string{
+			"parent":  "http://10.0.0.1:3128",
+			"generic": "http://10.0.0.2:3128",
+		},
+		Rules: map[string]string{
+			"example.com": "parent",
+			".":           "generic",
+		},
+	}
+	routing := newRouter(conf).routing()
+
+	match := matchRoute("www.example.com", "", routing)
+	if match.rule != "example.com" || match.alias != "parent" {
+		t.Errorf("Expected example.com rule and parent upstream, got %v", match)
+	}
+
+	match = matchRoute("www.example.org", "", routing)
+	if match.rule != "." || match.alias != "generic" {
+		t.Errorf("Expected generic upstream, got %v", match)
+	}
+}
+
+func TestRouteExplainHeader(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	s := "explain_networks=[\"127.0.0.1/32\"]\n"
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	setRouteExplainHandler(conf, proxy, newRouter(conf))
+
+	req, err := http.NewRequest("GET", background.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(proxyExplainHeader, "1")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	expected := "rule=- upstream=DIRECT"
+	if actual := resp.Header.Get(proxyRouteHeader); actual != expected {
+		t.Errorf("Expected '%s', actual '%s'", expected, actual)
+	}
+}
+
+func TestRouteFallback(t *testing.T) {
+	routing := newRouter(&Configuration{RouteFallback: routeFallbackDeny}).routing()
+	if match := matchRoute("www.example.com", "", routing); match.kind != routeDeny {
+		t.Errorf("Expected DENY route, got %v", match)
+	}
+
+	routing = newRouter(&Configuration{RouteFallback: routeFallbackDirect}).routing()
+	if match := matchRoute("www.example.com", "", routing); match.kind != routeDirect || match.url != nil {
+		t.Errorf("Expected DIRECT route, got %v", match)
+	}
+}
+
+func TestRouteFallbackDeny(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	s := "route_fallback=\"deny\"\n"
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	setForwardProxy(conf, proxy, newRouter(conf), newProxyHealth(conf))
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected 403 status code, got", resp.Status)
+	}
+}
+
+func TestDirectFallback(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+	tlsBackground := httptest.NewTLSServer(ConstantHanlder("OK"))
+	defer tlsBackground.Close()
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer parent.Close()
+
+	for _, domains := range []string{`["127.0.0.1"]`, `["example.com"]`} {
+		proxy := goproxy.NewProxyHttpServer()
+		proxyserver := httptest.NewServer(withRequestInfo(proxy))
+		defer proxyserver.Close()
+
+		proxyURL, _ := url.Parse(proxyserver.URL)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+
+		s := fmt.Sprintf("direct_fallback_domains=%s\n[proxies]\nparent=\"%s\"\n[rules]\n\".\"=\"parent\"\n", domains, parent.URL)
+		conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+		setForwardProxy(conf, proxy, newRouter(conf), newProxyHealth(conf))
+
+		fallback := domains != `["example.com"]`
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		expected := http.StatusBadGateway
+		if fallback {
+			expected = http.StatusOK
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("%s: expected %v status code, got %v", domains, expected, resp.Status)
+		}
+
+		resp, err = client.Get(tlsBackground.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if fallback != (err == nil) {
+			t.Errorf("%s: expected CONNECT fallback=%v, got %v", domains, fallback, err)
+		}
+	}
+}
+
+func TestRuleKeywords(t *testing.T) {
+	conf := &Configuration{
+		ForwardProxyURL: "http://10.0.0.1:3128",
+		Rules: map[string]string{
+			".internal.example.com": ruleDirect,
+			".ads.example.com":      ruleDeny,
+		},
+	}
+	routing := newRouter(conf).routing()
+
+	if match := matchRoute("git.internal.example.com", "", routing); match.kind != routeDirect {
+		t.Errorf("Expected DIRECT route, got %v", match)
+	}
+
+	if match := matchRoute("cdn.ads.example.com", "", routing); match.kind != routeDeny {
+		t.Errorf("Expected DENY route, got %v", match)
+	}
+
+	if match := matchRoute("www.example.com", "", routing); match.kind != routeProxy || match.url.Host != "10.0.0.1:3128" {
+		t.Errorf("Expected forward proxy route, got %v", match)
+	}
+}
+
+func TestNetworkRules(t *testing.T) {
+	conf := &Configuration{
+		Proxies: map[string]string{"parent": "http://10.0.0.1:3128"},
+		Rules: map[string]string{
+			"192.168.0.0/16":  "parent",
+			"192.168.10.0/24": ruleDirect,
+			"203.0.113.7":     ruleDeny,
+			".example.com":    "parent",
+		},
+	}
+	routing := newRouter(conf).routing()
+
+	if match := matchRoute("192.168.1.1", "", routing); match.kind != routeProxy || match.alias != "parent" {
+		t.Errorf("Expected route via parent, got %v", match)
+	}
+
+	if match := matchRoute("192.168.10.1", "", routing); match.kind != routeDirect || match.rule != "192.168.10.0/24" {
+		t.Errorf("Expected DIRECT route by the longest prefix, got %v", match)
+	}
+
+	if match := matchRoute("203.0.113.7", "", routing); match.kind != routeDeny {
+		t.Errorf("Expected DENY route, got %v", match)
+	}
+
+	// host names aren't resolved unless it's enabled
+	if match := matchRoute("localhost", "", routing); match.kind != routeDirect || match.rule != "" {
+		t.Errorf("Expected fallback route, got %v", match)
+	}
+}
+
+func TestExclusionRules(t *testing.T) {
+	conf := &Configuration{
+		Proxies: map[string]string{"proxyA": "http://10.0.0.1:3128"},
+		Rules: map[string]string{
+			".example.com":           "proxyA",
+			"!.internal.example.com": "proxyA",
+			".":                      ruleDeny,
+			"!.example.net":          ruleDeny,
+		},
+	}
+	routing := newRouter(conf).routing()
+
+	if match := matchRoute("www.example.com", "", routing); match.kind != routeProxy || match.alias != "proxyA" {
+		t.Errorf("Expected route via proxyA, got %v", match)
+	}
+
+	// excluded from ".example.com" rule, so the generic rule is used
+	if match := matchRoute("git.internal.example.com", "", routing); match.kind != routeDeny || match.rule != "." {
+		t.Errorf("Expected DENY route by the generic rule, got %v", match)
+	}
+
+	if match := matchRoute("www.example.net", "", routing); match.kind != routeDirect || match.rule != "" {
+		t.Errorf("Expected fallback route, got %v", match)
+	}
+}
+
+func TestDestinationNetworks(t *testing.T) {
+	conf := &Configuration{DisallowedDestinationNetworks: []string{"169.254.0.0/16"}}
+	proxy := goproxy.NewProxyHttpServer()
+	setDestinationNetworksHandler(conf, proxy)
+
+	req := httptest.NewRequest("GET", "http://169.254.169.254/latest/meta-data/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected 403 status code, got", w.Code)
+	}
+}
+
+func TestConnectIPLiterals(t *testing.T) {
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+
+	tests := []struct {
+		policy string
+		host   string
+		denied bool
+	}{
+		{connectIPLiteralsDeny, "10.0.0.1:443", true},
+		{connectIPLiteralsDeny, "[2001:db8::1]:443", true},
+		{connectIPLiteralsDeny, "www.example.com:443", false},
+		{connectIPLiteralsACL, "10.0.0.1:443", false},
+		{connectIPLiteralsACL, "192.168.0.1:443", true},
+		{connectIPLiteralsACL, "www.example.com:443", false},
+	}
+
+	for _, test := range tests {
+		conf := &Configuration{ConnectIPLiterals: test.policy, AllowedDestinationNetworks: []string{"10.0.0.0/8"}}
+		req := httptest.NewRequest(http.MethodConnect, test.host, nil)
+		if denied := connectIPLiteralDenied(conf)(req, ctx); denied != test.denied {
+			t.Errorf("%s with %s policy: expected denied=%v, got %v", test.host, test.policy, test.denied, denied)
+		}
+	}
+}
+
+func TestMetadataProtection(t *testing.T) {
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+	conf := &Configuration{MetadataProtection: true, MetadataAllowedNetworks: []string{"10.0.0.0/8"}}
+
+	tests := []struct {
+		method, target, client string
+		denied                 bool
+	}{
+		{http.MethodGet, "http://169.254.169.254/latest/meta-data/", "192.0.2.1:1234", true},
+		{http.MethodGet, "http://METADATA.google.internal./computeMetadata/v1/", "192.0.2.1:1234", true},
+		{http.MethodConnect, "[fd00:ec2::254]:443", "192.0.2.1:1234", true},
+		{http.MethodConnect, "[::ffff:169.254.169.254]:443", "192.0.2.1:1234", true},
+		{http.MethodGet, "http://169.254.169.254/latest/meta-data/", "10.1.2.3:1234", false},
+		{http.MethodGet, "http://www.example.com/", "192.0.2.1:1234", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.RemoteAddr = test.client
+		if denied := metadataRequested(conf)(req, ctx); denied != test.denied {
+			t.Errorf("%s from %s: expected denied=%v, got %v", test.target, test.client, test.denied, denied)
+		}
+	}
+}
+
+func TestUserRules(t *testing.T) {
+	conf := &Configuration{
+		Proxies: map[string]string{
+			"parent": "http://10.0.0.1:3128",
+			"team":   "http://10.0.0.2:3128",
+			"alice":  "http://10.0.0.3:3128",
+		},
+		Rules: map[string]string{
+			".example.com": "parent",
+		},
+		Groups: map[string][]string{
+			"devs": {"alice", "bob"},
+		},
+		UserRules: map[string]map[string]string{
+			"alice": {".private.example.com": "alice"},
+			"@devs": {".": "team"},
+		},
+	}
+	routing := newRouter(conf).routing()
+
+	tests := []struct {
+		host, user, rule, id string
+	}{
+		{"www.private.example.com", "alice", "alice:.private.example.com", "user_rules.alice:.private.example.com"},
+		{"www.example.com", "alice", "@devs:.", "user_rules.@devs:."},
+		{"www.example.com", "bob", "@devs:.", "user_rules.@devs:."},
+		{"www.example.com", "carol", ".example.com", "rules:.example.com"},
+		{"www.example.com", "", ".example.com", "rules:.example.com"},
+		{"www.example.org", "", "", "route_fallback"},
+	}
+
+	for _, test := range tests {
+		match := matchRoute(test.host, test.user, routing)
+		if match.rule != test.rule {
+			t.Errorf("%s for %s: expected rule %s, got %v", test.host, test.user, test.rule, match)
+		}
+		if id := match.ruleID(); id != test.id {
+			t.Errorf("%s for %s: expected rule ID %s, got %s", test.host, test.user, test.id, id)
+		}
+	}
+}
+
+func TestUserRulesWithAuth(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxyserver := httptest.NewServer(withRequestInfo(proxy))
+	defer proxyserver.Close()
+
+	proxyURL, _ := url.Parse(proxyserver.URL)
+	proxyURL.User = url.UserPassword(user, password)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	s := "[user_rules.user]\n\".\"=\"DENY\"\n"
+	conf := newConfiguration(bytes.NewBuffer([]byte(s)))
+	setForwardProxy(conf, proxy, newRouter(conf), newProxyHealth(conf))
+
+	auth, err := newBasicAuth(bytes.NewBuffer([]byte(user + ":" + password + "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setProxyBasicAuth(proxy, realm, makeBasicAuthValidator(auth), nil)
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected 403 status code, got", resp.Status)
+	}
+}
+
+func BenchmarkFindMatchingProxy(b *testing.B) {
+	conf := &Configuration{
+		Proxies: map[string]string{"parent": "http://10.0.0.1:3128"},
+		Rules:   map[string]string{".": "parent"},
+	}
+	for i := 0; i < 1000; i++ {
+		conf.Rules[fmt.Sprintf("host%d.example.com", i)] = ruleDirect
+	}
+	conf.Rules["example.org"] = "parent"
+	routing := newRouter(conf).routing()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if findMatchingProxy("www.example.org", routing) == nil {
+			b.Fatal("Expected parent upstream")
+		}
+	}
+}
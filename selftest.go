@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	selftestBody           = "microproxy selftest"
+	selftestUpstreamHeader = "X-Selftest-Upstream"
+	selftestGenericHost    = "selftest.invalid"
+	selftestTimeout        = 10 * time.Second
+)
+
+// runSelftest implements "microproxy selftest" subcommand which runs the proxy with
+// the given configuration against embedded origin and upstream servers and checks
+// that requests are handled as configured.
+func runSelftest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	configFile := flags.String("config", "microproxy.toml", "proxy configuration file")
+	user := flags.String("user", "", "user name to authenticate with, AUTH_USER is used by default")
+	password := flags.String("password", "", "password to authenticate with, AUTH_PASS is used by default")
+	bench := flags.Int("bench", 0, "number of requests to send for the throughput benchmark, 0 disables it")
+	concurrency := flags.Int("concurrency", 10, "number of concurrent benchmark clients")
+	verbose := flags.Bool("v", false, "show the proxy's activity log")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s selftest [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 0 || *bench < 0 || *concurrency <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	conf := newConfigurationFromFile(*configFile)
+	if *user == "" {
+		*user, *password = conf.AuthUser, conf.AuthPassword
+	}
+
+	var activity io.Writer = io.Discard
+	if *verbose {
+		activity = os.Stderr
+	}
+
+	st := newSelftest(conf, *user, *password, activity)
+	defer st.close()
+
+	ok := st.run(os.Stdout)
+	if ok && *bench > 0 {
+		ok = st.benchmark(os.Stdout, *bench, *concurrency)
+	}
+
+	if !ok {
+		return 1
+	}
+
+	return 0
+}
+
+// selftest runs the proxy on a loopback listener, all outgoing connections except
+// the ones to the embedded upstream proxies are redirected to the embedded origin.
+type selftest struct {
+	conf      *Configuration
+	user      string
+	password  string
+	router    *Router
+	origin    *httptest.Server
+	upstreams []*httptest.Server
+	server    *httptest.Server
+	client    *http.Client
+	failed    bool
+}
+
+func newSelftest(conf *Configuration, user, password string, activity io.Writer) *selftest {
+	st := &selftest{user: user, password: password}
+	st.origin = httptest.NewServer(selftestHandler(""))
+
+	// replace upstream proxies with embedded ones answering on their own behalf
+	c := *conf
+	c.AccessLog = ""
+	c.Proxies = make(map[string]string, len(conf.Proxies))
+	upstreams := make(map[string]bool)
+	for alias, proxyURL := range conf.Proxies {
+		c.Proxies[alias] = st.upstream(alias, proxyURL, upstreams)
+	}
+	if conf.ForwardProxyURL != "" {
+		c.ForwardProxyURL = st.upstream("forward_proxy_url", conf.ForwardProxyURL, upstreams)
+	}
+	st.conf = &c
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = log.New(activity, "", log.LstdFlags)
+	// the test must not depend on the environment's proxies
+	proxy.ConnectDial = nil
+	proxy.Tr.Proxy = nil
+	proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !upstreams[addr] {
+			addr = st.origin.Listener.Addr().String()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+
+	logger := newProxyLogger(st.conf)
+	st.router = newRouter(st.conf)
+	setProxyHandlers(st.conf, proxy, logger, st.router, newProxyHealth(st.conf), newTunnelRegistry(), nil, nil, nil)
+
+	handler := withRequestInfo(withAccessLog(proxy, logger))
+	st.server = httptest.NewUnstartedServer(withRequestHeads(withAdmissionControl(handler, st.conf), st.conf))
+	if heads, ok := st.server.Config.Handler.(*requestHeadHandler); ok {
+		st.server.Listener = heads.serve(st.server.Config, st.server.Listener)
+	}
+	st.server.Start()
+
+	proxyURL, _ := url.Parse(st.server.URL)
+	if user != "" {
+		proxyURL.User = url.UserPassword(user, password)
+	}
+	st.client = &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+		Timeout:   selftestTimeout,
+	}
+
+	return st
+}
+
+// upstream starts an embedded upstream proxy and returns its URL keeping the
+// credentials of the original one.
+func (st *selftest) upstream(name, proxyURL string, upstreams map[string]bool) string {
+	srv := httptest.NewServer(selftestHandler(name))
+	st.upstreams = append(st.upstreams, srv)
+	upstreams[srv.Listener.Addr().String()] = true
+
+	u, _ := url.Parse(srv.URL)
+	if original, err := url.Parse(proxyURL); err == nil {
+		u.User = original.User
+	}
+
+	return u.String()
+}
+
+func (st *selftest) close() {
+	st.server.Close()
+	st.origin.Close()
+	for _, srv := range st.upstreams {
+		srv.Close()
+	}
+}
+
+// selftestHandler answers requests on behalf of the named upstream proxy or of the
+// origin if the name is empty. Tunneled requests are answered by the upstream proxy
+// itself as well.
+func selftestHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			if name != "" {
+				w.Header().Set(selftestUpstreamHeader, name)
+			}
+			io.WriteString(w, selftestBody)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		tunneled, err := http.ReadRequest(rw.Reader)
+		if err != nil {
+			return
+		}
+
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Request:       tunneled,
+			Header:        http.Header{selftestUpstreamHeader: {name}},
+			Body:          io.NopCloser(strings.NewReader(selftestBody)),
+			ContentLength: int64(len(selftestBody)),
+			Close:         true,
+		}
+		resp.Write(conn)
+	})
+}
+
+// hosts returns destinations to check: a host matched by no rule and a host matched
+// by every domain rule.
+func (st *selftest) hosts() []string {
+	seen := map[string]bool{selftestGenericHost: true}
+	hosts := []string{}
+
+	add := func(rules map[string]string) {
+		for domain := range rules {
+			if domain == "." || strings.HasPrefix(domain, ruleExclusionPrefix) || parseNetwork(domain) != nil {
+				continue
+			}
+			host := domain
+			if strings.HasPrefix(domain, ".") {
+				host = "selftest" + domain
+			}
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	add(st.conf.Rules)
+	for _, rules := range st.conf.UserRules {
+		add(rules)
+	}
+	sort.Strings(hosts)
+
+	return append([]string{selftestGenericHost}, hosts...)
+}
+
+func (st *selftest) run(out io.Writer) bool {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	clientAccess := newClientAccess(st.conf)
+	clientAccess.refresh(nil)
+	if access := evalClientAccess(clientAccess, net.ParseIP("127.0.0.1")); access != "allowed" {
+		status, err := st.get(selftestGenericHost)
+		st.report(w, "client access", access, err == nil && status == http.StatusForbidden,
+			fmt.Sprintf("expected 403, got %s", formatResult(status, "", err)))
+		fmt.Fprintf(w, "remaining checks:\tskipped\n")
+		return !st.failed
+	}
+	st.report(w, "client access", "allowed", true, "")
+
+	if st.conf.authEnabled() {
+		status, err := st.anonymousGet(selftestGenericHost)
+		st.report(w, "authentication", "407 without credentials",
+			err == nil && status == http.StatusProxyAuthRequired,
+			fmt.Sprintf("expected 407, got %s", formatResult(status, "", err)))
+
+		if st.conf.AuthType == "digest" || st.user == "" {
+			fmt.Fprintf(w, "remaining checks:\tskipped, no credentials of a basic auth user\n")
+			return !st.failed
+		}
+	}
+
+	connectPort := strconv.Itoa(st.conf.AllowedConnectPorts[0])
+	if port := st.disallowedConnectPort(); port != "" {
+		status, _, err := st.connect(net.JoinHostPort(selftestGenericHost, port))
+		st.report(w, "CONNECT port "+port, "rejected", status != http.StatusOK,
+			fmt.Sprintf("expected rejection, got %s", formatResult(status, "", err)))
+	}
+
+	for _, host := range st.hosts() {
+		match := matchRoute(host, st.user, st.router.routing())
+
+		status, upstream, err := st.getUpstream(host)
+		st.checkRoute(w, "GET "+host, match, status, upstream, err)
+
+		status, upstream, err = st.connect(net.JoinHostPort(host, connectPort))
+		st.checkRoute(w, "CONNECT "+net.JoinHostPort(host, connectPort), match, status, upstream, err)
+	}
+
+	return !st.failed
+}
+
+func (st *selftest) checkRoute(w io.Writer, name string, match routeMatch, status int, upstream string, err error) {
+	expected := match.upstream()
+	if match.kind == routeDeny {
+		st.report(w, name, expected, err == nil && status == http.StatusForbidden,
+			fmt.Sprintf("expected 403, got %s", formatResult(status, upstream, err)))
+		return
+	}
+
+	got := upstream
+	if got == "" {
+		got = ruleDirect
+	}
+	st.report(w, name, expected, err == nil && status == http.StatusOK && got == expected,
+		fmt.Sprintf("expected 200 via %s, got %s", expected, formatResult(status, got, err)))
+}
+
+func (st *selftest) report(w io.Writer, name, result string, ok bool, failure string) {
+	if ok {
+		fmt.Fprintf(w, "%s:\tok, %s\n", name, result)
+		return
+	}
+
+	st.failed = true
+	fmt.Fprintf(w, "%s:\tFAIL, %s\n", name, failure)
+}
+
+func formatResult(status int, upstream string, err error) string {
+	switch {
+	case err != nil:
+		return err.Error()
+	case status == 0:
+		return "connection closed"
+	case status == http.StatusOK && upstream != "":
+		return fmt.Sprintf("%d via %s", status, upstream)
+	default:
+		return strconv.Itoa(status)
+	}
+}
+
+// disallowedConnectPort returns a port CONNECT requests should be rejected to.
+func (st *selftest) disallowedConnectPort() string {
+	allowed := make(map[int]bool)
+	for _, port := range st.conf.AllowedConnectPorts {
+		allowed[port] = true
+	}
+
+	for _, port := range []int{25, 22, 8080} {
+		if !allowed[port] {
+			return strconv.Itoa(port)
+		}
+	}
+
+	return ""
+}
+
+func (st *selftest) get(host string) (int, error) {
+	status, _, err := st.getUpstream(host)
+	return status, err
+}
+
+// getUpstream sends a plain HTTP request through the proxy and returns the name of
+// the embedded upstream proxy which answered it, empty for the origin.
+func (st *selftest) getUpstream(host string) (int, string, error) {
+	resp, err := st.client.Get("http://" + host + "/")
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if resp.StatusCode == http.StatusOK && string(body) != selftestBody {
+		return resp.StatusCode, "", errors.New("unexpected response body")
+	}
+
+	return resp.StatusCode, resp.Header.Get(selftestUpstreamHeader), nil
+}
+
+func (st *selftest) anonymousGet(host string) (int, error) {
+	proxyURL, _ := url.Parse(st.server.URL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+		Timeout:   selftestTimeout,
+	}
+
+	resp, err := client.Get("http://" + host + "/")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
+
+// connect establishes a tunnel through the proxy and sends a request through it, 0
+// status is returned if the proxy closed the connection without a response.
+func (st *selftest) connect(addr string) (int, string, error) {
+	conn, err := net.DialTimeout("tcp", st.server.Listener.Addr().String(), selftestTimeout)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(selftestTimeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if st.user != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(st.user + ":" + st.password))
+		req.Header.Set(ProxyAuthorizatonHeader, "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		return 0, "", err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, "", nil
+	}
+
+	tunneled, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	tunneled.Close = true
+	if err := tunneled.Write(conn); err != nil {
+		return 0, "", err
+	}
+
+	resp, err = http.ReadResponse(r, tunneled)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	if string(body) != selftestBody {
+		return 0, "", errors.New("unexpected response through the tunnel")
+	}
+
+	return http.StatusOK, resp.Header.Get(selftestUpstreamHeader), nil
+}
+
+// benchmark sends plain HTTP requests through the proxy and reports the throughput.
+func (st *selftest) benchmark(out io.Writer, requests, concurrency int) bool {
+	host := ""
+	for _, h := range st.hosts() {
+		if matchRoute(h, st.user, st.router.routing()).kind != routeDeny {
+			host = h
+			break
+		}
+	}
+
+	if host == "" {
+		fmt.Fprintf(out, "benchmark: skipped, all destinations are denied\n")
+		return true
+	}
+
+	transport := st.client.Transport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = false
+	transport.MaxIdleConnsPerHost = concurrency
+	client := &http.Client{Transport: transport, Timeout: selftestTimeout}
+	defer transport.CloseIdleConnections()
+
+	var mu sync.Mutex
+	var failures int
+	var wg sync.WaitGroup
+
+	queue := make(chan struct{}, requests)
+	for i := 0; i < requests; i++ {
+		queue <- struct{}{}
+	}
+	close(queue)
+
+	started := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range queue {
+				resp, err := client.Get("http://" + host + "/")
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				if err != nil || resp.StatusCode != http.StatusOK {
+					mu.Lock()
+					failures++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	fmt.Fprintf(out, "benchmark: %d requests to %s, concurrency %d, %.1f requests/s, %d failed\n",
+		requests, host, concurrency, float64(requests)/elapsed.Seconds(), failures)
+
+	return failures == 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// shadowEvaluator evaluates requests with the candidate configuration of
+// shadow_config alongside the active one and logs requests the candidate would
+// handle differently, so big rule changes can be validated on real traffic before
+// switching to them.
+type shadowEvaluator struct {
+	active       *Configuration
+	activeAccess *clientAccess
+	router       *Router
+	candidate    *Configuration
+	// the candidate's routing, it isn't changed by the admin API
+	candidateRouting *Routing
+	candidateAccess  *clientAccess
+	log              *moduleLogger
+}
+
+// newShadowEvaluator returns nil if shadow_config isn't set.
+func newShadowEvaluator(conf *Configuration, router *Router, proxy *goproxy.ProxyHttpServer) *shadowEvaluator {
+	if conf.ShadowConfig == "" {
+		return nil
+	}
+
+	candidate := newConfigurationFromFile(conf.ShadowConfig)
+	proxy.Logger.Printf("evaluating candidate configuration %v in shadow\n", conf.ShadowConfig)
+
+	s := &shadowEvaluator{
+		active:           conf,
+		activeAccess:     newClientAccess(conf),
+		router:           router,
+		candidate:        candidate,
+		candidateRouting: newRouter(candidate).routing(),
+		candidateAccess:  newClientAccess(candidate),
+		log:              newModuleLogger(proxy, logModuleShadow),
+	}
+	// lookup failures of the active configuration are logged by its handlers
+	s.activeAccess.start(conf, nil)
+	s.candidateAccess.start(candidate, proxy)
+
+	return s
+}
+
+// evaluate returns decisions of the active and the candidate configurations.
+func (s *shadowEvaluator) evaluate(req *http.Request, user string) (active, candidate string) {
+	return decide(s.active, s.activeAccess, s.router.routing(), req, user),
+		decide(s.candidate, s.candidateAccess, s.candidateRouting, req, user)
+}
+
+// decide describes how the configuration handles the request: the first access
+// check denying it or its route. Only settings which don't need the destination
+// to be resolved are evaluated, the same way as by "microproxy eval".
+func decide(conf *Configuration, access *clientAccess, routing *Routing, req *http.Request, user string) string {
+	client := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if result := evalClientAccess(access, net.ParseIP(client)); result != "allowed" {
+		return "client access " + result
+	}
+
+	host := req.URL.Hostname()
+	if req.Method == http.MethodConnect {
+		if access := evalConnectPort(conf, req.URL.Port()); access != "allowed" {
+			return "connect port " + access
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if access := evalConnectIPLiteral(conf, ip); access != "allowed" {
+				return "connect to IP address " + access
+			}
+		}
+	}
+
+	return "route " + matchRoute(host, user, routing).String()
+}
+
+// withShadowEvaluation compares decisions once the request was handled, so the
+// authenticated user is known. Has to be wrapped by withRequestInfo.
+func withShadowEvaluation(handler http.Handler, shadow *shadowEvaluator) http.Handler {
+	if shadow == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+
+		user := ""
+		if info := requestInfoFromRequest(req); info != nil {
+			user = info.user
+		}
+
+		if active, candidate := shadow.evaluate(req, user); active != candidate {
+			shadow.log.logf(nil, slog.LevelInfo, "candidate configuration differs for %v %v from %v user %q: active %v, candidate %v",
+				req.Method, req.URL, req.RemoteAddr, user, active, candidate)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShadowEvaluation(t *testing.T) {
+	active := &Configuration{
+		AllowedConnectPorts: []int{443},
+		Rules:               map[string]string{".example.com": ruleDirect},
+	}
+	candidate := &Configuration{
+		AllowedConnectPorts: []int{443, 8443},
+		DisallowedNetworks:  []string{"10.1.0.0/16"},
+		Proxies:             map[string]string{"parent": "http://10.0.0.1:3128"},
+		Rules:               map[string]string{".example.com": ruleDirect},
+		UserRules:           map[string]map[string]string{"alice": {".": "parent"}},
+	}
+	shadow := &shadowEvaluator{
+		active:           active,
+		activeAccess:     newClientAccess(active),
+		router:           newRouter(active),
+		candidate:        candidate,
+		candidateRouting: newRouter(candidate).routing(),
+		candidateAccess:  newClientAccess(candidate),
+	}
+
+	tests := []struct {
+		method, target, client, user string
+		differs                      bool
+	}{
+		{http.MethodGet, "http://www.example.com/", "10.0.0.1:1234", "", false},
+		{http.MethodGet, "http://www.example.com/", "10.0.0.1:1234", "alice", true},
+		{http.MethodGet, "http://www.example.com/", "10.1.0.1:1234", "", true},
+		{http.MethodConnect, "www.example.com:443", "10.0.0.1:1234", "", false},
+		{http.MethodConnect, "www.example.com:8443", "10.0.0.1:1234", "", true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		req.RemoteAddr = test.client
+		active, candidate := shadow.evaluate(req, test.user)
+		if differs := active != candidate; differs != test.differs {
+			t.Errorf("%s %s from %s user %q: expected differs=%v, got active %q, candidate %q",
+				test.method, test.target, test.client, test.user, test.differs, active, candidate)
+		}
+	}
+}
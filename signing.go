@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of request_signing type.
+const (
+	signingHMAC  = "hmac"
+	signingAWSv4 = "aws-sigv4"
+)
+
+const (
+	defaultSigningHeader = "X-Signature"
+	// request bodies are kept in memory to be hashed
+	maxSignedBodySize = 10 << 20
+)
+
+// SigningRule signs requests to hosts and their subdomains, either with HMAC-SHA256
+// of the request in the header or with AWS Signature Version 4.
+type SigningRule struct {
+	Hosts []string `toml:"hosts"`
+	Type  string   `toml:"type"`
+
+	Header string `toml:"header"`
+	Secret string `toml:"secret"`
+
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+	SessionToken    string `toml:"session_token"`
+	Region          string `toml:"region"`
+	Service         string `toml:"service"`
+}
+
+type compiledSigningRule struct {
+	SigningRule
+	hosts []string
+}
+
+// sign adds the rule's signature to the request, body is the request's body.
+func (rule *compiledSigningRule) sign(req *http.Request, body []byte, now time.Time) {
+	if rule.Type == signingAWSv4 {
+		signAWSv4(req, body, now, &rule.SigningRule)
+	} else {
+		signHMAC(req, body, now, rule.Secret, rule.Header)
+	}
+}
+
+// signHMAC sets the header to "t=TIMESTAMP,v1=SIGNATURE", where the signature is
+// hex encoded HMAC-SHA256 of the timestamp, method, host, path with query and hex
+// encoded SHA-256 of the body, separated by newlines.
+func signHMAC(req *http.Request, body []byte, now time.Time, secret, header string) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, strings.Join([]string{
+		timestamp, req.Method, requestHost(req), req.URL.RequestURI(), hex.EncodeToString(bodyHash[:]),
+	}, "\n"))
+
+	req.Header.Set(header, "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+
+	return req.URL.Host
+}
+
+// signAWSv4 signs the request with AWS Signature Version 4, the signature covers
+// Host and X-Amz-* headers set here.
+func signAWSv4(req *http.Request, body []byte, now time.Time, rule *SigningRule) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + rule.Region + "/" + rule.Service + "/aws4_request"
+	bodyHash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(bodyHash[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if rule.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", rule.SessionToken)
+	}
+	// only S3 requires the payload hash header
+	if rule.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	headers := map[string]string{"host": requestHost(req)}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// paths are encoded once more for all services except S3
+	path := awsURIEncode(req.URL.EscapedPath(), false)
+	if rule.Service == "s3" {
+		path = awsURIEncode(req.URL.Path, false)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, awsCanonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + rule.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), rule.Region, rule.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		rule.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, data)
+	return mac.Sum(nil)
+}
+
+// awsURIEncode encodes everything except unreserved characters (RFC 3986), slashes
+// are kept unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+func compileSigningRules(rules []SigningRule) []compiledSigningRule {
+	compiled := make([]compiledSigningRule, 0, len(rules))
+	for _, rule := range rules {
+		c := compiledSigningRule{SigningRule: rule}
+		if c.Header == "" {
+			c.Header = defaultSigningHeader
+		}
+		for _, host := range rule.Hosts {
+			c.hosts = append(c.hosts, strings.ToLower(strings.TrimPrefix(host, ".")))
+		}
+		compiled = append(compiled, c)
+	}
+
+	return compiled
+}
+
+// setRequestSigningHandler signs requests to hosts of request_signing rules, the
+// first matching rule is used. Only requests the proxy sees are signed, i.e. plain
+// HTTP ones and requests in inspected tunnels (mitm_domains). Bodies are buffered
+// within memory's budget, memory may be nil.
+func setRequestSigningHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer, memory *memoryGuard) {
+	if len(conf.RequestSigning) == 0 {
+		return
+	}
+
+	rules := compileSigningRules(conf.RequestSigning)
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			host := strings.ToLower(req.URL.Hostname())
+
+			for i := range rules {
+				if !matchesDomains(host, rules[i].hosts) {
+					continue
+				}
+
+				var body []byte
+				if req.Body != nil && req.Body != http.NoBody {
+					// bodies can't be signed without buffering them, under memory
+					// pressure such requests are rejected instead
+					reserved := int64(maxSignedBodySize + 1)
+					if req.ContentLength >= 0 && req.ContentLength < reserved {
+						reserved = req.ContentLength
+					}
+					if !memory.reserve(reserved) {
+						req.Body.Close()
+						resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable,
+							"Proxy is overloaded, try again later")
+						resp.Header.Set("Retry-After", strconv.Itoa(int(memoryCheckInterval.Seconds())))
+						return req, resp
+					}
+
+					var err error
+					body, err = io.ReadAll(io.LimitReader(req.Body, maxSignedBodySize+1))
+					req.Body.Close()
+					// only the body passed on stays reserved until it's sent
+					kept := int64(len(body))
+					if err != nil || kept > maxSignedBodySize {
+						kept = 0
+					}
+					memory.release(reserved - kept)
+					if err != nil {
+						return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest,
+							"Couldn't read request body")
+					}
+					if len(body) > maxSignedBodySize {
+						return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusRequestEntityTooLarge,
+							"Request body is too large to be signed")
+					}
+					req.Body, req.ContentLength = http.NoBody, 0
+					if len(body) > 0 {
+						req.Body, req.ContentLength = memory.bufferedBody(req.Context(), body), int64(len(body))
+					}
+				} else if req.Body != nil {
+					req.ContentLength = 0
+				}
+
+				rules[i].sign(req, body, time.Now())
+				break
+			}
+
+			return req, nil
+		})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWSv4(t *testing.T) {
+	// "get-vanilla" case of the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "http://example.amazonaws.com/", nil)
+	rule := &SigningRule{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+	}
+
+	signAWSv4(req, nil, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC), rule)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Expected %s, got %s", expected, auth)
+	}
+	if date := req.Header.Get("X-Amz-Date"); date != "20150830T123600Z" {
+		t.Errorf("Unexpected X-Amz-Date %s", date)
+	}
+}
+
+func TestAWSCanonicalQuery(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/?b=2&a=x%20y&a=1&c=/", nil)
+	if query := awsCanonicalQuery(req.URL.Query()); query != "a=1&a=x%20y&b=2&c=%2F" {
+		t.Errorf("Unexpected canonical query %s", query)
+	}
+}
+
+func TestRequestSigning(t *testing.T) {
+	signed := make(chan string, 1)
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		bodyHash := sha256.Sum256(body)
+		timestamp, _, _ := strings.Cut(strings.TrimPrefix(req.Header.Get("X-Signature"), "t="), ",")
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		io.WriteString(mac, strings.Join([]string{
+			timestamp, req.Method, req.Host, req.URL.RequestURI(), hex.EncodeToString(bodyHash[:]),
+		}, "\n"))
+		expected := "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+
+		if req.Header.Get("X-Signature") != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		signed <- string(body)
+	}))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	conf := &Configuration{RequestSigning: []SigningRule{
+		{Hosts: []string{"example.com"}, Type: signingAWSv4},
+		{Hosts: []string{"127.0.0.1"}, Type: signingHMAC, Secret: "secret"},
+	}}
+	setRequestSigningHandler(conf, proxy, nil)
+
+	resp, err := client.Post(background.URL+"/path?q=1", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected valid signature, got %v", resp.StatusCode)
+	}
+	if body := <-signed; body != "payload" {
+		t.Errorf("Expected the body to be passed to the origin, got '%s'", body)
+	}
+
+	resp, err = client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	<-signed
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected valid signature of request without body, got %v", resp.StatusCode)
+	}
+}
+
+func TestRequestSigningUnderMemoryPressure(t *testing.T) {
+	received := make(chan string, 1)
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("X-Signature")
+	}))
+	defer background.Close()
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	memory := newMemoryGuard(&Configuration{MemoryLimit: "100MiB", MemoryShedRatio: 0.5})
+	memory.update(60<<20, proxy)
+	conf := &Configuration{RequestSigning: []SigningRule{
+		{Hosts: []string{"127.0.0.1"}, Type: signingHMAC, Secret: "secret"},
+	}}
+	setRequestSigningHandler(conf, proxy, memory)
+
+	// bodies aren't buffered under pressure
+	resp, err := client.Post(background.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 503 status code with Retry-After, got %v", resp.StatusCode)
+	}
+
+	// requests without body are still signed
+	resp, err = client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if signature := <-received; resp.StatusCode != http.StatusOK || signature == "" {
+		t.Errorf("Expected signed request, got %v '%s'", resp.StatusCode, signature)
+	}
+
+	// once memory usage is back to normal the buffer is released after the request
+	memory.update(10<<20, proxy)
+	resp, err = client.Post(background.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	<-received
+	if resp.StatusCode != http.StatusOK || memory.buffered.Load() != 0 {
+		t.Errorf("Expected signed request, got %v with %v bytes reserved", resp.StatusCode, memory.buffered.Load())
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929).
+const (
+	socksVersion          = 0x05
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xFF
+	socksAuthPasswordVer  = 0x01
+	socksCmdConnect       = 0x01
+	socksAddrIPv4         = 0x01
+	socksAddrDomain       = 0x03
+	socksAddrIPv6         = 0x04
+)
+
+// socksHandshakeTimeout bounds negotiation with the upstream SOCKS server once the
+// TCP connection to it is established.
+const socksHandshakeTimeout = 30 * time.Second
+
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func isSOCKSProxy(proxyURL *url.URL) bool {
+	return proxyURL.Scheme == "socks5"
+}
+
+// dialSOCKS5 connects to addr through the SOCKS5 server of proxyURL. Host names
+// are resolved by the SOCKS server, so Tor and SSH dynamic tunnels see them.
+func dialSOCKS5(ctx context.Context, proxy *goproxy.ProxyHttpServer, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in address '%s'", addr)
+	}
+
+	server := proxyURL.Host
+	if proxyURL.Port() == "" {
+		server = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+
+	conn, err := dialDirect(ctx, proxy, network, server)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err := socksHandshake(conn, proxyURL.User, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", proxyURL.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func socksHandshake(conn net.Conn, user *url.Userinfo, host string, port uint16) error {
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = []byte{socksAuthPassword}
+	}
+
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errors.New("server requires authentication")
+		}
+		if err := socksAuthenticate(conn, user); err != nil {
+			return err
+		}
+	case socksAuthNoAcceptable:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name is too long")
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		if msg, exists := socksReplies[head[1]]; exists {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("unknown reply code %d", head[1])
+	}
+
+	// skip the bound address
+	var skip int
+	switch head[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len
+	case socksAddrIPv6:
+		skip = net.IPv6len
+	case socksAddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unknown address type %d", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+
+	return err
+}
+
+func socksAuthenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("username or password is too long")
+	}
+
+	req := []byte{socksAuthPasswordVer, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// SOCKS5 reply codes (RFC 1928).
+const (
+	socksReplySucceeded       = 0x00
+	socksReplyFailure         = 0x01
+	socksReplyNotAllowed      = 0x02
+	socksReplyHostUnreach     = 0x04
+	socksReplyCmdUnsupported  = 0x07
+	socksReplyAddrUnsupported = 0x08
+)
+
+var errSOCKSHandshake = errors.New("SOCKS handshake failed")
+
+// withSOCKS makes handler serve SOCKS5 clients. Every SOCKS CONNECT request is
+// turned into HTTP CONNECT request to handler, so access control, authentication,
+// routing and logging are the same as for HTTP clients, and the response is turned
+// into SOCKS reply. Connections are translated only on servers started by
+// serverSet.serve with the returned handler. Usernames and passwords of SOCKS
+// clients are passed to handler as basic auth credentials.
+func withSOCKS(handler http.Handler, conf *Configuration) *socksHandler {
+	return &socksHandler{handler: handler, authRequired: conf.authEnabled()}
+}
+
+type socksHandler struct {
+	handler      http.Handler
+	authRequired bool
+}
+
+func (h *socksHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.handler.ServeHTTP(w, req)
+}
+
+func (h *socksHandler) listener(ln net.Listener) net.Listener {
+	return &socksListener{Listener: ln, authRequired: h.authRequired}
+}
+
+type socksListener struct {
+	net.Listener
+	authRequired bool
+}
+
+func (ln *socksListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &socksConn{Conn: c, authRequired: ln.authRequired}, nil
+}
+
+// socksConn performs SOCKS handshake on the first read, which is done by the HTTP
+// server's goroutine serving the connection, so its read deadlines apply. The client's
+// request is read as HTTP CONNECT request, status line of the response is written
+// as SOCKS reply. After successful reply the connection is passed through.
+type socksConn struct {
+	net.Conn
+	authRequired bool
+
+	mu        sync.Mutex
+	handshake bool
+	request   []byte
+	// the response's head is collected until its status line is complete and
+	// skipped until its end
+	head    []byte
+	replied bool
+	failed  bool
+}
+
+func (c *socksConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.handshake {
+		c.handshake = true
+		request, err := c.readRequest()
+		if err != nil {
+			c.failed = true
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.request = request
+	}
+	failed := c.failed
+	if len(c.request) > 0 {
+		n := copy(b, c.request)
+		c.request = c.request[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	c.mu.Unlock()
+
+	// nothing is read after failure, so the server closes the connection
+	if failed {
+		return 0, io.EOF
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *socksConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failed {
+		return len(b), nil
+	}
+	if c.head == nil && c.replied {
+		return c.Conn.Write(b)
+	}
+
+	c.head = append(c.head, b...)
+	if !c.replied {
+		end := bytes.Index(c.head, []byte("\r\n"))
+		if end < 0 {
+			return len(b), nil
+		}
+		c.replied = true
+
+		reply := socksReplyFor(c.head[:end])
+		if err := c.reply(reply); err != nil {
+			return 0, err
+		}
+		if reply != socksReplySucceeded {
+			c.failed = true
+			return len(b), nil
+		}
+	}
+
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(b), nil
+	}
+	rest := c.head[end+4:]
+	c.head = nil
+	if len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Close sends a failure reply if the request was read but the proxy closes the
+// connection without a response, i.e. CONNECT rejected by goproxy.AlwaysReject.
+func (c *socksConn) Close() error {
+	c.mu.Lock()
+	if c.handshake && !c.replied && !c.failed {
+		c.replied, c.failed = true, true
+		c.reply(socksReplyNotAllowed)
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// socksReplyFor maps status line of the proxy's response to SOCKS reply code.
+func socksReplyFor(statusLine []byte) byte {
+	var proto string
+	var status int
+	if _, err := fmt.Sscanf(string(statusLine), "%s %d", &proto, &status); err != nil {
+		return socksReplyFailure
+	}
+
+	switch {
+	case status == http.StatusOK:
+		return socksReplySucceeded
+	case status == http.StatusForbidden || status == http.StatusProxyAuthRequired:
+		return socksReplyNotAllowed
+	case status == http.StatusBadGateway || status == http.StatusGatewayTimeout:
+		return socksReplyHostUnreach
+	default:
+		return socksReplyFailure
+	}
+}
+
+// readRequest negotiates authentication, reads the client's request and returns
+// it as HTTP CONNECT request.
+func (c *socksConn) readRequest() ([]byte, error) {
+	var buf [255]byte
+
+	if _, err := io.ReadFull(c.Conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, errSOCKSHandshake
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(c.Conn, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(socksAuthNoAcceptable)
+	if bytes.IndexByte(methods, socksAuthPassword) >= 0 {
+		method = socksAuthPassword
+	} else if !c.authRequired && bytes.IndexByte(methods, socksAuthNone) >= 0 {
+		method = socksAuthNone
+	}
+	if _, err := c.Conn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+	if method == socksAuthNoAcceptable {
+		return nil, errSOCKSHandshake
+	}
+
+	var credentials string
+	if method == socksAuthPassword {
+		var err error
+		if credentials, err = c.readCredentials(); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.ReadFull(c.Conn, buf[:4]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, errSOCKSHandshake
+	}
+	if buf[1] != socksCmdConnect {
+		c.reply(socksReplyCmdUnsupported)
+		return nil, errSOCKSHandshake
+	}
+
+	var host string
+	switch buf[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if buf[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		if _, err := io.ReadFull(c.Conn, buf[:size]); err != nil {
+			return nil, err
+		}
+		host = net.IP(buf[:size]).String()
+	case socksAddrDomain:
+		if _, err := io.ReadFull(c.Conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		name := buf[:buf[0]]
+		if _, err := io.ReadFull(c.Conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		c.reply(socksReplyAddrUnsupported)
+		return nil, errSOCKSHandshake
+	}
+
+	if _, err := io.ReadFull(c.Conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+
+	request := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if credentials != "" {
+		request += ProxyAuthorizatonHeader + ": Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+
+	return []byte(request + "\r\n"), nil
+}
+
+// readCredentials reads username/password of the client (RFC 1929). They are
+// accepted here and checked by the proxy's authentication handler.
+func (c *socksConn) readCredentials() (string, error) {
+	var buf [255]byte
+
+	if _, err := io.ReadFull(c.Conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != socksAuthPasswordVer {
+		return "", errSOCKSHandshake
+	}
+	username := make([]byte, buf[1])
+	if _, err := io.ReadFull(c.Conn, username); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(c.Conn, buf[:1]); err != nil {
+		return "", err
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(c.Conn, password); err != nil {
+		return "", err
+	}
+
+	if _, err := c.Conn.Write([]byte{socksAuthPasswordVer, 0}); err != nil {
+		return "", err
+	}
+
+	return string(username) + ":" + string(password), nil
+}
+
+// reply writes SOCKS reply with unspecified bound address.
+func (c *socksConn) reply(code byte) error {
+	_, err := c.Conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+// startSOCKSServer runs a minimal SOCKS5 server with username/password
+// authentication, requested addresses are sent to the returned channel.
+func startSOCKSServer(t *testing.T, username, password string) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	requested := make(chan string, 10)
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		buf := make([]byte, 512)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{socksVersion, socksAuthPassword})
+
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			conn.Write([]byte{socksAuthPasswordVer, 1})
+			return
+		}
+		conn.Write([]byte{socksAuthPasswordVer, 0})
+
+		io.ReadFull(conn, buf[:4])
+		var host string
+		switch buf[3] {
+		case socksAddrDomain:
+			io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		case socksAddrIPv4:
+			io.ReadFull(conn, buf[:net.IPv4len])
+			host = net.IP(buf[:net.IPv4len]).String()
+		default:
+			return
+		}
+		io.ReadFull(conn, buf[:2])
+		port := strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))
+		requested <- net.JoinHostPort(host, port)
+
+		if host == "localhost" {
+			host = "127.0.0.1"
+		}
+		upstream, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			conn.Write([]byte{socksVersion, 0x05, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{socksVersion, 0, 0, socksAddrIPv4, 127, 0, 0, 1, 0, 0})
+
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return ln, requested
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	echo := startEchoServer(t)
+	socks, requested := startSOCKSServer(t, "user", "secret")
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	proxy := goproxy.NewProxyHttpServer()
+
+	proxyURL, _ := url.Parse("socks5://user:secret@" + socks.Addr().String())
+	conn, err := dialSOCKS5(context.Background(), proxy, proxyURL, "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if addr := <-requested; addr != net.JoinHostPort("localhost", port) {
+		t.Errorf("Expected host name to be sent to SOCKS server, got %v", addr)
+	}
+
+	msg := []byte("ping")
+	conn.Write(msg)
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, msg) {
+		t.Errorf("Expected echoed message, got '%s' (%v)", reply, err)
+	}
+
+	proxyURL, _ = url.Parse("socks5://user:wrong@" + socks.Addr().String())
+	if conn, err := dialSOCKS5(context.Background(), proxy, proxyURL, "tcp", echo.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("Expected authentication failure")
+	}
+}
+
+func TestSOCKSForwardProxy(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("OK"))
+	defer background.Close()
+	socks, requested := startSOCKSServer(t, "user", "secret")
+
+	client, proxy, proxyserver := oneShotProxy()
+	defer proxyserver.Close()
+
+	conf := &Configuration{ForwardProxyURL: "socks5://user:secret@" + socks.Addr().String()}
+	setForwardProxy(conf, proxy, newRouter(conf), newProxyHealth(conf))
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(msg) != "OK" {
+		t.Errorf("Expected 200 OK response, got %v '%s'", resp.StatusCode, msg)
+	}
+	if addr := <-requested; addr != background.Listener.Addr().String() {
+		t.Errorf("Expected request to %v through SOCKS server, got %v", background.Listener.Addr(), addr)
+	}
+}
+
+func TestSOCKSListener(t *testing.T) {
+	echo := startEchoServer(t)
+
+	conf := &Configuration{AuthType: "basic", AuthUser: "user", AuthPassword: "secret", AuthRealm: "test"}
+	proxy := goproxy.NewProxyHttpServer()
+	setAllowedConnectPortsHandler(&Configuration{AllowedConnectPorts: []int{echo.Addr().(*net.TCPAddr).Port}}, proxy)
+	setAuthenticationHandler(conf, proxy, nil)
+
+	servers := newServerSet()
+	ln, err := servers.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go servers.serve(ln, "127.0.0.1:0", withSOCKS(withRequestHeads(withRequestInfo(proxy), conf), conf), nil, conf)
+	defer servers.shutdown(context.Background())
+
+	tests := []struct {
+		user string
+		addr string
+		err  string
+	}{
+		{"user:secret", echo.Addr().String(), ""},
+		{"user:wrong", echo.Addr().String(), "connection not allowed by ruleset"},
+		{"", echo.Addr().String(), "no acceptable authentication methods"},
+		{"user:secret", "127.0.0.1:1", "connection not allowed by ruleset"},
+	}
+
+	for _, test := range tests {
+		proxyURL := &url.URL{Scheme: "socks5", Host: ln.Addr().String()}
+		if test.user != "" {
+			username, password, _ := strings.Cut(test.user, ":")
+			proxyURL.User = url.UserPassword(username, password)
+		}
+
+		conn, err := dialSOCKS5(context.Background(), proxy, proxyURL, "tcp", test.addr)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %s: expected error %q, got %v", test.user, test.addr, test.err, err)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %v", test.user, test.addr, err)
+			continue
+		}
+
+		msg := []byte("ping")
+		conn.Write(msg)
+		reply := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, msg) {
+			t.Errorf("Expected echoed message, got '%s' (%v)", reply, err)
+		}
+		conn.Close()
+	}
+}
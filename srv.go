@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	defaultSRVRefreshInterval = 30 * time.Second
+	srvLookupTimeout          = 10 * time.Second
+)
+
+// PoolMember is an upstream proxy discovered through DNS SRV records of a
+// srv_proxies alias.
+type PoolMember struct {
+	URL      string `json:"url"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+type poolMember struct {
+	url      *url.URL
+	priority uint16
+	weight   uint16
+}
+
+// parseSRVProxyURL parses srv_proxies value, which is SRV name with optional
+// scheme and credentials of the discovered proxies, i.e. "_proxy._tcp.example.com"
+// or "socks5://user:password@_socks._tcp.example.com". The scheme is http by
+// default.
+func parseSRVProxyURL(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || u.Port() != "" {
+		return nil, errors.New("SRV name without port is expected")
+	}
+
+	return u, nil
+}
+
+// compilePool parses members' URLs, members are ordered by priority.
+func compilePool(members []PoolMember) ([]poolMember, error) {
+	pool := make([]poolMember, 0, len(members))
+	for _, m := range members {
+		u, err := url.Parse(m.URL)
+		if err != nil {
+			return nil, err
+		}
+		pool = append(pool, poolMember{url: u, priority: m.Priority, weight: m.Weight})
+	}
+
+	sort.SliceStable(pool, func(i, j int) bool {
+		return pool[i].priority < pool[j].priority
+	})
+
+	return pool, nil
+}
+
+// pickPoolMember chooses one of the pool's members for the request: the members
+// with the lowest priority among the available ones share requests according to
+// their weights (RFC 2782). If none is available the first one is returned, so
+// the request fails as for any other unavailable upstream.
+func (r *Router) pickPoolMember(pool []poolMember) *url.URL {
+	var candidates []poolMember
+	total := 0
+	for _, m := range pool {
+		if len(candidates) > 0 && m.priority != candidates[0].priority {
+			break
+		}
+		if r.health.check(m.url.Host) != nil {
+			continue
+		}
+		candidates = append(candidates, m)
+		// zero weight members get a small chance
+		total += int(m.weight) + 1
+	}
+
+	if len(candidates) == 0 {
+		return pool[0].url
+	}
+
+	n := rand.Intn(total)
+	for _, m := range candidates {
+		if n -= int(m.weight) + 1; n < 0 {
+			return m.url
+		}
+	}
+
+	return candidates[len(candidates)-1].url
+}
+
+// srvDiscovery periodically resolves SRV names of srv_proxies and updates members
+// of their pools in the routing.
+type srvDiscovery struct {
+	names    map[string]string
+	interval time.Duration
+	router   *Router
+	lookup   func(ctx context.Context, name string) ([]*net.SRV, error)
+}
+
+func newSRVDiscovery(conf *Configuration, router *Router) *srvDiscovery {
+	if len(conf.SRVProxies) == 0 {
+		return nil
+	}
+
+	return &srvDiscovery{
+		names:    conf.SRVProxies,
+		interval: conf.SRVRefreshInterval,
+		router:   router,
+		lookup: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			return addrs, err
+		},
+	}
+}
+
+// start resolves the names in background and keeps re-resolving them.
+func (d *srvDiscovery) start(proxy *goproxy.ProxyHttpServer) {
+	if d == nil {
+		return
+	}
+
+	go func() {
+		for {
+			for alias := range d.names {
+				if err := d.refresh(proxy, alias); err != nil {
+					proxy.Logger.Printf("WARN: couldn't resolve SRV records of upstream pool '%s': %v\n", alias, err)
+				}
+			}
+			time.Sleep(d.interval)
+		}
+	}()
+}
+
+// refresh resolves the alias' SRV name and replaces members of the pool if they
+// were changed. Members are kept if the lookup fails, but are removed if the name
+// doesn't exist anymore.
+func (d *srvDiscovery) refresh(proxy *goproxy.ProxyHttpServer, alias string) error {
+	// validated when configuration is loaded
+	base, _ := parseSRVProxyURL(d.names[alias])
+
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+
+	addrs, err := d.lookup(ctx, base.Hostname())
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	members := make([]PoolMember, 0, len(addrs))
+	for _, addr := range addrs {
+		u := *base
+		u.Host = net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port)))
+		members = append(members, PoolMember{URL: u.String(), Priority: addr.Priority, Weight: addr.Weight})
+	}
+	// the resolver shuffles records with the same priority
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Priority != members[j].Priority {
+			return members[i].Priority < members[j].Priority
+		}
+		return members[i].URL < members[j].URL
+	})
+
+	if slices.Equal(d.router.routing().Pools[alias], members) {
+		return nil
+	}
+
+	err = d.router.update(func(routing *Routing) error {
+		routing.Pools[alias] = members
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't update pool: %w", err)
+	}
+
+	hosts := make([]string, 0, len(members))
+	for _, m := range members {
+		u, _ := url.Parse(m.URL)
+		hosts = append(hosts, u.Host)
+	}
+	proxy.Logger.Printf("upstream pool '%s' members: %s\n", alias, strings.Join(hosts, ", "))
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestSRVDiscovery(t *testing.T) {
+	conf := &Configuration{
+		SRVProxies: map[string]string{"pool": "_proxy._tcp.example.com"},
+		Rules:      map[string]string{".example.org": "pool"},
+	}
+	router := newRouter(conf)
+	proxy := goproxy.NewProxyHttpServer()
+
+	records := []*net.SRV{
+		{Target: "b.example.com.", Port: 3128, Priority: 10, Weight: 1},
+		{Target: "a.example.com.", Port: 3128, Priority: 10, Weight: 1},
+		{Target: "backup.example.com.", Port: 8080, Priority: 20, Weight: 1},
+	}
+	var lookupErr error
+	discovery := newSRVDiscovery(conf, router)
+	discovery.lookup = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		if name != "_proxy._tcp.example.com" {
+			t.Errorf("Unexpected SRV name %v", name)
+		}
+		return records, lookupErr
+	}
+
+	if err := discovery.refresh(proxy, "pool"); err != nil {
+		t.Fatal(err)
+	}
+
+	members := router.routing().Pools["pool"]
+	if len(members) != 3 || members[0].URL != "http://a.example.com:3128" || members[2].URL != "http://backup.example.com:8080" {
+		t.Fatalf("Unexpected pool members %+v", members)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.org/", nil)
+	for i := 0; i < 20; i++ {
+		match := findMatchingRoute(req, nil, router)
+		if match.alias != "pool" || (match.url.Host != "a.example.com:3128" && match.url.Host != "b.example.com:3128") {
+			t.Fatalf("Expected a member with the lowest priority, got %v", match.url)
+		}
+	}
+
+	// members are kept if the lookup fails
+	lookupErr = errors.New("timeout")
+	if err := discovery.refresh(proxy, "pool"); err == nil {
+		t.Error("Expected lookup error")
+	}
+	if len(router.routing().Pools["pool"]) != 3 {
+		t.Error("Expected pool members to be kept")
+	}
+
+	// and removed if the name doesn't exist
+	records, lookupErr = nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	if err := discovery.refresh(proxy, "pool"); err != nil {
+		t.Fatal(err)
+	}
+	if len(router.routing().Pools["pool"]) != 0 {
+		t.Error("Expected pool members to be removed")
+	}
+}
+
+func TestPickPoolMember(t *testing.T) {
+	health := newProxyHealth(&Configuration{UpstreamMaxFailures: 1, UpstreamRetryInterval: time.Minute})
+	router := &Router{health: health}
+
+	pool, err := compilePool([]PoolMember{
+		{URL: "http://backup.example.com:3128", Priority: 20},
+		{URL: "http://a.example.com:3128", Priority: 10, Weight: 100},
+		{URL: "http://b.example.com:3128", Priority: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	picked := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		picked[router.pickPoolMember(pool).Host]++
+	}
+	if picked["backup.example.com:3128"] != 0 || picked["a.example.com:3128"] < picked["b.example.com:3128"]*10 {
+		t.Errorf("Expected members to be picked by priority and weight, got %v", picked)
+	}
+
+	health.markFailure("a.example.com:3128", errors.New("refused"))
+	health.markFailure("b.example.com:3128", errors.New("refused"))
+	if u := router.pickPoolMember(pool); u.Host != "backup.example.com:3128" {
+		t.Errorf("Expected backup member when the others are down, got %v", u)
+	}
+
+	health.markFailure("backup.example.com:3128", errors.New("refused"))
+	if u := router.pickPoolMember(pool); u.Host != "a.example.com:3128" {
+		t.Errorf("Expected the first member when all are down, got %v", u)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// requests rate and error rate are averaged over this many last seconds
+	statsRateSeconds = 60
+	// top destinations and users are counted over one to two such periods
+	statsTopPeriod = 5 * time.Minute
+	statsTopSize   = 10
+	// keys above this number are counted as "other", so a scan of many hosts
+	// doesn't blow up memory
+	statsMaxKeys = 10000
+	statsOther   = "(other)"
+	// recent denied requests shown by the admin UI
+	statsDenials = 50
+)
+
+// statsSecond counts requests finished within a second.
+type statsSecond struct {
+	at       int64
+	requests int64
+	errors   int64
+	denied   int64
+}
+
+// statsCounters counts requests and bytes per destination or user.
+type statsCounters map[string]*statsCount
+
+type statsCount struct {
+	Requests int64
+	Errors   int64
+	Bytes    int64
+}
+
+func (c statsCounters) add(key string, errored bool, bytes int64) {
+	count, exists := c[key]
+	if !exists {
+		if len(c) >= statsMaxKeys {
+			key = statsOther
+			count = c[key]
+		}
+		if count == nil {
+			count = &statsCount{}
+			c[key] = count
+		}
+	}
+
+	count.Requests++
+	count.Bytes += bytes
+	if errored {
+		count.Errors++
+	}
+}
+
+// StatsDenial is a denied request, 403 and 407 responses are counted as denials.
+type StatsDenial struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	User   string    `json:"user,omitempty"`
+	Method string    `json:"method"`
+	Target string    `json:"target"`
+	Status int       `json:"status"`
+	Rule   string    `json:"rule,omitempty"`
+}
+
+// proxyStats collects access log entries for the stats dashboard served on
+// stats_listen address and the admin UI.
+type proxyStats struct {
+	started time.Time
+
+	mu      sync.Mutex
+	total   int64
+	seconds [statsRateSeconds]statsSecond
+	rotated time.Time
+	hosts   [2]statsCounters
+	users   [2]statsCounters
+	// ring of the last statsDenials denials, next is the oldest one's index
+	denials []StatsDenial
+	next    int
+}
+
+// newProxyStats returns nil if neither stats_listen nor admin_ui is set.
+func newProxyStats(conf *Configuration) *proxyStats {
+	if conf.StatsListen == "" && !conf.AdminUI {
+		return nil
+	}
+
+	now := time.Now()
+	return &proxyStats{
+		started: now,
+		rotated: now,
+		hosts:   [2]statsCounters{make(statsCounters), make(statsCounters)},
+		users:   [2]statsCounters{make(statsCounters), make(statsCounters)},
+	}
+}
+
+// record counts the finished request, CONNECT requests are counted once their
+// tunnels are closed.
+func (s *proxyStats) record(m *LogData) {
+	if m.tunnel == nil && m.resp == nil {
+		return
+	}
+
+	req, status, bytes := m.req, http.StatusOK, int64(0)
+	if m.tunnel != nil {
+		bytes = m.tunnel.sent + m.tunnel.received
+	} else {
+		req, status = m.resp.Request, m.statusCode()
+		if m.resp.ContentLength > 0 {
+			bytes = m.resp.ContentLength
+		}
+	}
+
+	host := "-"
+	if req != nil && req.URL != nil && req.URL.Hostname() != "" {
+		host = req.URL.Hostname()
+	}
+	errored := m.err != nil || status >= http.StatusInternalServerError
+	denied := status == http.StatusForbidden || status == http.StatusProxyAuthRequired
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(m.time)
+	s.total++
+
+	second := &s.seconds[m.time.Unix()%statsRateSeconds]
+	if second.at != m.time.Unix() {
+		*second = statsSecond{at: m.time.Unix()}
+	}
+	second.requests++
+	if errored {
+		second.errors++
+	}
+	if denied {
+		second.denied++
+	}
+
+	s.hosts[0].add(host, errored, bytes)
+	s.users[0].add(m.user, errored, bytes)
+
+	if denied {
+		s.addDenial(m, req, host, status)
+	}
+}
+
+// addDenial must be called with the lock held.
+func (s *proxyStats) addDenial(m *LogData, req *http.Request, host string, status int) {
+	denial := StatsDenial{Time: m.time, Client: "-", User: m.user, Method: "-", Target: host, Status: status, Rule: m.rule}
+	if req != nil {
+		denial.Method = req.Method
+		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			denial.Client = ip
+		}
+		if req.URL != nil && req.URL.Host != "" {
+			denial.Target = req.URL.Host
+		}
+	}
+
+	if len(s.denials) < statsDenials {
+		s.denials = append(s.denials, denial)
+		return
+	}
+	s.denials[s.next] = denial
+	s.next = (s.next + 1) % statsDenials
+}
+
+// recentDenials returns the last denials, the latest first.
+func (s *proxyStats) recentDenials() []StatsDenial {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	denials := make([]StatsDenial, 0, len(s.denials))
+	for i := len(s.denials) - 1; i >= 0; i-- {
+		denials = append(denials, s.denials[(s.next+i)%len(s.denials)])
+	}
+
+	return denials
+}
+
+// rotate starts new counters of top destinations and users every statsTopPeriod,
+// the previous period's counters are kept, so the tops don't start from scratch.
+func (s *proxyStats) rotate(now time.Time) {
+	if now.Sub(s.rotated) < statsTopPeriod {
+		return
+	}
+
+	s.hosts = [2]statsCounters{make(statsCounters), s.hosts[0]}
+	s.users = [2]statsCounters{make(statsCounters), s.users[0]}
+	if now.Sub(s.rotated) >= 2*statsTopPeriod {
+		s.hosts[1], s.users[1] = make(statsCounters), make(statsCounters)
+	}
+	s.rotated = now
+}
+
+type statsTopEntry struct {
+	Name string
+	statsCount
+}
+
+type statsView struct {
+	Now         time.Time
+	Uptime      time.Duration
+	Total       int64
+	Rate        float64
+	ErrorRate   float64
+	DeniedRate  float64
+	Tunnels     []TunnelInfo
+	TopHosts    []statsTopEntry
+	TopUsers    []statsTopEntry
+	RateSeconds int
+}
+
+func top(counters [2]statsCounters) []statsTopEntry {
+	merged := make(map[string]statsCount)
+	for _, c := range counters {
+		for name, count := range c {
+			m := merged[name]
+			m.Requests += count.Requests
+			m.Errors += count.Errors
+			m.Bytes += count.Bytes
+			merged[name] = m
+		}
+	}
+
+	entries := make([]statsTopEntry, 0, len(merged))
+	for name, count := range merged {
+		entries = append(entries, statsTopEntry{Name: name, statsCount: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Requests != entries[j].Requests {
+			return entries[i].Requests > entries[j].Requests
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > statsTopSize {
+		entries = entries[:statsTopSize]
+	}
+
+	return entries
+}
+
+func (s *proxyStats) view(now time.Time) *statsView {
+	v := &statsView{Now: now, Uptime: now.Sub(s.started).Round(time.Second), RateSeconds: statsRateSeconds}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotate(now)
+	v.Total = s.total
+
+	var requests, errors, denied int64
+	for _, second := range s.seconds {
+		// the current second isn't over yet
+		if age := now.Unix() - second.at; age > 0 && age <= statsRateSeconds {
+			requests += second.requests
+			errors += second.errors
+			denied += second.denied
+		}
+	}
+	v.Rate = float64(requests) / statsRateSeconds
+	if requests > 0 {
+		v.ErrorRate = 100 * float64(errors) / float64(requests)
+		v.DeniedRate = 100 * float64(denied) / float64(requests)
+	}
+
+	v.TopHosts = top(s.hosts)
+	v.TopUsers = top(s.users)
+
+	return v
+}
+
+// statsPage renders the dashboard, it's refreshed by browsers every few seconds.
+type statsPage struct {
+	stats    *proxyStats
+	tunnels  *tunnelRegistry
+	template *template.Template
+}
+
+func newStatsPage(stats *proxyStats, tunnels *tunnelRegistry) *statsPage {
+	return &statsPage{
+		stats:    stats,
+		tunnels:  tunnels,
+		template: template.Must(template.New("stats").Parse(statsTemplate)),
+	}
+}
+
+func (p *statsPage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+
+	v := p.stats.view(time.Now())
+	v.Tunnels = p.tunnels.snapshot()
+	sort.Slice(v.Tunnels, func(i, j int) bool { return v.Tunnels[i].ID < v.Tunnels[j].ID })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := p.template.Execute(w, v); err != nil {
+		log.Printf("Couldn't render stats page: %v", err)
+	}
+}
+
+const statsTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>microproxy stats</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; }
+th { background: #eee; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>microproxy</h1>
+<table>
+<tr><th>Uptime</th><td>{{.Uptime}}</td></tr>
+<tr><th>Requests</th><td class="n">{{.Total}}</td></tr>
+<tr><th>Requests per second</th><td class="n">{{printf "%.2f" .Rate}}</td></tr>
+<tr><th>Errors</th><td class="n">{{printf "%.1f" .ErrorRate}}%</td></tr>
+<tr><th>Denied</th><td class="n">{{printf "%.1f" .DeniedRate}}%</td></tr>
+<tr><th>Active tunnels</th><td class="n">{{len .Tunnels}}</td></tr>
+</table>
+<p>Rates are averaged over the last {{.RateSeconds}} seconds, errors are 5xx responses and failed requests, denied are 403 and 407 responses. Tunnels are counted once closed.</p>
+
+<h2>Top destinations</h2>
+<table>
+<tr><th>Host</th><th>Requests</th><th>Errors</th><th>Bytes</th></tr>
+{{range .TopHosts}}<tr><td>{{.Name}}</td><td class="n">{{.Requests}}</td><td class="n">{{.Errors}}</td><td class="n">{{.Bytes}}</td></tr>
+{{end}}</table>
+
+<h2>Top users</h2>
+<table>
+<tr><th>User</th><th>Requests</th><th>Errors</th><th>Bytes</th></tr>
+{{range .TopUsers}}<tr><td>{{.Name}}</td><td class="n">{{.Requests}}</td><td class="n">{{.Errors}}</td><td class="n">{{.Bytes}}</td></tr>
+{{end}}</table>
+
+<h2>Active tunnels</h2>
+<table>
+<tr><th>ID</th><th>User</th><th>Client</th><th>Target</th><th>Upstream</th><th>Started</th><th>Sent</th><th>Received</th><th>Idle, s</th></tr>
+{{range .Tunnels}}<tr><td>{{.ID}}</td><td>{{.User}}</td><td>{{.Client}}</td><td>{{.Target}}</td><td>{{.Upstream}}</td><td>{{.Started.Format "2006-01-02 15:04:05"}}</td><td class="n">{{.Sent}}</td><td class="n">{{.Received}}</td><td class="n">{{printf "%.0f" .IdleSeconds}}</td></tr>
+{{end}}</table>
+<p>Updated {{.Now.Format "2006-01-02 15:04:05"}}, top destinations and users are counted over the last 5 to 10 minutes.</p>
+</body>
+</html>
+`
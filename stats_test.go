@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyStats(t *testing.T) {
+	stats := newProxyStats(&Configuration{StatsListen: "127.0.0.1:0"})
+	now := time.Now().Add(-time.Second)
+
+	entry := func(target, user string, status int, err error) *LogData {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		return &LogData{
+			action: AppendLog,
+			resp:   &http.Response{StatusCode: status, ContentLength: 10, Request: req},
+			user:   user,
+			err:    err,
+			time:   now,
+		}
+	}
+
+	stats.record(entry("http://www.example.com/", "alice", http.StatusOK, nil))
+	stats.record(entry("http://www.example.com/x", "alice", http.StatusOK, nil))
+	stats.record(entry("http://www.example.org/", "bob", http.StatusBadGateway, errors.New("refused")))
+	stats.record(entry("http://www.example.net/", "-", http.StatusForbidden, nil))
+	stats.record(&LogData{action: AppendLog, req: httptest.NewRequest(http.MethodConnect, "www.example.com:443", nil), time: now})
+
+	v := stats.view(now.Add(time.Second))
+	if v.Total != 4 || v.Rate != 4.0/statsRateSeconds || v.ErrorRate != 25 || v.DeniedRate != 25 {
+		t.Errorf("Unexpected totals: %+v", v)
+	}
+	if len(v.TopHosts) != 3 || v.TopHosts[0].Name != "www.example.com" || v.TopHosts[0].Requests != 2 || v.TopHosts[0].Bytes != 20 {
+		t.Errorf("Unexpected top destinations: %+v", v.TopHosts)
+	}
+	if len(v.TopUsers) != 3 || v.TopUsers[0].Name != "alice" || v.TopUsers[2].Name != "bob" || v.TopUsers[2].Errors != 1 {
+		t.Errorf("Unexpected top users: %+v", v.TopUsers)
+	}
+
+	// counters of the previous period are kept, the older ones are dropped
+	if v := stats.view(now.Add(statsTopPeriod + time.Second)); len(v.TopHosts) != 3 || v.Rate != 0 {
+		t.Errorf("Expected the previous period's top destinations, got %+v", v)
+	}
+	if v := stats.view(now.Add(3*statsTopPeriod + time.Second)); len(v.TopHosts) != 0 || v.Total != 4 {
+		t.Errorf("Expected empty top destinations, got %+v", v)
+	}
+
+	stats = newProxyStats(&Configuration{StatsListen: "127.0.0.1:0"})
+	stats.record(entry("http://www.example.com/", "alice", http.StatusOK, nil))
+	w := httptest.NewRecorder()
+	newStatsPage(stats, newTunnelRegistry()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<td>alice</td>") {
+		t.Errorf("Unexpected stats page: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	notifySocketEnv = "NOTIFY_SOCKET"
+	watchdogUsecEnv = "WATCHDOG_USEC"
+	watchdogPIDEnv  = "WATCHDOG_PID"
+)
+
+// sdNotify sends the state to systemd's notification socket, it does nothing unless
+// the proxy was started by a Type=notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv(notifySocketEnv)
+	if socket == "" {
+		return nil
+	}
+
+	// names starting with @ are abstract sockets, Go translates them
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the watchdog has to be pinged, half of
+// WatchdogSec= as recommended by systemd, or zero if the watchdog isn't enabled
+// for this process. A restarted process inherits the environment of its parent,
+// so it ignores WATCHDOG_PID and pings on behalf of the service.
+func watchdogInterval(restarted bool) time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(watchdogUsecEnv), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv(watchdogPIDEnv); pid != "" && !restarted && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// selfCheck sends "OPTIONS *" request to the proxy's listener, it's answered by
+// the HTTP server itself without going through access control and logging, so a
+// response shows the proxy still accepts and serves connections.
+func selfCheck(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprint(conn, "OPTIONS * HTTP/1.1\r\nHost: microproxy\r\nConnection: close\r\n\r\n"); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	return nil
+}
+
+// notifySystemd reports readiness once the proxy listeners are up and keeps pinging
+// the watchdog while the self-check passes, so systemd restarts a wedged proxy.
+// A restarted process also reports its PID, the service's main process is going
+// to exit once its connections are drained.
+func notifySystemd(conf *Configuration, proxy *goproxy.ProxyHttpServer, servers *serverSet, restarted bool) {
+	if os.Getenv(notifySocketEnv) == "" {
+		return
+	}
+
+	for _, addr := range conf.Listen {
+		for !servers.serving(addr) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	state := "READY=1"
+	if restarted {
+		state += fmt.Sprintf("\nMAINPID=%d", os.Getpid())
+	}
+	if err := sdNotify(state); err != nil {
+		proxy.Logger.Printf("WARN: couldn't notify systemd: %v\n", err)
+		return
+	}
+
+	interval := watchdogInterval(restarted)
+	if interval == 0 {
+		return
+	}
+
+	for {
+		time.Sleep(interval)
+
+		// a gracefully restarting process stops pinging, its replacement does it
+		if !servers.serving(conf.Listen[0]) {
+			return
+		}
+
+		var err error
+		for _, addr := range conf.Listen {
+			if err = selfCheck(addr, interval); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			proxy.Logger.Printf("WARN: self-check failed, not pinging systemd watchdog: %v\n", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			proxy.Logger.Printf("WARN: couldn't ping systemd watchdog: %v\n", err)
+		}
+	}
+}
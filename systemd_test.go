@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv(notifySocketEnv, socket)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", buf[:n])
+	}
+
+	t.Setenv(notifySocketEnv, "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Expected no error without %v, got %v", notifySocketEnv, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec      string
+		pid       string
+		restarted bool
+		expected  time.Duration
+	}{
+		{"", "", false, 0},
+		{"30000000", "", false, 15 * time.Second},
+		{"30000000", pid, false, 15 * time.Second},
+		{"30000000", "1", false, 0},
+		{"30000000", "1", true, 15 * time.Second},
+		{"invalid", pid, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Setenv(watchdogUsecEnv, test.usec)
+		t.Setenv(watchdogPIDEnv, test.pid)
+		if interval := watchdogInterval(test.restarted); interval != test.expected {
+			t.Errorf("%v=%q %v=%q restarted %v: expected %v, got %v", watchdogUsecEnv, test.usec, watchdogPIDEnv,
+				test.pid, test.restarted, test.expected, interval)
+		}
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	handled := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handled = true
+	}))
+
+	if err := selfCheck(server.Listener.Addr().String(), time.Second); err != nil {
+		t.Errorf("Expected self-check to pass, got %v", err)
+	}
+	if handled {
+		t.Error("Expected self-check request to bypass the handler")
+	}
+
+	server.Close()
+	if err := selfCheck(server.Listener.Addr().String(), time.Second); err == nil {
+		t.Error("Expected self-check of closed listener to fail")
+	}
+}
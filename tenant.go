@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/elazarl/goproxy"
+)
+
+// tenant is an isolated proxy configured in [tenants.name] section, it has its own
+// listener, policies, admission limits and logs. Tenants share the process-wide
+// memory guard, graceful restarts and signals with the main proxy.
+type tenant struct {
+	name    string
+	conf    *Configuration
+	proxy   *goproxy.ProxyHttpServer
+	logger  *ProxyLogger
+	tunnels *tunnelRegistry
+	shadow  *shadowEvaluator
+}
+
+// newTenant creates the tenant, memory is shared by all tenants and may be nil.
+func newTenant(name string, conf *Configuration, memory *memoryGuard, verbose, insecure bool) *tenant {
+	t := &tenant{
+		name:    name,
+		conf:    conf,
+		proxy:   createProxy(conf),
+		logger:  newProxyLogger(conf),
+		tunnels: newTunnelRegistry(),
+	}
+	setVerbose(t.proxy, verbose)
+
+	feeds := newThreatFeeds(conf)
+	feeds.start(t.proxy)
+
+	router := newRouter(conf)
+	setProxyHandlers(conf, t.proxy, t.logger, router, newProxyHealth(conf), t.tunnels, feeds, nil, memory)
+	startIdleTunnelReaper(conf, t.proxy, t.tunnels)
+	startUpstreamPrewarming(conf, t.proxy, router)
+	t.shadow = newShadowEvaluator(conf, router, t.proxy)
+
+	t.proxy.Tr.TLSClientConfig = newUpstreamTLSConfig(conf, insecure)
+
+	return t
+}
+
+// newTenants creates tenants in the order of their names.
+func newTenants(conf *Configuration, memory *memoryGuard, verbose, insecure bool) []*tenant {
+	names := make([]string, 0, len(conf.Tenants))
+	for name := range conf.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tenants := make([]*tenant, 0, len(names))
+	for _, name := range names {
+		tenants = append(tenants, newTenant(name, conf.Tenants[name], memory, verbose, insecure))
+	}
+
+	return tenants
+}
+
+func (t *tenant) handler(memory *memoryGuard) http.Handler {
+	handler := withRequestInfo(withShadowEvaluation(withAccessLog(t.proxy, t.logger), t.shadow))
+	handler = withMemoryGuard(withAdmissionControl(handler, t.conf), memory)
+
+	return withRequestHeads(withPanicRecovery(handler, t.conf, t.proxy, nil), t.conf)
+}
+
+// serve starts accepting the tenant's requests in background.
+func (t *tenant) serve(servers *serverSet, memory *memoryGuard) {
+	handler := t.handler(memory)
+	for _, addr := range t.conf.Listen {
+		ln, err := servers.listen(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := servers.serve(ln, addr, handler, nil, t.conf); err != nil {
+				log.Fatal(err)
+			}
+		}()
+
+		t.proxy.Logger.Printf("tenant %v listening on %v\n", t.name, addr)
+	}
+}
+
+func (t *tenant) reopenLogs() {
+	if !t.conf.LogToStdout {
+		t.logger.reopen()
+		setActivityLog(t.conf, t.proxy)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestTenantConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	conf := newConfiguration(bytes.NewBufferString(`
+listen = "127.0.0.1:3128"
+allowed_networks = ["127.0.0.1/32"]
+
+[tenants.acme]
+listen = "127.0.0.1:4128"
+allowed_networks = ["0.0.0.0/0"]
+access_log = "` + filepath.Join(dir, "acme.log") + `"
+disallowed_destination_networks = ["198.51.100.0/24"]
+
+[tenants.globex]
+listen = "127.0.0.1:5128"
+`))
+
+	acme, globex := conf.Tenants["acme"], conf.Tenants["globex"]
+	if acme == nil || globex == nil {
+		t.Fatalf("Expected two tenants, got %v", conf.Tenants)
+	}
+
+	if len(acme.AllowedConnectPorts) != 1 || acme.AllowedConnectPorts[0] != defaultAllowedConnectPort {
+		t.Error("Expected tenant's defaults to be set, got", acme.AllowedConnectPorts)
+	}
+	if len(globex.AllowedNetworks) != 1 || globex.AllowedNetworks[0] != defaultAllowedNetwork {
+		t.Error("Expected tenant's settings not to be inherited, got", globex.AllowedNetworks)
+	}
+	if len(conf.DisallowedDestinationNetworks) != 0 {
+		t.Error("Expected tenant's settings not to leak to the main configuration, got", conf.DisallowedDestinationNetworks)
+	}
+
+	tenants := newTenants(conf, nil, false, false)
+	if len(tenants) != 2 || tenants[0].name != "acme" || tenants[1].name != "globex" {
+		t.Fatalf("Unexpected tenants %+v", tenants)
+	}
+
+	req := httptest.NewRequest("GET", "http://198.51.100.10/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	tenants[0].handler(newMemoryGuard(conf)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected request denied by tenant's policy, got", w.Code)
+	}
+
+	tenants[0].logger.close()
+	tenants[1].logger.close()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of threat feeds' format setting.
+const (
+	threatFeedDomains = "domains"
+	threatFeedCSV     = "csv"
+	threatFeedJSON    = "json"
+
+	defaultThreatFeedRefresh = time.Hour
+	threatFeedFetchTimeout   = time.Minute
+	maxThreatFeedSize        = 64 << 20
+)
+
+// ThreatFeed is a remote blocklist of destination host names or IP addresses.
+type ThreatFeed struct {
+	URL    string `toml:"url"`
+	Format string `toml:"format"`
+	// 1-based column of CSV feeds with destinations
+	Column int `toml:"column"`
+	// field of objects in JSON feeds with destinations, JSON feeds are arrays of
+	// strings if it isn't set
+	Field string `toml:"field"`
+}
+
+// ThreatFeedStatus describes the state of a feed for the admin API.
+type ThreatFeedStatus struct {
+	URL       string    `json:"url"`
+	Entries   int       `json:"entries"`
+	Fetched   time.Time `json:"fetched"`
+	Updated   time.Time `json:"updated"`
+	AgeSec    float64   `json:"age_sec"`
+	Fetches   uint64    `json:"fetches"`
+	Failures  uint64    `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type threatFeed struct {
+	ThreatFeed
+
+	mu           sync.RWMutex
+	entries      map[string]bool
+	etag         string
+	lastModified string
+	fetched      time.Time
+	updated      time.Time
+	fetches      uint64
+	failures     uint64
+	lastError    string
+}
+
+// threatFeeds periodically fetches configured feeds, a feed's entries are replaced
+// only after the new version is downloaded and parsed successfully.
+type threatFeeds struct {
+	feeds   []*threatFeed
+	refresh time.Duration
+	client  *http.Client
+}
+
+func newThreatFeeds(conf *Configuration) *threatFeeds {
+	if len(conf.ThreatFeeds) == 0 {
+		return nil
+	}
+
+	tf := &threatFeeds{
+		refresh: conf.ThreatFeedRefresh,
+		client:  &http.Client{Timeout: threatFeedFetchTimeout},
+	}
+	for _, feed := range conf.ThreatFeeds {
+		tf.feeds = append(tf.feeds, &threatFeed{ThreatFeed: feed})
+	}
+
+	return tf
+}
+
+// start fetches the feeds in background and keeps refreshing them.
+func (tf *threatFeeds) start(proxy *goproxy.ProxyHttpServer) {
+	if tf == nil {
+		return
+	}
+
+	for _, feed := range tf.feeds {
+		go func(feed *threatFeed) {
+			for {
+				if err := tf.fetch(feed); err != nil {
+					proxy.Logger.Printf("WARN: couldn't fetch threat feed %v: %v\n", feed.URL, err)
+				}
+				time.Sleep(tf.refresh)
+			}
+		}(feed)
+	}
+}
+
+// fetch downloads the feed if it was changed since the previous fetch.
+func (tf *threatFeeds) fetch(feed *threatFeed) error {
+	err := tf.download(feed)
+
+	feed.mu.Lock()
+	feed.fetches++
+	if err != nil {
+		feed.failures++
+		feed.lastError = err.Error()
+	} else {
+		feed.lastError = ""
+	}
+	feed.mu.Unlock()
+
+	return err
+}
+
+func (tf *threatFeeds) download(feed *threatFeed) error {
+	req, err := http.NewRequest(http.MethodGet, feed.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	feed.mu.RLock()
+	if feed.etag != "" {
+		req.Header.Set("If-None-Match", feed.etag)
+	}
+	if feed.lastModified != "" {
+		req.Header.Set("If-Modified-Since", feed.lastModified)
+	}
+	feed.mu.RUnlock()
+
+	resp, err := tf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		feed.mu.Lock()
+		feed.fetched = now
+		feed.mu.Unlock()
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxThreatFeedSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxThreatFeedSize {
+		return fmt.Errorf("feed is larger than %v bytes", maxThreatFeedSize)
+	}
+
+	entries, err := parseThreatFeed(&feed.ThreatFeed, data)
+	if err != nil {
+		return err
+	}
+
+	feed.mu.Lock()
+	feed.entries = entries
+	feed.etag = resp.Header.Get("ETag")
+	feed.lastModified = resp.Header.Get("Last-Modified")
+	feed.fetched, feed.updated = now, now
+	feed.mu.Unlock()
+
+	return nil
+}
+
+func normalizeThreatFeedEntry(entry string) string {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	entry = strings.TrimPrefix(entry, "*.")
+
+	return strings.TrimSuffix(entry, ".")
+}
+
+// parseThreatFeed returns the set of hosts listed in the feed. Empty lines and
+// lines starting with '#' are ignored in domain lists and CSV feeds.
+func parseThreatFeed(feed *ThreatFeed, data []byte) (map[string]bool, error) {
+	var values []string
+
+	switch feed.Format {
+	case threatFeedJSON:
+		if feed.Field == "" {
+			if err := json.Unmarshal(data, &values); err != nil {
+				return nil, err
+			}
+			break
+		}
+		var objects []map[string]interface{}
+		if err := json.Unmarshal(data, &objects); err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			if value, ok := object[feed.Field].(string); ok {
+				values = append(values, value)
+			}
+		}
+
+	case threatFeedCSV:
+		column := feed.Column
+		if column <= 0 {
+			column = 1
+		}
+		r := csv.NewReader(bytes.NewReader(data))
+		r.Comment = '#'
+		r.FieldsPerRecord = -1
+		for {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if column <= len(record) {
+				values = append(values, record[column-1])
+			}
+		}
+
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			// hosts file format: "0.0.0.0 example.com"
+			fields := strings.Fields(line)
+			values = append(values, fields[len(fields)-1])
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make(map[string]bool, len(values))
+	for _, value := range values {
+		if entry := normalizeThreatFeedEntry(value); entry != "" {
+			entries[entry] = true
+		}
+	}
+
+	return entries, nil
+}
+
+// match returns URL of the feed listing the host or its parent domain, empty string
+// is returned if the host isn't listed.
+func (tf *threatFeeds) match(host string) string {
+	if tf == nil {
+		return ""
+	}
+
+	host = normalizeThreatFeedEntry(host)
+	for _, feed := range tf.feeds {
+		feed.mu.RLock()
+		entries := feed.entries
+		feed.mu.RUnlock()
+
+		for name := host; name != ""; {
+			if entries[name] {
+				return feed.URL
+			}
+			_, parent, found := strings.Cut(name, ".")
+			if !found || net.ParseIP(host) != nil {
+				break
+			}
+			name = parent
+		}
+	}
+
+	return ""
+}
+
+func (tf *threatFeeds) snapshot() []ThreatFeedStatus {
+	result := []ThreatFeedStatus{}
+	if tf == nil {
+		return result
+	}
+
+	now := time.Now()
+	for _, feed := range tf.feeds {
+		feed.mu.RLock()
+		status := ThreatFeedStatus{
+			URL:       feed.URL,
+			Entries:   len(feed.entries),
+			Fetched:   feed.fetched,
+			Updated:   feed.updated,
+			Fetches:   feed.fetches,
+			Failures:  feed.failures,
+			LastError: feed.lastError,
+		}
+		if !feed.updated.IsZero() {
+			status.AgeSec = now.Sub(feed.updated).Seconds()
+		}
+		feed.mu.RUnlock()
+		result = append(result, status)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].URL < result[j].URL })
+
+	return result
+}
+
+// setThreatFeedsHandler denies requests to destinations listed in threat feeds.
+func setThreatFeedsHandler(feeds *threatFeeds, proxy *goproxy.ProxyHttpServer) {
+	if feeds == nil {
+		return
+	}
+
+	denied := func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		url := feeds.match(req.URL.Hostname())
+		if url == "" {
+			return false
+		}
+
+		ctx.Warnf("destination %v is listed in threat feed %v, client %v", req.URL.Hostname(), url, req.RemoteAddr)
+		denyRequest(ctx, "threat_feeds:"+url)
+		return true
+	}
+
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if denied(ctx.Req, ctx) {
+				ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Access denied")
+				return goproxy.RejectConnect, host
+			}
+			return nil, ""
+		})
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if denied(req, ctx) {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+			}
+			return req, nil
+		})
+}
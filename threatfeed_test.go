@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestParseThreatFeed(t *testing.T) {
+	tests := []struct {
+		feed ThreatFeed
+		data string
+	}{
+		{ThreatFeed{}, "# comment\n\nbad.example.com\n0.0.0.0 Evil.Example.org.\n192.0.2.1\n"},
+		{ThreatFeed{Format: threatFeedCSV, Column: 2}, "# id,host\n1,bad.example.com\n2,evil.example.org\n3,192.0.2.1\n"},
+		{ThreatFeed{Format: threatFeedJSON}, `["bad.example.com", "*.evil.example.org", "192.0.2.1"]`},
+		{ThreatFeed{Format: threatFeedJSON, Field: "host"}, `[{"host": "bad.example.com"}, {"host": "evil.example.org"}, {"host": "192.0.2.1"}, {"id": 4}]`},
+	}
+
+	for _, test := range tests {
+		entries, err := parseThreatFeed(&test.feed, []byte(test.data))
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.feed, err)
+			continue
+		}
+		if len(entries) != 3 || !entries["bad.example.com"] || !entries["evil.example.org"] || !entries["192.0.2.1"] {
+			t.Errorf("%+v: unexpected entries %v", test.feed, entries)
+		}
+	}
+}
+
+func TestThreatFeeds(t *testing.T) {
+	body := "bad.example.com\n192.0.2.1\n"
+	requests, notModified := 0, 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	defer origin.Close()
+
+	conf := &Configuration{
+		ThreatFeeds:       []ThreatFeed{{URL: origin.URL}},
+		ThreatFeedRefresh: time.Hour,
+	}
+	feeds := newThreatFeeds(conf)
+
+	for i := 0; i < 2; i++ {
+		if err := feeds.fetch(feeds.feeds[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("Expected conditional refresh, got %v requests, %v not modified", requests, notModified)
+	}
+
+	tests := []struct {
+		host   string
+		listed bool
+	}{
+		{"bad.example.com", true},
+		{"www.Bad.example.com", true},
+		{"example.com", false},
+		{"192.0.2.1", true},
+		{"192.0.2.10", false},
+	}
+	for _, test := range tests {
+		if listed := feeds.match(test.host) != ""; listed != test.listed {
+			t.Errorf("%s: expected listed=%v, got %v", test.host, test.listed, listed)
+		}
+	}
+
+	status := feeds.snapshot()
+	if len(status) != 1 || status[0].Entries != 2 || status[0].Fetches != 2 || status[0].Failures != 0 {
+		t.Errorf("Unexpected feed status %+v", status)
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	setThreatFeedsHandler(feeds, proxy)
+
+	req := httptest.NewRequest("GET", "http://www.bad.example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected 403 status code, got", w.Code)
+	}
+
+	origin.Close()
+	if err := feeds.fetch(feeds.feeds[0]); err == nil {
+		t.Error("Expected fetch error")
+	}
+	if feeds.match("bad.example.com") == "" {
+		t.Error("Expected previous entries to be kept after failed fetch")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238) used by authenticator apps by default.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// accepted clock skew between the proxy and clients' devices in periods
+	totpSkew = 1
+)
+
+// decodeTOTPSecret decodes a base32 secret as shown by authenticator apps, spaces
+// and padding are optional.
+func decodeTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty TOTP secret")
+	}
+
+	return secret, nil
+}
+
+func totpCode(secret []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0F
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7FFFFFFF
+
+	modulus := uint32(1)
+	for range totpDigits {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// validTOTP checks code against the periods around now.
+func validTOTP(secret []byte, code string, now time.Time) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	counter := uint64(now.Unix() / totpPeriod)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		if hmac.Equal([]byte(totpCode(secret, counter+uint64(i))), []byte(code)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	traceparentHeader         = "Traceparent"
+	defaultTracingServiceName = "microproxy"
+
+	tracingBatchSize     = 512
+	tracingFlushInterval = 5 * time.Second
+	tracingExportTimeout = 10 * time.Second
+)
+
+// OTLP span kind and status codes.
+const (
+	otlpSpanKindServer  = 2
+	otlpStatusCodeError = 2
+)
+
+// traceContext identifies the request's span, parent is zero for root spans.
+// See W3C Trace Context recommendation.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	sampled bool
+}
+
+// newTraceContext starts a span continuing the trace of traceparent header value,
+// a new trace is started if the value is empty or malformed.
+func newTraceContext(traceparent string) *traceContext {
+	tc := &traceContext{sampled: true}
+	if !parseTraceparent(traceparent, tc) {
+		tc.parent = [8]byte{}
+		rand.Read(tc.traceID[:])
+	}
+	rand.Read(tc.spanID[:])
+
+	return tc
+}
+
+// parseTraceparent parses "version-traceid-parentid-flags" value, all-zero ids are
+// invalid. Future versions may append fields, which are ignored.
+func parseTraceparent(value string, tc *traceContext) bool {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return false
+	}
+
+	var version, flags [1]byte
+	if len(parts[3]) != 2 || !decodeHex(version[:], parts[0]) || !decodeHex(tc.traceID[:], parts[1]) ||
+		!decodeHex(tc.parent[:], parts[2]) || !decodeHex(flags[:], parts[3]) {
+		return false
+	}
+	if tc.traceID == [16]byte{} || tc.parent == [8]byte{} {
+		return false
+	}
+	tc.sampled = flags[0]&1 == 1
+
+	return true
+}
+
+// decodeHex decodes lowercase hex s into dst of exactly the same size.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+
+	return err == nil
+}
+
+// traceparent returns the header value making the span the parent of the next hop.
+func (tc *traceContext) traceparent() string {
+	flags := "00"
+	if tc.sampled {
+		flags = "01"
+	}
+
+	return "00-" + hex.EncodeToString(tc.traceID[:]) + "-" + hex.EncodeToString(tc.spanID[:]) + "-" + flags
+}
+
+// setTracingHandler starts a span for every request, continuing the client's trace
+// if the request has traceparent header. Plain HTTP requests are sent with the
+// header pointing to the proxy's span, so origins' spans are its children.
+func setTracingHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if conf.TracingEndpoint == "" {
+		return
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			tc := newTraceContext(req.Header.Get(traceparentHeader))
+			getRequestInfo(ctx).trace = tc
+			req.Header.Set(traceparentHeader, tc.traceparent())
+			return req, nil
+		})
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if ctx.Req != nil {
+				getRequestInfo(ctx).trace = newTraceContext(ctx.Req.Header.Get(traceparentHeader))
+			}
+			return nil, host
+		})
+}
+
+// tracer exports spans of access log entries to an OTLP/HTTP endpoint in JSON
+// encoding. Spans are sent in batches, they are dropped if the endpoint can't keep
+// up or is unavailable.
+type tracer struct {
+	endpoint string
+	resource otlpResource
+	client   *http.Client
+	spans    chan otlpSpan
+	done     chan struct{}
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpAnyValue{IntValue: &s}}
+}
+
+func doubleAttribute(key string, value float64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{DoubleValue: &value}}
+}
+
+// newTracer returns nil if tracing_endpoint isn't set.
+func newTracer(conf *Configuration) *tracer {
+	if conf.TracingEndpoint == "" {
+		return nil
+	}
+
+	t := &tracer{
+		endpoint: conf.TracingEndpoint,
+		resource: otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", conf.TracingServiceName)}},
+		client:   &http.Client{Timeout: tracingExportTimeout},
+		spans:    make(chan otlpSpan, tracingBatchSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+
+	return t
+}
+
+// record queues the span of the log entry. CONNECT requests get their spans once
+// the tunnels are closed.
+func (t *tracer) record(m *LogData) {
+	if m.trace == nil || !m.trace.sampled || (m.tunnel == nil && m.resp == nil) {
+		return
+	}
+
+	select {
+	case t.spans <- m.span():
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]otlpSpan, 0, tracingBatchSize)
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			if batch = append(batch, span); len(batch) == tracingBatchSize {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+
+	scope := otlpScopeSpans{Spans: spans}
+	scope.Scope.Name = "microproxy"
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{
+		{Resource: t.resource, ScopeSpans: []otlpScopeSpans{scope}},
+	}})
+	if err != nil {
+		log.Printf("Couldn't encode spans: %v", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Couldn't export %d spans: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Couldn't export %d spans: %v", len(spans), resp.Status)
+	}
+}
+
+// close exports queued spans, record mustn't be called afterwards.
+func (t *tracer) close() {
+	close(t.spans)
+	<-t.done
+}
+
+// span converts the log entry, attributes follow OpenTelemetry semantic
+// conventions where there are ones.
+func (m *LogData) span() otlpSpan {
+	r := m.record(&timeFormatter{epoch: true})
+	start := m.time
+	if m.timing.duration > 0 {
+		start = start.Add(-m.timing.duration)
+	}
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(m.trace.traceID[:]),
+		SpanID:            hex.EncodeToString(m.trace.spanID[:]),
+		Name:              r.Method,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(m.time.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttribute("http.request.method", r.Method),
+			stringAttribute("url.full", r.URL),
+			stringAttribute("server.address", r.Host),
+			stringAttribute("microproxy.upstream", r.Upstream),
+		},
+	}
+	if m.trace.parent != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(m.trace.parent[:])
+	}
+
+	client := r.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	span.Attributes = append(span.Attributes, stringAttribute("client.address", client))
+	if r.User != "-" {
+		span.Attributes = append(span.Attributes, stringAttribute("enduser.id", r.User))
+	}
+	if r.ASN != "" {
+		span.Attributes = append(span.Attributes, stringAttribute("microproxy.asn", r.ASN))
+	}
+	if r.Rule != "" {
+		span.Attributes = append(span.Attributes, stringAttribute("microproxy.rule", r.Rule))
+	}
+
+	if m.tunnel != nil {
+		span.Attributes = append(span.Attributes,
+			intAttribute("microproxy.sent_bytes", m.tunnel.sent),
+			intAttribute("microproxy.received_bytes", m.tunnel.received))
+	} else {
+		span.Attributes = append(span.Attributes, intAttribute("http.response.status_code", int64(r.Status)))
+		if r.Status >= http.StatusInternalServerError {
+			span.Status = otlpStatus{Code: otlpStatusCodeError, Message: fmt.Sprintf("status %d", r.Status)}
+		}
+	}
+	if m.err != nil {
+		span.Status = otlpStatus{Code: otlpStatusCodeError, Message: m.err.Error()}
+	}
+
+	for _, timing := range []struct {
+		key   string
+		value *float64
+	}{{"microproxy.connect_duration", r.Connect}, {"microproxy.ttfb", r.TTFB}} {
+		if timing.value != nil {
+			span.Attributes = append(span.Attributes, doubleAttribute(timing.key, *timing.value))
+		}
+	}
+
+	return span
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		var tc traceContext
+		if valid := parseTraceparent(test.value, &tc); valid != test.valid || (valid && tc.sampled != test.sampled) {
+			t.Errorf("%q: expected valid=%v sampled=%v, got %v %v", test.value, test.valid, test.sampled, valid, tc.sampled)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exported := make(chan otlpTraces, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var traces otlpTraces
+		if err := json.NewDecoder(req.Body).Decode(&traces); err != nil {
+			t.Error(err)
+		}
+		exported <- traces
+	}))
+	defer collector.Close()
+
+	traceparent := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent <- req.Header.Get(traceparentHeader)
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	conf := &Configuration{TracingEndpoint: collector.URL, TracingServiceName: "proxy"}
+	logger := newProxyLogger(conf)
+	proxy := goproxy.NewProxyHttpServer()
+	setHTTPLoggingHandler(proxy, logger)
+	setTracingHandler(conf, proxy)
+
+	req := httptest.NewRequest("GET", origin.URL+"/path", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	withRequestInfo(withAccessLog(proxy, logger)).ServeHTTP(httptest.NewRecorder(), req)
+	logger.close()
+
+	traces := <-exported
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 ||
+		len(traces.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("Expected a single span, got %+v", traces)
+	}
+	if name := *traces.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name != "proxy" {
+		t.Errorf("Unexpected service name %s", name)
+	}
+
+	span := traces.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" || span.Name != "GET" {
+		t.Errorf("Unexpected span %+v", span)
+	}
+	if expected := "00-" + span.TraceID + "-" + span.SpanID + "-01"; <-traceparent != expected {
+		t.Errorf("Expected the origin to get %s traceparent", expected)
+	}
+
+	attributes := make(map[string]otlpAnyValue)
+	for _, attribute := range span.Attributes {
+		attributes[attribute.Key] = attribute.Value
+	}
+	if status := attributes["http.response.status_code"].IntValue; status == nil || *status != "200" {
+		t.Errorf("Expected status code attribute, got %+v", span.Attributes)
+	}
+	if url := attributes["url.full"].StringValue; url == nil || !strings.HasSuffix(*url, "/path") {
+		t.Errorf("Expected url.full attribute, got %+v", span.Attributes)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of trailers setting.
+const (
+	trailersPass  = "pass"
+	trailersStrip = "strip"
+)
+
+// trailerBody copies the upstream response's trailers to the client's response
+// once the body was read, they are known only at that point.
+type trailerBody struct {
+	io.ReadCloser
+	trailer http.Header
+	header  http.Header
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		for name, values := range b.trailer {
+			b.header[http.TrailerPrefix+name] = values
+		}
+	}
+
+	return n, err
+}
+
+// setTrailersHandler passes trailers of chunked requests and responses through or
+// strips them. Request trailers are sent upstream by the transport as is, response
+// trailers have to be copied to the client's response explicitly.
+func setTrailersHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	switch conf.Trailers {
+	case trailersPass:
+		proxy.OnResponse().DoFunc(
+			func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+				info := requestInfoFromRequest(ctx.Req)
+				if resp == nil || len(resp.Trailer) == 0 || info == nil || info.writer == nil {
+					return resp
+				}
+
+				// trailers have to be announced, so the response to the client is chunked
+				names := make([]string, 0, len(resp.Trailer))
+				for name := range resp.Trailer {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				resp.Header.Set("Trailer", strings.Join(names, ", "))
+
+				resp.Body = &trailerBody{ReadCloser: resp.Body, trailer: resp.Trailer, header: info.writer.Header()}
+				return resp
+			})
+	case trailersStrip:
+		proxy.OnRequest().DoFunc(
+			func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				req.Trailer = nil
+				return req, nil
+			})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the client's first bytes have to arrive within this time after the connection is
+// accepted, they tell TLS from plain HTTP
+const transparentSniffTimeout = 10 * time.Second
+
+// withTransparent makes handler serve connections redirected to the proxy by the
+// firewall (iptables REDIRECT or TPROXY target) from clients which aren't configured
+// to use a proxy. TLS connections are turned into CONNECT requests to the host name
+// of their ClientHello (SNI), or to the original destination address without it,
+// and plain HTTP requests into proxy requests to their Host, so access control,
+// routing and logging are the same as for proxy clients. Connections are translated
+// only on servers started by serverSet.serve with the returned handler.
+func withTransparent(handler http.Handler) *transparentHandler {
+	return &transparentHandler{handler: handler}
+}
+
+type transparentHandler struct {
+	handler http.Handler
+}
+
+func (h *transparentHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// requests sent to origins have only the path
+	if req.Method != http.MethodConnect && !req.URL.IsAbs() {
+		local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		req.URL.Scheme = "http"
+		req.URL.Host = strings.TrimSuffix(transparentDestination(req.Host, local, "80"), ":80")
+	}
+
+	h.handler.ServeHTTP(w, req)
+}
+
+func (h *transparentHandler) listener(ln net.Listener) net.Listener {
+	l := &transparentListener{
+		Listener: ln,
+		handler:  h.handler,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.accept()
+
+	return l
+}
+
+// transparentDestination returns host:port the client connected to, the host name
+// is taken from host (Host header or SNI) if it's known and the port from the
+// original destination.
+func transparentDestination(host string, dst net.Addr, defaultPort string) string {
+	hostname, port := host, defaultPort
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	}
+	hostname = strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]")
+
+	if addr, ok := dst.(*net.TCPAddr); ok {
+		if hostname == "" {
+			hostname = addr.IP.String()
+		}
+		port = strconv.Itoa(addr.Port)
+	}
+
+	return net.JoinHostPort(hostname, port)
+}
+
+// transparentListener sniffs accepted connections in their own goroutines, so slow
+// clients don't block accepting other connections. TLS connections are passed to
+// the handler as CONNECT requests right away, other connections are returned by
+// Accept to be served by the HTTP server.
+type transparentListener struct {
+	net.Listener
+	handler http.Handler
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (ln *transparentListener) accept() {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			select {
+			case ln.errs <- err:
+			case <-ln.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go ln.sniff(c)
+	}
+}
+
+func (ln *transparentListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.conns:
+		return c, nil
+	case err := <-ln.errs:
+		return nil, err
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *transparentListener) Close() error {
+	ln.once.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
+}
+
+func (ln *transparentListener) sniff(c net.Conn) {
+	dst := originalDestination(c)
+	if dst == nil {
+		// TPROXY keeps the original destination as the local address
+		dst, _ = c.LocalAddr().(*net.TCPAddr)
+	}
+	tc := &transparentConn{Conn: c, reader: bufio.NewReaderSize(c, maxClientHelloSize), dst: dst}
+
+	c.SetReadDeadline(time.Now().Add(transparentSniffTimeout))
+	first, err := tc.reader.Peek(1)
+	if err != nil {
+		c.Close()
+		return
+	}
+	if first[0] == tlsRecordHandshake {
+		hostName := clientHelloHostName(tc.reader)
+		c.SetReadDeadline(time.Time{})
+		ln.tunnel(tc, hostName)
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	select {
+	case ln.conns <- tc:
+	case <-ln.done:
+		c.Close()
+	}
+}
+
+// tunnel passes the connection to the handler as CONNECT request. The response is
+// swallowed by the connection, rejected connections are closed.
+func (ln *transparentListener) tunnel(c *transparentConn, hostName string) {
+	if c.dst == nil {
+		c.Close()
+		return
+	}
+
+	c.tunnel = true
+	addr := transparentDestination(hostName, c.dst, "443")
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       addr,
+		RemoteAddr: c.RemoteAddr().String(),
+		RequestURI: addr,
+	}
+	req = req.WithContext(context.WithValue(context.Background(), http.LocalAddrContextKey, c.LocalAddr()))
+
+	w := &transparentResponseWriter{conn: c, header: make(http.Header)}
+	defer func() {
+		if !w.hijacked {
+			c.Close()
+		}
+		// the HTTP server would close the connection on deliberate aborts as well
+		if value := recover(); value != nil && value != http.ErrAbortHandler {
+			panic(value)
+		}
+	}()
+
+	ln.handler.ServeHTTP(w, req)
+}
+
+// clientHelloHostName returns the server name of ClientHello at the beginning of
+// the stream, empty string is returned if there is none or it can't be parsed.
+func clientHelloHostName(r *bufio.Reader) string {
+	data, _ := r.Peek(r.Buffered())
+	for {
+		message, err := clientHelloMessage(data)
+		if err != nil {
+			return ""
+		}
+		if message != nil {
+			hello, err := parseClientHello(message)
+			if err != nil {
+				return ""
+			}
+			return hello.hostName
+		}
+
+		if len(data) >= r.Size() {
+			return ""
+		}
+		if data, err = r.Peek(max(r.Buffered(), len(data)+1)); err != nil {
+			return ""
+		}
+	}
+}
+
+// transparentConn reports the original destination as its local address. The
+// stream is read from the sniffing reader, tunnels' CONNECT responses aren't sent
+// to the client.
+type transparentConn struct {
+	net.Conn
+	reader *bufio.Reader
+	dst    *net.TCPAddr
+	tunnel bool
+
+	mu      sync.Mutex
+	head    []byte
+	replied bool
+}
+
+func (c *transparentConn) LocalAddr() net.Addr {
+	if c.dst != nil {
+		return c.dst
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+func (c *transparentConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *transparentConn) Write(b []byte) (int, error) {
+	if !c.tunnel {
+		return c.Conn.Write(b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+
+	c.head = append(c.head, b...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(b), nil
+	}
+	c.replied = true
+
+	// the client can't be told why the tunnel was rejected
+	status := strings.Fields(string(c.head[:end]))
+	if len(status) < 2 || !strings.HasPrefix(status[1], "2") {
+		c.Conn.Close()
+		return len(b), nil
+	}
+
+	rest := c.head[end+4:]
+	c.head = nil
+	if len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// transparentResponseWriter hands the connection over to the handler of CONNECT
+// request, responses written without hijacking it are discarded.
+type transparentResponseWriter struct {
+	conn     *transparentConn
+	header   http.Header
+	hijacked bool
+}
+
+func (w *transparentResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *transparentResponseWriter) WriteHeader(int) {}
+
+func (w *transparentResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *transparentResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// originalDestination returns the destination of a connection redirected by
+// iptables REDIRECT or DNAT target, nil is returned if it's unknown, i.e. the
+// connection wasn't redirected or was intercepted by TPROXY, which keeps the
+// original destination as the local address.
+func originalDestination(c net.Conn) *net.TCPAddr {
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var addr *net.TCPAddr
+	raw.Control(func(fd uintptr) {
+		if local, ok := c.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			// struct sockaddr_in6 fits into struct ip6_mtuinfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+			if err == nil {
+				// the port is in network byte order
+				port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+				addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port))}
+			}
+			return
+		}
+
+		// struct sockaddr_in fits into struct ipv6_mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err == nil {
+			sa := mreq.Multiaddr
+			addr = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+		}
+	})
+
+	return addr
+}
+
+// allowTPROXY lets the listener accept connections intercepted by iptables TPROXY
+// target, i.e. to addresses which aren't local. It requires CAP_NET_ADMIN.
+func allowTPROXY(ln *net.TCPListener) error {
+	raw, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
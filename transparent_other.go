@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDestination isn't available without netfilter, only connections
+// intercepted with the original destination as the local address are supported.
+func originalDestination(c net.Conn) *net.TCPAddr {
+	return nil
+}
+
+func allowTPROXY(ln *net.TCPListener) error {
+	return errors.New("TPROXY is supported only on Linux")
+}
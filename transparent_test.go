@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestClientHelloHostName(t *testing.T) {
+	data := clientHelloBytes(t, &tls.Config{ServerName: "www.example.com"})
+	if name := clientHelloHostName(bufio.NewReader(bytes.NewReader(data))); name != "www.example.com" {
+		t.Errorf("Expected www.example.com server name, got %q", name)
+	}
+
+	data = clientHelloBytes(t, &tls.Config{InsecureSkipVerify: true})
+	if name := clientHelloHostName(bufio.NewReader(bytes.NewReader(data))); name != "" {
+		t.Errorf("Expected no server name, got %q", name)
+	}
+
+	if name := clientHelloHostName(bufio.NewReader(bytes.NewReader(data[:len(data)-1]))); name != "" {
+		t.Errorf("Expected no server name of truncated ClientHello, got %q", name)
+	}
+}
+
+func TestTransparentDestination(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080}
+
+	tests := []struct {
+		host string
+		dst  net.Addr
+		want string
+	}{
+		{"www.example.com", dst, "www.example.com:8080"},
+		{"www.example.com:80", dst, "www.example.com:8080"},
+		{"[2001:db8::1]", dst, "[2001:db8::1]:8080"},
+		{"", dst, "192.0.2.1:8080"},
+		{"www.example.com", nil, "www.example.com:443"},
+		{"www.example.com:8443", nil, "www.example.com:8443"},
+	}
+
+	for _, test := range tests {
+		if got := transparentDestination(test.host, test.dst, "443"); got != test.want {
+			t.Errorf("%q %v: expected %v, got %v", test.host, test.dst, test.want, got)
+		}
+	}
+}
+
+func TestTransparentListener(t *testing.T) {
+	echo := startEchoServer(t)
+
+	servers := newServerSet()
+	ln, err := servers.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	// without netfilter the listener's address is the original destination
+	connected := make(chan string, 10)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs("denied.example.com:" + port)).HandleConnect(goproxy.AlwaysReject)
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		connected <- host
+		return goproxy.OkConnect, echo.Addr().String()
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, req.URL.String())
+	})
+
+	conf := &Configuration{}
+	go servers.serve(ln, "127.0.0.1:0", withTransparent(withRequestHeads(withRequestInfo(proxy), conf)), nil, conf)
+	defer servers.shutdown(context.Background())
+
+	// TLS is tunneled to the server name with the sniffed ClientHello
+	hello := clientHelloBytes(t, &tls.Config{ServerName: "www.example.com"})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(hello, "ping"...))
+	reply := make([]byte, len(hello)+4)
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, append(hello, "ping"...)) {
+		t.Errorf("Expected ClientHello and data to be passed through, got %q (%v)", reply, err)
+	}
+	conn.Close()
+	if host := <-connected; host != "www.example.com:"+port {
+		t.Errorf("Expected CONNECT to www.example.com:%v, got %v", port, host)
+	}
+
+	// rejected tunnels are closed without a response
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(clientHelloBytes(t, &tls.Config{ServerName: "denied.example.com"}))
+	if data, _ := io.ReadAll(conn); len(data) != 0 {
+		t.Errorf("Expected rejected connection to be closed, got %q", data)
+	}
+	conn.Close()
+
+	// plain HTTP requests are proxied to their Host
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /path HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "http://www.example.com:" + port + "/path"; string(body) != want {
+		t.Errorf("Expected request to %v, got %q", want, body)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+type halfCloser interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+// tunnelConn wraps the destination side of a CONNECT tunnel and counts bytes
+// passed through it, onClose is called once both directions of the tunnel are done.
+type tunnelConn struct {
+	net.Conn
+	// assigned by tunnelRegistry
+	id uint64
+	// tunnel's owner and endpoints
+	user     string
+	client   string
+	target   string
+	upstream string
+	// when the CONNECT request was received and how long dialing took
+	started time.Time
+	connect time.Duration
+	// nanoseconds from started to the first byte read, zero until then
+	firstByte atomic.Int64
+	// unix time in nanoseconds of the last read or write
+	lastActivity atomic.Int64
+	sent         atomic.Int64
+	received     atomic.Int64
+	halfClosed   atomic.Int32
+	closeOnce    sync.Once
+	onClose      func(c *tunnelConn)
+	// set for WebSocket connections goproxy passes through after the upgrade
+	websocket bool
+	// client's ClientHello is captured from data sent through the tunnel if set
+	hello       *clientHelloCapture
+	fingerprint atomic.Pointer[tlsFingerprint]
+}
+
+// halfClosableTunnelConn is used for connections supporting half-close, so goproxy
+// keeps shutting down each direction of the tunnel separately.
+type halfClosableTunnelConn struct {
+	*tunnelConn
+}
+
+func newTunnelConn(conn net.Conn, started time.Time, connect time.Duration, onClose func(c *tunnelConn)) *tunnelConn {
+	c := &tunnelConn{Conn: conn, started: started, connect: connect, onClose: onClose}
+	c.lastActivity.Store(time.Now().UnixNano())
+
+	return c
+}
+
+// netConn returns the connection to be used by goproxy.
+func (c *tunnelConn) netConn() net.Conn {
+	if _, ok := c.Conn.(halfCloser); ok {
+		return halfClosableTunnelConn{c}
+	}
+
+	return c
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+		if c.received.Add(int64(n)) == int64(n) {
+			c.firstByte.Store(int64(time.Since(c.started)))
+		}
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	if c.hello != nil {
+		if fp := c.hello.feed(b); fp != nil {
+			c.fingerprint.Store(fp)
+		}
+	}
+
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+		c.sent.Add(int64(n))
+	}
+	return n, err
+}
+
+// idle returns how long nothing was sent or received through the tunnel.
+func (c *tunnelConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastActivity.Load()))
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.finish()
+	return err
+}
+
+func (c *tunnelConn) finish() {
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+}
+
+func (c *tunnelConn) timing() requestTiming {
+	firstByte := time.Duration(c.firstByte.Load())
+	if firstByte == 0 {
+		firstByte = -1
+	}
+
+	return requestTiming{
+		duration:  time.Since(c.started),
+		connect:   c.connect,
+		firstByte: firstByte,
+	}
+}
+
+func (c halfClosableTunnelConn) CloseWrite() error {
+	err := c.Conn.(halfCloser).CloseWrite()
+	c.halfClose()
+	return err
+}
+
+func (c halfClosableTunnelConn) CloseRead() error {
+	err := c.Conn.(halfCloser).CloseRead()
+	c.halfClose()
+	return err
+}
+
+// halfClose closes the connection once both directions are shut down, goproxy
+// never calls Close() for half-closable connections.
+func (c halfClosableTunnelConn) halfClose() {
+	if c.halfClosed.Add(1) == 2 {
+		c.Close()
+	}
+}
+
+// setTunnelLoggingHandler wraps CONNECT dialer, so every tunnel gets an access log
+// entry with its traffic volume and timings when it's closed. Has to be called
+// after all other handlers replacing the dialer.
+func setTunnelLoggingHandler(proxy *goproxy.ProxyHttpServer, logger *ProxyLogger, tunnels *tunnelRegistry) {
+	dial := proxy.ConnectDialWithReq
+	connectDial := proxy.ConnectDial
+
+	proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+
+		started := time.Now()
+		info := requestInfoFromRequest(req)
+		if info != nil {
+			started = info.started
+		}
+
+		dialStarted := time.Now()
+		switch {
+		case dial != nil:
+			conn, err = dial(req, network, addr)
+		case connectDial != nil:
+			setRequestUpstream(req, "HTTPS_PROXY", false)
+			conn, err = connectDial(network, addr)
+		default:
+			setRequestUpstream(req, ruleDirect, false)
+			conn, err = dialDirect(req.Context(), proxy, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c := newTunnelConn(conn, started, time.Since(dialStarted), func(c *tunnelConn) {
+			tunnels.remove(c)
+			logger.logTunnel(req, c)
+		})
+		c.client, c.target = req.RemoteAddr, addr
+		// goproxy dials for plain requests only to pass WebSocket upgrades through
+		c.websocket = req.Method != http.MethodConnect
+		if logger.logFingerprints {
+			c.hello = &clientHelloCapture{}
+		}
+		if info != nil {
+			c.user, c.upstream = info.user, info.upstream
+		}
+		tunnels.add(c)
+
+		return c.netConn(), nil
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// tunnelRegistry keeps track of active CONNECT tunnels and of the traffic passed
+// through tunnels per user.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	tunnels map[uint64]*tunnelConn
+	// active tunnels per user, users without active tunnels are removed
+	active map[string]int64
+	// traffic of closed tunnels per user, users above statsMaxKeys are counted as
+	// statsOther, so many distinct users don't blow up memory
+	users map[string]*UserTraffic
+	// closed and replaced every time a tunnel is removed
+	done chan struct{}
+}
+
+// TunnelInfo describes an active tunnel for the admin API.
+type TunnelInfo struct {
+	ID          uint64    `json:"id"`
+	User        string    `json:"user"`
+	Client      string    `json:"client"`
+	Target      string    `json:"target"`
+	Upstream    string    `json:"upstream"`
+	Started     time.Time `json:"started"`
+	Sent        int64     `json:"sent"`
+	Received    int64     `json:"received"`
+	IdleSeconds float64   `json:"idle_seconds"`
+}
+
+// UserTraffic accumulates tunnels' traffic of a single user.
+type UserTraffic struct {
+	Tunnels  int64 `json:"tunnels"`
+	Active   int64 `json:"active"`
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{
+		tunnels: make(map[uint64]*tunnelConn),
+		active:  make(map[string]int64),
+		users:   make(map[string]*UserTraffic),
+		done:    make(chan struct{}),
+	}
+}
+
+func (r *tunnelRegistry) add(c *tunnelConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	c.id = r.nextID
+	r.tunnels[c.id] = c
+	r.active[c.user]++
+}
+
+func (r *tunnelRegistry) remove(c *tunnelConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.tunnels[c.id]; !exists {
+		return
+	}
+	delete(r.tunnels, c.id)
+
+	if r.active[c.user]--; r.active[c.user] <= 0 {
+		delete(r.active, c.user)
+	}
+
+	user := c.user
+	if _, exists := r.users[user]; !exists && len(r.users) >= statsMaxKeys {
+		user = statsOther
+	}
+	traffic, exists := r.users[user]
+	if !exists {
+		traffic = &UserTraffic{}
+		r.users[user] = traffic
+	}
+	traffic.Tunnels++
+	traffic.Sent += c.sent.Load()
+	traffic.Received += c.received.Load()
+
+	// wake up waiters, they check the number of tunnels again
+	close(r.done)
+	r.done = make(chan struct{})
+}
+
+func (r *tunnelRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.tunnels)
+}
+
+// wait blocks until there are no active tunnels or the context is done.
+func (r *tunnelRegistry) wait(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		active, done := len(r.tunnels), r.done
+		r.mu.Unlock()
+
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// snapshot returns active tunnels ordered by ID.
+func (r *tunnelRegistry) snapshot() []TunnelInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]TunnelInfo, 0, len(r.tunnels))
+	for _, c := range r.tunnels {
+		result = append(result, TunnelInfo{
+			ID:          c.id,
+			User:        c.user,
+			Client:      c.client,
+			Target:      c.target,
+			Upstream:    c.upstream,
+			Started:     c.started,
+			Sent:        c.sent.Load(),
+			Received:    c.received.Load(),
+			IdleSeconds: c.idle().Seconds(),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// userTraffic returns traffic per user including active tunnels, anonymous users'
+// traffic is reported under "-".
+func (r *tunnelRegistry) userTraffic() map[string]UserTraffic {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make(map[string]UserTraffic, len(r.users))
+	for user, traffic := range r.users {
+		result[formatUser(user)] = *traffic
+	}
+
+	for user, active := range r.active {
+		traffic := result[formatUser(user)]
+		traffic.Active = active
+		result[formatUser(user)] = traffic
+	}
+	for _, c := range r.tunnels {
+		traffic := result[formatUser(c.user)]
+		traffic.Sent += c.sent.Load()
+		traffic.Received += c.received.Load()
+		result[formatUser(c.user)] = traffic
+	}
+
+	return result
+}
+
+func formatUser(user string) string {
+	if user == "" {
+		return "-"
+	}
+
+	return user
+}
+
+// close closes the tunnel with the given ID, false is returned if there is no such tunnel.
+func (r *tunnelRegistry) close(id uint64) bool {
+	r.mu.Lock()
+	c, exists := r.tunnels[id]
+	r.mu.Unlock()
+
+	if exists {
+		c.Close()
+	}
+
+	return exists
+}
+
+// closeIdle closes tunnels which didn't pass any data for longer than timeout and
+// returns the number of closed tunnels.
+func (r *tunnelRegistry) closeIdle(timeout time.Duration) int {
+	var idle []*tunnelConn
+
+	r.mu.Lock()
+	for _, c := range r.tunnels {
+		if c.idle() > timeout {
+			idle = append(idle, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+
+	return len(idle)
+}
+
+// startIdleTunnelReaper periodically closes tunnels idle for longer than tunnel_idle_timeout.
+func startIdleTunnelReaper(conf *Configuration, proxy *goproxy.ProxyHttpServer, tunnels *tunnelRegistry) {
+	if conf.TunnelIdleTimeout <= 0 {
+		return
+	}
+
+	interval := conf.TunnelIdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if n := tunnels.closeIdle(conf.TunnelIdleTimeout); n > 0 {
+				newModuleLogger(proxy, logModuleTunnel).logf(nil, slog.LevelInfo, "closed %v idle tunnels", n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func startEchoServer(t testing.TB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestTunnelLogging(t *testing.T) {
+	echo := startEchoServer(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	logger := newProxyLogger(&Configuration{AccessLog: path})
+	proxy := goproxy.NewProxyHttpServer()
+	setTunnelLoggingHandler(proxy, logger, newTunnelRegistry())
+
+	srv := httptest.NewServer(withRequestInfo(proxy))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := echo.Addr().String()
+	if _, err := conn.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected 200 status code, got", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	io.Copy(io.Discard, r)
+	conn.Close()
+
+	// the entry is written asynchronously once both directions are closed
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, err = os.ReadFile(path); err == nil && strings.Contains(string(data), "closed") {
+			break
+		}
+	}
+
+	if !strings.Contains(string(data), "CONNECT") || !strings.Contains(string(data), "sent=5 received=5 upstream=DIRECT duration=") ||
+		strings.Contains(string(data), "ttfb=-") {
+		t.Errorf("Unexpected access log content: %q", data)
+	}
+}
+
+func TestTunnelRegistryWait(t *testing.T) {
+	tunnels := newTunnelRegistry()
+
+	conn, _ := net.Pipe()
+	c := newTunnelConn(conn, time.Now(), 0, tunnels.remove)
+	tunnels.add(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tunnels.wait(ctx); err == nil {
+		t.Error("wait must time out while a tunnel is active")
+	}
+
+	go c.Close()
+	if err := tunnels.wait(context.Background()); err != nil || tunnels.count() != 0 {
+		t.Errorf("wait must return once tunnels are closed, got %v", err)
+	}
+}
+
+func TestTunnelRegistryIdle(t *testing.T) {
+	tunnels := newTunnelRegistry()
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+
+	c := newTunnelConn(conn, time.Now(), 0, tunnels.remove)
+	c.user = "alice"
+	tunnels.add(c)
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := tunnels.closeIdle(time.Hour); n != 0 {
+		t.Errorf("active tunnel must not be closed, closed %v", n)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if n := tunnels.closeIdle(10 * time.Millisecond); n != 1 {
+		t.Errorf("Expected 1 idle tunnel to be closed, closed %v", n)
+	}
+
+	traffic := tunnels.userTraffic()["alice"]
+	if traffic.Tunnels != 1 || traffic.Active != 0 || traffic.Sent != 5 {
+		t.Errorf("Unexpected user's traffic: %+v", traffic)
+	}
+}
+
+func TestTunnelRegistryUsers(t *testing.T) {
+	tunnels := newTunnelRegistry()
+
+	for i := 0; i <= statsMaxKeys; i++ {
+		conn, peer := net.Pipe()
+		peer.Close()
+		c := newTunnelConn(conn, time.Now(), 0, tunnels.remove)
+		c.user = "user" + strconv.Itoa(i)
+		tunnels.add(c)
+		if i == 0 {
+			if traffic := tunnels.userTraffic()[c.user]; traffic.Active != 1 {
+				t.Fatalf("Expected an active tunnel, got %+v", traffic)
+			}
+		}
+		c.Close()
+	}
+
+	// users without active tunnels aren't tracked, closed tunnels of users above
+	// the limit are counted together
+	if len(tunnels.active) != 0 || len(tunnels.users) != statsMaxKeys+1 || tunnels.users[statsOther].Tunnels != 1 {
+		t.Errorf("Unexpected users: %v active, %v with traffic", len(tunnels.active), len(tunnels.users))
+	}
+}
+
+// BenchmarkConnectSetup measures how long it takes to establish a tunnel through the
+// proxy with the default policies.
+func BenchmarkConnectSetup(b *testing.B) {
+	echo := startEchoServer(b)
+	addr := echo.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+
+	conf := newConfiguration(strings.NewReader("allowed_connect_ports = [" + port + "]\n"))
+	conf.AccessLog = filepath.Join(b.TempDir(), "access.log")
+	proxy := createProxy(conf)
+	setProxyHandlers(conf, proxy, newProxyLogger(conf), newRouter(conf), newProxyHealth(conf), newTunnelRegistry(), nil, nil, nil)
+
+	srv := httptest.NewServer(withRequestInfo(proxy))
+	defer srv.Close()
+
+	request := []byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Write(request); err != nil {
+			b.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			b.Fatal("Expected 200 status code, got", resp.StatusCode)
+		}
+		conn.Close()
+	}
+}
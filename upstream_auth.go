@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Values of upstream_auth entries.
+const (
+	upstreamAuthBasic     = "basic"
+	upstreamAuthNTLM      = "ntlm"
+	upstreamAuthNegotiate = "negotiate"
+)
+
+// challenge responses' bodies above this size aren't read to keep the connection
+const maxNTLMChallengeBody = 64 << 10
+
+var errNTLMNotRequested = errors.New("upstream proxy didn't ask for NTLM authentication")
+
+// upstreamProxyAddr returns host:port of the proxy, upstream_auth entries are
+// looked up by it.
+func upstreamProxyAddr(proxyURL *url.URL) string {
+	if isHTTPSProxy(proxyURL) {
+		return httpsProxyAddr(proxyURL)
+	}
+	if proxyURL.Port() == "" {
+		return net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	return proxyURL.Host
+}
+
+// upstreamAuth authenticates to upstream proxies listed in upstream_auth with NTLM,
+// the rest use Basic authentication. NTLM authenticates the connection rather than
+// requests, so CONNECT tunnels are authenticated on their own connections and
+// plain HTTP requests are sent over authenticated connections kept by ntlmTransport.
+type upstreamAuth struct {
+	proxy   *goproxy.ProxyHttpServer
+	https   *httpsProxies
+	schemes map[string]string
+
+	mu         sync.Mutex
+	transports map[httpsProxyTransportKey]*ntlmTransport
+}
+
+func newUpstreamAuth(conf *Configuration, proxy *goproxy.ProxyHttpServer, https *httpsProxies) *upstreamAuth {
+	return &upstreamAuth{
+		proxy:      proxy,
+		https:      https,
+		schemes:    conf.UpstreamAuth,
+		transports: make(map[httpsProxyTransportKey]*ntlmTransport),
+	}
+}
+
+// ntlmScheme returns the authentication scheme of NTLM messages sent to the proxy,
+// empty string is returned if it doesn't use NTLM or there are no credentials.
+// Negotiate scheme carries NTLM messages as well, Kerberos isn't supported.
+func (a *upstreamAuth) ntlmScheme(proxyURL *url.URL) string {
+	if proxyURL.User == nil || proxyURL.User.Username() == "" || isSOCKSProxy(proxyURL) {
+		return ""
+	}
+
+	switch a.schemes[upstreamProxyAddr(proxyURL)] {
+	case upstreamAuthNTLM:
+		return "NTLM"
+	case upstreamAuthNegotiate:
+		return "Negotiate"
+	}
+
+	return ""
+}
+
+// dial connects to the proxy with dial, or with the transport's dialer if it's nil.
+func (a *upstreamAuth) dial(ctx context.Context, dial dialContextFunc, proxyURL *url.URL) (net.Conn, error) {
+	if isHTTPSProxy(proxyURL) {
+		return a.https.dial(ctx, dial, proxyURL)
+	}
+	if dial != nil {
+		return dial(ctx, "tcp", upstreamProxyAddr(proxyURL))
+	}
+
+	return dialDirect(ctx, a.proxy, "tcp", upstreamProxyAddr(proxyURL))
+}
+
+// dialConnect connects to addr through a CONNECT tunnel of the proxy authenticated
+// with NTLM.
+func (a *upstreamAuth) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := a.dial(ctx, nil, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	conn.SetDeadline(time.Now().Add(httpsProxyConnectTimeout))
+	reader := bufio.NewReader(conn)
+	resp, err := ntlmExchange(conn, reader, req, req, a.ntlmScheme(proxyURL), proxyURL.User)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %w", proxyURL.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s refused connection: %s", proxyURL.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// ntlmExchange authenticates the connection: negotiate request is sent with NTLM
+// negotiate message, the proxy is expected to answer with 407 and a challenge, then
+// req is sent with the response to the challenge. The response to req is returned.
+func ntlmExchange(conn net.Conn, reader *bufio.Reader, negotiate, req *http.Request, scheme string,
+	user *url.Userinfo,
+) (*http.Response, error) {
+	negotiate.Header.Set(ProxyAuthorizatonHeader, scheme+" "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()))
+	if err := negotiate.WriteProxy(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(reader, negotiate)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		if negotiate != req {
+			resp.Body.Close()
+			return nil, errNTLMNotRequested
+		}
+		return resp, nil
+	}
+
+	challenge := ntlmToken(resp.Header.Values("Proxy-Authenticate"), scheme)
+	_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, maxNTLMChallengeBody))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil {
+		return nil, fmt.Errorf("upstream proxy didn't send %s challenge", scheme)
+	}
+	if resp.Close {
+		return nil, errors.New("upstream proxy closed the connection during NTLM authentication")
+	}
+
+	password, _ := user.Password()
+	msg, err := ntlmAuthenticateMessage(challenge, user.Username(), password)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(ProxyAuthorizatonHeader, scheme+" "+base64.StdEncoding.EncodeToString(msg))
+	if err := req.WriteProxy(conn); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(reader, req)
+}
+
+// transport returns the round tripper sending plain HTTP requests through the proxy
+// over NTLM authenticated connections, they are dialed the same way as base does.
+func (a *upstreamAuth) transport(base *http.Transport, proxyURL *url.URL) http.RoundTripper {
+	key := httpsProxyTransportKey{base: base, proxyURL: proxyURL.String()}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if tr, exists := a.transports[key]; exists {
+		return tr
+	}
+
+	tr := &ntlmTransport{auth: a, base: base, proxyURL: proxyURL, scheme: a.ntlmScheme(proxyURL)}
+	a.transports[key] = tr
+
+	return tr
+}
+
+// ntlmTransport keeps idle connections authenticated by earlier requests. Requests
+// without a body are sent over them and retried on a new connection if the proxy
+// closed the connection or asks to authenticate again. Requests with a body are
+// always sent over a new connection, the negotiate message is sent with the request
+// without its body, so the body is sent only once.
+type ntlmTransport struct {
+	auth     *upstreamAuth
+	base     *http.Transport
+	proxyURL *url.URL
+	scheme   string
+
+	mu   sync.Mutex
+	idle []*ntlmConn
+}
+
+type ntlmConn struct {
+	net.Conn
+	reader *bufio.Reader
+	since  time.Time
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the route is recorded and unavailable upstreams aren't used
+	if t.base.Proxy != nil {
+		if _, err := t.base.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+
+	out := req.Clone(req.Context())
+	out.Header.Del(ProxyAuthorizatonHeader)
+	hasBody := req.Body != nil && req.Body != http.NoBody
+
+	if !hasBody {
+		if c := t.idleConn(); c != nil {
+			resp, err := t.send(c, out, func() (*http.Response, error) {
+				if err := out.WriteProxy(c); err != nil {
+					return nil, err
+				}
+				return http.ReadResponse(c.reader, out)
+			})
+			if err == nil && resp.StatusCode != http.StatusProxyAuthRequired {
+				return resp, nil
+			}
+			if err == nil {
+				// the proxy doesn't consider the connection authenticated anymore
+				resp.Body.(*ntlmBody).reuse = false
+				resp.Body.Close()
+			}
+		}
+	}
+
+	dialed, err := t.auth.dial(req.Context(), t.base.DialContext, t.proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &ntlmConn{Conn: dialed, reader: bufio.NewReader(dialed)}
+
+	negotiate := out
+	if hasBody {
+		negotiate = out.Clone(out.Context())
+		negotiate.Body, negotiate.ContentLength, negotiate.TransferEncoding = nil, 0, nil
+	}
+
+	return t.send(c, out, func() (*http.Response, error) {
+		return ntlmExchange(c, c.reader, negotiate, out, t.scheme, t.proxyURL.User)
+	})
+}
+
+// send returns the response of roundTrip over the connection, the connection is
+// returned to idle ones once the response's body is read.
+func (t *ntlmTransport) send(c *ntlmConn, req *http.Request, roundTrip func() (*http.Response, error)) (*http.Response, error) {
+	stop := context.AfterFunc(req.Context(), func() {
+		c.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if timeout := t.base.ResponseHeaderTimeout; timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	resp, err := roundTrip()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+
+	resp.Body = &ntlmBody{
+		ReadCloser: resp.Body,
+		transport:  t,
+		conn:       c,
+		reuse:      !resp.Close && !req.Close,
+		eof:        resp.Body == http.NoBody,
+	}
+
+	return resp, nil
+}
+
+func (t *ntlmTransport) idleConn() *ntlmConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.idle) > 0 {
+		c := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		if t.base.IdleConnTimeout <= 0 || time.Since(c.since) < t.base.IdleConnTimeout {
+			return c
+		}
+		c.Close()
+	}
+
+	return nil
+}
+
+func (t *ntlmTransport) putIdle(c *ntlmConn) {
+	maxIdle := t.base.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = http.DefaultMaxIdleConnsPerHost
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.idle) >= maxIdle {
+		c.Close()
+		return
+	}
+	c.since = time.Now()
+	t.idle = append(t.idle, c)
+}
+
+// ntlmBody returns the connection to idle ones once the body is read to the end,
+// otherwise the connection is closed.
+type ntlmBody struct {
+	io.ReadCloser
+	transport *ntlmTransport
+	conn      *ntlmConn
+	reuse     bool
+	eof       bool
+	once      sync.Once
+}
+
+func (b *ntlmBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+
+	return n, err
+}
+
+func (b *ntlmBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if b.eof && b.reuse {
+			b.transport.putIdle(b.conn)
+		} else {
+			b.conn.Close()
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+var errResponseStalled = errors.New("origin stopped sending the response body")
+
+// watchdogBody aborts reading of the origin's response body if a read doesn't return
+// within the timeout. Time spent writing to the client isn't accounted, so slow
+// clients don't trigger it.
+type watchdogBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled *atomic.Bool
+}
+
+func newWatchdogBody(body io.ReadCloser, timeout time.Duration, stalled *atomic.Bool, onStall func()) *watchdogBody {
+	b := &watchdogBody{ReadCloser: body, timeout: timeout, stalled: stalled}
+	b.timer = time.AfterFunc(timeout, func() {
+		stalled.Store(true)
+		onStall()
+		body.Close()
+	})
+	b.timer.Stop()
+
+	return b
+}
+
+func (b *watchdogBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+
+	if b.stalled.Load() {
+		return n, errResponseStalled
+	}
+
+	return n, err
+}
+
+func (b *watchdogBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// setResponseWatchdogHandler aborts plain HTTP responses whose origin didn't send
+// any data of the body for response_stall_timeout. Such requests are logged with
+// 504 status and the client's connection is closed, so the client doesn't take
+// the truncated response for a complete one.
+func setResponseWatchdogHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	if conf.ResponseStallTimeout <= 0 {
+		return
+	}
+
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			info := getRequestInfo(ctx)
+			next := ctx.RoundTripper
+			ctx.RoundTripper = goproxy.RoundTripperFunc(
+				func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+					var resp *http.Response
+					var err error
+					if next != nil {
+						resp, err = next.RoundTrip(req, ctx)
+					} else {
+						resp, err = requestTransport(req, proxy).RoundTrip(req)
+					}
+					if err == nil && resp.Body != nil && resp.Body != http.NoBody {
+						resp.Body = newWatchdogBody(resp.Body, conf.ResponseStallTimeout, &info.stalled, func() {
+							ctx.Warnf("response from %v stalled for %v, aborting", req.URL.Host, conf.ResponseStallTimeout)
+						})
+					}
+					return resp, err
+				})
+			return req, nil
+		})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestResponseWatchdog(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-release
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	conf := &Configuration{AccessLog: path, ResponseStallTimeout: 100 * time.Millisecond}
+	logger := newProxyLogger(conf)
+	proxy := goproxy.NewProxyHttpServer()
+	setHTTPLoggingHandler(proxy, logger)
+	setResponseWatchdogHandler(conf, proxy)
+
+	srv := httptest.NewServer(withRequestInfo(withAccessLog(proxy, logger)))
+	defer srv.Close()
+
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(origin.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("Unexpected response %q, %v", body, err)
+	}
+
+	// depending on buffering the connection is closed before or after the headers
+	if resp, err = client.Get(origin.URL + "/slow"); err == nil {
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Errorf("Expected stalled response to be aborted, got %q", body)
+		}
+	}
+
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, _ = os.ReadFile(path); strings.Contains(string(data), "/slow") {
+			break
+		}
+	}
+
+	// the client retries the request after the connection was closed before headers
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 || !strings.Contains(lines[0], "/fast 200 ") || !strings.Contains(lines[1], "/slow 504 ") {
+		t.Errorf("Unexpected access log entries: %q", data)
+	}
+}
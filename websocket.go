@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+var errWebSocketHandshake = errors.New("WebSocket handshake failed")
+
+// isWebSocketUpgrade reports whether the request asks to switch to WebSocket, the
+// same way goproxy decides to pass the connection through after the handshake.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, s := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webSocketACL holds domains of websocket_allowed_domains and websocket_denied_domains.
+type webSocketACL struct {
+	allowed []string
+	denied  []string
+}
+
+func newWebSocketACL(conf *Configuration) *webSocketACL {
+	normalize := func(domains []string) []string {
+		result := make([]string, 0, len(domains))
+		for _, domain := range domains {
+			result = append(result, strings.ToLower(strings.Trim(domain, ".")))
+		}
+		return result
+	}
+
+	return &webSocketACL{allowed: normalize(conf.WebSocketAllowedDomains), denied: normalize(conf.WebSocketDeniedDomains)}
+}
+
+// deniedBy returns the rule denying WebSocket upgrades to the host, empty string is
+// returned if they are allowed.
+func (a *webSocketACL) deniedBy(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range a.denied {
+		if matchesDomains(host, []string{domain}) {
+			return "websocket_denied_domains:" + domain
+		}
+	}
+	if len(a.allowed) > 0 && !matchesDomains(host, a.allowed) {
+		return "websocket_allowed_domains"
+	}
+
+	return ""
+}
+
+// setWebSocketHandler applies websocket_allowed_domains and websocket_denied_domains
+// to upgrade requests. goproxy passes allowed upgrades through on its own, dialing
+// the destination with the CONNECT dialer, so they get a websocket access log entry
+// when they are closed (see setTunnelLoggingHandler). Once it's done with the
+// connection goproxy would also send the request to the origin again, which is
+// prevented by answering with the handshake's response.
+func setWebSocketHandler(conf *Configuration, proxy *goproxy.ProxyHttpServer) {
+	acl := newWebSocketACL(conf)
+	proxy.OnRequest().DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if !isWebSocketUpgrade(req) {
+				return req, nil
+			}
+
+			if rule := acl.deniedBy(req.URL.Hostname()); rule != "" {
+				ctx.Warnf("WebSocket upgrade to %v is denied by %v", req.URL.Host, rule)
+				denyRequest(ctx, rule)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, "Access denied")
+			}
+
+			ctx.RoundTripper = goproxy.RoundTripperFunc(
+				func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+					// the destination couldn't be reached or didn't answer
+					if ctx.Resp == nil {
+						return nil, errWebSocketHandshake
+					}
+					// the handshake's response was already sent to the client
+					resp := *ctx.Resp
+					resp.Body = http.NoBody
+					return &resp, nil
+				})
+			return req, nil
+		})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func TestWebSocketACL(t *testing.T) {
+	acl := newWebSocketACL(&Configuration{
+		WebSocketAllowedDomains: []string{".Example.com", "192.0.2.1"},
+		WebSocketDeniedDomains:  []string{"ads.example.com"},
+	})
+
+	tests := []struct {
+		host string
+		rule string
+	}{
+		{"example.com", ""},
+		{"chat.example.com.", ""},
+		{"192.0.2.1", ""},
+		{"ads.example.com", "websocket_denied_domains:ads.example.com"},
+		{"tracker.ads.example.com", "websocket_denied_domains:ads.example.com"},
+		{"example.org", "websocket_allowed_domains"},
+	}
+
+	for _, test := range tests {
+		if rule := acl.deniedBy(test.host); rule != test.rule {
+			t.Errorf("%v: expected rule %q, got %q", test.host, test.rule, rule)
+		}
+	}
+
+	if rule := newWebSocketACL(&Configuration{}).deniedBy("example.org"); rule != "" {
+		t.Errorf("Expected upgrades to be allowed by default, got %q", rule)
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	var upgrades atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upgrades.Add(1)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer origin.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	conf := &Configuration{AccessLog: path, WebSocketDeniedDomains: []string{"localhost"}}
+	logger := newProxyLogger(conf)
+	proxy := goproxy.NewProxyHttpServer()
+	setHTTPLoggingHandler(proxy, logger)
+	setWebSocketHandler(conf, proxy)
+	setTunnelLoggingHandler(proxy, logger, newTunnelRegistry())
+
+	srv := httptest.NewServer(withRequestInfo(withPanicRecovery(withAccessLog(proxy, logger), conf, proxy, nil)))
+	defer srv.Close()
+
+	upgrade := func(host string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET http://" + host + "/chat HTTP/1.1\r\nHost: " + host +
+			"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, r, resp
+	}
+
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	conn, _, resp := upgrade("localhost:" + port)
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden || upgrades.Load() != 0 {
+		t.Errorf("Expected denied upgrade not to reach the origin, got %v", resp.StatusCode)
+	}
+
+	conn, r, resp := upgrade(origin.Listener.Addr().String())
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101 response, got %v", resp.StatusCode)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected echoed message, got %q (%v)", buf, err)
+	}
+	conn.Close()
+
+	// entries are written asynchronously once the connection is closed
+	var data []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if data, _ = os.ReadFile(path); strings.Contains(string(data), " 101 ") {
+			break
+		}
+	}
+
+	if !strings.Contains(string(data), "/chat websocket - - sent=") || !strings.Contains(string(data), "/chat 101 ") ||
+		!strings.Contains(string(data), "/chat 403 ") {
+		t.Errorf("Unexpected access log content: %q", data)
+	}
+	if upgrades.Load() != 1 {
+		t.Errorf("Expected the upgrade to be sent to the origin once, got %d", upgrades.Load())
+	}
+}